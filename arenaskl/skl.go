@@ -159,12 +159,34 @@ func (s *Skiplist) Arena() *Arena { return s.arena }
 // Size returns the number of bytes that have allocated from the arena.
 func (s *Skiplist) Size() uint32 { return s.arena.Size() }
 
+// Inserter adds keys to a Skiplist, using the position of the key it most
+// recently added as a hint for the position of the next key. Keys added in
+// increasing order are positioned with a couple of comparisons rather than a
+// full search of the skiplist. Keys added in any other order fall back to a
+// full search. The zero value is ready to use. An Inserter must only be used
+// with a single Skiplist, and is not safe for concurrent use, though other
+// goroutines may add keys to the Skiplist concurrently.
+type Inserter struct {
+	spl [maxHeight]splice
+	// The number of levels of spl which have been populated.
+	height uint32
+}
+
+// Add adds a new key to list if it does not yet exist, as Skiplist.Add does.
+func (ins *Inserter) Add(list *Skiplist, key db.InternalKey, value []byte) error {
+	return list.addInternal(key, value, ins)
+}
+
 // Add adds a new key if it does not yet exist. If the key already exists, then
 // Add returns ErrRecordExists. If there isn't enough room in the arena, then
 // Add returns ErrArenaFull.
 func (s *Skiplist) Add(key db.InternalKey, value []byte) error {
-	var spl [maxHeight]splice
-	if s.findSplice(key, &spl) {
+	var ins Inserter
+	return s.addInternal(key, value, &ins)
+}
+
+func (s *Skiplist) addInternal(key db.InternalKey, value []byte, ins *Inserter) error {
+	if s.findSplice(key, ins) {
 		// Found a matching node, but handle case where it's been deleted.
 		return ErrRecordExists
 	}
@@ -180,6 +202,11 @@ func (s *Skiplist) Add(key db.InternalKey, value []byte) error {
 	if err != nil {
 		return err
 	}
+	if height > ins.height {
+		// The levels above the splice are populated as nd is linked in.
+		ins.height = height
+	}
+	spl := &ins.spl
 
 	ndOffset := s.arena.getPointerOffset(unsafe.Pointer(nd))
 
@@ -249,6 +276,8 @@ func (s *Skiplist) Add(key db.InternalKey, value []byte) error {
 				}
 
 				next.casPrevOffset(i, prevOffset, ndOffset)
+				// A key following nd is inserted between nd and next.
+				spl[i].init(nd, next)
 				break
 			}
 
@@ -312,23 +341,47 @@ func (s *Skiplist) randomHeight() uint32 {
 	return h
 }
 
-func (s *Skiplist) findSplice(key db.InternalKey, spl *[maxHeight]splice) (found bool) {
-	level := int(s.Height() - 1)
-	prev, next := s.head, (*node)(nil)
+func (s *Skiplist) findSplice(key db.InternalKey, ins *Inserter) (found bool) {
+	listHeight := s.Height()
+	level := int(listHeight)
+	prev := s.head
+
+	if ins.height == listHeight {
+		// Find the lowest level at which the splice of the previously added key
+		// is intact and brackets key, and search the levels below it starting
+		// from the splice.
+		for i := 0; i < int(listHeight); i++ {
+			spl := &ins.spl[i]
+			if s.getNext(spl.prev, i) != spl.next {
+				// A node has been inserted within the splice at this level.
+				continue
+			}
+			if spl.prev != s.head && db.InternalCompare(s.cmp, key, spl.prev.getKey(s.arena)) <= 0 {
+				// The key lies before the splice.
+				break
+			}
+			if spl.next != s.tail && db.InternalCompare(s.cmp, key, spl.next.getKey(s.arena)) >= 0 {
+				// The key lies after the splice.
+				break
+			}
+			level = i
+			prev = spl.prev
+			break
+		}
+	} else {
+		// The height of the list has changed, so the splice does not cover
+		// every level.
+		ins.height = listHeight
+	}
 
-	for {
+	for level--; level >= 0; level-- {
+		var next *node
 		prev, next, found = s.findSpliceForLevel(key, level, prev)
 		if next == nil {
 			next = s.tail
 		}
 
-		spl[level].init(prev, next)
-
-		if level == 0 {
-			break
-		}
-
-		level--
+		ins.spl[level].init(prev, next)
 	}
 
 	return
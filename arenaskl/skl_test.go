@@ -316,6 +316,81 @@ func TestConcurrentAdd(t *testing.T) {
 	require.Equal(t, n, lengthRev(l))
 }
 
+// TestInserterAdd tests adding keys in various orders using an Inserter.
+func TestInserterAdd(t *testing.T) {
+	const n = 1000
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	orders := map[string][]int{
+		"ascending":  make([]int, n),
+		"descending": make([]int, n),
+		"random":     rng.Perm(n),
+		"runs":       make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		orders["ascending"][i] = i
+		orders["descending"][i] = n - 1 - i
+		// Ascending runs of 10 keys, with the runs in descending order.
+		orders["runs"][i] = (n/10-1-i/10)*10 + i%10
+	}
+
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			l := NewSkiplist(NewArena(arenaSize, 0), bytes.Compare)
+			var ins Inserter
+			for _, i := range order {
+				require.Nil(t, ins.Add(l, makeIntKey(i), makeValue(i)))
+			}
+			// The keys cannot be added again, with or without the Inserter.
+			for _, i := range order[:10] {
+				require.Equal(t, ErrRecordExists, ins.Add(l, makeIntKey(i), nil))
+				require.Equal(t, ErrRecordExists, l.Add(makeIntKey(i), nil))
+			}
+
+			require.Equal(t, n, length(l))
+			require.Equal(t, n, lengthRev(l))
+			it := l.NewIter()
+			i := 0
+			for it.First(); it.Valid(); it.Next() {
+				require.EqualValues(t, makeIntKey(i), it.Key())
+				require.EqualValues(t, makeValue(i), it.Value())
+				i++
+			}
+		})
+	}
+}
+
+// TestConcurrentInserterAdd races between Inserters adding interleaved keys,
+// so that the splice of each Inserter is invalidated by the other.
+func TestConcurrentInserterAdd(t *testing.T) {
+	const n = 1000
+
+	// Set testing flag to make it easier to trigger unusual race conditions.
+	l := NewSkiplist(NewArena(arenaSize, 0), bytes.Compare)
+	l.testing = true
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for f := 0; f < 2; f++ {
+		go func(f int) {
+			defer wg.Done()
+			var ins Inserter
+			for i := f; i < n; i += 2 {
+				require.Nil(t, ins.Add(l, makeIntKey(i), nil))
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	require.Equal(t, n, length(l))
+	require.Equal(t, n, lengthRev(l))
+	it := l.NewIter()
+	i := 0
+	for it.First(); it.Valid(); it.Next() {
+		require.EqualValues(t, makeIntKey(i), it.Key())
+		i++
+	}
+}
+
 // TestIteratorNext tests a basic iteration over all nodes from the beginning.
 func TestIteratorNext(t *testing.T) {
 	const n = 100
@@ -27,6 +27,27 @@ var ErrNotIndexed = errors.New("pebble: batch not indexed")
 // ErrInvalidBatch indicates that a batch is invalid or otherwise corrupted.
 var ErrInvalidBatch = errors.New("pebble: invalid batch")
 
+// ErrKeyTooLarge indicates that a key is larger than db.Options.MaxKeySize.
+var ErrKeyTooLarge = errors.New("pebble: key too large")
+
+// ErrBatchTooLarge indicates that a batch is too large to fit in a MemTable,
+// and thus can never be applied to the DB.
+var ErrBatchTooLarge = errors.New("pebble: batch too large")
+
+// ErrInvalidSeqNum indicates that the sequence number at which a batch was to
+// be applied by DB.ApplyAtSeqNum precedes the next sequence number of the DB,
+// or is otherwise invalid.
+var ErrInvalidSeqNum = errors.New("pebble: invalid sequence number")
+
+// ErrValueTooLarge indicates that a value is larger than
+// db.Options.MaxValueSize, or that a key/value pair is too large to fit in a
+// MemTable.
+var ErrValueTooLarge = errors.New("pebble: value too large")
+
+// ErrInvalidRange indicates that the start key of a range is not less than its
+// end key.
+var ErrInvalidRange = errors.New("pebble: invalid range")
+
 type batchStorage struct {
 	// Data is the wire format of a batch's log entry:
 	//   - 8 bytes for a sequence number of the first batch element,
@@ -36,8 +57,16 @@ type batchStorage struct {
 	//   - count elements, being:
 	//     - one byte for the kind
 	//     - the varint-string user key,
-	//     - the varint-string value (if kind != delete).
+	//     - the varint-string value (if kind != delete). For range
+	//       deletions, the value is the end key of the range. For range
+	//       keys, the value is the end key of the range followed by the
+	//       range key's value (see encodeRangeKeyValue).
 	// The sequence number and count are stored in little-endian order.
+	//
+	// This is the format of the records in the WAL and of Batch.Repr, and is
+	// compatible with the LevelDB and RocksDB WriteBatch encoding. It has no
+	// explicit version number: since existing WALs and replicated batches must
+	// remain readable, the format may only be extended by adding new kinds.
 	data      []byte
 	cmp       db.Compare
 	inlineKey db.InlineKey
@@ -137,14 +166,73 @@ func (b *Batch) release() {
 func (b *Batch) refreshMemTableSize() {
 	b.memTableSize = 0
 	for iter := b.iter(); ; {
-		_, key, value, ok := iter.next()
+		kind, key, value, ok := iter.next()
 		if !ok {
 			break
 		}
+		if kind == db.InternalKeyKindLogData {
+			continue
+		}
 		b.memTableSize += memTableEntrySize(len(key), len(value))
 	}
 }
 
+// checkSize returns an error if the key or value exceeds the limits configured
+// for the DB to which the batch will be committed. Entries which are too large
+// to fit in an empty memtable are rejected here because makeRoomForWrite
+// would otherwise loop forever trying to find room for them.
+func (b *Batch) checkSize(key, value []byte) error {
+	if err := b.checkKeySize(key); err != nil {
+		return err
+	}
+	if b.db != nil && b.db.opts.MaxValueSize > 0 && len(value) > b.db.opts.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return b.checkEntrySize(key, value)
+}
+
+// checkRangeSize is checkSize for a range [start,end) with the specified
+// value, whose memtable entry stores start as its key and entry as its value.
+// Both start and end are limited by db.Options.MaxKeySize.
+func (b *Batch) checkRangeSize(start, end, value, entry []byte) error {
+	if err := b.checkKeySize(start); err != nil {
+		return err
+	}
+	if err := b.checkKeySize(end); err != nil {
+		return err
+	}
+	if b.db != nil && b.db.opts.MaxValueSize > 0 && len(value) > b.db.opts.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return b.checkEntrySize(start, entry)
+}
+
+// checkKeySize returns ErrKeyTooLarge if key exceeds db.Options.MaxKeySize.
+func (b *Batch) checkKeySize(key []byte) error {
+	if b.db != nil && b.db.opts.MaxKeySize > 0 && len(key) > b.db.opts.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// checkEntrySize returns ErrValueTooLarge if the memtable entry for the
+// specified key and value cannot fit in an empty memtable.
+func (b *Batch) checkEntrySize(key, value []byte) error {
+	if b.db != nil && uint64(memTableEntrySize(len(key), len(value))) > uint64(b.db.maxEntrySize) {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// compare compares keys using the comparer of the DB to which the batch will be
+// committed, or db.DefaultComparer if the batch is not associated with a DB.
+func (b *Batch) compare(a, c []byte) int {
+	if b.db != nil {
+		return b.db.cmp(a, c)
+	}
+	return db.DefaultComparer.Compare(a, c)
+}
+
 // Apply the operations contained in the batch to the receiver batch.
 //
 // It is safe to modify the contents of the arguments after Apply returns.
@@ -166,12 +254,15 @@ func (b *Batch) Apply(batch *Batch, _ *db.WriteOptions) error {
 	count := binary.LittleEndian.Uint32(batch.data[8:12])
 	b.setCount(b.count() + count)
 
-	start := batchReader(b.data[offset:])
-	for iter := batchReader(start); ; {
-		_, key, value, ok := iter.next()
+	start := batchDecoder(b.data[offset:])
+	for iter := batchDecoder(start); ; {
+		kind, key, value, ok := iter.next()
 		if !ok {
 			break
 		}
+		if kind == db.InternalKeyKindLogData {
+			continue
+		}
 		if b.index != nil {
 			offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&start[0]))
 			if err := b.index.Add(uint32(offset)); err != nil {
@@ -198,13 +289,17 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 	iter := b.index.NewIter()
 	iter.SeekGE(key)
 	for ; iter.Valid(); iter.Next() {
-		_, ekey, value, ok := b.decode(iter.KeyOffset())
+		kind, ekey, value, ok := b.decode(iter.KeyOffset())
 		if !ok {
 			return nil, fmt.Errorf("corrupted batch")
 		}
 		if b.cmp(key, ekey) > 0 {
 			break
 		}
+		if isRangeKeyKind(kind) {
+			// Range keys do not affect the point keys.
+			continue
+		}
 		// Invariant: b.cmp(key, ekey) == 0.
 		return value, nil
 	}
@@ -215,6 +310,9 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 //
 // It is safe to modify the contents of the arguments after Set returns.
 func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
+	if err := b.checkSize(key, value); err != nil {
+		return err
+	}
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -241,6 +339,9 @@ func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Merge returns.
 func (b *Batch) Merge(key, value []byte, _ *db.WriteOptions) error {
+	if err := b.checkSize(key, value); err != nil {
+		return err
+	}
 	if len(b.data) == 0 {
 		b.init(len(key) + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -265,6 +366,9 @@ func (b *Batch) Merge(key, value []byte, _ *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Delete returns.
 func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
+	if err := b.checkSize(key, nil); err != nil {
+		return err
+	}
 	if len(b.data) == 0 {
 		b.init(len(key) + binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -285,11 +389,18 @@ func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
 }
 
 // DeleteRange deletes all of the keys (and values) in the range [start,end)
-// (inclusive on start, exclusive on end).
+// (inclusive on start, exclusive on end). It returns ErrInvalidRange, leaving
+// the batch unmodified, if start is not less than end.
 //
 // It is safe to modify the contents of the arguments after DeleteRange
 // returns.
 func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
+	if b.compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	if err := b.checkRangeSize(start, end, nil, end); err != nil {
+		return err
+	}
 	if len(b.data) == 0 {
 		b.init(len(start) + len(end) + 2*binary.MaxVarintLen64 + batchHeaderLen)
 	}
@@ -310,12 +421,142 @@ func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// LogData adds the specified data to the batch. The data is written to the
+// WAL along with the other operations of the batch, but does not modify the
+// keyspace. See Writer.LogData.
+//
+// A LogData operation is not counted by the batch header, which counts the
+// operations assigned a sequence number, and is not indexed.
+//
+// It is safe to modify the contents of the arguments after LogData returns.
+func (b *Batch) LogData(data []byte, _ *db.WriteOptions) error {
+	if len(b.data) == 0 {
+		b.init(len(data) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	b.data = append(b.data, byte(db.InternalKeyKindLogData))
+	b.appendStr(data)
+	return nil
+}
+
+// RangeKeySet adds an action to the batch that sets the value of the range
+// key [start,end) (inclusive on start, exclusive on end). See
+// DB.RangeKeySet.
+//
+// It is safe to modify the contents of the arguments after RangeKeySet
+// returns.
+func (b *Batch) RangeKeySet(start, end, value []byte, _ *db.WriteOptions) error {
+	return b.addRangeKey(db.InternalKeyKindRangeKeySet, start, end, value)
+}
+
+// RangeKeyUnset adds an action to the batch that removes any range key
+// covering [start,end) (inclusive on start, exclusive on end). See
+// DB.RangeKeyUnset.
+//
+// It is safe to modify the contents of the arguments after RangeKeyUnset
+// returns.
+func (b *Batch) RangeKeyUnset(start, end []byte, _ *db.WriteOptions) error {
+	return b.addRangeKey(db.InternalKeyKindRangeKeyUnset, start, end, nil)
+}
+
+func (b *Batch) addRangeKey(kind db.InternalKeyKind, start, end, value []byte) error {
+	encoded := encodeRangeKeyValue(end, value)
+	if err := b.checkRangeSize(start, end, value, encoded); err != nil {
+		return err
+	}
+	if len(b.data) == 0 {
+		b.init(len(start) + len(encoded) + 2*binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+	offset := uint32(len(b.data))
+	b.data = append(b.data, byte(kind))
+	b.appendStr(start)
+	b.appendStr(encoded)
+	if b.index != nil {
+		if err := b.index.Add(offset); err != nil {
+			// We never add duplicate entries, so an error should never occur.
+			panic(err)
+		}
+	}
+	b.memTableSize += memTableEntrySize(len(start), len(encoded))
+	return nil
+}
+
 // Repr returns the underlying batch representation. It is not safe to modify
-// the contents.
+// the contents. The representation can be used to reconstruct the batch,
+// possibly on another node, using NewBatchFromRepr. See batchStorage for a
+// description of the format.
 func (b *Batch) Repr() []byte {
 	return b.data
 }
 
+// NewBatchFromRepr returns a batch containing the operations encoded in a
+// batch representation, as returned by Batch.Repr. The batch takes ownership
+// of repr, which is modified when the batch is applied. The batch is not
+// indexed, and is applied using DB.Apply. Applying a batch whose
+// representation is corrupt fails with ErrInvalidBatch.
+func NewBatchFromRepr(repr []byte) *Batch {
+	b := &Batch{}
+	if len(repr) == 0 {
+		return b
+	}
+	if len(repr) < batchHeaderLen {
+		b.init(batchHeaderLen)
+		b.setCount(invalidBatchCount)
+		return b
+	}
+	b.data = repr
+	b.refreshMemTableSize()
+	if !b.validate() {
+		b.setCount(invalidBatchCount)
+	}
+	return b
+}
+
+// Iterate invokes fn for each operation in the batch in the order the
+// operations were added. For a DeleteRange operation, key is the start key
+// and value is the end key of the range. For a LogData operation, key is the
+// data and value is nil. The slices passed to fn alias the
+// batch's storage and must not be retained or modified. Iteration stops at
+// the first error returned by fn, which is then returned by Iterate. If the
+// batch is corrupt, ErrInvalidBatch is returned.
+func (b *Batch) Iterate(fn func(kind db.InternalKeyKind, key, value []byte) error) error {
+	if len(b.data) == 0 {
+		return nil
+	}
+	if len(b.data) < batchHeaderLen {
+		return ErrInvalidBatch
+	}
+	for iter := b.iter(); len(iter) > 0; {
+		kind, ukey, value, ok := iter.next()
+		if !ok {
+			return ErrInvalidBatch
+		}
+		if err := fn(kind, ukey, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate returns whether every entry in the batch can be decoded and the
+// number of entries other than LogData entries matches the count in the batch
+// header.
+func (b *Batch) validate() bool {
+	var n uint32
+	for iter := b.iter(); len(iter) > 0; {
+		kind, _, _, ok := iter.next()
+		if !ok {
+			return false
+		}
+		if kind != db.InternalKeyKindLogData {
+			n++
+		}
+	}
+	return n == b.count()
+}
+
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE, SeekLT,
 // First or Last. Only indexed batches support iterators.
@@ -323,7 +564,7 @@ func (b *Batch) NewIter(o *db.IterOptions) db.Iterator {
 	if b.index == nil {
 		return &dbIter{err: ErrNotIndexed}
 	}
-	return b.db.newIterInternal(b.newInternalIter(o), o)
+	return b.db.newIterInternal(b, db.InternalKeySeqNumMax, o)
 }
 
 // newInternalIter creates a new InternalIterator that iterates over the
@@ -414,33 +655,13 @@ func (b *Batch) count() uint32 {
 	return binary.LittleEndian.Uint32(b.countData())
 }
 
-func (b *Batch) iter() batchReader {
+func (b *Batch) iter() batchDecoder {
 	return b.data[batchHeaderLen:]
 }
 
 func (b *Batch) decode(offset uint32) (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
-	p := b.data[offset:]
-	if len(p) == 0 {
-		return 0, nil, nil, false
-	}
-	kind, p = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
-		return 0, nil, nil, false
-	}
-	p, ukey, ok = batchDecodeStr(p)
-	if !ok {
-		return 0, nil, nil, false
-	}
-	switch kind {
-	case db.InternalKeyKindSet,
-		db.InternalKeyKindMerge,
-		db.InternalKeyKindRangeDelete:
-		_, value, ok = batchDecodeStr(p)
-		if !ok {
-			return 0, nil, nil, false
-		}
-	}
-	return kind, ukey, value, true
+	d := batchDecoder(b.data[offset:])
+	return d.next()
 }
 
 func batchDecodeStr(data []byte) (odata []byte, s []byte, ok bool) {
@@ -455,17 +676,20 @@ func batchDecodeStr(data []byte) (odata []byte, s []byte, ok bool) {
 	return data[v:], data[:v], true
 }
 
-type batchReader []byte
+// batchDecoder decodes the operations in a batch's repr. It is shared by the
+// batch itself, memtable application and WAL replay so that every consumer
+// agrees on the format.
+type batchDecoder []byte
 
 // next returns the next operation in this batch.
-// The final return value is false if the batch is corrupi.
-func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
+// The final return value is false if the batch is corrupt.
+func (r *batchDecoder) next() (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
 	p := *r
 	if len(p) == 0 {
 		return 0, nil, nil, false
 	}
 	kind, *r = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
+	if !kind.Valid() {
 		return 0, nil, nil, false
 	}
 	ukey, ok = r.nextStr()
@@ -473,7 +697,11 @@ func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte
 		return 0, nil, nil, false
 	}
 	switch kind {
-	case db.InternalKeyKindSet, db.InternalKeyKindRangeDelete:
+	case db.InternalKeyKindSet,
+		db.InternalKeyKindMerge,
+		db.InternalKeyKindRangeDelete,
+		db.InternalKeyKindRangeKeySet,
+		db.InternalKeyKindRangeKeyUnset:
 		value, ok = r.nextStr()
 		if !ok {
 			return 0, nil, nil, false
@@ -482,7 +710,7 @@ func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte
 	return kind, ukey, value, true
 }
 
-func (r *batchReader) nextStr() (s []byte, ok bool) {
+func (r *batchDecoder) nextStr() (s []byte, ok bool) {
 	p := *r
 	u, numBytes := binary.Uvarint(p)
 	if numBytes <= 0 {
@@ -553,6 +781,10 @@ func (i *batchIter) SeekGE(key []byte) {
 	i.iter.SeekGE(key)
 }
 
+func (i *batchIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
+}
+
 func (i *batchIter) SeekLT(key []byte) {
 	i.clearPrevCache()
 	i.iter.SeekLT(key)
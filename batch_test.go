@@ -5,13 +5,16 @@
 package pebble
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/petermattis/pebble/datadriven"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestBatch(t *testing.T) {
@@ -31,12 +34,18 @@ func TestBatch(t *testing.T) {
 		{db.InternalKeyKindDelete, "nosuchkey", ""},
 		{db.InternalKeyKindSet, "binarydata", "\x00"},
 		{db.InternalKeyKindSet, "binarydata", "\xff"},
+		{db.InternalKeyKindMerge, "merge", "mergedata"},
+		{db.InternalKeyKindMerge, "merge", ""},
+		{db.InternalKeyKindMerge, "", ""},
 	}
 	var b Batch
 	for _, tc := range testCases {
-		if tc.kind == db.InternalKeyKindDelete {
+		switch tc.kind {
+		case db.InternalKeyKindDelete:
 			b.Delete([]byte(tc.key), nil)
-		} else {
+		case db.InternalKeyKindMerge:
+			b.Merge([]byte(tc.key), []byte(tc.value), nil)
+		default:
 			b.Set([]byte(tc.key), []byte(tc.value), nil)
 		}
 	}
@@ -104,6 +113,46 @@ func TestBatchIncrement(t *testing.T) {
 	}
 }
 
+func TestBatchDeleteRangeInvalid(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	seqNum := atomic.LoadUint64(&d.mu.versions.logSeqNum)
+
+	for _, r := range [][2]string{{"b", "b"}, {"c", "b"}, {"", ""}} {
+		start, end := []byte(r[0]), []byte(r[1])
+		var b Batch
+		if err := b.DeleteRange(start, end, nil); err != ErrInvalidRange {
+			t.Fatalf("[%s,%s): expected %v, but found %v", start, end, ErrInvalidRange, err)
+		}
+		if len(b.data) != 0 {
+			t.Fatalf("[%s,%s): expected an empty batch, but found %x", start, end, b.data)
+		}
+		if err := d.DeleteRange(start, end, nil); err != ErrInvalidRange {
+			t.Fatalf("[%s,%s): expected %v, but found %v", start, end, ErrInvalidRange, err)
+		}
+	}
+	if s := atomic.LoadUint64(&d.mu.versions.logSeqNum); s != seqNum {
+		t.Fatalf("expected log sequence number %d, but found %d", seqNum, s)
+	}
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, but found %q (%v)", v, err)
+	}
+
+	if err := d.DeleteRange([]byte("a"), []byte("b"), nil); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
 func TestBatchGet(t *testing.T) {
 	testCases := []struct {
 		key      []byte
@@ -135,6 +184,177 @@ func TestBatchGet(t *testing.T) {
 	}
 }
 
+func TestBatchRepr(t *testing.T) {
+	open := func() *DB {
+		d, err := Open("", &db.Options{
+			Storage: storage.NewMem(),
+		})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return d
+	}
+	src, dst := open(), open()
+
+	// memTableContents returns the entries in the mutable memtable of d.
+	memTableContents := func(d *DB) string {
+		d.mu.Lock()
+		iter := d.mu.mem.mutable.NewIter(nil)
+		d.mu.Unlock()
+		var buf bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s\n", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	b := src.NewBatch()
+	b.Set([]byte("a"), []byte("1"), nil)
+	b.Merge([]byte("b"), []byte("2"), nil)
+	b.Delete([]byte("a"), nil)
+	b.DeleteRange([]byte("c"), []byte("d"), nil)
+	b.Set([]byte("e"), []byte("3"), nil)
+	b.Merge([]byte("b"), []byte("4"), nil)
+	if err := src.Apply(b, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ship a copy of the batch representation and replay it.
+	repr := append([]byte(nil), b.Repr()...)
+	if err := dst.Apply(NewBatchFromRepr(repr), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := memTableContents(src)
+	if got := memTableContents(dst); got != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, got)
+	}
+	for _, key := range []string{"a", "b", "e"} {
+		v1, err1 := src.Get([]byte(key))
+		v2, err2 := dst.Get([]byte(key))
+		if string(v1) != string(v2) || err1 != err2 {
+			t.Fatalf("%s: expected %q (%v), but found %q (%v)", key, v1, err1, v2, err2)
+		}
+	}
+
+	// Empty and corrupt representations.
+	if err := dst.Apply(NewBatchFromRepr(nil), nil); err != nil {
+		t.Fatalf("empty batch: %v", err)
+	}
+	for _, repr := range [][]byte{
+		b.Repr()[:batchHeaderLen-1],
+		b.Repr()[:len(b.Repr())-1],
+		append(append([]byte(nil), b.Repr()...), byte(db.InternalKeyKindSet)),
+	} {
+		r := append([]byte(nil), repr...)
+		if err := dst.Apply(NewBatchFromRepr(r), nil); err != ErrInvalidBatch {
+			t.Fatalf("%q: expected %v, but found %v", repr, ErrInvalidBatch, err)
+		}
+	}
+	if got := memTableContents(dst); got != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, got)
+	}
+
+	for _, d := range []*DB{src, dst} {
+		if err := d.Close(); err != nil {
+			t.Fatalf("db Close: %v", err)
+		}
+	}
+}
+
+func TestBatchIterate(t *testing.T) {
+	type op struct {
+		kind       db.InternalKeyKind
+		key, value string
+	}
+	expected := []op{
+		{db.InternalKeyKindSet, "a", "1"},
+		{db.InternalKeyKindMerge, "b", "2"},
+		{db.InternalKeyKindDelete, "c", ""},
+		{db.InternalKeyKindLogData, "marker", ""},
+		{db.InternalKeyKindRangeDelete, "d", "f"},
+		{db.InternalKeyKindSet, "a", ""},
+	}
+	build := func(b *Batch) {
+		b.Set([]byte("a"), []byte("1"), nil)
+		b.Merge([]byte("b"), []byte("2"), nil)
+		b.Delete([]byte("c"), nil)
+		b.LogData([]byte("marker"), nil)
+		b.DeleteRange([]byte("d"), []byte("f"), nil)
+		b.Set([]byte("a"), nil, nil)
+	}
+
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%t", indexed), func(t *testing.T) {
+			var b *Batch
+			if indexed {
+				b = newIndexedBatch(nil, db.DefaultComparer)
+			} else {
+				b = newBatch(nil)
+			}
+			build(b)
+			// LogData is not counted.
+			if n := b.count(); n != uint32(len(expected)-1) {
+				t.Fatalf("expected count %d, but found %d", len(expected)-1, n)
+			}
+
+			var ops []op
+			err := b.Iterate(func(kind db.InternalKeyKind, key, value []byte) error {
+				ops = append(ops, op{kind, string(key), string(value)})
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("iterate: %v", err)
+			}
+			if len(ops) != len(expected) {
+				t.Fatalf("expected %d ops, but found %d", len(expected), len(ops))
+			}
+			for i := range expected {
+				if ops[i] != expected[i] {
+					t.Fatalf("%d: expected %v, but found %v", i, expected[i], ops[i])
+				}
+			}
+
+			// An error returned by the callback stops the iteration.
+			stop := fmt.Errorf("stop")
+			var n int
+			err = b.Iterate(func(kind db.InternalKeyKind, key, value []byte) error {
+				n++
+				return stop
+			})
+			if err != stop {
+				t.Fatalf("expected %v, but found %v", stop, err)
+			}
+			if n != 1 {
+				t.Fatalf("expected 1 callback, but found %d", n)
+			}
+		})
+	}
+
+	// A corrupt batch is reported as invalid.
+	b := newBatch(nil)
+	build(b)
+	b.data = b.data[:len(b.data)-1]
+	err := b.Iterate(func(kind db.InternalKeyKind, key, value []byte) error {
+		return nil
+	})
+	if err != ErrInvalidBatch {
+		t.Fatalf("expected %v, but found %v", ErrInvalidBatch, err)
+	}
+
+	// An empty batch invokes no callbacks.
+	var empty Batch
+	if err := empty.Iterate(func(kind db.InternalKeyKind, key, value []byte) error {
+		t.Fatalf("unexpected callback")
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+}
+
 func TestBatchIter(t *testing.T) {
 	var b *Batch
 	datadriven.RunTest(t, "testdata/internal_iter_next", func(d *datadriven.TestData) string {
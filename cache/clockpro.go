@@ -162,6 +162,16 @@ func (c *Cache) Get(fileNum, offset uint64) []byte {
 	return e.val
 }
 
+// Size returns the total size of the blocks held by the cache.
+func (c *Cache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.countHot + c.countCold
+}
+
 // Set ...
 func (c *Cache) Set(fileNum, offset uint64, value []byte) {
 	if c == nil {
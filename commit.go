@@ -5,12 +5,15 @@
 package pebble
 
 import (
+	"errors"
+	"fmt"
 	"math/bits"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/rate"
 )
 
@@ -120,6 +123,9 @@ type commitEnv struct {
 	visibleSeqNum *uint64
 	// Controller for measuring and limiting the commit rate.
 	controller *controller
+	// Whether to check the consistency of the sequence numbers of the batches
+	// as they are prepared and published. See db.Options.DebugCheck.
+	debugCheck bool
 
 	// Apply the batch to the specified memtable. Called concurrently.
 	apply func(b *Batch, mem *memTable) error
@@ -147,12 +153,40 @@ type commitPipeline struct {
 	// Queue of pending batches to commit.
 	pending commitQueue
 
+	// The syncer coalesces concurrent sync requests (group commit). Every WAL
+	// write is assigned a position. Before syncing, the sync goroutine notes
+	// the position of the most recent write; when the sync completes, every
+	// batch at or below that position is durable, including batches which had
+	// not yet registered as waiting for the sync.
 	syncer struct {
 		sync.Mutex
-		cond    sync.Cond
+		cond sync.Cond
+		// The position of the most recent WAL write. Incremented atomically
+		// while holding commitEnv.mu.
+		written uint64
+		// The position up to which the WAL is known to be durable. Protected by
+		// syncer.Mutex.
+		synced uint64
+		// The number of syncs performed. Updated atomically.
+		count   uint64
 		closed  bool
-		pending []*Batch
+		pending []syncRequest
 	}
+
+	// The state of the sequence number checks performed if
+	// commitEnv.debugCheck is set. Protected by commitEnv.mu.
+	debug struct {
+		// Whether a batch has been prepared.
+		prepared bool
+		// The sequence number following the most recently prepared batch.
+		nextSeqNum uint64
+	}
+}
+
+// syncRequest is a batch waiting for the WAL to be synced through pos.
+type syncRequest struct {
+	b   *Batch
+	pos uint64
 }
 
 func newCommitPipeline(env commitEnv) *commitPipeline {
@@ -187,8 +221,9 @@ func (p *commitPipeline) syncLoop() {
 			return
 		}
 
-		pending := s.pending
-		s.pending = nil
+		// All of the writes up to target have been performed and will be
+		// covered by the sync.
+		target := atomic.LoadUint64(&s.written)
 
 		s.Unlock()
 
@@ -196,12 +231,25 @@ func (p *commitPipeline) syncLoop() {
 			// TODO(peter): Handle error notification.
 			panic(err)
 		}
-
-		for _, b := range pending {
-			b.commit.Done()
-		}
+		atomic.AddUint64(&s.count, 1)
 
 		s.Lock()
+		s.synced = target
+
+		// Release the waiters whose writes are now durable. Waiters for writes
+		// performed after target remain pending for the next sync.
+		pending := s.pending[:0]
+		for _, r := range s.pending {
+			if r.pos <= target {
+				r.b.commit.Done()
+			} else {
+				pending = append(pending, r)
+			}
+		}
+		for i := len(pending); i < len(s.pending); i++ {
+			s.pending[i] = syncRequest{}
+		}
+		s.pending = pending
 	}
 }
 
@@ -216,15 +264,32 @@ func (p *commitPipeline) Close() {
 // WAL, and applying the batch to the memtable. Upon successful return the
 // batch's mutations will be visible for reading.
 func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
+	return p.CommitAt(b, 0, syncWAL)
+}
+
+// CommitAt is like Commit, but commits the batch at the specified sequence
+// number rather than at the next sequence number, unless seqNum is 0. The
+// sequence number must not precede the next sequence number. The sequence
+// numbers which are skipped are never assigned, and the next sequence number
+// becomes the sequence number following the batch.
+func (p *commitPipeline) CommitAt(b *Batch, seqNum uint64, syncWAL bool) error {
 	if len(b.data) == 0 {
 		return nil
 	}
+	if b.count() == invalidBatchCount {
+		// An invalid batch is rejected before it enters the pipeline.
+		return ErrInvalidBatch
+	}
 
 	// Prepare the batch for committing: enqueuing the batch in the pending
 	// queue, determining the batch sequence number and writing the data to the
 	// WAL.
-	mem, err := p.prepare(b, true /* writeWAL */, syncWAL)
+	mem, err := p.prepare(b, seqNum, true /* writeWAL */, syncWAL)
 	if err != nil {
+		if errors.Is(err, ErrInvalidSeqNum) {
+			// The batch was rejected before it entered the pipeline.
+			return err
+		}
 		// TODO(peter): what to do on error? the pipeline will be horked at this
 		// point.
 		panic(err)
@@ -237,7 +302,11 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 		panic(err)
 	}
 
-	// Publish the batch sequence number.
+	// Publish the batch sequence number. The batch has been applied in its
+	// entirety, and publish does not advance the visible sequence number past
+	// the batch until every earlier batch has also been applied. A reader at
+	// the visible sequence number observes either all of the batch or none of
+	// it.
 	p.publish(b)
 
 	return nil
@@ -271,13 +340,17 @@ func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64
 	// number order.
 	p.pending.enqueue(b, &p.cond)
 
-	// Assign the batch a sequence number.
+	// Assign the batch a sequence number. The batch ends at the new logSeqNum
+	// even if sequence number 0 is skipped, so that the visible sequence number
+	// does not advance past the sequence numbers which have been assigned.
 	seqNum := atomic.AddUint64(p.env.logSeqNum, 1) - 1
 	if seqNum == 0 {
 		seqNum = atomic.AddUint64(p.env.logSeqNum, 1) - 1
-		b.setCount(2)
 	}
 	b.setSeqNum(seqNum)
+	if p.env.debugCheck {
+		p.checkSeqNum(b, false /* explicit */)
+	}
 
 	// Invoke the prepare callback. Note the lack of error reporting. Even if the
 	// callback internally fails, the sequence number needs to be published in
@@ -293,7 +366,9 @@ func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64
 	p.publish(b)
 }
 
-func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, error) {
+func (p *commitPipeline) prepare(
+	b *Batch, seqNum uint64, writeWAL, syncWAL bool,
+) (*memTable, error) {
 	n := uint64(b.count())
 	if n == invalidBatchCount {
 		return nil, ErrInvalidBatch
@@ -302,25 +377,52 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	if syncWAL {
 		count++
 	}
-	b.commit.Add(count)
 
 	p.env.controller.WaitN(len(b.data))
 
 	p.env.mu.Lock()
 
+	// An explicit sequence number is checked before the batch is enqueued, so
+	// that a rejected batch does not enter the pipeline.
+	if seqNum != 0 {
+		if next := atomic.LoadUint64(p.env.logSeqNum); seqNum < next {
+			p.env.mu.Unlock()
+			return nil, newError(ErrInvalidSeqNum, nil,
+				"pebble: sequence number %d precedes the next sequence number %d", seqNum, next)
+		}
+		if n > 0 && seqNum+n-1 > db.InternalKeySeqNumMax {
+			p.env.mu.Unlock()
+			return nil, newError(ErrInvalidSeqNum, nil,
+				"pebble: sequence number %d of a batch of %d entries is too large", seqNum, n)
+		}
+	}
+	b.commit.Add(count)
+
 	// Enqueue the batch in the pending queue. Note that while the pending queue
 	// is lock-free, we want the order of batches to be the same as the sequence
 	// number order.
 	p.pending.enqueue(b, &p.cond)
 
-	// Assign the batch a sequence number.
-	b.setSeqNum(atomic.AddUint64(p.env.logSeqNum, n) - n)
+	// Assign the batch a sequence number. An explicit sequence number skips
+	// the sequence numbers which precede it. It is stored while holding
+	// commitEnv.mu, so the WAL records remain in sequence number order.
+	if seqNum == 0 {
+		b.setSeqNum(atomic.AddUint64(p.env.logSeqNum, n) - n)
+	} else {
+		b.setSeqNum(seqNum)
+		atomic.StoreUint64(p.env.logSeqNum, seqNum+n)
+	}
+	if p.env.debugCheck {
+		p.checkSeqNum(b, seqNum != 0)
+	}
 
 	// Write the data to the WAL.
 	var mem *memTable
 	var err error
+	var pos uint64
 	if writeWAL {
 		mem, err = p.env.write(b)
+		pos = atomic.AddUint64(&p.syncer.written, 1)
 	}
 
 	p.env.mu.Unlock()
@@ -328,14 +430,38 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	if syncWAL {
 		s := &p.syncer
 		s.Lock()
-		s.pending = append(s.pending, b)
-		s.cond.Signal()
+		if pos <= s.synced {
+			// A sync which started after our write has already completed.
+			b.commit.Done()
+		} else {
+			s.pending = append(s.pending, syncRequest{b: b, pos: pos})
+			s.cond.Signal()
+		}
 		s.Unlock()
 	}
 
 	return mem, err
 }
 
+// checkSeqNum checks that the sequence number assigned to b immediately
+// follows the sequence numbers of the previously prepared batch, or that it
+// does not precede them if b was given an explicit sequence number. Batches
+// are enqueued and written to the WAL in the order they are prepared, so a
+// gap or overlap indicates that the WAL, the pending queue and the sequence
+// numbers disagree about the order of the batches. p.env.mu must be held.
+func (p *commitPipeline) checkSeqNum(b *Batch, explicit bool) {
+	if p.debug.prepared && explicit && b.seqNum() < p.debug.nextSeqNum {
+		panic(fmt.Sprintf("pebble: batch sequence number %d precedes the previous batch, which ended at %d",
+			b.seqNum(), p.debug.nextSeqNum))
+	}
+	if p.debug.prepared && !explicit && b.seqNum() != p.debug.nextSeqNum {
+		panic(fmt.Sprintf("pebble: batch sequence number %d does not follow the previous batch, which ended at %d",
+			b.seqNum(), p.debug.nextSeqNum))
+	}
+	p.debug.prepared = true
+	p.debug.nextSeqNum = b.seqNum() + uint64(b.count())
+}
+
 func (p *commitPipeline) publish(b *Batch) {
 	// Mark the batch as applied.
 	atomic.StoreUint32(&b.applied, 1)
@@ -366,6 +492,18 @@ func (p *commitPipeline) publish(b *Batch) {
 				// t's sequence number has already been published.
 				break
 			}
+			if p.env.debugCheck {
+				// Publishing t must not make a part of t visible, nor any
+				// sequence numbers which have not been assigned.
+				if curSeqNum > t.seqNum() {
+					panic(fmt.Sprintf("pebble: visible sequence number %d is within batch [%d,%d)",
+						curSeqNum, t.seqNum(), newSeqNum))
+				}
+				if logSeqNum := atomic.LoadUint64(p.env.logSeqNum); newSeqNum > logSeqNum {
+					panic(fmt.Sprintf("pebble: batch [%d,%d) ends past log sequence number %d",
+						t.seqNum(), newSeqNum, logSeqNum))
+				}
+			}
 			if atomic.CompareAndSwapUint64(p.env.visibleSeqNum, curSeqNum, newSeqNum) {
 				// We successfully published t's sequence number.
 				break
@@ -9,13 +9,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/petermattis/pebble/arenaskl"
+	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/storage"
 )
 
 type testCommitEnv struct {
@@ -91,6 +95,38 @@ func TestCommitPipeline(t *testing.T) {
 	}
 }
 
+func TestCommitPipelineGroupSync(t *testing.T) {
+	var e testCommitEnv
+	env := e.env()
+	env.sync = func() error {
+		// Simulate the latency of an fsync.
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	p := newCommitPipeline(env)
+	defer p.Close()
+
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			var b Batch
+			_ = b.Set([]byte(fmt.Sprint(i)), nil, nil)
+			_ = p.Commit(&b, true /* sync */)
+		}(i)
+	}
+	wg.Wait()
+
+	if s := atomic.LoadUint64(&e.visibleSeqNum); n != s {
+		t.Fatalf("expected %d, but found %d", n, s)
+	}
+	if s := atomic.LoadUint64(&p.syncer.count); s == 0 || s > n/10 {
+		t.Fatalf("expected far fewer than %d syncs, but found %d", n, s)
+	}
+}
+
 func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	var e testCommitEnv
 	p := newCommitPipeline(e.env())
@@ -128,6 +164,178 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	}
 }
 
+func TestCommitPipelineDebugCheck(t *testing.T) {
+	var e testCommitEnv
+	env := e.env()
+	env.debugCheck = true
+	type applied struct {
+		seqNum, count uint64
+	}
+	var mu sync.Mutex
+	var batches []applied
+	env.apply = func(b *Batch, mem *memTable) error {
+		mu.Lock()
+		batches = append(batches, applied{b.seqNum(), uint64(b.count())})
+		mu.Unlock()
+		return nil
+	}
+	p := newCommitPipeline(env)
+	defer p.Close()
+
+	// Commit batches of varying sizes concurrently, interleaved with sequence
+	// number allocations.
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			if i%10 == 0 {
+				p.AllocateSeqNum(func() {}, func(seqNum uint64) {
+					mu.Lock()
+					batches = append(batches, applied{seqNum, 1})
+					mu.Unlock()
+				})
+				return
+			}
+			var b Batch
+			for j := 0; j <= i%3; j++ {
+				_ = b.Set([]byte(fmt.Sprint(i, j)), nil, nil)
+			}
+			_ = p.Commit(&b, i%7 == 0)
+		}(i)
+	}
+	wg.Wait()
+
+	// The batches are assigned monotonic, gap-free sequence numbers. The first
+	// batch may be an allocation, which skips sequence number 0.
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].seqNum < batches[j].seqNum
+	})
+	next := batches[0].seqNum
+	if next > 1 {
+		t.Fatalf("expected first sequence number to be 0 or 1, but found %d", next)
+	}
+	for _, b := range batches {
+		if b.seqNum != next {
+			t.Fatalf("expected batch at sequence number %d, but found %d", next, b.seqNum)
+		}
+		next += b.count
+	}
+	if s := atomic.LoadUint64(&e.logSeqNum); next != s {
+		t.Fatalf("expected log sequence number %d, but found %d", next, s)
+	}
+	if s := atomic.LoadUint64(&e.visibleSeqNum); next != s {
+		t.Fatalf("expected visible sequence number %d, but found %d", next, s)
+	}
+
+	// A batch whose sequence number does not follow the previous batch is
+	// detected.
+	env.write = func(b *Batch) (*memTable, error) {
+		atomic.AddUint64(&e.logSeqNum, 1)
+		return nil, nil
+	}
+	p2 := newCommitPipeline(env)
+	defer p2.Close()
+	commit := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		var b Batch
+		_ = b.Set([]byte("a"), nil, nil)
+		return p2.Commit(&b, false)
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("expected first commit to succeed, but found %v", err)
+	}
+	if err := commit(); err == nil {
+		t.Fatalf("expected sequence number gap to be detected")
+	}
+}
+
+func TestCommitPipelineAtomicVisibility(t *testing.T) {
+	// A small memtable rotates often, so readers also observe batches which
+	// have been flushed.
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MemTableSize: 64 << 10,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+
+	// Every batch sets all of the keys to the same value, so a reader which
+	// observes differing values, or a subset of the keys, has observed a part
+	// of a batch.
+	const numKeys = 10
+	commit := func(value string) error {
+		b := d.NewBatch()
+		for i := 0; i < numKeys; i++ {
+			_ = b.Set([]byte(fmt.Sprintf("%02d", i)), []byte(value), nil)
+		}
+		return d.Apply(b, nil)
+	}
+	if err := commit("initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	const numWriters = 4
+	var wg sync.WaitGroup
+	var done uint32
+	errCh := make(chan error, numWriters+1)
+	wg.Add(numWriters)
+	for w := 0; w < numWriters; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				if err := commit(fmt.Sprintf("%d-%d", w, i)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for atomic.LoadUint32(&done) == 0 {
+			iter := d.NewIter(nil)
+			var keys []string
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+			}
+			if err := iter.Close(); err != nil {
+				errCh <- err
+				return
+			}
+			if len(keys) != numKeys {
+				errCh <- fmt.Errorf("expected %d keys, but found %s", numKeys, keys)
+				return
+			}
+			value := keys[0][strings.Index(keys[0], ":"):]
+			for _, k := range keys {
+				if !strings.HasSuffix(k, value) {
+					errCh <- fmt.Errorf("observed a part of a batch: %s", keys)
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	atomic.StoreUint32(&done, 1)
+	readers.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkCommitPipeline(b *testing.B) {
 	for _, parallelism := range []int{1, 2, 4, 8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("parallel=%d", parallelism), func(b *testing.B) {
@@ -190,3 +398,38 @@ func BenchmarkCommitPipeline(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkCommitPipelineGroupSync(b *testing.B) {
+	for _, parallelism := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("parallel=%d", parallelism), func(b *testing.B) {
+			b.SetParallelism(parallelism)
+			var e testCommitEnv
+			env := e.env()
+			env.sync = func() error {
+				// Simulate the latency of an fsync.
+				time.Sleep(100 * time.Microsecond)
+				return nil
+			}
+			p := newCommitPipeline(env)
+			defer p.Close()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					batch := newBatch(nil)
+					batch.Set([]byte("foo"), nil, nil)
+					if err := p.Commit(batch, true /* sync */); err != nil {
+						b.Fatal(err)
+					}
+					batch.release()
+				}
+			})
+			b.StopTimer()
+
+			syncs := atomic.LoadUint64(&p.syncer.count)
+			if parallelism > 1 && b.N >= 1000 && syncs > uint64(b.N)/2 {
+				b.Fatalf("expected far fewer than %d syncs, but found %d", b.N, syncs)
+			}
+		})
+	}
+}
@@ -5,8 +5,13 @@
 package pebble
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/sstable"
@@ -36,6 +41,17 @@ type compaction struct {
 
 	// inputs are the tables to be compacted.
 	inputs [3][]fileMetadata
+
+	// covered is the set of file numbers of the inputs whose entire key range
+	// is deleted by a newer range tombstone in another input. The contents of
+	// covered tables are not read by the compaction; the tables are simply
+	// deleted.
+	covered map[uint64]bool
+
+	// dropDeleted is set if the compaction drops the entries of its inputs
+	// which are deleted by a newer range tombstone in its inputs. See
+	// DB.CompactPrefix.
+	dropDeleted bool
 }
 
 // pickCompaction picks the best compaction, if any, for vs' current version.
@@ -43,17 +59,30 @@ func pickCompaction(vs *versionSet) (c *compaction) {
 	cur := vs.currentVersion()
 
 	// Pick a compaction based on size. If none exist, pick one based on seeks.
-	if cur.compactionScore >= 1 {
-		c = &compaction{
-			version: cur,
-			level:   cur.compactionLevel,
-		}
-		// TODO(peter): Pick the first file that comes after the compaction pointer
-		// for c.level.
-		c.inputs[0] = []fileMetadata{cur.files[c.level][0]}
-	} else {
+	if cur.compactionScore < 1 {
+		return nil
+	}
+	return pickCompactionAtLevel(vs, cur.compactionLevel)
+}
+
+// pickCompactionAtLevel picks a compaction of the specified level of vs'
+// current version, or returns nil if the level is empty.
+func pickCompactionAtLevel(vs *versionSet, level int) (c *compaction) {
+	cur := vs.currentVersion()
+	if len(cur.files[level]) == 0 {
 		return nil
 	}
+	c = &compaction{
+		version: cur,
+		level:   level,
+	}
+	// TODO(peter): Pick the first file that comes after the compaction pointer
+	// for c.level.
+	i := 0
+	if c.level > 0 && c.level+1 < numLevels {
+		i = pickMinOverlapFile(vs.cmp, cur.files[c.level], cur.files[c.level+1])
+	}
+	c.inputs[0] = []fileMetadata{cur.files[c.level][i]}
 
 	// Files in level 0 may overlap each other, so pick up all overlapping ones.
 	if c.level == 0 {
@@ -68,7 +97,45 @@ func pickCompaction(vs *versionSet) (c *compaction) {
 	return c
 }
 
-// TODO(peter): user initiated compactions.
+// pickMinOverlapFile returns the index of the file in files whose compaction
+// into the next level rewrites the fewest bytes of the next level per byte of
+// the file, preferring earlier files on ties. The bytes rewritten for a file
+// are those of the files in next which overlap its key range, as computed by
+// overlappingBytes. Both files and next must be sorted and non-overlapping,
+// as they are in the levels other than level 0.
+func pickMinOverlapFile(cmp db.Compare, files, next []fileMetadata) int {
+	best, bestRatio := 0, math.Inf(1)
+	for i := range files {
+		f := &files[i]
+		ratio := float64(overlappingBytes(cmp, next, f.smallest.UserKey, f.largest.UserKey))
+		if f.size > 0 {
+			ratio /= float64(f.size)
+		}
+		if ratio < bestRatio {
+			best, bestRatio = i, ratio
+		}
+	}
+	return best
+}
+
+// overlappingBytes returns the total size of the files in the sorted and
+// non-overlapping slice files whose key ranges overlap the user key range
+// [smallest, largest].
+func overlappingBytes(cmp db.Compare, files []fileMetadata, smallest, largest []byte) uint64 {
+	// The overlapping files are those from the first one which ends at or after
+	// smallest, up to (but not including) the first one which starts after
+	// largest.
+	lo := sort.Search(len(files), func(i int) bool {
+		return cmp(files[i].largest.UserKey, smallest) >= 0
+	})
+	hi := sort.Search(len(files), func(i int) bool {
+		return cmp(files[i].smallest.UserKey, largest) > 0
+	})
+	if lo >= hi {
+		return 0
+	}
+	return totalSize(files[lo:hi])
+}
 
 // setupOtherInputs fills in the rest of the compaction inputs, regardless of
 // whether the compaction was automatically scheduled or user initiated.
@@ -136,11 +203,208 @@ func (c *compaction) isBaseLevelForUkey(userCmp db.Compare, ukey []byte) bool {
 	return true
 }
 
+// findCoveredInputs populates c.covered with the inputs at c.level and
+// c.level+1 that are entirely deleted by a range tombstone in the c.level
+// inputs. A table is covered by a range tombstone if the tombstone spans the
+// table's user key range, the tombstone is newer than every entry in the
+// table, and no snapshot can see the table's entries but not the tombstone.
+// A table which may contain range keys is never covered, as range keys are not
+// deleted by range tombstones. The bounds of a table do not include the end keys of its own range
+// tombstones, so a table containing a range tombstone which ends past the end
+// of the covering tombstone is not covered: dropping the table would lose the
+// part of its tombstone which the covering tombstone does not span, and with
+// it the deletion of the keys in that part of the deeper levels.
+//
+// TODO(peter): Finding the range tombstones requires scanning the c.level
+// inputs. Store range tombstones in a separate sstable block so that they can
+// be read without scanning the point entries.
+func (c *compaction) findCoveredInputs(
+	cmp db.Compare, newIter tableNewIter, snapshots []uint64,
+) error {
+	// own holds the range tombstones of each table which has been read. The
+	// tombstones of the c.level inputs are also the candidate covering
+	// tombstones.
+	own := make(map[uint64][]rangeTombstone)
+	var tombstones []rangeTombstone
+	for i := range c.inputs[0] {
+		t, err := collectRangeTombstones(newIter, c.inputs[0][i:i+1], nil)
+		if err != nil {
+			return err
+		}
+		own[c.inputs[0][i].fileNum] = t
+		tombstones = append(tombstones, t...)
+	}
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	// extends returns whether f contains a range tombstone which ends past the
+	// end of t. The c.level+1 inputs are only read if they may contain range
+	// tombstones and are otherwise covered.
+	extends := func(t *rangeTombstone, f *fileMetadata) (bool, error) {
+		ft, ok := own[f.fileNum]
+		if !ok {
+			if !f.mayContainRangeDeletions() {
+				return false, nil
+			}
+			var err error
+			ft, err = collectRangeTombstones(newIter, []fileMetadata{*f}, nil)
+			if err != nil {
+				return false, err
+			}
+			own[f.fileNum] = ft
+		}
+		for i := range ft {
+			if cmp(ft[i].end, t.end) > 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	covers := func(t *rangeTombstone, f *fileMetadata) bool {
+		// Range keys are not deleted by range tombstones, so a table which may
+		// contain range keys is never dropped.
+		if f.mayContainRangeKeys() {
+			return false
+		}
+		// A largest sequence number of zero indicates a table written before
+		// sequence numbers were recorded in the file metadata, so we can't tell
+		// whether the tombstone is newer than its entries.
+		if f.largestSeqNum == 0 || f.largestSeqNum >= t.seqNum {
+			return false
+		}
+		if cmp(t.start, f.smallest.UserKey) > 0 || cmp(f.largest.UserKey, t.end) >= 0 {
+			return false
+		}
+		for _, s := range snapshots {
+			if f.largestSeqNum < s && s <= t.seqNum {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 2; i++ {
+		for j := range c.inputs[i] {
+			f := &c.inputs[i][j]
+			for k := range tombstones {
+				if !covers(&tombstones[k], f) {
+					continue
+				}
+				if ext, err := extends(&tombstones[k], f); err != nil {
+					return err
+				} else if !ext {
+					if c.covered == nil {
+						c.covered = make(map[uint64]bool)
+					}
+					c.covered[f.fileNum] = true
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rangeTombstone is a range tombstone read from a table.
+type rangeTombstone struct {
+	start, end []byte
+	seqNum     uint64
+}
+
+// covers returns whether t deletes the entry with the specified key. Range
+// tombstones only delete point keys: other range tombstones and range keys,
+// which may extend past the end of t, are never deleted.
+func (t *rangeTombstone) covers(cmp db.Compare, key db.InternalKey) bool {
+	kind := key.Kind()
+	return key.SeqNum() < t.seqNum && kind != db.InternalKeyKindRangeDelete &&
+		!isRangeKeyKind(kind) && cmp(t.start, key.UserKey) <= 0 && cmp(key.UserKey, t.end) < 0
+}
+
+// collectRangeTombstones appends the range tombstones in files to tombstones.
+//
+// TODO(peter): Finding the range tombstones requires scanning the files. Store
+// range tombstones in a separate sstable block so that they can be read
+// without scanning the point entries.
+func collectRangeTombstones(
+	newIter tableNewIter, files []fileMetadata, tombstones []rangeTombstone,
+) ([]rangeTombstone, error) {
+	for i := range files {
+		iter, err := newIter(&files[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if key.Kind() != db.InternalKeyKindRangeDelete {
+				continue
+			}
+			tombstones = append(tombstones, rangeTombstone{
+				start:  append([]byte(nil), key.UserKey...),
+				end:    append([]byte(nil), iter.Value()...),
+				seqNum: key.SeqNum(),
+			})
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return tombstones, nil
+}
+
+// filterEntry applies Options.CompactionFilter to an entry being written to
+// the specified level. It returns the entry to write in its place, and false if
+// the entry is omitted. isBase reports whether no older version of a user key
+// can exist below level; a nil isBase assumes that one can. snapshots are the
+// sequence numbers of the open snapshots, in increasing order.
+func (d *DB) filterEntry(
+	level int,
+	key db.InternalKey,
+	value []byte,
+	isBase func(ukey []byte) bool,
+	snapshots []uint64,
+) (db.InternalKey, []byte, bool) {
+	f := d.opts.CompactionFilter
+	if f == nil || key.Kind() != db.InternalKeyKindSet {
+		return key, value, true
+	}
+	if n := len(snapshots); n > 0 && key.SeqNum() < snapshots[n-1] {
+		// The entry may be visible to a snapshot.
+		return key, value, true
+	}
+	newValue, op := f.Filter(level, key.UserKey, value)
+	switch op {
+	case db.FilterDrop:
+		if isBase != nil && isBase(key.UserKey) {
+			return key, nil, false
+		}
+		return db.MakeInternalKey(key.UserKey, key.SeqNum(), db.InternalKeyKindDelete), nil, true
+	case db.FilterChange:
+		return key, newValue, true
+	}
+	return key, value, true
+}
+
+// liveInputs returns the inputs at c.level+i which are not covered by a range
+// tombstone and need to be read by the compaction.
+func (c *compaction) liveInputs(i int) []fileMetadata {
+	if len(c.covered) == 0 {
+		return c.inputs[i]
+	}
+	var files []fileMetadata
+	for _, f := range c.inputs[i] {
+		if !c.covered[f.fileNum] {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
 // maybeScheduleFlush schedules a flush if necessary.
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleFlush() {
-	if d.mu.compact.flushing || d.mu.closed {
+	if d.mu.compact.flushing || atomic.LoadInt32(&d.closed) != 0 {
 		return
 	}
 	if len(d.mu.mem.queue) <= 1 {
@@ -176,10 +440,10 @@ func (d *DB) flush() {
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) flush1() error {
-	// var dirty int
-	// for _, mem := range d.mu.mem.queue {
-	// 	dirty += mem.ApproximateMemoryUsage()
-	// }
+	var dirty int
+	for _, mem := range d.mu.mem.queue {
+		dirty += mem.ApproximateMemoryUsage()
+	}
 
 	var n int
 	for ; n < len(d.mu.mem.queue)-1; n++ {
@@ -194,27 +458,39 @@ func (d *DB) flush1() error {
 
 	var iter db.InternalIterator
 	if n == 1 {
-		iter = d.mu.mem.queue[0].NewIter(nil)
+		iter = d.mu.mem.queue[0].newFlushIter()
 	} else {
 		iters := make([]db.InternalIterator, n)
 		for i := range iters {
-			iters[i] = d.mu.mem.queue[i].NewIter(nil)
+			iters[i] = d.mu.mem.queue[i].newFlushIter()
 		}
 		iter = newMergingIter(d.cmp, iters...)
 	}
 
-	meta, err := d.writeLevel0Table(d.opts.Storage, iter)
+	metas, err := d.writeLevel0Table(d.opts.Storage, iter)
 	if err != nil {
 		return err
 	}
+	if atomic.LoadInt32(&d.canceled) != 0 {
+		// The DB was closed while the flush was running. The memtables remain
+		// in the WAL, and the tables are deleted rather than left orphaned.
+		for _, meta := range metas {
+			delete(d.mu.compact.pendingOutputs, meta.fileNum)
+			d.opts.Storage.Remove(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+		}
+		return errCanceled
+	}
 
-	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+	ve := &versionEdit{
 		logNumber: d.mu.log.number,
-		newFiles: []newFileEntry{
-			{level: 0, meta: meta},
-		},
-	})
-	delete(d.mu.compact.pendingOutputs, meta.fileNum)
+	}
+	for _, meta := range metas {
+		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
+	}
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, ve)
+	for _, meta := range metas {
+		delete(d.mu.compact.pendingOutputs, meta.fileNum)
+	}
 	if err != nil {
 		return err
 	}
@@ -225,12 +501,12 @@ func (d *DB) flush1() error {
 	}
 	d.mu.mem.queue = d.mu.mem.queue[n:]
 
-	// var newDirty int
-	// for _, mem := range d.mu.mem.queue {
-	// 	newDirty += mem.ApproximateMemoryUsage()
-	// }
-	// fmt.Printf("flushed %d: %.1f MB -> %.1f MB\n",
-	// 	n, float64(dirty)/(1<<20), float64(newDirty)/(1<<20))
+	var newDirty int
+	for _, mem := range d.mu.mem.queue {
+		newDirty += mem.ApproximateMemoryUsage()
+	}
+	d.opts.Logger.Infof("flushed %d memtables: %.1f MB -> %.1f MB",
+		n, float64(dirty)/(1<<20), float64(newDirty)/(1<<20))
 
 	d.deleteObsoleteFiles()
 	return nil
@@ -240,28 +516,90 @@ func (d *DB) flush1() error {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleCompaction() {
-	if d.mu.compact.compacting || d.mu.closed {
+	if atomic.LoadInt32(&d.closed) != 0 {
 		return
 	}
 
 	// TODO(peter): check for manual compactions.
 
+	// Refresh the queue from the current version so that it reflects the
+	// backlog even while a compaction is running.
 	v := d.mu.versions.currentVersion()
 	// TODO(peter): check v.fileToCompact.
-	if v.compactionScore < 1 {
+	d.mu.compact.queue.update(v, d.opts)
+	if d.mu.compact.compacting {
+		return
+	}
+	c, ok := d.mu.compact.queue.pop()
+	if !ok {
 		// There is no work to be done.
 		return
 	}
 
 	d.mu.compact.compacting = true
-	go d.compact()
+	go d.compact(c)
+}
+
+// CompactionLevelInfo describes the compaction state of a single level.
+type CompactionLevelInfo struct {
+	// The number of files in the level.
+	NumFiles int
+	// The total size in bytes of the files in the level.
+	Size uint64
+	// The compaction score of the level. For level-0 the score is the number of
+	// files relative to Options.L0CompactionThreshold. For the other levels the
+	// score is the size of the level relative to its MaxBytes. The last level
+	// is never compacted and always has a score of 0.
+	Score float64
+}
+
+// CompactionPickerInfo describes the state used to pick the next compaction.
+type CompactionPickerInfo struct {
+	// The compaction state of each level.
+	Levels []CompactionLevelInfo
+	// The level which would be compacted next, or -1 if no level has a
+	// compaction score of at least 1.
+	Level int
+}
+
+// CompactionPickerDebug returns the compaction scores of each level of the
+// current version, and the level that would be picked for the next
+// compaction. No compaction is performed. This exposes the heuristics used to
+// schedule compactions, and is intended for debugging and for tuning level
+// sizes.
+func (d *DB) CompactionPickerDebug() *CompactionPickerInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return compactionPickerInfo(d.mu.versions.currentVersion(), d.opts)
+}
+
+func compactionPickerInfo(v *version, opts *db.Options) *CompactionPickerInfo {
+	scores := v.compactionScores(opts)
+	info := &CompactionPickerInfo{
+		Levels: make([]CompactionLevelInfo, numLevels),
+		Level:  -1,
+	}
+	for level := range info.Levels {
+		info.Levels[level] = CompactionLevelInfo{
+			NumFiles: len(v.files[level]),
+			Size:     totalSize(v.files[level]),
+			Score:    scores[level],
+		}
+	}
+	// NB: v.compactionScore and v.compactionLevel are what pickCompaction
+	// uses, and were computed from the same scores when v was created.
+	if v.compactionScore >= 1 {
+		info.Level = v.compactionLevel
+	}
+	return info
 }
 
-// compact runs one compaction and maybe schedules another call to compact.
-func (d *DB) compact() {
+// compact runs the compaction of candidate c and maybe schedules another call
+// to compact.
+func (d *DB) compact(c compactionCandidate) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.compact1(); err != nil {
+	if err := d.compact1(c); err != nil {
 		// TODO(peter): count consecutive compaction errors and backoff.
 	}
 	d.mu.compact.compacting = false
@@ -271,17 +609,24 @@ func (d *DB) compact() {
 	d.mu.compact.cond.Broadcast()
 }
 
-// compact1 runs one compaction.
+// compact1 runs the compaction of candidate cand.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
-func (d *DB) compact1() error {
+func (d *DB) compact1(cand compactionCandidate) error {
 	// TODO(peter): support manual compactions.
 
-	c := pickCompaction(&d.mu.versions)
+	// The version may have changed since the candidate was queued, in which
+	// case the level may no longer need compacting.
+	if d.mu.versions.currentVersion().compactionScores(d.opts)[cand.level] < 1 {
+		return nil
+	}
+	c := pickCompactionAtLevel(&d.mu.versions, cand.level)
 	if c == nil {
 		return nil
 	}
+	d.opts.Logger.Infof("compacting L%d (score %.2f): %d+%d files into L%d",
+		c.level, cand.score, len(c.inputs[0]), len(c.inputs[1]), c.level+1)
 
 	// Check for a trivial move of one table from one level to the next.
 	// We avoid such a move if there is lots of overlapping grandparent data.
@@ -302,10 +647,31 @@ func (d *DB) compact1() error {
 		})
 	}
 
+	return d.compactAndApply(c)
+}
+
+// compactAndApply runs compaction c, rewriting its inputs, and installs the
+// resulting version.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) compactAndApply(c *compaction) error {
+	start := time.Now()
 	ve, pendingOutputs, err := d.compactDiskTables(c)
 	if err != nil {
 		return err
 	}
+	if atomic.LoadInt32(&d.canceled) != 0 {
+		// The DB was closed while the compaction was running. The outputs are
+		// not installed, so they are deleted rather than left orphaned.
+		for _, fileNum := range pendingOutputs {
+			delete(d.mu.compact.pendingOutputs, fileNum)
+		}
+		for i := range ve.newFiles {
+			d.opts.Storage.Remove(dbFilename(d.dirname, fileTypeTable, ve.newFiles[i].meta.fileNum))
+		}
+		return errCanceled
+	}
 	err = d.mu.versions.logAndApply(d.opts, d.dirname, ve)
 	for _, fileNum := range pendingOutputs {
 		delete(d.mu.compact.pendingOutputs, fileNum)
@@ -313,7 +679,229 @@ func (d *DB) compact1() error {
 	if err != nil {
 		return err
 	}
+
+	info := db.CompactionInfo{
+		Level:           c.level,
+		InputLevelBytes: totalSize(c.inputs[0]),
+		Duration:        time.Since(start),
+	}
+	info.InputBytes = info.InputLevelBytes + totalSize(c.inputs[1])
+	for i := range ve.newFiles {
+		info.OutputBytes += ve.newFiles[i].meta.size
+	}
+	total := &d.mu.compact.total
+	d.mu.compact.count++
+	total.InputBytes += info.InputBytes
+	total.InputLevelBytes += info.InputLevelBytes
+	total.OutputBytes += info.OutputBytes
+	total.Duration += info.Duration
+
 	d.deleteObsoleteFiles()
+
+	// The compaction is reported without holding d.mu, so that a slow
+	// EventListener does not block the DB.
+	d.mu.Unlock()
+	d.opts.EventListener.CompactionEnd(info)
+	d.mu.Lock()
+	return nil
+}
+
+// CompactFiles compacts the tables with the specified file numbers into the
+// next level, regardless of whether the compaction heuristics would pick
+// them. The tables are grouped by level, and each group is compacted along
+// with the tables of the next level which it overlaps. The groups are
+// compacted starting with the deepest level, so that the compaction of one
+// group does not consume the named tables of a deeper group. The tables are
+// always rewritten, even when a table could be moved to the next level as-is.
+// Level 0 tables may overlap each other, so a level 0 table is compacted
+// along with the other level 0 tables it overlaps.
+//
+// CompactFiles waits for a running compaction to finish. It returns an error
+// if a table is not in the current version, is in the last level, or is being
+// written by a flush, compaction or ingestion which is in progress.
+func (d *DB) CompactFiles(fileNums []uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+
+	// Find the level of each of the named tables.
+	cur := d.mu.versions.currentVersion()
+	levels := make(map[uint64]int, len(fileNums))
+	for level := range cur.files {
+		for i := range cur.files[level] {
+			levels[cur.files[level][i].fileNum] = level
+		}
+	}
+	var named [numLevels]map[uint64]bool
+	for _, fileNum := range fileNums {
+		if _, ok := d.mu.compact.pendingOutputs[fileNum]; ok {
+			return fmt.Errorf("pebble: file %06d is being compacted", fileNum)
+		}
+		level, ok := levels[fileNum]
+		if !ok {
+			return fmt.Errorf("pebble: file %06d is not live", fileNum)
+		}
+		if level == numLevels-1 {
+			return fmt.Errorf("pebble: file %06d is in the last level", fileNum)
+		}
+		if named[level] == nil {
+			named[level] = make(map[uint64]bool)
+		}
+		named[level][fileNum] = true
+	}
+
+	d.mu.compact.compacting = true
+	defer func() {
+		d.mu.compact.compacting = false
+		d.maybeScheduleCompaction()
+		d.mu.compact.cond.Broadcast()
+	}()
+
+	for level := numLevels - 2; level >= 0; level-- {
+		if named[level] == nil {
+			continue
+		}
+		// The version changes as each group is compacted, so the inputs are
+		// retrieved from the current version. The named tables are in level key
+		// order.
+		c := &compaction{
+			version: d.mu.versions.currentVersion(),
+			level:   level,
+		}
+		for _, f := range c.version.files[level] {
+			if named[level][f.fileNum] {
+				c.inputs[0] = append(c.inputs[0], f)
+			}
+		}
+		if level == 0 {
+			smallest, largest := ikeyRange(d.cmp, c.inputs[0], nil)
+			c.inputs[0] = c.version.overlaps(0, d.cmp, smallest.UserKey, largest.UserKey)
+		}
+		smallest0, largest0 := ikeyRange(d.cmp, c.inputs[0], nil)
+		c.inputs[1] = c.version.overlaps(level+1, d.cmp, smallest0.UserKey, largest0.UserKey)
+		if level+2 < numLevels {
+			smallest01, largest01 := ikeyRange(d.cmp, c.inputs[0], c.inputs[1])
+			c.inputs[2] = c.version.overlaps(level+2, d.cmp, smallest01.UserKey, largest01.UserKey)
+		}
+
+		d.opts.Logger.Infof("compacting L%d (manual): %d+%d files into L%d",
+			c.level, len(c.inputs[0]), len(c.inputs[1]), c.level+1)
+		if err := d.compactAndApply(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactPrefix rewrites the tables containing keys with the specified
+// prefix, as determined by db.Comparer.Split, dropping the entries which have
+// been deleted by a range tombstone. It is intended for reclaiming the space
+// of a deleted key prefix, such as the keys of an evicted tenant, without
+// compacting the rest of the DB: only the tables overlapping the prefix and
+// the tables of the next level they overlap are rewritten. The memtable is
+// flushed first so that recent deletions are included.
+//
+// The prefix's data is compacted level by level into the lowest level
+// containing the prefix. If the prefix only occupies a single level, its
+// tables are rewritten in place.
+func (d *DB) CompactPrefix(prefix []byte) error {
+	split := d.opts.Comparer.Split
+	if split == nil {
+		return fmt.Errorf("pebble: CompactPrefix requires Comparer.Split")
+	}
+	if split(prefix) != len(prefix) {
+		return fmt.Errorf("pebble: %q is not a key prefix", prefix)
+	}
+	if err := d.Flush(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.compact.compacting = true
+	defer func() {
+		d.mu.compact.compacting = false
+		d.maybeScheduleCompaction()
+		d.mu.compact.cond.Broadcast()
+	}()
+
+	// The keys with the prefix sort contiguously, so a table overlaps the
+	// prefix if either of its bounds has the prefix or its bounds straddle
+	// the prefix.
+	hasPrefix := func(key []byte) bool {
+		return bytes.Equal(key[:split(key)], prefix)
+	}
+	prefixFiles := func(v *version, level int) (ret []fileMetadata) {
+		for _, f := range v.files[level] {
+			if hasPrefix(f.smallest.UserKey) || hasPrefix(f.largest.UserKey) ||
+				(d.cmp(f.smallest.UserKey, prefix) < 0 && d.cmp(prefix, f.largest.UserKey) < 0) {
+				ret = append(ret, f)
+			}
+		}
+		return ret
+	}
+
+	first, last := -1, -1
+	cur := d.mu.versions.currentVersion()
+	for level := range cur.files {
+		if len(prefixFiles(cur, level)) > 0 {
+			if first < 0 {
+				first = level
+			}
+			last = level
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	if last == 0 {
+		last = 1
+	}
+	if first == last {
+		// Rewrite the tables in place using a compaction with no c.level
+		// inputs.
+		first--
+	}
+
+	for level := first; level < last; level++ {
+		// The version changes as each level is compacted, so the inputs are
+		// retrieved from the current version.
+		c := &compaction{
+			version:     d.mu.versions.currentVersion(),
+			level:       level,
+			dropDeleted: true,
+		}
+		c.inputs[0] = prefixFiles(c.version, level)
+		if level == 0 && len(c.inputs[0]) > 0 {
+			smallest, largest := ikeyRange(d.cmp, c.inputs[0], nil)
+			c.inputs[0] = c.version.overlaps(0, d.cmp, smallest.UserKey, largest.UserKey)
+		}
+		// The c.level+1 inputs include all of the tables overlapping the
+		// prefix, even if the c.level inputs do not overlap them.
+		next := prefixFiles(c.version, level+1)
+		if len(c.inputs[0]) == 0 && len(next) == 0 {
+			continue
+		}
+		smallest0, largest0 := ikeyRange(d.cmp, c.inputs[0], next)
+		c.inputs[1] = c.version.overlaps(level+1, d.cmp, smallest0.UserKey, largest0.UserKey)
+		if level+2 < numLevels {
+			smallest01, largest01 := ikeyRange(d.cmp, c.inputs[0], c.inputs[1])
+			c.inputs[2] = c.version.overlaps(level+2, d.cmp, smallest01.UserKey, largest01.UserKey)
+		}
+
+		d.opts.Logger.Infof("compacting L%d (prefix): %d+%d files into L%d",
+			c.level, len(c.inputs[0]), len(c.inputs[1]), c.level+1)
+		if err := d.compactAndApply(c); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -337,21 +925,59 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	iiter, err := compactionIterator(d.cmp, d.newIter, c)
+	// The DB does not support explicit snapshots, so there are no snapshots
+	// to pass to the compaction iterator, and every entry is in a single
+	// snapshot stripe: tombstones are elided on the assumption that no reader
+	// can see the entries they shadow. Open iterators hold a reference to the
+	// version they were created from and are unaffected by compactions, and
+	// NewIterAtSeqNum does not retain old versions of keys.
+	//
+	// TODO(peter): Populate snapshots once the DB supports explicit snapshots.
+	var snapshots []uint64
+	// Compactions always read their inputs with d.tableCache.newIter, even
+	// when d.newIter skips corrupt tables: the inputs are deleted by the
+	// compaction, so skipping a table would silently lose its data.
+	newIter := d.tableCache.newIter
+	if err := c.findCoveredInputs(d.cmp, newIter, snapshots); err != nil {
+		return nil, pendingOutputs, err
+	}
+	var tombstones []rangeTombstone
+	if c.dropDeleted {
+		for i := 0; i < 2; i++ {
+			var err error
+			tombstones, err = collectRangeTombstones(newIter, c.liveInputs(i), tombstones)
+			if err != nil {
+				return nil, pendingOutputs, err
+			}
+		}
+	}
+	deleted := func(key db.InternalKey) bool {
+		for i := range tombstones {
+			if tombstones[i].covers(d.cmp, key) {
+				return true
+			}
+		}
+		return false
+	}
+	iiter, err := compactionIterator(d.cmp, newIter, d.tableCache.newRangeKeyIter, c)
 	if err != nil {
 		return nil, pendingOutputs, err
 	}
+	isBase := func(key []byte) bool {
+		return c.isBaseLevelForUkey(d.cmp, key)
+	}
 	iter := &compactionIter{
-		cmp:   d.cmp,
-		merge: d.merge,
-		iter:  iiter,
+		cmp:            d.cmp,
+		merge:          d.merge,
+		partialMerge:   d.partialMerge,
+		iter:           iiter,
+		snapshots:      snapshots,
+		elideTombstone: isBase,
 	}
 
-	// TODO(peter): output to more than one table, if it would otherwise be too large.
 	var (
-		fileNum  uint64
-		filename string
-		tw       *sstable.Writer
+		filenames []string
+		tw        *sstable.Writer
 	)
 	defer func() {
 		if iter != nil {
@@ -361,34 +987,81 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			retErr = firstError(retErr, tw.Close())
 		}
 		if retErr != nil {
-			d.opts.Storage.Remove(filename)
+			for _, filename := range filenames {
+				d.opts.Storage.Remove(filename)
+			}
 		}
 	}()
 
-	var smallest, largest db.InternalKey
+	ve = &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{},
+	}
+	levelOpts := d.opts.Level(c.level + 1)
+	var meta fileMetadata
+	// finishOutput closes the table being written and adds it to ve.
+	finishOutput := func() error {
+		w := tw
+		tw = nil
+		if err := w.Close(); err != nil {
+			return err
+		}
+		stat, err := w.Stat()
+		if err != nil {
+			return err
+		}
+		meta.size = uint64(stat.Size())
+		ve.newFiles = append(ve.newFiles, newFileEntry{
+			level: c.level + 1,
+			meta:  meta,
+		})
+		return nil
+	}
+
 	for iter.First(); iter.Valid(); iter.Next() {
 		// TODO(peter): support c.shouldStopBefore.
 
-		ikey := iter.Key()
-		if ikey.Kind() == db.InternalKeyKindDelete &&
-			c.isBaseLevelForUkey(d.opts.Comparer.Compare, ikey.UserKey) {
-			continue
+		if atomic.LoadInt32(&d.canceled) != 0 {
+			return nil, pendingOutputs, errCanceled
 		}
 
+		ikey, value := iter.Key(), iter.Value()
+		if deleted(ikey) {
+			continue
+		}
+		var keep bool
+		ikey, value, keep = d.filterEntry(c.level+1, ikey, value, isBase, snapshots)
+		if !keep {
+			continue
+		}
+		// Start a new output table once the current one reaches the target file
+		// size. A user key is never split across tables, so that the output
+		// tables do not overlap.
+		if tw != nil && tw.EstimatedSize() >= uint64(levelOpts.TargetFileSize) &&
+			d.cmp(meta.largest.UserKey, ikey.UserKey) != 0 {
+			if err := finishOutput(); err != nil {
+				return nil, pendingOutputs, err
+			}
+		}
 		if tw == nil {
 			d.mu.Lock()
-			fileNum = d.mu.versions.nextFileNum()
+			fileNum := d.mu.versions.nextFileNum()
 			d.mu.compact.pendingOutputs[fileNum] = struct{}{}
 			pendingOutputs = append(pendingOutputs, fileNum)
 			d.mu.Unlock()
 
-			filename = dbFilename(d.dirname, fileTypeTable, fileNum)
+			filename := dbFilename(d.dirname, fileTypeTable, fileNum)
+			filenames = append(filenames, filename)
 			file, err := d.opts.Storage.Create(filename)
 			if err != nil {
 				return nil, pendingOutputs, err
 			}
-			tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.level+1))
-			smallest = ikey.Clone()
+			file = newRateLimitedFile(file, d.compactController)
+			tw = sstable.NewWriter(file, d.opts, levelOpts)
+			meta = fileMetadata{
+				fileNum:        fileNum,
+				smallest:       ikey.Clone(),
+				smallestSeqNum: math.MaxUint64,
+			}
 		}
 
 		// Avoid the memory allocation in InternalKey.Clone() by reusing the buffer
@@ -396,37 +1069,26 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		//
 		// TODO(peter): sstable.Writer internally keeps track of the last key
 		// added. Rather than making our own copy here, we should expose that one.
-		largest.UserKey = append(largest.UserKey[:0], ikey.UserKey...)
-		largest.Trailer = ikey.Trailer
-		if err := tw.Add(ikey, iter.Value()); err != nil {
+		meta.largest.UserKey = append(meta.largest.UserKey[:0], ikey.UserKey...)
+		meta.largest.Trailer = ikey.Trailer
+		meta.updateSeqNum(ikey.SeqNum())
+		meta.updateStats(ikey, value)
+		if err := tw.Add(ikey, value); err != nil {
 			return nil, pendingOutputs, err
 		}
 	}
 
-	if err := tw.Close(); err != nil {
-		tw = nil
-		return nil, pendingOutputs, err
-	}
-	stat, err := tw.Stat()
-	if err != nil {
-		tw = nil
-		return nil, pendingOutputs, err
+	// If every entry in the inputs was dropped there is no output table, and
+	// the compaction simply deletes its inputs.
+	if tw != nil {
+		if err := finishOutput(); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
-	tw = nil
-
-	ve = &versionEdit{
-		deletedFiles: map[deletedFileEntry]bool{},
-		newFiles: []newFileEntry{
-			{
-				level: c.level + 1,
-				meta: fileMetadata{
-					fileNum:  fileNum,
-					size:     uint64(stat.Size()),
-					smallest: smallest,
-					largest:  largest,
-				},
-			},
-		},
+	if len(ve.newFiles) > 0 {
+		if err := d.dataDir.Sync(); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
 	for i := 0; i < 2; i++ {
 		for _, f := range c.inputs[i] {
@@ -457,6 +1119,21 @@ func (d *DB) deleteObsoleteFiles() {
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
+	if d.walSeparate() {
+		// The WAL directory contains only log files.
+		walFS := d.opts.WALStorage
+		list, err := walFS.List(d.walDirname)
+		if err == nil {
+			for _, filename := range list {
+				fileType, fileNum, ok := parseDBFilename(filename)
+				if ok && fileType == fileTypeLog && fileNum < logNumber {
+					// Ignore any file system errors.
+					walFS.Remove(filepath.Join(d.walDirname, filename))
+				}
+			}
+		}
+	}
+
 	fs := d.opts.Storage
 	list, err := fs.List(d.dirname)
 	if err != nil {
@@ -490,8 +1167,16 @@ func (d *DB) deleteObsoleteFiles() {
 }
 
 // compactionIterator returns an iterator over all the tables in a compaction.
+// The range keys of the inputs, which are read with newRangeKeyIter, are
+// merged with the point keys. The grandparent tables in c.inputs[2] are not
+// inputs, and their range keys are not read. Range keys are never dropped by a
+// compaction, and a table which may contain range keys is never covered by a
+// range tombstone (see findCoveredInputs).
+//
+// TODO(peter): Range keys which are shadowed by newer range keys in the
+// compaction could be elided, as could unsets at the bottom of the LSM.
 func compactionIterator(
-	cmp db.Compare, newIter tableNewIter, c *compaction,
+	cmp db.Compare, newIter tableNewIter, newRangeKeyIter tableNewRangeKeyIter, c *compaction,
 ) (cIter db.InternalIterator, retErr error) {
 	iters := make([]db.InternalIterator, 0, len(c.inputs[0])+1)
 	defer func() {
@@ -504,13 +1189,14 @@ func compactionIterator(
 		}
 	}()
 
+	inputs0 := c.liveInputs(0)
 	if c.level != 0 {
-		iter := newLevelIter(cmp, newIter, c.inputs[0])
+		iter := newLevelIter(nil, cmp, newIter, inputs0)
 		iters = append(iters, iter)
 	} else {
-		for i := range c.inputs[0] {
-			f := &c.inputs[0][i]
-			iter, err := newIter(f)
+		for i := range inputs0 {
+			f := &inputs0[i]
+			iter, err := newIter(f, nil)
 			if err != nil {
 				return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 			}
@@ -519,7 +1205,24 @@ func compactionIterator(
 		}
 	}
 
-	iter := newLevelIter(cmp, newIter, c.inputs[1])
+	iter := newLevelIter(nil, cmp, newIter, c.liveInputs(1))
 	iters = append(iters, iter)
+
+	for i := 0; i < 2; i++ {
+		inputs := c.liveInputs(i)
+		for j := range inputs {
+			f := &inputs[j]
+			if !f.mayContainRangeKeys() {
+				continue
+			}
+			iter, err := newRangeKeyIter(f)
+			if err != nil {
+				return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
+			}
+			if iter != nil {
+				iters = append(iters, iter)
+			}
+		}
+	}
 	return newMergingIter(cmp, iters...), nil
 }
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -13,21 +14,71 @@ import (
 type compactionIterPos int8
 
 const (
-	compactionIterCur  compactionIterPos = 0
-	compactionIterNext                   = 1
+	compactionIterCur         compactionIterPos = 0
+	compactionIterNext                          = 1
+	compactionIterRangeDelete                   = 2
 )
 
+// compactionIter provides a forward-only iterator that encapsulates the logic
+// for collapsing entries during compaction. Only the newest entry for a user
+// key is output within each snapshot stripe, where a stripe is the range of
+// sequence numbers between two consecutive open snapshots: no reader can
+// distinguish between the entries within a stripe.
 type compactionIter struct {
-	cmp      db.Compare
-	merge    db.Merge
-	iter     db.InternalIterator
-	err      error
-	key      db.InternalKey
-	keyBuf   []byte
-	value    []byte
-	valueBuf []byte
-	valid    bool
-	pos      compactionIterPos
+	cmp   db.Compare
+	merge db.Merge
+	// partialMerge folds two merge operands when no base value has been found
+	// beneath them. A nil partialMerge uses merge.
+	partialMerge db.Merge
+	iter         db.InternalIterator
+	// snapshots is the list of the sequence numbers of the open snapshots, in
+	// increasing order. A snapshot with sequence number s can see entries with
+	// sequence numbers less than s.
+	snapshots []uint64
+	// elideTombstone returns true if a deletion tombstone for the user key can
+	// be dropped because there are no entries for the key in the levels below
+	// the compaction's output level. A nil elideTombstone never drops
+	// tombstones.
+	elideTombstone func(key []byte) bool
+	err            error
+	key            db.InternalKey
+	keyBuf         []byte
+	value          []byte
+	valueBuf       []byte
+	valid          bool
+	pos            compactionIterPos
+	// The index of the snapshot stripe of the current entry.
+	curSnapshotIdx int
+}
+
+// snapshotIndex returns the index of the oldest snapshot which can see the
+// specified sequence number. Entries with the same snapshot index are in the
+// same stripe. An index of 0 means the entry is visible to every snapshot.
+func (i *compactionIter) snapshotIndex(seqNum uint64) int {
+	return sort.Search(len(i.snapshots), func(j int) bool {
+		return seqNum < i.snapshots[j]
+	})
+}
+
+// skipStripe advances the underlying iterator past the remaining entries for
+// the current user key which are in the current snapshot stripe. Range
+// tombstones and range keys for the user key are not skipped.
+//
+// TODO(peter): Skipping stops at a range tombstone or range key, so the older
+// entries in the stripe which follow it are output.
+func (i *compactionIter) skipStripe() {
+	if !i.iter.Valid() {
+		return
+	}
+	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
+	for i.iter.Next() {
+		key := i.iter.Key()
+		if i.cmp(i.keyBuf, key.UserKey) != 0 ||
+			i.snapshotIndex(key.SeqNum()) != i.curSnapshotIdx ||
+			key.Kind() == db.InternalKeyKindRangeDelete || isRangeKeyKind(key.Kind()) {
+			break
+		}
+	}
 }
 
 func (i *compactionIter) findNextEntry() bool {
@@ -36,8 +87,17 @@ func (i *compactionIter) findNextEntry() bool {
 
 	for i.iter.Valid() {
 		i.key = i.iter.Key()
+		i.curSnapshotIdx = i.snapshotIndex(i.key.SeqNum())
 		switch i.key.Kind() {
 		case db.InternalKeyKindDelete:
+			if i.curSnapshotIdx == 0 && i.elideTombstone != nil &&
+				i.elideTombstone(i.key.UserKey) {
+				// The tombstone is visible to every snapshot and nothing below the
+				// output level contains the key, so the tombstone and the older
+				// entries it shadows can all be dropped.
+				i.skipStripe()
+				continue
+			}
 			i.value = i.iter.Value()
 			i.valid = true
 			return true
@@ -50,6 +110,24 @@ func (i *compactionIter) findNextEntry() bool {
 		case db.InternalKeyKindMerge:
 			return i.mergeNext()
 
+		case db.InternalKeyKindRangeDelete:
+			// A range tombstone covers keys other than its start key, so it is
+			// neither shadowed by nor shadows the other entries for its start key.
+			// It is always output and the iterator advances past only the
+			// tombstone itself.
+			i.value = i.iter.Value()
+			i.valid = true
+			i.pos = compactionIterRangeDelete
+			return true
+
+		case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+			// Range keys are a separate keyspace from the point keys, and are
+			// output like range tombstones.
+			i.value = i.iter.Value()
+			i.valid = true
+			i.pos = compactionIterRangeDelete
+			return true
+
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", i.key.Kind())
 			return false
@@ -79,12 +157,26 @@ func (i *compactionIter) mergeNext() bool {
 			i.pos = compactionIterNext
 			return true
 		}
+		if i.snapshotIndex(key.SeqNum()) != i.curSnapshotIdx {
+			// We've advanced into an older snapshot stripe. The older entries
+			// are visible to a snapshot and must not be merged.
+			i.pos = compactionIterNext
+			return true
+		}
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
 			// We've hit a deletion tombstone. Return everything up to this
 			// point.
 			return true
 
+		case db.InternalKeyKindRangeDelete,
+			db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+			// We've hit a range tombstone or range key. Return everything up to
+			// this point, leaving the range tombstone or range key to be output
+			// next.
+			i.pos = compactionIterNext
+			return true
+
 		case db.InternalKeyKindSet:
 			// We've hit a Set value. Merge with the existing value and return. We
 			// change the kind of the resulting key to a Set so that it shadows keys
@@ -94,9 +186,14 @@ func (i *compactionIter) mergeNext() bool {
 			return true
 
 		case db.InternalKeyKindMerge:
-			// We've hit another Merge value. Merge with the existing value and
-			// continue looping.
-			i.value = i.merge(i.key.UserKey, i.value, i.iter.Value(), nil)
+			// We've hit another Merge value. Fold it into the existing value and
+			// continue looping. The result remains a Merge, which is merged with
+			// the base value, if any, when the key is read or compacted with it.
+			merge := i.partialMerge
+			if merge == nil {
+				merge = i.merge
+			}
+			i.value = merge(i.key.UserKey, i.value, i.iter.Value(), nil)
 
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", i.key.Kind())
@@ -122,8 +219,10 @@ func (i *compactionIter) Next() bool {
 		// TODO(peter): Rather than calling NextUserKey here, we should advance the
 		// iterator manually to the next key looking for any entries which have
 		// invalid keys and returning them.
-		i.iter.NextUserKey()
+		i.skipStripe()
 	case compactionIterNext:
+	case compactionIterRangeDelete:
+		i.iter.Next()
 	}
 	return i.findNextEntry()
 }
@@ -7,6 +7,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -18,11 +19,18 @@ func TestCompactionIter(t *testing.T) {
 	var keys []db.InternalKey
 	var vals [][]byte
 
+	var snapshots []uint64
+	var elideTombstones bool
+
 	newIter := func() *compactionIter {
 		return &compactionIter{
-			cmp:   db.DefaultComparer.Compare,
-			merge: db.DefaultMerger.Merge,
-			iter:  &fakeIter{keys: keys, vals: vals},
+			cmp:       db.DefaultComparer.Compare,
+			merge:     db.DefaultMerger.Merge,
+			iter:      &fakeIter{keys: keys, vals: vals},
+			snapshots: snapshots,
+			elideTombstone: func([]byte) bool {
+				return elideTombstones
+			},
 		}
 	}
 
@@ -39,6 +47,29 @@ func TestCompactionIter(t *testing.T) {
 			return ""
 
 		case "iter":
+			snapshots = snapshots[:0]
+			elideTombstones = false
+			for _, arg := range d.CmdArgs {
+				switch arg.Key {
+				case "snapshots":
+					for _, val := range arg.Vals {
+						seqNum, err := strconv.Atoi(val)
+						if err != nil {
+							return err.Error()
+						}
+						snapshots = append(snapshots, uint64(seqNum))
+					}
+				case "elide-tombstones":
+					var err error
+					elideTombstones, err = strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+				default:
+					t.Fatalf("%s: unknown arg: %s", d.Cmd, arg.Key)
+				}
+			}
+
 			iter := newIter()
 			var b bytes.Buffer
 			for _, line := range strings.Split(d.Input, "\n") {
@@ -0,0 +1,107 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// maxCompactionQueueLen bounds the number of candidate compactions held by a
+// compactionQueue.
+const maxCompactionQueueLen = numLevels
+
+// compactionCandidate is a level which is eligible for compaction, ordered
+// within a compactionQueue by its compaction score.
+type compactionCandidate struct {
+	level int
+	score float64
+}
+
+// compactionQueue holds the candidate compactions which are waiting for a
+// compaction worker, ordered from highest to lowest score. Ties are broken in
+// favor of the lower level. There is at most one candidate per level, and the
+// queue holds at most maxLen candidates, dropping the lowest scoring ones.
+//
+// The queue is protected by DB.mu.
+type compactionQueue struct {
+	maxLen int
+	items  []compactionCandidate
+	closed bool
+}
+
+func (q *compactionQueue) init(maxLen int) {
+	q.maxLen = maxLen
+}
+
+// less returns whether a should be compacted before b.
+func (q *compactionQueue) less(a, b compactionCandidate) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	return a.level < b.level
+}
+
+// push adds c to the queue, replacing any candidate for the same level. The
+// push is ignored once the queue has been closed.
+func (q *compactionQueue) push(c compactionCandidate) {
+	if q.closed {
+		return
+	}
+	for i := range q.items {
+		if q.items[i].level == c.level {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	i := sort.Search(len(q.items), func(i int) bool {
+		return q.less(c, q.items[i])
+	})
+	if i >= q.maxLen {
+		return
+	}
+	q.items = append(q.items, compactionCandidate{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = c
+	if len(q.items) > q.maxLen {
+		q.items = q.items[:q.maxLen]
+	}
+}
+
+// pop removes and returns the highest priority candidate. It returns false if
+// the queue is empty.
+func (q *compactionQueue) pop() (compactionCandidate, bool) {
+	if len(q.items) == 0 {
+		return compactionCandidate{}, false
+	}
+	c := q.items[0]
+	q.items = q.items[1:]
+	return c, true
+}
+
+// update replaces the contents of the queue with the levels of v which need
+// compacting.
+func (q *compactionQueue) update(v *version, opts *db.Options) {
+	q.items = q.items[:0]
+	scores := v.compactionScores(opts)
+	for level, score := range scores {
+		if score >= 1 {
+			q.push(compactionCandidate{level: level, score: score})
+		}
+	}
+}
+
+// close drains the queue and causes subsequent pushes to be ignored, so that
+// no further compactions are started.
+func (q *compactionQueue) close() {
+	q.items = nil
+	q.closed = true
+}
+
+// len returns the number of candidates in the queue.
+func (q *compactionQueue) len() int {
+	return len(q.items)
+}
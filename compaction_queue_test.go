@@ -0,0 +1,87 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+)
+
+func TestCompactionQueue(t *testing.T) {
+	drain := func(q *compactionQueue) string {
+		var parts []string
+		for {
+			c, ok := q.pop()
+			if !ok {
+				break
+			}
+			parts = append(parts, fmt.Sprintf("L%d:%.1f", c.level, c.score))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	var q compactionQueue
+	q.init(3)
+	q.push(compactionCandidate{level: 2, score: 1.5})
+	q.push(compactionCandidate{level: 0, score: 4})
+	q.push(compactionCandidate{level: 1, score: 1.5})
+	q.push(compactionCandidate{level: 3, score: 2})
+	if n := q.len(); n != 3 {
+		t.Fatalf("expected 3 candidates, but found %d", n)
+	}
+	// The lowest scoring candidate was dropped, and ties go to the lower level.
+	if s, expected := drain(&q), "L0:4.0 L3:2.0 L1:1.5"; s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+
+	// A push replaces the candidate for the same level.
+	q.push(compactionCandidate{level: 1, score: 1})
+	q.push(compactionCandidate{level: 2, score: 2})
+	q.push(compactionCandidate{level: 1, score: 3})
+	if s, expected := drain(&q), "L1:3.0 L2:2.0"; s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+
+	// Closing the queue drains it and ignores further pushes.
+	q.push(compactionCandidate{level: 1, score: 3})
+	q.close()
+	q.push(compactionCandidate{level: 2, score: 2})
+	if n := q.len(); n != 0 {
+		t.Fatalf("expected 0 candidates, but found %d", n)
+	}
+}
+
+func TestCompactionQueueUpdate(t *testing.T) {
+	opts := (&db.Options{
+		L0CompactionThreshold: 2,
+	}).EnsureDefaults()
+
+	// L0 has a score of 1.5, L1 of 3, L2 of 1.25 and L3 of 0.5.
+	var v version
+	for i := 0; i < 3; i++ {
+		v.files[0] = append(v.files[0], fileMetadata{fileNum: uint64(i)})
+	}
+	v.files[1] = []fileMetadata{{size: uint64(3 * opts.Level(1).MaxBytes)}}
+	v.files[2] = []fileMetadata{{size: uint64(5 * opts.Level(2).MaxBytes / 4)}}
+	v.files[3] = []fileMetadata{{size: uint64(opts.Level(3).MaxBytes / 2)}}
+
+	var q compactionQueue
+	q.init(maxCompactionQueueLen)
+	q.update(&v, opts)
+	var levels []int
+	for {
+		c, ok := q.pop()
+		if !ok {
+			break
+		}
+		levels = append(levels, c.level)
+	}
+	if s, expected := fmt.Sprint(levels), "[1 0 2]"; s != expected {
+		t.Fatalf("expected compactions of levels %s, but found %s", expected, s)
+	}
+}
@@ -7,13 +7,17 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/rate"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
@@ -389,6 +393,90 @@ func TestPickCompaction(t *testing.T) {
 			},
 			want: "200 300 ",
 		},
+
+		{
+			desc: "2 L1 files, 3 L2 files, pick the least overlap",
+			version: version{
+				files: [numLevels][]fileMetadata{
+					1: []fileMetadata{
+						{
+							fileNum:  200,
+							size:     10,
+							smallest: db.ParseInternalKey("a1.SET.201"),
+							largest:  db.ParseInternalKey("m1.SET.202"),
+						},
+						{
+							fileNum:  210,
+							size:     10,
+							smallest: db.ParseInternalKey("n1.SET.211"),
+							largest:  db.ParseInternalKey("n2.SET.212"),
+						},
+					},
+					2: []fileMetadata{
+						{
+							fileNum:  300,
+							size:     100,
+							smallest: db.ParseInternalKey("a0.SET.301"),
+							largest:  db.ParseInternalKey("f0.SET.302"),
+						},
+						{
+							fileNum:  310,
+							size:     100,
+							smallest: db.ParseInternalKey("g0.SET.311"),
+							largest:  db.ParseInternalKey("m0.SET.312"),
+						},
+						{
+							fileNum:  320,
+							size:     5,
+							smallest: db.ParseInternalKey("n0.SET.321"),
+							largest:  db.ParseInternalKey("z0.SET.322"),
+						},
+					},
+				},
+				compactionScore: 99,
+				compactionLevel: 1,
+			},
+			want: "210 320 ",
+		},
+
+		{
+			desc: "2 L1 files, 2 L2 files, pick the least overlap per input byte",
+			version: version{
+				files: [numLevels][]fileMetadata{
+					1: []fileMetadata{
+						{
+							fileNum:  200,
+							size:     1,
+							smallest: db.ParseInternalKey("a1.SET.201"),
+							largest:  db.ParseInternalKey("a2.SET.202"),
+						},
+						{
+							fileNum:  210,
+							size:     100,
+							smallest: db.ParseInternalKey("n1.SET.211"),
+							largest:  db.ParseInternalKey("n2.SET.212"),
+						},
+					},
+					2: []fileMetadata{
+						{
+							fileNum:  300,
+							size:     10,
+							smallest: db.ParseInternalKey("a0.SET.301"),
+							largest:  db.ParseInternalKey("m0.SET.302"),
+						},
+						{
+							fileNum:  310,
+							size:     20,
+							smallest: db.ParseInternalKey("n0.SET.311"),
+							largest:  db.ParseInternalKey("z0.SET.312"),
+						},
+					},
+				},
+				compactionScore: 99,
+				compactionLevel: 1,
+			},
+			want: "210 310 ",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -661,3 +749,965 @@ func TestCompaction(t *testing.T) {
 		t.Fatalf("db Close: %v", err)
 	}
 }
+
+func TestCompactionElidesTombstones(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write and then delete "a". Flushing after each write creates
+	// L0CompactionThreshold level-0 tables, triggering a compaction into level
+	// 1, which is the bottom-most level containing data.
+	steps := []func() error{
+		func() error { return d.Set([]byte("a"), []byte("a"), nil) },
+		func() error { return d.Delete([]byte("a"), nil) },
+		func() error { return d.Set([]byte("b"), []byte("b"), nil) },
+		func() error { return d.Set([]byte("c"), []byte("c"), nil) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	// tableKeys returns every internal key in every table in the current
+	// version.
+	tableKeys := func() (keys []string, err error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		v := d.mu.versions.currentVersion()
+		for _, files := range v.files {
+			for _, meta := range files {
+				f, err := fs.Open(dbFilename("", fileTypeTable, meta.fileNum))
+				if err != nil {
+					return nil, fmt.Errorf("Open: %v", err)
+				}
+				r := sstable.NewReader(f, meta.fileNum, nil)
+				iter := r.NewIter(nil)
+				for iter.First(); iter.Valid(); iter.Next() {
+					keys = append(keys, iter.Key().String())
+				}
+				if err := firstError(iter.Close(), r.Close()); err != nil {
+					return nil, err
+				}
+			}
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+
+	// The compaction of the tables containing "a" drops both the tombstone and
+	// the value it deletes.
+	err = try(100*time.Microsecond, 20*time.Second, func() error {
+		keys, err := tableKeys()
+		if err != nil {
+			return err
+		}
+		if got, want := strings.Join(keys, " "), "b#2,1 c#3,1"; got != want {
+			return fmt.Errorf("expected %s, but found %s", want, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestCompactionRangeTombstoneCoversTables(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write a large span of keys to a table, and move the table to level 1.
+	const numKeys = 1000
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("k%04d", i)), value, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	d.mu.Lock()
+	data := d.mu.versions.currentVersion().files[0][0]
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{
+			deletedFileEntry{level: 0, fileNum: data.fileNum}: true,
+		},
+		newFiles: []newFileEntry{
+			{level: 1, meta: data},
+		},
+	})
+	if err != nil {
+		t.Fatalf("logAndApply: %v", err)
+	}
+
+	// Delete the entire span, and flush the range tombstone to level 0.
+	d.mu.Unlock()
+	err = d.DeleteRange([]byte("k"), []byte("l"), nil)
+	if err == nil {
+		err = d.Set([]byte("z"), []byte("z"), nil)
+	}
+	if err == nil {
+		err = d.Flush()
+	}
+	d.mu.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := d.mu.versions.currentVersion()
+	c := &compaction{
+		version: v,
+		level:   0,
+	}
+	c.inputs[0] = v.files[0]
+	c.inputs[1] = v.files[1]
+
+	// The level 1 table is never opened by the compaction: remove it to prove
+	// that.
+	if err := fs.Remove(dbFilename(d.dirname, fileTypeTable, data.fileNum)); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	d.tableCache.evict(data.fileNum)
+
+	ve, pendingOutputs, err := d.compactDiskTables(c)
+	if err != nil {
+		t.Fatalf("compactDiskTables: %v", err)
+	}
+	if !c.covered[data.fileNum] {
+		t.Fatalf("expected table %d to be covered by the range tombstone", data.fileNum)
+	}
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, ve)
+	for _, fileNum := range pendingOutputs {
+		delete(d.mu.compact.pendingOutputs, fileNum)
+	}
+	if err != nil {
+		t.Fatalf("logAndApply: %v", err)
+	}
+
+	v = d.mu.versions.currentVersion()
+	if n := len(v.files[0]); n != 0 {
+		t.Fatalf("expected 0 L0 tables, but found %d", n)
+	}
+	if n := len(v.files[1]); n != 1 {
+		t.Fatalf("expected 1 L1 table, but found %d", n)
+	}
+	out := v.files[1][0]
+	if out.size >= data.size/10 {
+		t.Fatalf("expected the output table to be much smaller than %d bytes, but found %d",
+			data.size, out.size)
+	}
+
+	f, err := fs.Open(dbFilename(d.dirname, fileTypeTable, out.fileNum))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r := sstable.NewReader(f, out.fileNum, nil)
+	var keys []string
+	iter := r.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key().String())
+	}
+	if err := firstError(iter.Close(), r.Close()); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("k#%d,15 z#%d,1", numKeys, numKeys+1)
+	if got := strings.Join(keys, " "); got != expected {
+		t.Fatalf("expected %s, but found %s", expected, got)
+	}
+
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestCompactionRangeTombstoneExtendsPastCoveringTombstone(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write a span of keys and a range tombstone which extends past them to a
+	// table, and move the table to level 1. The bounds of the table end at the
+	// start of its range tombstone.
+	const numKeys = 1000
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("k%04d", i)), value, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.DeleteRange([]byte("k5"), []byte("zz"), nil); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	d.mu.Lock()
+	data := d.mu.versions.currentVersion().files[0][0]
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{
+			deletedFileEntry{level: 0, fileNum: data.fileNum}: true,
+		},
+		newFiles: []newFileEntry{
+			{level: 1, meta: data},
+		},
+	})
+	if err != nil {
+		t.Fatalf("logAndApply: %v", err)
+	}
+
+	// Delete the bounds of the level 1 table, and flush the range tombstone to
+	// level 0.
+	d.mu.Unlock()
+	err = d.DeleteRange([]byte("k"), []byte("l"), nil)
+	if err == nil {
+		err = d.Set([]byte("z"), []byte("z"), nil)
+	}
+	if err == nil {
+		err = d.Flush()
+	}
+	d.mu.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := d.mu.versions.currentVersion()
+	c := &compaction{
+		version: v,
+		level:   0,
+	}
+	c.inputs[0] = v.files[0]
+	c.inputs[1] = v.files[1]
+
+	ve, pendingOutputs, err := d.compactDiskTables(c)
+	if err != nil {
+		t.Fatalf("compactDiskTables: %v", err)
+	}
+	if c.covered[data.fileNum] {
+		t.Fatalf("expected table %d not to be covered by the range tombstone", data.fileNum)
+	}
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, ve)
+	for _, fileNum := range pendingOutputs {
+		delete(d.mu.compact.pendingOutputs, fileNum)
+	}
+	if err != nil {
+		t.Fatalf("logAndApply: %v", err)
+	}
+
+	// The range tombstone of the level 1 table must survive the compaction.
+	v = d.mu.versions.currentVersion()
+	if n := len(v.files[1]); n != 1 {
+		t.Fatalf("expected 1 L1 table, but found %d", n)
+	}
+	out := v.files[1][0]
+	f, err := fs.Open(dbFilename(d.dirname, fileTypeTable, out.fileNum))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r := sstable.NewReader(f, out.fileNum, nil)
+	var found bool
+	iter := r.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key.Kind() == db.InternalKeyKindRangeDelete && string(key.UserKey) == "k5" {
+			found = string(iter.Value()) == "zz"
+		}
+	}
+	if err := firstError(iter.Close(), r.Close()); err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("expected the output table to contain the [k5,zz) range tombstone")
+	}
+
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactFiles(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write three tables with disjoint key ranges and move them to level 1.
+	var l1 []uint64
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		meta := d.mu.versions.currentVersion().files[0][0]
+		err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+			deletedFiles: map[deletedFileEntry]bool{
+				deletedFileEntry{level: 0, fileNum: meta.fileNum}: true,
+			},
+			newFiles: []newFileEntry{
+				{level: 1, meta: meta},
+			},
+		})
+		d.mu.Unlock()
+		if err != nil {
+			t.Fatalf("logAndApply: %v", err)
+		}
+		l1 = append(l1, meta.fileNum)
+	}
+
+	if err := d.CompactFiles([]uint64{12345}); err == nil ||
+		!strings.Contains(err.Error(), "is not live") {
+		t.Fatalf("expected not live error, but found %v", err)
+	}
+	d.mu.Lock()
+	d.mu.compact.pendingOutputs[l1[0]] = struct{}{}
+	d.mu.Unlock()
+	if err := d.CompactFiles(l1[:2]); err == nil ||
+		!strings.Contains(err.Error(), "is being compacted") {
+		t.Fatalf("expected being compacted error, but found %v", err)
+	}
+	d.mu.Lock()
+	delete(d.mu.compact.pendingOutputs, l1[0])
+	d.mu.Unlock()
+
+	// Compacting the two adjacent tables merges them into a single level 2
+	// table, leaving the third table in level 1.
+	if err := d.CompactFiles(l1[:2]); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	if n := len(v.files[1]); n != 1 || v.files[1][0].fileNum != l1[2] {
+		t.Fatalf("expected L1 table %d, but found %d tables", l1[2], n)
+	}
+	if n := len(v.files[2]); n != 1 {
+		t.Fatalf("expected 1 L2 table, but found %d", n)
+	}
+	out := v.files[2][0]
+	d.mu.Unlock()
+	if s, l := string(out.smallest.UserKey), string(out.largest.UserKey); s != "a000" || l != "b099" {
+		t.Fatalf("expected L2 table [a000,b099], but found [%s,%s]", s, l)
+	}
+	for _, key := range []string{"a000", "a050", "b099", "c042"} {
+		if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+			t.Fatalf("%s: expected %s, but found %s (%v)", key, key, v, err)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactionRate(t *testing.T) {
+	const bytesPerSecond = 1 << 20
+	d, err := Open("", &db.Options{
+		Storage:                  storage.NewMem(),
+		CompactionBytesPerSecond: bytesPerSecond,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if l := d.compactController.limiter.Limit(); l != bytesPerSecond {
+		t.Fatalf("expected compaction rate %d, but found %.0f", bytesPerSecond, l)
+	}
+	if l := d.flushController.limiter.Limit(); l != rate.Inf {
+		t.Fatalf("expected unlimited flush rate, but found %.0f", l)
+	}
+
+	// Write two overlapping L0 tables of incompressible values, which must be
+	// rewritten by the compaction.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var l0 []uint64
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2000; j++ {
+			value := make([]byte, 1024)
+			rng.Read(value)
+			if err := d.Set([]byte(fmt.Sprintf("%04d", j)), value, nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	d.mu.Lock()
+	for _, meta := range d.mu.versions.currentVersion().files[0] {
+		l0 = append(l0, meta.fileNum)
+	}
+	d.mu.Unlock()
+	if len(l0) != 2 {
+		t.Fatalf("expected 2 L0 tables, but found %d", len(l0))
+	}
+
+	start := time.Now()
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	// The compaction writes more than the limiter's burst, and the bytes
+	// beyond the burst cannot be written faster than the limit.
+	var written uint64
+	d.mu.Lock()
+	for _, meta := range d.mu.versions.currentVersion().files[1] {
+		written += meta.size
+	}
+	d.mu.Unlock()
+	burst := uint64(d.compactController.limiter.Burst())
+	if written < burst+bytesPerSecond/2 {
+		t.Fatalf("expected the compaction to write at least %d bytes, but found %d",
+			burst+bytesPerSecond/2, written)
+	}
+	minElapsed := time.Duration(float64(written-burst) / bytesPerSecond * float64(time.Second))
+	if elapsed < minElapsed*9/10 {
+		t.Fatalf("expected the compaction of %d bytes to take at least %s, but found %s",
+			written, minElapsed, elapsed)
+	}
+
+	// The compaction rate can be changed, and removed, while the DB is open.
+	d.SetCompactionRate(2 * bytesPerSecond)
+	if l := d.compactController.limiter.Limit(); l != 2*bytesPerSecond {
+		t.Fatalf("expected compaction rate %d, but found %.0f", 2*bytesPerSecond, l)
+	}
+	d.SetCompactionRate(0)
+	if l := d.compactController.limiter.Limit(); l != rate.Inf {
+		t.Fatalf("expected unlimited compaction rate, but found %.0f", l)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// ttlFilter is a CompactionFilter for values of the form "<expiry>/<data>",
+// which drops values whose expiry is before now, and rewrites the data "old"
+// as "new". An expiry of 0 never expires.
+type ttlFilter struct {
+	mu  sync.Mutex
+	now int
+	// levels are the levels passed to Filter, in order.
+	levels []int
+}
+
+func (f *ttlFilter) Filter(level int, key, value []byte) ([]byte, db.FilterOp) {
+	f.mu.Lock()
+	if n := len(f.levels); n == 0 || f.levels[n-1] != level {
+		f.levels = append(f.levels, level)
+	}
+	now := f.now
+	f.mu.Unlock()
+
+	parts := strings.SplitN(string(value), "/", 2)
+	expiry, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 {
+		return nil, db.FilterKeep
+	}
+	if expiry != 0 && expiry < now {
+		return nil, db.FilterDrop
+	}
+	if parts[1] == "old" {
+		return []byte(parts[0] + "/new"), db.FilterChange
+	}
+	return nil, db.FilterKeep
+}
+
+func TestCompactionFilter(t *testing.T) {
+	fs := storage.NewMem()
+	filter := &ttlFilter{now: 3}
+	d, err := Open("", &db.Options{
+		Storage:          fs,
+		CompactionFilter: filter,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, kv := range [][2]string{
+		{"a", "1/a"},
+		{"b", "5/b"},
+		{"c", "1/c"},
+		{"d", "0/old"},
+	} {
+		if err := d.Set([]byte(kv[0]), []byte(kv[1]), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	tableKeys := func(level int) (fileNums []uint64, keys []string) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, meta := range d.mu.versions.currentVersion().files[level] {
+			fileNums = append(fileNums, meta.fileNum)
+			f, err := fs.Open(dbFilename("", fileTypeTable, meta.fileNum))
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			r := sstable.NewReader(f, meta.fileNum, nil)
+			iter := r.NewIter(nil)
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+			}
+			if err := firstError(iter.Close(), r.Close()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fileNums, keys
+	}
+
+	// The flush writes deletions in place of the expired values, as older
+	// versions of the keys may exist in the lower levels.
+	l0, keys := tableKeys(0)
+	if got, want := strings.Join(keys, " "), "a#0,0: b#1,1:5/b c#2,0: d#3,1:0/new"; got != want {
+		t.Fatalf("expected %s, but found %s", want, got)
+	}
+	for key, want := range map[string]string{"a": "", "b": "5/b", "c": "", "d": "0/new"} {
+		v, err := d.Get([]byte(key))
+		if want == "" {
+			if err != db.ErrNotFound {
+				t.Fatalf("%s: expected %v, but found %v", key, db.ErrNotFound, err)
+			}
+		} else if err != nil || string(v) != want {
+			t.Fatalf("%s: expected %s, but found %s (%v)", key, want, v, err)
+		}
+	}
+
+	// Compacting into level 1, the bottom-most level containing data, drops
+	// the deletions. Advancing the clock expires "b".
+	filter.mu.Lock()
+	filter.now = 6
+	filter.mu.Unlock()
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	_, keys = tableKeys(1)
+	if got, want := strings.Join(keys, " "), "d#3,1:0/new"; got != want {
+		t.Fatalf("expected %s, but found %s", want, got)
+	}
+	if _, err := d.Get([]byte("b")); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+
+	filter.mu.Lock()
+	if got := fmt.Sprint(filter.levels); got != "[0 1]" {
+		t.Fatalf("expected filter levels [0 1], but found %s", got)
+	}
+	filter.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactionPartialMerge(t *testing.T) {
+	sum := func(key, oldValue, newValue, buf []byte) []byte {
+		a, _ := strconv.Atoi(string(oldValue))
+		b, _ := strconv.Atoi(string(newValue))
+		return strconv.AppendInt(buf, int64(a+b), 10)
+	}
+	var partialMerges int32
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+		Merger: &db.Merger{
+			Merge: sum,
+			PartialMerge: func(key, oldValue, newValue, buf []byte) []byte {
+				atomic.AddInt32(&partialMerges, 1)
+				return sum(key, oldValue, newValue, buf)
+			},
+			Name: "test.sum",
+		},
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	tables := func(level int) (fileNums []uint64, keys []string) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, meta := range d.mu.versions.currentVersion().files[level] {
+			fileNums = append(fileNums, meta.fileNum)
+			f, err := fs.Open(dbFilename("", fileTypeTable, meta.fileNum))
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			r := sstable.NewReader(f, meta.fileNum, nil)
+			iter := r.NewIter(nil)
+			for iter.First(); iter.Valid(); iter.Next() {
+				key := iter.Key()
+				keys = append(keys, fmt.Sprintf("%s,%d:%s", key.UserKey, key.Kind(), iter.Value()))
+			}
+			if err := firstError(iter.Close(), r.Close()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return fileNums, keys
+	}
+	get := func(want string) {
+		v, err := d.Get([]byte("count"))
+		if err != nil || string(v) != want {
+			t.Fatalf("expected %s, but found %s (%v)", want, v, err)
+		}
+	}
+
+	// The base value of the counter is moved down to L2, so that it is not an
+	// input of the compaction of the merge operands.
+	if err := d.Set([]byte("count"), []byte("1000"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	l0, _ := tables(0)
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	l1, _ := tables(1)
+	if err := d.CompactFiles(l1); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	if _, keys := tables(2); strings.Join(keys, " ") != "count,1:1000" {
+		t.Fatalf("expected count,1:1000 in L2, but found %s", keys)
+	}
+
+	// The counter receives 100 merges, flushed in 10 tables. Flushes write
+	// every operand, so a read of the counter merges 100 records.
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			if err := d.Merge([]byte("count"), []byte("1"), nil); err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	l0, keys := tables(0)
+	if len(l0) != 10 || len(keys) != 100 {
+		t.Fatalf("expected 100 records in 10 L0 tables, but found %d in %d", len(keys), len(l0))
+	}
+	get("1100")
+
+	// Compacting L0 folds the operands into a single Merge, which is still
+	// merged with the base value in L2 when read.
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	if _, keys := tables(1); strings.Join(keys, " ") != "count,2:100" {
+		t.Fatalf("expected count,2:100 in L1, but found %s", keys)
+	}
+	if n := atomic.LoadInt32(&partialMerges); n != 99 {
+		t.Fatalf("expected 99 partial merges, but found %d", n)
+	}
+	get("1100")
+
+	// Compacting the operand with the base value fully merges them into a Set.
+	l1, _ = tables(1)
+	if err := d.CompactFiles(l1); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	if _, keys := tables(2); strings.Join(keys, " ") != "count,1:1100" {
+		t.Fatalf("expected count,1:1100 in L2, but found %s", keys)
+	}
+	get("1100")
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactPrefix(t *testing.T) {
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '/'); i >= 0 {
+			return i + 1
+		}
+		return len(a)
+	}
+	d, err := Open("", &db.Options{
+		Comparer: &comparer,
+		Storage:  storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := d.CompactPrefix([]byte("b/000")); err == nil ||
+		!strings.Contains(err.Error(), "is not a key prefix") {
+		t.Fatalf("expected not a key prefix error, but found %v", err)
+	}
+
+	// Write a table for each of three tenants and move the tables to level 1.
+	// The values are incompressible so that the tables are much larger than a
+	// table containing a few small entries.
+	rng := rand.New(rand.NewSource(0))
+	sizes := make(map[uint64]uint64)
+	for _, tenant := range []string{"a/", "b/", "c/"} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%s%03d", tenant, i))
+			value := make([]byte, 100)
+			rng.Read(value)
+			if err := d.Set(key, value, nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		meta := d.mu.versions.currentVersion().files[0][0]
+		err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+			deletedFiles: map[deletedFileEntry]bool{
+				deletedFileEntry{level: 0, fileNum: meta.fileNum}: true,
+			},
+			newFiles: []newFileEntry{
+				{level: 1, meta: meta},
+			},
+		})
+		d.mu.Unlock()
+		if err != nil {
+			t.Fatalf("logAndApply: %v", err)
+		}
+		sizes[meta.fileNum] = meta.size
+	}
+
+	// Evict tenant b. The keys written to the memtable before the deletion
+	// are deleted, and the key written after the deletion is not.
+	for _, key := range []string{"b/new0", "b/new1"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.DeleteRange([]byte("b/"), []byte("b0"), nil); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := d.Set([]byte("b/new2"), []byte("b/new2"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.CompactPrefix([]byte("b/")); err != nil {
+		t.Fatalf("CompactPrefix: %v", err)
+	}
+
+	// The tables of the other tenants are unchanged, and the remaining tables
+	// only contain the tombstone and the key written after the deletion.
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	var unchanged int
+	var remaining uint64
+	for level := range v.files {
+		for _, f := range v.files[level] {
+			if size, ok := sizes[f.fileNum]; ok {
+				if f.size != size {
+					t.Fatalf("table %06d: expected size %d, but found %d", f.fileNum, size, f.size)
+				}
+				if s := string(f.smallest.UserKey); s[:2] == "b/" {
+					t.Fatalf("table %06d: expected tenant b table to be rewritten", f.fileNum)
+				}
+				unchanged++
+				continue
+			}
+			remaining += f.size
+		}
+	}
+	d.mu.Unlock()
+	if unchanged != 2 {
+		t.Fatalf("expected 2 unchanged tables, but found %d", unchanged)
+	}
+	for fileNum, size := range sizes {
+		if remaining >= size/4 {
+			t.Fatalf("expected remaining tables to be much smaller than %06d (%d bytes), but found %d bytes",
+				fileNum, size, remaining)
+		}
+	}
+
+	for _, key := range []string{"b/000", "b/099", "b/new0", "b/new1"} {
+		if _, err := d.Get([]byte(key)); err != db.ErrNotFound {
+			t.Fatalf("%s: expected not found, but found %v", key, err)
+		}
+	}
+	for _, key := range []string{"a/000", "b/new2", "c/099"} {
+		if _, err := d.Get([]byte(key)); err != nil {
+			t.Fatalf("%s: expected found, but found %v", key, err)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactPrefixRangeKeys(t *testing.T) {
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '/'); i >= 0 {
+			return i + 1
+		}
+		return len(a)
+	}
+	d, err := Open("", &db.Options{
+		Comparer: &comparer,
+		Storage:  storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// The range key starts inside the range tombstone and ends past it.
+	for _, key := range []string{"b/1", "b/3", "b/7"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.RangeKeySet([]byte("b/0"), []byte("b/9"), []byte("1"), nil); err != nil {
+		t.Fatalf("RangeKeySet: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := d.DeleteRange([]byte("b/0"), []byte("b/5"), nil); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := d.CompactPrefix([]byte("b/")); err != nil {
+		t.Fatalf("CompactPrefix: %v", err)
+	}
+
+	// The point keys in the range tombstone are dropped, and the range key is
+	// not.
+	for _, key := range []string{"b/1", "b/3"} {
+		if _, err := d.Get([]byte(key)); err != db.ErrNotFound {
+			t.Fatalf("%s: expected not found, but found %v", key, err)
+		}
+	}
+	if _, err := d.Get([]byte("b/7")); err != nil {
+		t.Fatalf("b/7: expected found, but found %v", err)
+	}
+	d.mu.Lock()
+	frags, err := d.loadRangeKeys(nil, db.InternalKeySeqNumMax, nil, d.mu.versions.currentVersion())
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("loadRangeKeys: %v", err)
+	}
+	var buf bytes.Buffer
+	for _, r := range frags {
+		fmt.Fprintf(&buf, "[%s,%s)=%s", r.Start, r.End, r.Value)
+	}
+	if s, expected := buf.String(), "[b/0,b/9)=1"; s != expected {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactionPickerDebug(t *testing.T) {
+	opts := (&db.Options{
+		L0CompactionThreshold: 4,
+	}).EnsureDefaults()
+
+	var v version
+	for i := 0; i < 8; i++ {
+		v.files[0] = append(v.files[0], fileMetadata{
+			fileNum: uint64(100 + i),
+			size:    1 << 20,
+		})
+	}
+	// L1 is over-full, but by less than L0.
+	v.files[1] = []fileMetadata{{
+		fileNum: 200,
+		size:    uint64(opts.Level(1).MaxBytes) * 3 / 2,
+	}}
+	v.files[2] = []fileMetadata{{
+		fileNum: 300,
+		size:    1 << 20,
+	}}
+	v.updateCompactionScore(opts)
+
+	info := compactionPickerInfo(&v, opts)
+	if len(info.Levels) != numLevels {
+		t.Fatalf("expected %d levels, but found %d", numLevels, len(info.Levels))
+	}
+	if l := info.Levels[0]; l.NumFiles != 8 || l.Size != 8<<20 || l.Score != 2 {
+		t.Fatalf("unexpected L0 info: %+v", l)
+	}
+	if s := info.Levels[1].Score; s != 1.5 {
+		t.Fatalf("expected L1 score 1.5, but found %f", s)
+	}
+	for level, l := range info.Levels[1:] {
+		if l.Score >= info.Levels[0].Score {
+			t.Fatalf("expected L0 to have the highest score, but found L%d: %+v", level+1, l)
+		}
+	}
+	if info.Level != 0 {
+		t.Fatalf("expected L0 to be picked, but found L%d", info.Level)
+	}
+
+	// With L0 below its threshold, the over-full L1 is picked.
+	v.files[0] = v.files[0][:2]
+	v.updateCompactionScore(opts)
+	if info := compactionPickerInfo(&v, opts); info.Level != 1 {
+		t.Fatalf("expected L1 to be picked, but found L%d", info.Level)
+	}
+
+	// With no level over-full, nothing is picked.
+	v.files[1] = nil
+	v.updateCompactionScore(opts)
+	if info := compactionPickerInfo(&v, opts); info.Level != -1 {
+		t.Fatalf("expected no level to be picked, but found L%d", info.Level)
+	}
+
+	// A freshly opened DB has nothing to compact.
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := d.CompactionPickerDebug(); info.Level != -1 || info.Levels[0].NumFiles != 0 {
+		t.Fatalf("unexpected picker info: %+v", info)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -24,6 +24,15 @@ func newController(l *rate.Limiter) *controller {
 	}
 }
 
+// rateLimit returns the limit of a limiter allowing n bytes per second,
+// where 0 means no limit.
+func rateLimit(n int) rate.Limit {
+	if n <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(n)
+}
+
 func (c *controller) WaitN(n int) {
 	size := n
 	if burst := c.limiter.Burst(); size > burst {
@@ -8,6 +8,7 @@ package pebble // import "github.com/petermattis/pebble"
 import (
 	"fmt"
 	"io"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -49,7 +50,7 @@ type Reader interface {
 	//
 	// It is not safe to close a DB until all outstanding iterators are closed.
 	// It is valid to call Close multiple times. Other methods should not be
-	// called after the DB has been closed.
+	// called after the DB has been closed; those of a DB return ErrClosed.
 	Close() error
 }
 
@@ -69,17 +70,44 @@ type Writer interface {
 	Delete(key []byte, o *db.WriteOptions) error
 
 	// DeleteRange deletes all of the keys (and values) in the range [start,end)
-	// (inclusive on start, exclusive on end).
+	// (inclusive on start, exclusive on end). It returns ErrInvalidRange if
+	// start is not less than end.
 	//
 	// It is safe to modify the contents of the arguments after Delete returns.
 	DeleteRange(start, end []byte, o *db.WriteOptions) error
 
+	// LogData adds the specified data to the WAL without modifying the
+	// keyspace. The data is surfaced by Batch.Iterate, in order with the other
+	// operations of its batch, to readers of the WAL such as replication
+	// followers. It does not consume a sequence number and is ignored when the
+	// WAL is replayed into the memtable.
+	//
+	// It is safe to modify the contents of the arguments after LogData returns.
+	LogData(data []byte, o *db.WriteOptions) error
+
 	// Merge merges the value for the given key. The details of the merge are
 	// dependent upon the configured merge operation.
 	//
 	// It is safe to modify the contents of the arguments after Merge returns.
 	Merge(key, value []byte, o *db.WriteOptions) error
 
+	// RangeKeySet sets the value of the range key [start,end) (inclusive on
+	// start, exclusive on end). Range keys are a separate keyspace from the
+	// point keys: they do not shadow or delete the keys they cover, and are
+	// surfaced by Iterator.RangeKeys at each covered key. A range key replaces
+	// the portions of older range keys which it overlaps.
+	//
+	// It is safe to modify the contents of the arguments after RangeKeySet
+	// returns.
+	RangeKeySet(start, end, value []byte, o *db.WriteOptions) error
+
+	// RangeKeyUnset removes the portions of any range keys which overlap
+	// [start,end) (inclusive on start, exclusive on end).
+	//
+	// It is safe to modify the contents of the arguments after RangeKeyUnset
+	// returns.
+	RangeKeyUnset(start, end []byte, o *db.WriteOptions) error
+
 	// Set sets the value for the given key. It overwrites any previous value
 	// for that key; a DB is not a multi-map.
 	//
@@ -94,12 +122,28 @@ type DB struct {
 	cmp       db.Compare
 	merge     db.Merge
 	inlineKey db.InlineKey
+	// partialMerge folds merge operands during compactions of sstables.
+	// Flushes write the memtable entries without merging them.
+	partialMerge db.Merge
+
+	// The maximum memtable size of a single batch entry. Entries larger than
+	// this will never fit in a memtable and are rejected by Batch.checkSize.
+	maxEntrySize uint32
 
 	tableCache tableCache
-	newIter    tableNewIter
+	// newIter creates the table iterators used by reads. It treats corrupt
+	// tables as empty if Options.SkipCorruptTables is set.
+	newIter tableNewIter
 
 	commit   *commitPipeline
 	fileLock io.Closer
+	// dataDir is the DB directory, which is synced after files are created in
+	// it so that the new directory entries are durable.
+	dataDir storage.File
+	// walDirname is the directory containing the WAL, which is Options.WALDir
+	// or the DB directory. walDir is synced after log files are created in it.
+	walDirname string
+	walDir     storage.File
 
 	// Rate limiter for how much bandwidth to allow for commits, compactions, and
 	// flushes.
@@ -111,13 +155,29 @@ type DB struct {
 	compactController *controller
 	flushController   *controller
 
+	// closed is set to 1 by Close, while holding mu, and is accessed
+	// atomically so that it can be checked without acquiring mu.
+	closed int32
+
+	// canceled is set to 1 by CloseWithTimeout, while holding mu, when it
+	// gives up waiting for a flush or compaction. The flush or compaction
+	// abandons its work, and deletes its outputs, when it next checks. It is
+	// accessed atomically so that it can be checked without acquiring mu.
+	canceled int32
+
+	// openIters is the number of iterators which have been created and not
+	// yet closed. It is accessed atomically. See Options.MaxOpenIterators.
+	openIters int32
+
+	// readAmp is the read amplification of the most recent Get or iterator
+	// creation. It is accessed atomically. See LastReadAmplification.
+	readAmp int32
+
 	// TODO(peter): describe exactly what this mutex protects. So far: every
 	// field in the struct.
 	mu struct {
 		sync.Mutex
 
-		closed bool
-
 		versions versionSet
 
 		log struct {
@@ -137,6 +197,10 @@ type DB struct {
 			// True when the memtable is actively been switched. Both mem.mutable and
 			// log.LogWriter are invalid while switching is true.
 			switching bool
+			// Flushes the mutable memtable once Options.MemTableFlushInterval has
+			// elapsed since its first write. Nil if the interval is not set or the
+			// mutable memtable has not been written to.
+			flushTimer *time.Timer
 		}
 
 		compact struct {
@@ -144,6 +208,13 @@ type DB struct {
 			flushing       bool
 			compacting     bool
 			pendingOutputs map[uint64]struct{}
+			// queue holds the candidate compactions waiting for the compaction
+			// worker.
+			queue compactionQueue
+			// count and total accumulate the compactions which rewrote tables,
+			// for Metrics. The Level of total is unused.
+			count int64
+			total db.CompactionInfo
 		}
 	}
 }
@@ -156,7 +227,55 @@ var _ Writer = (*DB)(nil)
 //
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
+//
+// The returned slice remains valid indefinitely: the memory it refers to is
+// never reused, even once the memtable or table containing the value is
+// flushed, compacted away or evicted from the table cache (values read from
+// memory-mapped tables are copied). However, the slice may refer to the
+// memtable or the table block containing the value, which is then retained
+// for as long as the slice is. Use GetCopy to avoid retaining that memory, or
+// to obtain a value which may be modified.
 func (d *DB) Get(key []byte) ([]byte, error) {
+	value, _, err := d.getInternal(key)
+	return value, err
+}
+
+// GetCopy is like Get, but returns a freshly allocated copy of the value which
+// does not share memory with the DB. The caller may modify the contents of
+// the returned slice.
+func (d *DB) GetCopy(key []byte) ([]byte, error) {
+	value, _, err := d.getInternal(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(make([]byte, 0, len(value)), value...), nil
+}
+
+// GetInternal is like Get, but also returns the sequence number and kind of
+// the entry which satisfied the lookup. The kind is InternalKeyKindSet for a
+// value which was set, or InternalKeyKindMerge for a value resolved from merge
+// operands, in which case the sequence number is that of the most recent
+// operand. This allows optimistic concurrency schemes to detect whether a key
+// has been written since it was read.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after GetInternal returns.
+func (d *DB) GetInternal(
+	key []byte,
+) (value []byte, seqNum uint64, kind db.InternalKeyKind, err error) {
+	value, ikey, err := d.getInternal(key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return value, ikey.SeqNum(), ikey.Kind(), nil
+}
+
+// getInternal implements Get and GetInternal, returning the internal key of
+// the entry which satisfied the lookup.
+func (d *DB) getInternal(key []byte) ([]byte, db.InternalKey, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return nil, db.InternalKey{}, ErrClosed
+	}
 	d.mu.Lock()
 	snapshot := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
 	// Grab and reference the current version to prevent its underlying files
@@ -168,22 +287,80 @@ func (d *DB) Get(key []byte) ([]byte, error) {
 	memtables := d.mu.mem.queue
 	d.mu.Unlock()
 
-	ikey := db.MakeInternalKey(key, snapshot, db.InternalKeyKindMax)
+	// The visible sequence number is one past the sequence number of the most
+	// recently published write. Looking up the key at the visible sequence
+	// number itself would observe a batch which is being applied but has not
+	// been published (see dbIter.visible).
+	if snapshot == 0 {
+		return nil, db.InternalKey{}, db.ErrNotFound
+	}
+	ikey := db.MakeInternalKey(key, snapshot-1, db.InternalKeyKindMax)
 
 	// Look in the memtables before going to the on-disk current version.
+	var readAmp int
 	for i := len(memtables) - 1; i >= 0; i-- {
 		mem := memtables[i]
 		iter := mem.NewIter(nil)
 		iter.SeekGE(key)
-		value, conclusive, err := internalGet(iter, d.cmp, ikey)
+		readAmp++
+		value, found, conclusive, err := internalGet(iter, d.cmp, ikey, false)
 		if conclusive {
-			return value, err
+			atomic.StoreInt32(&d.readAmp, int32(readAmp))
+			if err == errMergeOperand {
+				value, err = d.getMerged(key, snapshot, current, memtables)
+			}
+			return value, found, err
 		}
 	}
 
 	// TODO(peter): update stats, maybe schedule compaction.
 
-	return current.get(ikey, d.newIter, d.cmp, nil)
+	// The value may point into a memory-mapped table, which can be unmapped
+	// once the table iterator is closed, so it is copied before then.
+	value, found, err := current.get(ikey, d.newIter, d.cmp, nil, d.opts.MmapTables, &readAmp)
+	atomic.StoreInt32(&d.readAmp, int32(readAmp))
+	if err == errMergeOperand {
+		value, err = d.getMerged(key, snapshot, current, memtables)
+	}
+	return value, found, err
+}
+
+// LastReadAmplification returns the read amplification of the most recent
+// Get, or of the most recently created iterator, by any goroutine. The read
+// amplification of a Get is the number of memtables and sstables it searched
+// before finding the key, which includes every overlapping L0 sstable. The
+// read amplification of an iterator is the number of memtables, L0 sstables
+// and non-empty levels it merges, including the batch of an indexed batch
+// iterator. A Get which resolves merge operands reports the read
+// amplification of the iterator used to merge them. A large read
+// amplification indicates that the DB would benefit from compaction.
+func (d *DB) LastReadAmplification() int {
+	return int(atomic.LoadInt32(&d.readAmp))
+}
+
+// getMerged retrieves the value for a key whose most recent entry is a merge
+// operand. The operands are resolved using an iterator which merges the
+// key's entries across the memtables and the version captured by Get, at
+// Get's snapshot, so that the value is consistent with the rest of the
+// lookup.
+func (d *DB) getMerged(
+	key []byte, seqNum uint64, current *version, memtables []*memTable,
+) ([]byte, error) {
+	// The iterator takes ownership of a reference to current, and releases an
+	// open iterator when it is closed. It is not subject to MaxOpenIterators,
+	// as it is internal to Get.
+	current.ref()
+	atomic.AddInt32(&d.openIters, 1)
+	iter := d.finishInitializingIter(nil, seqNum, current, memtables, nil, nil, nil)
+	iter.SeekGE(key)
+	if !iter.Valid() || d.cmp(key, iter.Key()) != 0 {
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		return nil, db.ErrNotFound
+	}
+	value := append([]byte(nil), iter.Value()...)
+	return value, iter.Close()
 }
 
 // Set sets the value for the given key. It overwrites any previous value
@@ -193,7 +370,9 @@ func (d *DB) Get(key []byte) ([]byte, error) {
 func (d *DB) Set(key, value []byte, opts *db.WriteOptions) error {
 	b := newBatch(d)
 	defer b.release()
-	_ = b.Set(key, value, opts)
+	if err := b.Set(key, value, opts); err != nil {
+		return err
+	}
 	return d.Apply(b, opts)
 }
 
@@ -204,19 +383,38 @@ func (d *DB) Set(key, value []byte, opts *db.WriteOptions) error {
 func (d *DB) Delete(key []byte, opts *db.WriteOptions) error {
 	b := newBatch(d)
 	defer b.release()
-	_ = b.Delete(key, opts)
+	if err := b.Delete(key, opts); err != nil {
+		return err
+	}
 	return d.Apply(b, opts)
 }
 
 // DeleteRange deletes all of the keys (and values) in the range [start,end)
-// (inclusive on start, exclusive on end).
+// (inclusive on start, exclusive on end). It returns ErrInvalidRange, leaving
+// the DB unmodified, if start is not less than end according to
+// Options.Comparer.
 //
 // It is safe to modify the contents of the arguments after DeleteRange
 // returns.
 func (d *DB) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
 	b := newBatch(d)
 	defer b.release()
-	_ = b.DeleteRange(start, end, opts)
+	if err := b.DeleteRange(start, end, opts); err != nil {
+		return err
+	}
+	return d.Apply(b, opts)
+}
+
+// LogData adds the specified data to the WAL without modifying the keyspace.
+// See Writer.LogData.
+//
+// It is safe to modify the contents of the arguments after LogData returns.
+func (d *DB) LogData(data []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	if err := b.LogData(data, opts); err != nil {
+		return err
+	}
 	return d.Apply(b, opts)
 }
 
@@ -228,15 +426,83 @@ func (d *DB) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
 func (d *DB) Merge(key, value []byte, opts *db.WriteOptions) error {
 	b := newBatch(d)
 	defer b.release()
-	_ = b.Merge(key, value, opts)
+	if err := b.Merge(key, value, opts); err != nil {
+		return err
+	}
+	return d.Apply(b, opts)
+}
+
+// RangeKeySet sets the value of the range key [start,end) (inclusive on
+// start, exclusive on end). See Writer.RangeKeySet.
+//
+// It is safe to modify the contents of the arguments after RangeKeySet
+// returns.
+func (d *DB) RangeKeySet(start, end, value []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	if err := b.RangeKeySet(start, end, value, opts); err != nil {
+		return err
+	}
 	return d.Apply(b, opts)
 }
 
-// Apply the operations contained in the batch to the DB.
+// RangeKeyUnset removes the portions of any range keys which overlap
+// [start,end) (inclusive on start, exclusive on end).
+//
+// It is safe to modify the contents of the arguments after RangeKeyUnset
+// returns.
+func (d *DB) RangeKeyUnset(start, end []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	if err := b.RangeKeyUnset(start, end, opts); err != nil {
+		return err
+	}
+	return d.Apply(b, opts)
+}
+
+// Apply the operations contained in the batch to the DB. ErrBatchTooLarge is
+// returned if the batch is too large to fit in a memtable.
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
-	return d.commit.Commit(batch, opts.GetSync())
+	return d.apply(batch, 0, opts)
+}
+
+// ApplyAtSeqNum is like Apply, but applies the operations in batch at the
+// specified sequence number, rather than at the next sequence number of the
+// DB, so that data being imported from another DB (e.g. when restoring or
+// replicating it) retains its original sequence numbers. The batch occupies
+// one sequence number for each of its operations, starting at seqNum, which
+// must not precede the next sequence number of the DB: the sequence numbers
+// of a DB never move backwards, so batches must be imported in sequence
+// number order and cannot be interleaved with the batches already applied.
+// The sequence numbers which are skipped are never assigned. The batch is
+// written to the WAL at its sequence number like any other batch, so it is
+// recovered at that sequence number. A seqNum which precedes the next
+// sequence number, or which is zero, returns ErrInvalidSeqNum.
+func (d *DB) ApplyAtSeqNum(batch *Batch, seqNum uint64, opts *db.WriteOptions) error {
+	if seqNum == 0 {
+		return newError(ErrInvalidSeqNum, nil, "pebble: sequence number 0 is reserved")
+	}
+	return d.apply(batch, seqNum, opts)
+}
+
+// apply applies the batch at seqNum, or at the next sequence number if seqNum
+// is 0.
+func (d *DB) apply(batch *Batch, seqNum uint64, opts *db.WriteOptions) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return ErrClosed
+	}
+	if batch.memTableSize > d.maxEntrySize {
+		// The batch would not fit even in an empty memtable, and would otherwise
+		// loop forever in makeRoomForWrite.
+		//
+		// TODO(peter): Allow large batches to be applied by flushing them
+		// directly to L0 tables.
+		return ErrBatchTooLarge
+	}
+	// There is nothing to sync if the WAL is disabled.
+	return d.commit.CommitAt(batch, seqNum, opts.GetSync() && !d.opts.DisableWAL)
 }
 
 func (d *DB) commitApply(b *Batch, mem *memTable) error {
@@ -273,19 +539,46 @@ func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 	if err := d.makeRoomForWrite(b); err != nil {
 		return nil, err
 	}
+	d.maybeStartFlushTimer()
 
+	if d.opts.DisableWAL {
+		return d.mu.mem.mutable, nil
+	}
 	_, err := d.mu.log.WriteRecord(b.data)
 	if err != nil {
+		d.opts.Logger.Fatalf("pebble: unable to write to WAL %06d: %v", d.mu.log.number, err)
 		panic(err)
 	}
 	return d.mu.mem.mutable, err
 }
 
-// newIterInternal constructs a new iterator, merging in batchIter as an extra
-// level.
-func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) db.Iterator {
+// acquireIter accounts for the creation of an iterator, returning an error if
+// it would exceed Options.MaxOpenIterators. The count is released when the
+// iterator is closed.
+func (d *DB) acquireIter() error {
+	n := atomic.AddInt32(&d.openIters, 1)
+	if max := d.opts.MaxOpenIterators; max > 0 && int(n) > max {
+		atomic.AddInt32(&d.openIters, -1)
+		return newError(ErrTooManyIterators, nil,
+			"pebble: too many open iterators (MaxOpenIterators is %d)", max)
+	}
+	return nil
+}
+
+// newIterInternal constructs a new iterator, merging in the contents of batch
+// (if non-nil) as an extra level. The iterator reads at seqNum, or at the
+// visible sequence number if seqNum is larger.
+func (d *DB) newIterInternal(batch *Batch, seqNum uint64, o *db.IterOptions) db.Iterator {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return &dbIter{err: ErrClosed}
+	}
+	if err := d.acquireIter(); err != nil {
+		return &dbIter{err: err}
+	}
 	d.mu.Lock()
-	seqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	if visible := atomic.LoadUint64(&d.mu.versions.visibleSeqNum); seqNum > visible {
+		seqNum = visible
+	}
 	// TODO(peter): The sstables in current are guaranteed to have sequence
 	// numbers less than d.mu.versions.logSeqNum, so why does dbIter need to check
 	// sequence numbers for every iter? Perhaps the sequence number filtering
@@ -299,6 +592,24 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 	memtables := d.mu.mem.queue
 	d.mu.Unlock()
 
+	var lower, upper []byte
+	if o != nil {
+		lower, upper = o.LowerBound, o.UpperBound
+	}
+	return d.finishInitializingIter(batch, seqNum, current, memtables, lower, upper, o)
+}
+
+// finishInitializingIter constructs an iterator over the state captured by
+// newIterInternal or dbIter.Clone. The iterator takes ownership of the
+// reference to current.
+func (d *DB) finishInitializingIter(
+	batch *Batch,
+	seqNum uint64,
+	current *version,
+	memtables []*memTable,
+	lower, upper []byte,
+	o *db.IterOptions,
+) *dbIter {
 	var buf struct {
 		dbi    dbIter
 		iters  [3 + numLevels]db.InternalIterator
@@ -306,13 +617,20 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 	}
 
 	dbi := &buf.dbi
+	dbi.db = d
+	dbi.batch = batch
+	dbi.memtables = memtables
+	dbi.opts = o
 	dbi.cmp = d.cmp
+	dbi.split = d.opts.Comparer.Split
 	dbi.merge = d.merge
 	dbi.version = current
+	dbi.lower = lower
+	dbi.upper = upper
 
 	iters := buf.iters[:0]
-	if batchIter != nil {
-		iters = append(iters, batchIter)
+	if batch != nil {
+		iters = append(iters, batch.newInternalIter(o))
 	}
 
 	for i := len(memtables) - 1; i >= 0; i-- {
@@ -323,7 +641,7 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 	// The level 0 files need to be added from newest to oldest.
 	for i := len(current.files[0]) - 1; i >= 0; i-- {
 		f := &current.files[0][i]
-		iter, err := d.newIter(f)
+		iter, err := d.newIter(f, o)
 		if err != nil {
 			dbi.err = err
 			return dbi
@@ -347,10 +665,11 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 			li = &levelIter{}
 		}
 
-		li.init(d.cmp, d.newIter, current.files[level])
+		li.init(o, d.cmp, d.newIter, current.files[level])
 		iters = append(iters, li)
 	}
 
+	atomic.StoreInt32(&d.readAmp, int32(len(iters)))
 	dbi.iter = newMergingIter(d.cmp, iters...)
 	dbi.seqNum = seqNum
 	return dbi
@@ -360,7 +679,29 @@ func (d *DB) newIterInternal(batchIter db.InternalIterator, o *db.IterOptions) d
 // return false). The iterator can be positioned via a call to SeekGE,
 // SeekLT, First or Last.
 func (d *DB) NewIter(o *db.IterOptions) db.Iterator {
-	return d.newIterInternal(nil, o)
+	return d.newIterInternal(nil, db.InternalKeySeqNumMax, o)
+}
+
+// NewIterAtSeqNum returns an iterator which reads the DB as of the specified
+// historical sequence number: only the writes with sequence numbers smaller
+// than seqNum are visible. An error is returned by the iterator if seqNum is
+// larger than the sequence number of the most recent write.
+//
+// The DB does not retain old versions of keys for the benefit of such
+// iterators. Compaction discards overwritten and deleted versions of a key,
+// so if a version needed by seqNum has been compacted away the key may appear
+// absent, as the newer versions are not visible at seqNum, or may appear with
+// an older version which survives in a lower level. Only versions which are
+// still in the memtables or in sstables which were not yet compacted are
+// guaranteed to be visible.
+func (d *DB) NewIterAtSeqNum(seqNum uint64, o *db.IterOptions) db.Iterator {
+	if visible := atomic.LoadUint64(&d.mu.versions.visibleSeqNum); seqNum > visible {
+		return &dbIter{
+			err: fmt.Errorf("pebble: sequence number %d is newer than the visible sequence number %d",
+				seqNum, visible),
+		}
+	}
+	return d.newIterInternal(nil, seqNum, o)
 }
 
 // NewBatch returns a new empty write-only batch. Any reads on the batch will
@@ -378,28 +719,112 @@ func (d *DB) NewIndexedBatch() *Batch {
 	return newIndexedBatch(d, d.opts.Comparer)
 }
 
+// walSeparate returns true if the WAL is stored outside of the DB directory.
+func (d *DB) walSeparate() bool {
+	return d.opts.WALStorage != d.opts.Storage || d.walDirname != d.dirname
+}
+
 // Close closes the DB.
 //
-// It is not safe to close a DB until all outstanding iterators are closed.
-// It is valid to call Close multiple times. Other methods should not be
-// called after the DB has been closed.
+// It is not safe to close a DB until all outstanding iterators are closed,
+// as the iterators are invalidated by Close. It is valid to call Close
+// multiple times. Once the DB is closed, Get, NewIter, Apply (and the methods which
+// write using it, such as Set) and Flush return ErrClosed, or an iterator
+// whose Error is ErrClosed. Other methods should not be called after the DB
+// has been closed.
 func (d *DB) Close() error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.mu.closed {
+	if atomic.LoadInt32(&d.closed) != 0 {
 		return nil
 	}
+	// Cancel the queued compactions so that only a running compaction is
+	// waited for.
+	d.mu.compact.queue.close()
 	for d.mu.compact.compacting || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
+	return d.closeLocked()
+}
+
+// CloseWithTimeout closes the DB as Close does, but waits at most timeout for
+// a running flush or compaction to finish. If the background work is still
+// running once the timeout has elapsed, it is canceled and the DB is closed
+// without waiting for it, returning ErrCloseTimedOut. The canceled work stops,
+// deleting the tables it has written, when it next checks for cancellation,
+// which may not be until a stalled write to storage returns.
+//
+// A DB closed by a timeout may still be writing to its directory, and must not
+// be reopened until the canceled work has stopped.
+func (d *DB) CloseWithTimeout(timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return nil
+	}
+	d.mu.compact.queue.close()
+	busy := func() bool {
+		return d.mu.compact.compacting || d.mu.compact.flushing
+	}
+	if busy() {
+		// The timer wakes the wait below once the timeout has elapsed.
+		var timedOut bool
+		t := time.AfterFunc(timeout, func() {
+			d.mu.Lock()
+			timedOut = true
+			d.mu.compact.cond.Broadcast()
+			d.mu.Unlock()
+		})
+		for busy() && !timedOut {
+			d.mu.compact.cond.Wait()
+		}
+		t.Stop()
+	}
+	if !busy() {
+		return d.closeLocked()
+	}
+	atomic.StoreInt32(&d.canceled, 1)
+	d.opts.Logger.Infof("close timed out after %s: canceling background work", timeout)
+	return firstError(ErrCloseTimedOut, d.closeLocked())
+}
+
+// closeLocked releases the resources of the DB once its background work has
+// finished or been canceled. d.mu must be held.
+func (d *DB) closeLocked() error {
+	if d.mu.mem.flushTimer != nil {
+		d.mu.mem.flushTimer.Stop()
+		d.mu.mem.flushTimer = nil
+	}
 	err := d.tableCache.Close()
 	err = firstError(err, d.mu.log.Close())
+	err = firstError(err, d.dataDir.Close())
+	err = firstError(err, d.walDir.Close())
 	err = firstError(err, d.fileLock.Close())
 	d.commit.Close()
-	d.mu.closed = true
+	atomic.StoreInt32(&d.closed, 1)
 	return err
 }
 
+// SetTableCacheSize changes the maximum number of sstable readers held open
+// by the table cache. Shrinking the table cache closes the least recently used
+// readers which are not in use by an iterator. Readers in use are closed when
+// the last iterator using them is closed. The size is not allowed to drop
+// below a small minimum.
+func (d *DB) SetTableCacheSize(size int) {
+	if size < minTableCacheSize {
+		size = minTableCacheSize
+	}
+	d.tableCache.setSize(size)
+}
+
+// SetCompactionRate changes the rate at which compactions write sstables to
+// bytesPerSecond, which is initially db.Options.CompactionBytesPerSecond. A
+// rate of 0 removes the limit. The new rate applies to compactions which are
+// already in progress, which allows background I/O to be shed under load.
+func (d *DB) SetCompactionRate(bytesPerSecond int) {
+	d.compactController.limiter.SetLimit(rateLimit(bytesPerSecond))
+}
+
 // Compact the specified range of keys in the database.
 //
 // TODO(peter): unimplemented
@@ -407,21 +832,147 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	panic("pebble.DB: Compact unimplemented")
 }
 
-// Flush the memtable to stable storage.
+// EstimateDiskUsage returns the estimated number of bytes occupied by the
+// sstables whose keys fall within the range [start, end). Tables entirely
+// contained in the range contribute their full size. Tables which only
+// partially overlap the range contribute a fraction of their size
+// proportional to the portion of their key span inside the range. Data in
+// the memtables is not included.
 //
-// TODO(peter): untested
-func (d *DB) Flush() error {
+// TODO(peter): Use the index blocks of partially overlapping tables to bound
+// the overlapping data blocks more accurately.
+func (d *DB) EstimateDiskUsage(start, end []byte) (uint64, error) {
+	if d.cmp(start, end) > 0 {
+		return 0, fmt.Errorf("pebble: invalid key range [%q, %q)", start, end)
+	}
+
 	d.mu.Lock()
-	mem := d.mu.mem.mutable
-	err := d.makeRoomForWrite(nil)
+	current := d.mu.versions.currentVersion()
+	current.ref()
 	d.mu.Unlock()
-	if err != nil {
+	defer current.unref()
+
+	var total uint64
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			smallest, largest := f.smallest.UserKey, f.largest.UserKey
+			if d.cmp(largest, start) < 0 || d.cmp(smallest, end) >= 0 {
+				// f does not overlap the range.
+				continue
+			}
+			if d.cmp(start, smallest) <= 0 && d.cmp(largest, end) < 0 {
+				// f is entirely contained in the range.
+				total += f.size
+				continue
+			}
+			lo, hi := smallest, largest
+			if d.cmp(lo, start) < 0 {
+				lo = start
+			}
+			if d.cmp(hi, end) > 0 {
+				hi = end
+			}
+			total += uint64(float64(f.size) * keySpanFraction(smallest, largest, lo, hi))
+		}
+	}
+	return total, nil
+}
+
+// keySpanFraction estimates the fraction of the key span [smallest, largest]
+// covered by [lo, hi], where smallest <= lo <= hi <= largest. Keys are
+// approximated as numbers formed from the 8 bytes following the common prefix
+// of smallest and largest. The numbers are compared by their distance only, so
+// that the estimate is also valid for comparers which order keys in
+// descending byte order.
+func keySpanFraction(smallest, largest, lo, hi []byte) float64 {
+	n := 0
+	for n < len(smallest) && n < len(largest) && smallest[n] == largest[n] {
+		n++
+	}
+	keyNum := func(key []byte) float64 {
+		var v uint64
+		for i := 0; i < 8; i++ {
+			v <<= 8
+			if j := n + i; j < len(key) {
+				v |= uint64(key[j])
+			}
+		}
+		return float64(v)
+	}
+	span := math.Abs(keyNum(largest) - keyNum(smallest))
+	if span == 0 {
+		return 1
+	}
+	f := math.Abs(keyNum(hi)-keyNum(lo)) / span
+	if f > 1 {
+		return 1
+	}
+	return f
+}
+
+// Flush the memtable to stable storage. When Flush returns without error,
+// every memtable which was queued for flushing when Flush was called,
+// including the memtable switched out by Flush itself, has been flushed to
+// L0, so all of the data written before Flush was called is on disk.
+func (d *DB) Flush() error {
+	d.mu.Lock()
+	if _, err := d.asyncFlush(); err != nil {
+		d.mu.Unlock()
 		return err
 	}
-	<-mem.flushed
+	// The last memtable in the queue is the mutable memtable.
+	queue := d.mu.mem.queue[:len(d.mu.mem.queue)-1]
+	flushed := make([]<-chan struct{}, len(queue))
+	for i, mem := range queue {
+		flushed[i] = mem.flushed
+	}
+	d.mu.Unlock()
+
+	for _, ch := range flushed {
+		<-ch
+	}
 	return nil
 }
 
+// AsyncFlush asynchronously flushes the memtable to stable storage.
+//
+// If no error is returned, the caller can receive from the returned channel
+// in order to wait for the flush to complete. If the memtable is empty there
+// is nothing to flush, and the returned channel is that of the most recent
+// memtable which is still being flushed, or an already closed channel if
+// there is no such memtable.
+func (d *DB) AsyncFlush() (<-chan struct{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.asyncFlush()
+}
+
+// asyncFlush implements AsyncFlush.
+//
+// d.mu must be held when calling this.
+func (d *DB) asyncFlush() (<-chan struct{}, error) {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return nil, ErrClosed
+	}
+
+	mem := d.mu.mem.mutable
+	// A memtable with a reference other than the DB's own has a batch being
+	// applied to it, and is not empty even if the batch is not yet visible.
+	if mem.Empty() && atomic.LoadInt32(&mem.refs) == 1 {
+		if n := len(d.mu.mem.queue); n > 1 {
+			return d.mu.mem.queue[n-2].flushed, nil
+		}
+		flushed := make(chan struct{})
+		close(flushed)
+		return flushed, nil
+	}
+	if err := d.makeRoomForWrite(nil); err != nil {
+		return nil, err
+	}
+	return mem.flushed, nil
+}
+
 // firstError returns the first non-nil error of err0 and err1, or nil if both
 // are nil.
 func firstError(err0, err1 error) error {
@@ -431,35 +982,39 @@ func firstError(err0, err1 error) error {
 	return err1
 }
 
-// writeLevel0Table writes a memtable to a level-0 on-disk table.
+// writeLevel0Table writes a memtable to level-0 on-disk tables. A new table is
+// started whenever the current one reaches the level's TargetFileSize. A user
+// key is never split across tables, so the tables have non-overlapping key
+// ranges.
 //
-// If no error is returned, it adds the file number of that on-disk table to
-// d.pendingOutputs. It is the caller's responsibility to remove that fileNum
-// from that set when it has been applied to d.mu.versions.
+// If no error is returned, it adds the file numbers of those on-disk tables to
+// d.pendingOutputs. It is the caller's responsibility to remove those fileNums
+// from that set when they have been applied to d.mu.versions.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) writeLevel0Table(
 	fs storage.Storage, iter db.InternalIterator,
-) (meta fileMetadata, err error) {
-	meta.fileNum = d.mu.versions.nextFileNum()
-	filename := dbFilename(d.dirname, fileTypeTable, meta.fileNum)
-	d.mu.compact.pendingOutputs[meta.fileNum] = struct{}{}
-	defer func(fileNum uint64) {
+) (metas []fileMetadata, err error) {
+	var filenames []string
+	defer func() {
 		if err != nil {
-			delete(d.mu.compact.pendingOutputs, fileNum)
+			for i := range metas {
+				delete(d.mu.compact.pendingOutputs, metas[i].fileNum)
+			}
+			for _, filename := range filenames {
+				fs.Remove(filename)
+			}
+			metas = nil
 		}
-	}(meta.fileNum)
+	}()
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	var (
-		file storage.File
-		tw   *sstable.Writer
-	)
+	var tw *sstable.Writer
 	defer func() {
 		if iter != nil {
 			err = firstError(err, iter.Close())
@@ -467,78 +1022,110 @@ func (d *DB) writeLevel0Table(
 		if tw != nil {
 			err = firstError(err, tw.Close())
 		}
-		if err != nil {
-			fs.Remove(filename)
-			meta = fileMetadata{}
-		}
 	}()
 
 	iter.First()
 	if !iter.Valid() {
-		return fileMetadata{}, fmt.Errorf("pebble: memtable empty")
+		return nil, fmt.Errorf("pebble: memtable empty")
 	}
 
-	file, err = fs.Create(filename)
-	if err != nil {
-		return fileMetadata{}, err
+	levelOpts := d.opts.Level(0)
+	var meta *fileMetadata
+	// finishTable closes the table being written and records its size.
+	finishTable := func() error {
+		meta.largest = meta.largest.Clone()
+		w := tw
+		tw = nil
+		if err := w.Close(); err != nil {
+			return err
+		}
+		stat, err := w.Stat()
+		if err != nil {
+			return err
+		}
+		size := stat.Size()
+		if size < 0 {
+			return fmt.Errorf("pebble: table file %q has negative size %d",
+				filenames[len(filenames)-1], size)
+		}
+		meta.size = uint64(size)
+		return nil
 	}
-	file = newRateLimitedFile(file, d.flushController)
-	tw = sstable.NewWriter(file, d.opts, d.opts.Level(0))
-
-	meta.smallest = iter.Key().Clone()
-	for {
-		// TODO(peter): support c.shouldStopBefore.
 
-		meta.largest = iter.Key()
-		if err1 := tw.Add(meta.largest, iter.Value()); err1 != nil {
-			return fileMetadata{}, err1
+	for ; iter.Valid(); iter.Next() {
+		if atomic.LoadInt32(&d.canceled) != 0 {
+			return metas, errCanceled
 		}
-		if !iter.Next() {
-			break
+		// TODO(peter): Pass the open snapshots to filterEntry once the DB
+		// supports explicit snapshots.
+		key, value, keep := d.filterEntry(0, iter.Key(), iter.Value(), nil, nil)
+		if !keep {
+			continue
+		}
+		if tw != nil && tw.EstimatedSize() >= uint64(levelOpts.TargetFileSize) &&
+			d.cmp(meta.largest.UserKey, key.UserKey) != 0 {
+			if err := finishTable(); err != nil {
+				return metas, err
+			}
+		}
+		if tw == nil {
+			d.mu.Lock()
+			fileNum := d.mu.versions.nextFileNum()
+			d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+			d.mu.Unlock()
+			metas = append(metas, fileMetadata{
+				fileNum:        fileNum,
+				smallest:       key.Clone(),
+				smallestSeqNum: math.MaxUint64,
+			})
+			meta = &metas[len(metas)-1]
+
+			filename := dbFilename(d.dirname, fileTypeTable, fileNum)
+			filenames = append(filenames, filename)
+			file, err := fs.Create(filename)
+			if err != nil {
+				return metas, err
+			}
+			file = newRateLimitedFile(file, d.flushController)
+			tw = sstable.NewWriter(file, d.opts, levelOpts)
 		}
-	}
-	meta.largest = meta.largest.Clone()
 
-	if err1 := iter.Close(); err1 != nil {
-		iter = nil
-		return fileMetadata{}, err1
+		meta.largest = key
+		meta.updateSeqNum(key.SeqNum())
+		meta.updateStats(key, value)
+		if err := tw.Add(key, value); err != nil {
+			return metas, err
+		}
 	}
-	iter = nil
-
-	if err1 := tw.Close(); err1 != nil {
-		tw = nil
-		return fileMetadata{}, err1
+	if err := finishTable(); err != nil {
+		return metas, err
 	}
-
-	stat, err := tw.Stat()
-	if err != nil {
-		return fileMetadata{}, err
+	if err := d.dataDir.Sync(); err != nil {
+		return metas, err
 	}
-	size := stat.Size()
-	if size < 0 {
-		return fileMetadata{}, fmt.Errorf("pebble: table file %q has negative size %d", filename, size)
+
+	if err := iter.Close(); err != nil {
+		iter = nil
+		return metas, err
 	}
-	meta.size = uint64(size)
-	tw = nil
+	iter = nil
 
 	// TODO(peter): After a flush we set the commit rate to 110% of the flush
 	// rate. The rationale behind the 110% is to account for slack. Investigate a
 	// more principled way of setting this.
 	// d.commitController.limiter.SetLimit(rate.Limit(d.flushController.sensor.Rate()))
-	// if false {
-	// 	fmt.Printf("flush: %.1f MB/s\n", d.flushController.sensor.Rate()/float64(1<<20))
-	// }
+	d.opts.Logger.Infof("flush: %.1f MB/s", d.flushController.sensor.Rate()/float64(1<<20))
 
 	// TODO(peter): compaction stats.
 
-	return meta, nil
+	return metas, nil
 }
 
 func (d *DB) throttleWrite() {
 	if len(d.mu.versions.currentVersion().files[0]) <= d.opts.L0SlowdownWritesThreshold {
 		return
 	}
-	// fmt.Printf("L0 slowdown writes threshold\n")
+	d.opts.Logger.Infof("L0 slowdown writes threshold")
 	// We are getting close to hitting a hard limit on the number of L0
 	// files. Rather than delaying a single write by several seconds when we hit
 	// the hard limit, start delaying each individual write by 1ms to reduce
@@ -550,19 +1137,60 @@ func (d *DB) throttleWrite() {
 	d.mu.Lock()
 }
 
+// maybeStartFlushTimer starts a timer which flushes the mutable memtable after
+// Options.MemTableFlushInterval, if the interval is set and the timer is not
+// already running. It is called after every write, so the timer is started by
+// the first write to each memtable.
+//
+// d.mu must be held when calling this.
+func (d *DB) maybeStartFlushTimer() {
+	if d.opts.MemTableFlushInterval <= 0 || d.mu.mem.flushTimer != nil {
+		return
+	}
+	mem := d.mu.mem.mutable
+	d.mu.mem.flushTimer = time.AfterFunc(d.opts.MemTableFlushInterval, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if atomic.LoadInt32(&d.closed) != 0 || d.mu.mem.mutable != mem {
+			// The memtable has already been switched out.
+			return
+		}
+		// NB: makeRoomForWrite only returns an error when given a batch.
+		_ = d.makeRoomForWrite(nil)
+	})
+}
+
 func (d *DB) makeRoomForWrite(b *Batch) error {
+	var stall *writeStallWatchdog
+	defer func() {
+		if stall != nil {
+			stall.stop()
+		}
+	}()
+
 	for force := b == nil; ; {
 		if d.mu.mem.switching {
 			d.mu.mem.cond.Wait()
 			continue
 		}
 		if b != nil {
-			err := d.mu.mem.mutable.prepare(b)
-			if err == nil {
-				return nil
+			// Once the memtable reaches the flush threshold it is switched out,
+			// unless doing so would require waiting. In that case the batch is
+			// written to the memtable if it still has room.
+			if d.mu.mem.mutable.reserved < uint32(d.opts.MemTableFlushThreshold) || d.writesStopped() {
+				err := d.mu.mem.mutable.prepare(b)
+				if err == nil {
+					return nil
+				}
+				if err != arenaskl.ErrArenaFull {
+					return err
+				}
 			}
-			if err != arenaskl.ErrArenaFull {
-				return err
+			if b.memTableSize > d.maxEntrySize {
+				// The batch does not fit in the memtable, and would not fit in an
+				// empty memtable either. Switching memtables would not make room
+				// for it, and would loop forever allocating memtables and WALs.
+				return ErrBatchTooLarge
 			}
 		} else if !force {
 			return nil
@@ -570,13 +1198,19 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold {
 			// We have filled up the current memtable, but the previous one is still
 			// being compacted, so we wait.
-			// fmt.Printf("memtable stop writes threshold\n")
+			d.opts.Logger.Infof("memtable stop writes threshold")
+			stall = d.watchWriteStall(stall, fmt.Sprintf(
+				"memtable queue full (%d memtables, MemTableStopWritesThreshold is %d)",
+				len(d.mu.mem.queue), d.opts.MemTableStopWritesThreshold))
 			d.mu.compact.cond.Wait()
 			continue
 		}
-		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
+		if n := len(d.mu.versions.currentVersion().files[0]); n > d.opts.L0StopWritesThreshold {
 			// There are too many level-0 files, so we wait.
-			// fmt.Printf("L0 stop writes threshold\n")
+			d.opts.Logger.Infof("L0 stop writes threshold")
+			stall = d.watchWriteStall(stall, fmt.Sprintf(
+				"L0 stop writes threshold (%d L0 files, L0StopWritesThreshold is %d)",
+				n, d.opts.L0StopWritesThreshold))
 			d.mu.compact.cond.Wait()
 			continue
 		}
@@ -585,7 +1219,13 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		d.mu.mem.switching = true
 		d.mu.Unlock()
 
-		newLogFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, newLogNumber))
+		newLogFile, err := d.opts.WALStorage.Create(dbFilename(d.walDirname, fileTypeLog, newLogNumber))
+		if err == nil {
+			err = d.walDir.Sync()
+			if err != nil {
+				newLogFile.Close()
+			}
+		}
 		if err == nil {
 			err = d.mu.log.Close()
 			if err != nil {
@@ -603,6 +1243,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			//
 			// What to do here? Stumbling on doesn't seem worthwhile. If we failed to
 			// close the previous log it is possible we lost a write.
+			d.opts.Logger.Fatalf("pebble: unable to switch to WAL %06d: %v", newLogNumber, err)
 			panic(err)
 		}
 
@@ -611,6 +1252,11 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// have been applied.
 		d.mu.log.number = newLogNumber
 		d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
+		d.opts.Logger.Infof("switched to WAL %06d", newLogNumber)
+		if d.mu.mem.flushTimer != nil {
+			d.mu.mem.flushTimer.Stop()
+			d.mu.mem.flushTimer = nil
+		}
 		imm := d.mu.mem.mutable
 		d.mu.mem.mutable = newMemTable(d.opts)
 		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
@@ -620,3 +1266,74 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		force = false
 	}
 }
+
+// writesStopped returns whether switching out the mutable memtable would have
+// to wait for a flush or compaction, because of MemTableStopWritesThreshold or
+// L0StopWritesThreshold.
+//
+// d.mu must be held when calling this.
+func (d *DB) writesStopped() bool {
+	return len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold ||
+		len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold
+}
+
+// writeStallWatchdog reports a write stalled in makeRoomForWrite once it has
+// been waiting for longer than Options.WriteStallWarningDuration. It is
+// protected by DB.mu.
+type writeStallWatchdog struct {
+	d       *DB
+	start   time.Time
+	reason  string
+	timer   *time.Timer
+	stopped bool
+}
+
+// watchWriteStall returns the watchdog for a write which is about to wait for
+// the reason given, creating it if the write was not already stalled. It
+// returns nil if write stall reports are disabled. d.mu must be held.
+func (d *DB) watchWriteStall(w *writeStallWatchdog, reason string) *writeStallWatchdog {
+	if d.opts.WriteStallWarningDuration <= 0 {
+		return nil
+	}
+	if w == nil {
+		w = &writeStallWatchdog{d: d, start: time.Now()}
+		// NB: fire acquires d.mu, so it cannot observe w before w.timer is
+		// set.
+		w.timer = time.AfterFunc(d.opts.WriteStallWarningDuration, w.fire)
+	}
+	w.reason = reason
+	return w
+}
+
+// fire reports the stall. The report is made without holding d.mu, so that a
+// slow Logger or EventListener does not block the DB.
+func (w *writeStallWatchdog) fire() {
+	d := w.d
+	d.mu.Lock()
+	if w.stopped {
+		d.mu.Unlock()
+		return
+	}
+	info := db.WriteStallInfo{
+		Reason:   w.reason,
+		Duration: time.Since(w.start),
+	}
+	current := d.mu.versions.currentVersion()
+	info.LevelFiles = make([]int, len(current.files))
+	for level := range current.files {
+		info.LevelFiles[level] = len(current.files[level])
+	}
+	w.timer.Reset(d.opts.WriteStallWarningDuration)
+	d.mu.Unlock()
+
+	d.opts.Logger.Infof("write stalled for %s: %s; files per level: %v",
+		info.Duration, info.Reason, info.LevelFiles)
+	d.opts.EventListener.WriteStall(info)
+}
+
+// stop stops the watchdog once the write is no longer stalled. d.mu must be
+// held.
+func (w *writeStallWatchdog) stop() {
+	w.stopped = true
+	w.timer.Stop()
+}
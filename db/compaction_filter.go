@@ -0,0 +1,35 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+// FilterOp is the decision of a CompactionFilter for an entry.
+type FilterOp int
+
+const (
+	// FilterKeep keeps the entry unchanged.
+	FilterKeep FilterOp = iota
+	// FilterDrop deletes the entry.
+	FilterDrop
+	// FilterChange replaces the value of the entry with the new value returned
+	// by the filter.
+	FilterChange
+)
+
+// CompactionFilter decides the fate of the entries written by flushes and
+// compactions, allowing an application to expire or rewrite values in the
+// background, such as dropping rows whose TTL has passed.
+//
+// Filter is called for each Set entry written to the specified level, with
+// the entry's user key and value. It is not called for deletions, merge
+// operands or range keys, nor for entries which may still be visible to an
+// open snapshot. A dropped entry is omitted from the output when no older
+// version of the key can exist below the output level; otherwise it is
+// replaced by a deletion, so that the older versions are not resurrected.
+//
+// Filter is called concurrently by flushes and compactions, and must not
+// retain or modify key or value. The new value is copied by the caller.
+type CompactionFilter interface {
+	Filter(level int, key, value []byte) (newValue []byte, op FilterOp)
+}
@@ -6,6 +6,8 @@ package db
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
 )
 
 // Compare returns -1, 0, or +1 depending on whether a is 'less than',
@@ -42,6 +44,32 @@ type Separator func(dst, a, b []byte) []byte
 // key, though it is valid to pass a nil.
 type Successor func(dst, a []byte) []byte
 
+// ImmediateSuccessor appends to dst the smallest key x such that a < x, and
+// returns the enlarged slice, like the built-in append function. It may be
+// used to turn an inclusive bound on a into an exclusive one: the keys k with
+// a <= k && k < x are exactly the keys equal to a.
+type ImmediateSuccessor func(dst, a []byte) []byte
+
+// PrefixSuccessor appends to dst the smallest key x which is greater than
+// every key having a as a byte-wise prefix, and returns the enlarged slice,
+// like the built-in append function. The keys with the prefix a are then
+// exactly the keys k with a <= k && k < x, which makes x suitable as the end
+// of a DeleteRange or as the IterOptions.UpperBound of a prefix scan.
+//
+// If no such key exists, because a is empty or every key greater than a has
+// the prefix a, dst is returned unchanged. In particular, a nil dst results
+// in a nil key, which is an unbounded IterOptions.UpperBound.
+//
+// For example, the prefix successor of "ab" is "ac", and the prefix successor
+// of "a\xff" is "b".
+type PrefixSuccessor func(dst, a []byte) []byte
+
+// Split returns the length of the prefix of the user key which is used for
+// prefix bloom filtering and prefix iteration (see Iterator.SeekPrefixGE). The
+// prefix must be a byte-wise prefix of the key, and all keys sharing a prefix
+// must sort contiguously.
+type Split func(a []byte) int
+
 // Comparer defines a total ordering over the space of []byte keys: a 'less
 // than' relationship.
 type Comparer struct {
@@ -50,6 +78,18 @@ type Comparer struct {
 	Separator Separator
 	Successor Successor
 
+	// ImmediateSuccessor and PrefixSuccessor are optional. They are not used
+	// by the DB, and are provided for users deriving bounds from keys and key
+	// prefixes. A comparer may leave them nil if its ordering has no such
+	// successors.
+	ImmediateSuccessor ImmediateSuccessor
+	PrefixSuccessor    PrefixSuccessor
+
+	// Split is optional. If specified, sstables with a table-level filter also
+	// add the prefix of each key to the filter, allowing SeekPrefixGE to skip
+	// sstables which do not contain the prefix.
+	Split Split
+
 	// Name is the name of the comparer.
 	//
 	// The Level-DB on-disk format stores the comparer name, and opening a
@@ -121,6 +161,23 @@ var DefaultComparer = &Comparer{
 		return append(dst, a...)
 	},
 
+	ImmediateSuccessor: func(dst, a []byte) []byte {
+		return append(append(dst, a...), 0x00)
+	},
+
+	PrefixSuccessor: func(dst, a []byte) []byte {
+		// Drop the trailing 0xff bytes, which cannot be incremented, and
+		// increment the last remaining byte.
+		for i := len(a) - 1; i >= 0; i-- {
+			if a[i] != 0xff {
+				dst = append(dst, a[:i+1]...)
+				dst[len(dst)-1]++
+				return dst
+			}
+		}
+		return dst
+	},
+
 	// This name is part of the C++ Level-DB implementation's default file
 	// format, and should not be changed.
 	Name: "leveldb.BytewiseComparator",
@@ -138,3 +195,152 @@ func SharedPrefixLen(a, b []byte) int {
 	}
 	return i
 }
+
+// ReverseComparer is an implementation of the Comparer interface which orders
+// keys in the reverse of the natural ordering used by DefaultComparer. It is
+// useful when keys are scanned in descending byte order: a forward iteration
+// with Iterator.First and Iterator.Next visits the keys from the largest to
+// the smallest byte string.
+//
+// Note that the empty key is the largest key under this ordering, rather than
+// the smallest. ReverseComparer does not provide ImmediateSuccessor or
+// PrefixSuccessor: the successor of most keys under the reverse ordering would
+// be the byte-wise predecessor, which is an infinite sequence of 0xff bytes.
+var ReverseComparer = &Comparer{
+	Compare: func(a, b []byte) int {
+		return bytes.Compare(b, a)
+	},
+
+	InlineKey: func(key []byte) uint64 {
+		return ^DefaultComparer.InlineKey(key)
+	},
+
+	Separator: func(dst, a, b []byte) []byte {
+		// Under the reverse ordering, a < b means that a is larger than b byte
+		// wise. The prefix of a up to and including the first byte which differs
+		// from b is then larger than b byte wise and no larger than a, and thus
+		// a valid separator.
+		i := SharedPrefixLen(a, b)
+		if len(b) > 0 && i < len(a) && (i == len(b) || a[i] > b[i]) {
+			return append(dst, a[:i+1]...)
+		}
+		return append(dst, a...)
+	},
+
+	Successor: func(dst, a []byte) []byte {
+		// Every prefix of a is smaller than a byte wise, and thus larger than a
+		// under the reverse ordering.
+		if len(a) > 1 {
+			return append(dst, a[:1]...)
+		}
+		return append(dst, a...)
+	},
+
+	Name: "rocksdb.ReverseBytewiseComparator",
+}
+
+// MVCCTimestampLen is the length of the timestamp suffix of the keys ordered
+// by MVCCComparer.
+const MVCCTimestampLen = 8
+
+// MakeMVCCKey appends to dst the MVCCComparer key for the version of userKey
+// at timestamp ts, and returns the enlarged slice, like the built-in append
+// function.
+func MakeMVCCKey(dst, userKey []byte, ts uint64) []byte {
+	var buf [MVCCTimestampLen]byte
+	binary.BigEndian.PutUint64(buf[:], ts)
+	return append(append(dst, userKey...), buf[:]...)
+}
+
+// mvccSplit returns the length of the user key of an MVCCComparer key. A key
+// shorter than MVCCTimestampLen consists of a user key and no timestamp.
+func mvccSplit(key []byte) int {
+	if len(key) < MVCCTimestampLen {
+		return len(key)
+	}
+	return len(key) - MVCCTimestampLen
+}
+
+// MVCCComparer is an implementation of the Comparer interface for keys of
+// multi-version data, each of which is a user key followed by an 8-byte
+// big-endian timestamp (see MakeMVCCKey). Keys are ordered by user key
+// ascending and then by timestamp descending, so the versions of a user key
+// sort contiguously, newest first: iterating forward from
+// MakeMVCCKey(nil, k, ts) visits the newest version of k no newer than ts and
+// then the older versions. A key shorter than the timestamp is a user key
+// without a timestamp, which sorts before the versions of its user key.
+//
+// Split returns the length of the user key, so prefix bloom filters and
+// Iterator.SeekPrefixGE operate on user keys. Separator and Successor shorten
+// the user key only, appending the largest timestamp to a shortened user key;
+// they never shorten a key into the timestamp of another version of the same
+// user key. MVCCComparer does not provide ImmediateSuccessor or
+// PrefixSuccessor, as the keys with a given byte-wise prefix do not sort
+// contiguously.
+var MVCCComparer = &Comparer{
+	Compare: func(a, b []byte) int {
+		an, bn := mvccSplit(a), mvccSplit(b)
+		if c := bytes.Compare(a[:an], b[:bn]); c != 0 {
+			return c
+		}
+		ats, bts := a[an:], b[bn:]
+		switch {
+		case len(ats) == 0 && len(bts) == 0:
+			return 0
+		case len(ats) == 0:
+			// A key without a timestamp sorts first.
+			return -1
+		case len(bts) == 0:
+			return +1
+		}
+		return bytes.Compare(bts, ats)
+	},
+
+	InlineKey: func(key []byte) uint64 {
+		// The first 8 bytes of the user key, left aligned so that a shorter
+		// user key is no larger than the keys it is a prefix of.
+		key = key[:mvccSplit(key)]
+		var v uint64
+		n := 8
+		if n > len(key) {
+			n = len(key)
+		}
+		for _, b := range key[:n] {
+			v <<= 8
+			v |= uint64(b)
+		}
+		return v << uint(8*(8-n))
+	},
+
+	Separator: func(dst, a, b []byte) []byte {
+		au := a[:mvccSplit(a)]
+		if len(b) > 0 {
+			bu := b[:mvccSplit(b)]
+			if bytes.Equal(au, bu) {
+				// The versions of a user key only differ in their timestamps.
+				return append(dst, a...)
+			}
+			return mvccShortened(dst, a, DefaultComparer.Separator(nil, au, bu))
+		}
+		return mvccShortened(dst, a, DefaultComparer.Successor(nil, au))
+	},
+
+	Successor: func(dst, a []byte) []byte {
+		return mvccShortened(dst, a, DefaultComparer.Successor(nil, a[:mvccSplit(a)]))
+	},
+
+	Split: mvccSplit,
+
+	Name: "pebble.MVCCComparator",
+}
+
+// mvccShortened appends to dst the MVCCComparer key with the shortened user
+// key u, which is byte-wise >= the user key of a, and returns the enlarged
+// slice. If u is the user key of a, a itself is appended. Otherwise the key is
+// u with the largest timestamp, which is the first key of the user key u.
+func mvccShortened(dst, a, u []byte) []byte {
+	if bytes.Equal(u, a[:mvccSplit(a)]) {
+		return append(dst, a...)
+	}
+	return MakeMVCCKey(dst, u, math.MaxUint64)
+}
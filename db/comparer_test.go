@@ -5,6 +5,8 @@
 package db
 
 import (
+	"bytes"
+	"math"
 	"testing"
 )
 
@@ -49,3 +51,187 @@ func TestDefAppendSeparator(t *testing.T) {
 		})
 	}
 }
+
+func TestReverseComparer(t *testing.T) {
+	c := ReverseComparer
+	if c.Compare([]byte("a"), []byte("b")) <= 0 {
+		t.Fatalf("expected a > b")
+	}
+	if c.InlineKey([]byte("a")) <= c.InlineKey([]byte("b")) {
+		t.Fatalf("expected InlineKey(a) > InlineKey(b)")
+	}
+
+	testCases := []struct {
+		a, b, want string
+	}{
+		{"blue", "black", "blu"},
+		{"2", "1", "2"},
+		{"29", "1", "2"},
+		{"19", "13", "19"},
+		{"295", "13", "2"},
+		{"135", "13", "135"},
+		{"1357", "13", "135"},
+		{"1", "", "1"},
+		{"", "", ""},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			got := string(c.Separator(nil, []byte(tc.a), []byte(tc.b)))
+			if got != tc.want {
+				t.Errorf("a, b = %q, %q: got %q, want %q", tc.a, tc.b, got, tc.want)
+			}
+			// The separator must satisfy a <= x && x < b.
+			if tc.b != "" {
+				if c.Compare([]byte(tc.a), []byte(got)) > 0 || c.Compare([]byte(got), []byte(tc.b)) >= 0 {
+					t.Errorf("a, b = %q, %q: %q is not a separator", tc.a, tc.b, got)
+				}
+			}
+		})
+	}
+
+	for _, a := range []string{"", "1", "13", "\xff\xff"} {
+		got := c.Successor(nil, []byte(a))
+		if c.Compare([]byte(a), got) > 0 {
+			t.Errorf("%q: %q is not a successor", a, got)
+		}
+	}
+}
+
+func TestDefaultSuccessors(t *testing.T) {
+	c := DefaultComparer
+	testCases := []struct {
+		a, succ, prefixSucc string
+	}{
+		{"", "", ""},
+		{"\x00", "\x01", "\x01"},
+		{"1", "2", "2"},
+		{"13", "2", "14"},
+		{"1\xff", "2", "2"},
+		{"13\xff\xff", "2", "14"},
+		{"\xff", "\xff", ""},
+		{"\xff\xff", "\xff\xff", ""},
+		{"\xff1", "\xff2", "\xff2"},
+		{"\xff1\xff", "\xff2", "\xff2"},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			a := []byte(tc.a)
+			if got := string(c.Successor(nil, a)); got != tc.succ {
+				t.Errorf("%q: expected successor %q, but found %q", tc.a, tc.succ, got)
+			}
+			got := c.ImmediateSuccessor(nil, a)
+			if string(got) != tc.a+"\x00" {
+				t.Errorf("%q: expected immediate successor %q, but found %q", tc.a, tc.a+"\x00", got)
+			}
+			got = c.PrefixSuccessor(nil, a)
+			if string(got) != tc.prefixSucc {
+				t.Errorf("%q: expected prefix successor %q, but found %q", tc.a, tc.prefixSucc, got)
+			}
+			if len(got) == 0 {
+				if got != nil {
+					t.Errorf("%q: expected a nil prefix successor, but found %q", tc.a, got)
+				}
+				return
+			}
+			// The prefix successor is greater than the keys with the prefix.
+			for _, suffix := range []string{"", "\x00", "\xff", "\xff\xff\xff"} {
+				if k := tc.a + suffix; c.Compare([]byte(k), got) >= 0 {
+					t.Errorf("%q: expected prefix successor %q to be greater than %q", tc.a, got, k)
+				}
+			}
+		})
+	}
+
+	// The successors are appended to dst.
+	if got := string(c.ImmediateSuccessor([]byte("x"), []byte("ab"))); got != "xab\x00" {
+		t.Fatalf("expected %q, but found %q", "xab\x00", got)
+	}
+	if got := string(c.PrefixSuccessor([]byte("x"), []byte("ab\xff"))); got != "xac" {
+		t.Fatalf("expected %q, but found %q", "xac", got)
+	}
+	if got := string(c.PrefixSuccessor([]byte("x"), []byte("\xff"))); got != "x" {
+		t.Fatalf("expected %q, but found %q", "x", got)
+	}
+}
+
+func TestMVCCComparer(t *testing.T) {
+	c := MVCCComparer
+	key := func(userKey string, ts uint64) []byte {
+		return MakeMVCCKey(nil, []byte(userKey), ts)
+	}
+
+	// The keys in ascending order: by user key, then newest first, with bare
+	// user keys before their versions.
+	keys := [][]byte{
+		[]byte(""),
+		key("", 1),
+		[]byte("a"),
+		key("a", math.MaxUint64),
+		key("a", 1<<40),
+		key("a", 300),
+		key("a", 2),
+		key("a", 1),
+		key("a", 0),
+		key("a\x00", 5),
+		key("ab", 9),
+		key("ab", 8),
+		key("b", 7),
+		key("\xff\xff", 1),
+	}
+	for i := range keys {
+		for j := range keys {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = +1
+			}
+			if got := c.Compare(keys[i], keys[j]); got != want {
+				t.Fatalf("%x, %x: got %d, want %d", keys[i], keys[j], got, want)
+			}
+			if i < j && c.InlineKey(keys[i]) > c.InlineKey(keys[j]) {
+				t.Fatalf("%x, %x: InlineKey not ordered", keys[i], keys[j])
+			}
+		}
+		if n := c.Split(keys[i]); !bytes.HasPrefix(keys[i], keys[i][:n]) || n > len(keys[i]) {
+			t.Fatalf("%x: bad split %d", keys[i], n)
+		}
+	}
+	if n := c.Split(key("abc", 5)); n != 3 {
+		t.Fatalf("expected split 3, but found %d", n)
+	}
+
+	// Separators of keys with distinct user keys shorten the user key, and
+	// separators of versions of the same user key do not cut into the
+	// timestamp.
+	testCases := []struct {
+		a, b, want []byte
+	}{
+		{key("black", 5), key("blue", 9), key("blb", math.MaxUint64)},
+		{key("13", 5), key("19", 9), key("14", math.MaxUint64)},
+		{key("1", 5), key("2", 9), key("1", 5)},
+		{key("abc", 5), key("abc", 4), key("abc", 5)},
+		{key("abc", 0x1ff), key("abc", 0x100), key("abc", 0x1ff)},
+		{key("black", 5), nil, key("c", math.MaxUint64)},
+	}
+	for _, tc := range testCases {
+		got := c.Separator(nil, tc.a, tc.b)
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("a, b = %x, %x: got %x, want %x", tc.a, tc.b, got, tc.want)
+		}
+	}
+
+	// Separators and successors of every pair of keys are valid.
+	for i := range keys {
+		if got := c.Successor(nil, keys[i]); c.Compare(keys[i], got) > 0 {
+			t.Fatalf("%x: %x is not a successor", keys[i], got)
+		}
+		for j := i + 1; j < len(keys); j++ {
+			got := c.Separator(nil, keys[i], keys[j])
+			if c.Compare(keys[i], got) > 0 || c.Compare(got, keys[j]) >= 0 {
+				t.Fatalf("a, b = %x, %x: %x is not a separator", keys[i], keys[j], got)
+			}
+		}
+	}
+}
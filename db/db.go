@@ -38,6 +38,13 @@ import (
 // ErrNotFound means that a get or delete call did not find the requested key.
 var ErrNotFound = errors.New("pebble/db: not found")
 
+// RangeKey is a value associated with the span of keys [Start,End). See
+// Iterator.RangeKeys.
+type RangeKey struct {
+	Start, End []byte
+	Value      []byte
+}
+
 // Iterator iterates over a DB's key/value pairs in key order.
 //
 // An iterator must be closed after use, but it is not necessary to read an
@@ -55,6 +62,14 @@ type Iterator interface {
 	// than or equal to the given key.
 	SeekGE(key []byte)
 
+	// SeekPrefixGE moves the iterator to the first key/value pair whose key is
+	// greater than or equal to the given key and which has the same prefix as
+	// the given key, as determined by Comparer.Split. The iterator is
+	// positioned at the end if no such key exists. Subsequent calls to Next and
+	// Prev are limited to keys with the same prefix. If Comparer.Split is nil,
+	// SeekPrefixGE is equivalent to SeekGE.
+	SeekPrefixGE(key []byte)
+
 	// SeekLT moves the iterator to the last key/value pair whose key is less
 	// than the given key.
 	SeekLT(key []byte)
@@ -87,6 +102,38 @@ type Iterator interface {
 	// and false otherwise.
 	Valid() bool
 
+	// RangeKeys returns the range keys which cover the current key, or nil if
+	// no range key covers it or the iterator is not positioned at a valid
+	// key/value pair. Range keys are set and unset independently of the point
+	// keys, so a range key does not shadow the key/value pairs it covers and
+	// is not itself returned by Key. The returned span is the fragment of the
+	// range key which contains the current key: overlapping range keys are
+	// split at their boundaries, with the most recently written range key
+	// winning within each fragment. The contents of the returned slice may
+	// change on the next call to Next.
+	RangeKeys() []RangeKey
+
+	// SetBounds sets the lower (inclusive) and upper (exclusive) bounds for the
+	// iterator, replacing any bounds specified in IterOptions, and leaves the
+	// iterator unpositioned. A nil bound means the key space is unbounded in
+	// that direction. The iterator retains references to the bound slices, so
+	// they should not be modified until the bounds are changed again or the
+	// iterator is closed.
+	//
+	// SetBounds reuses the iterator's internal state, which is cheaper than
+	// closing the iterator and creating a new one. The iterator continues to
+	// read from the snapshot of the DB taken when it was created; writes
+	// committed after that point are not visible.
+	SetBounds(lower, upper []byte)
+
+	// Clone returns a new, unpositioned iterator which reads from the same
+	// snapshot of the DB as this iterator and has the same bounds. The clone
+	// has its own position and is closed independently, so clones can be used
+	// concurrently, each in a dedicated goroutine, such as to scan disjoint
+	// ranges in parallel. The state shared by the clones is released when the
+	// last of them is closed.
+	Clone() Iterator
+
 	// Error returns any accumulated error.
 	Error() error
 
@@ -0,0 +1,89 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+import "time"
+
+// WriteStallInfo describes a write which has been stalled, waiting for
+// flushes or compactions to make room for it, for longer than
+// Options.WriteStallWarningDuration.
+type WriteStallInfo struct {
+	// Reason describes the condition stalling the write: either the memtable
+	// queue is full or L0 has reached its stop writes threshold.
+	Reason string
+	// Duration is how long the write has been stalled.
+	Duration time.Duration
+	// LevelFiles is the number of files in each level.
+	LevelFiles []int
+}
+
+// CompactionInfo describes a completed compaction which rewrote the tables
+// of a level and the overlapping tables of the next level into new tables of
+// the next level.
+type CompactionInfo struct {
+	// Level is the level compacted. The outputs are written to Level+1.
+	Level int
+	// InputBytes is the total size of the input tables of both levels, and
+	// InputLevelBytes the size of those of Level.
+	InputBytes      uint64
+	InputLevelBytes uint64
+	// OutputBytes is the total size of the output tables.
+	OutputBytes uint64
+	// Duration is the wall-clock time taken by the compaction.
+	Duration time.Duration
+}
+
+// ReadAmp returns the read amplification of the compaction: the bytes read
+// for each byte of Level compacted.
+func (i CompactionInfo) ReadAmp() float64 {
+	if i.InputLevelBytes == 0 {
+		return 0
+	}
+	return float64(i.InputBytes) / float64(i.InputLevelBytes)
+}
+
+// WriteAmp returns the write amplification of the compaction: the bytes
+// written for each byte of Level compacted.
+func (i CompactionInfo) WriteAmp() float64 {
+	if i.InputLevelBytes == 0 {
+		return 0
+	}
+	return float64(i.OutputBytes) / float64(i.InputLevelBytes)
+}
+
+// EventListener contains a set of functions that will be invoked when various
+// significant DB events occur. Note that the functions should not run for an
+// excessive amount of time as they are invoked synchronously by the DB and may
+// block continued DB work.
+type EventListener struct {
+	// TableSkipped is invoked when a data table which cannot be read is
+	// treated as empty by a read because Options.SkipCorruptTables is set, or
+	// is removed from the DB by Open for the same reason.
+	TableSkipped func(fileNum uint64, err error)
+
+	// WriteStall is invoked when a write has been stalled for longer than
+	// Options.WriteStallWarningDuration, and again each time that duration
+	// elapses until the write proceeds.
+	WriteStall func(info WriteStallInfo)
+
+	// CompactionEnd is invoked after a compaction which rewrote tables has
+	// been installed. Compactions which move a table to the next level without
+	// rewriting it are not reported.
+	CompactionEnd func(info CompactionInfo)
+}
+
+// EnsureDefaults ensures that every function in the listener is non-nil by
+// replacing unspecified functions with no-ops.
+func (l *EventListener) EnsureDefaults() {
+	if l.TableSkipped == nil {
+		l.TableSkipped = func(fileNum uint64, err error) {}
+	}
+	if l.WriteStall == nil {
+		l.WriteStall = func(info WriteStallInfo) {}
+	}
+	if l.CompactionEnd == nil {
+		l.CompactionEnd = func(info CompactionInfo) {}
+	}
+}
@@ -47,7 +47,10 @@ const (
 	InternalKeyKindDelete InternalKeyKind = 0
 	InternalKeyKindSet                    = 1
 	InternalKeyKindMerge                  = 2
-	// InternalKeyKindLogData                                  = 3
+	// InternalKeyKindLogData is only found in batches and WAL records, as an
+	// application payload which does not modify the keyspace. It is never
+	// added to a memtable or sstable.
+	InternalKeyKindLogData = 3
 	// InternalKeyKindColumnFamilyDeletion                     = 4
 	// InternalKeyKindColumnFamilyValue                        = 5
 	// InternalKeyKindColumnFamilyMerge                        = 6
@@ -63,6 +66,15 @@ const (
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
 	// InternalKeyKindBlobIndex                                = 17
 
+	// Range keys are stored separately from the point keys and range
+	// deletions, and are never compared against a search key formed with
+	// InternalKeyKindMax. Their kinds lie above InternalKeyKindMax because
+	// InternalKeyKindMax is written to the index blocks of sstables, and
+	// raising it would change the format shared with RocksDB. See
+	// InternalKeyKind.Valid.
+	InternalKeyKindRangeKeyUnset = 20
+	InternalKeyKindRangeKeySet   = 21
+
 	// This maximum value isn't part of the file format. It's unlikely,
 	// but future extensions may increase this value.
 	//
@@ -122,11 +134,13 @@ func MakeSearchKey(userKey []byte) InternalKey {
 }
 
 var kindsMap = map[string]InternalKeyKind{
-	"DEL":      InternalKeyKindDelete,
-	"RANGEDEL": InternalKeyKindRangeDelete,
-	"SET":      InternalKeyKindSet,
-	"MERGE":    InternalKeyKindMerge,
-	"MAX":      InternalKeyKindMax,
+	"DEL":           InternalKeyKindDelete,
+	"RANGEDEL":      InternalKeyKindRangeDelete,
+	"SET":           InternalKeyKindSet,
+	"MERGE":         InternalKeyKindMerge,
+	"RANGEKEYSET":   InternalKeyKindRangeKeySet,
+	"RANGEKEYUNSET": InternalKeyKindRangeKeyUnset,
+	"MAX":           InternalKeyKindMax,
 }
 
 // ParseInternalKey parses the string representation of an internal key. The
@@ -265,7 +279,17 @@ func (k InternalKey) Kind() InternalKeyKind {
 
 // Valid returns true if the key has a valid kind.
 func (k InternalKey) Valid() bool {
-	return k.Kind() <= InternalKeyKindMax
+	return k.Kind().Valid()
+}
+
+// Valid returns true if kind is a valid kind of internal key.
+func (kind InternalKeyKind) Valid() bool {
+	switch kind {
+	case InternalKeyKindRangeKeySet, InternalKeyKindRangeKeyUnset:
+		return true
+	default:
+		return kind <= InternalKeyKindMax
+	}
 }
 
 // Clone clones the storage for the UserKey component of the key.
@@ -307,6 +331,14 @@ type InternalIterator interface {
 	// than or equal to the given key.
 	SeekGE(key []byte)
 
+	// SeekPrefixGE moves the iterator to the first key/value pair whose key is
+	// greater than or equal to the given key and which has the specified
+	// prefix, as determined by Comparer.Split. An iterator may use the prefix
+	// to skip data which cannot contain it (e.g. using a prefix bloom filter),
+	// and so the iterator is only guaranteed to be positioned correctly if
+	// such a key exists. Keys which do not have the prefix may be skipped.
+	SeekPrefixGE(prefix, key []byte)
+
 	// SeekLT moves the iterator to the last key/value pair whose key is less
 	// than the given key.
 	SeekLT(key []byte)
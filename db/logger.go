@@ -0,0 +1,21 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+// Logger defines an interface for writing log messages.
+type Logger interface {
+	// Infof logs an informational message, such as a write stall or the start
+	// of a compaction.
+	Infof(format string, args ...interface{})
+
+	// Fatalf logs an unrecoverable error. The DB panics if Fatalf returns.
+	Fatalf(format string, args ...interface{})
+}
+
+// noopLogger is the default Logger, which discards all messages.
+type noopLogger struct{}
+
+func (noopLogger) Infof(format string, args ...interface{})  {}
+func (noopLogger) Fatalf(format string, args ...interface{}) {}
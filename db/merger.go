@@ -26,6 +26,18 @@ type Merge func(key, oldValue, newValue, buf []byte) []byte
 type Merger struct {
 	Merge Merge
 
+	// PartialMerge, if set, merges two merge operands when there is no base
+	// value beneath them. Compactions use it to fold a run of merge operands
+	// for a key into a single operand, which is merged with the base value by
+	// Merge when the key is read. PartialMerge must be associative, and
+	// consistent with Merge: merging a base value with the partially merged
+	// operands must produce the same value as merging it with each operand in
+	// turn. For many operators, such as integer addition, PartialMerge is the
+	// same function as Merge.
+	//
+	// The default value (nil) means Merge is used to fold merge operands.
+	PartialMerge Merge
+
 	// Name is the name of the merger.
 	//
 	// Pebble stores the merger name on disk, and opening a database with a
@@ -42,3 +54,13 @@ var DefaultMerger = &Merger{
 
 	Name: "pebble.concatenate",
 }
+
+// MergerSelector maps a key to the name of the Merger that should be used to
+// merge values for that key. Returning the empty string, or a name that was
+// not registered in Options.Mergers, selects Options.Merger.
+//
+// The selector must be deterministic: a key must always map to the same
+// merger, otherwise values merged at different times (e.g. during iteration
+// and during compaction) will be combined inconsistently. Selecting a merger
+// based on the Comparer.Split prefix of the key is a common choice.
+type MergerSelector func(key []byte) string
@@ -5,6 +5,10 @@
 package db
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/storage"
 )
@@ -16,6 +20,7 @@ const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	ZstdCompression
 	nCompression
 )
 
@@ -27,6 +32,38 @@ func (c Compression) String() string {
 		return "NoCompression"
 	case SnappyCompression:
 		return "Snappy"
+	case ZstdCompression:
+		return "ZSTD"
+	default:
+		return "Unknown"
+	}
+}
+
+// TableFormat is the format version of sstables. The format is stamped in the
+// footer of each sstable, and readers refuse tables in a format newer than the
+// ones they support.
+type TableFormat uint32
+
+// The available table formats. TableFormatRocksDBv2 is readable by RocksDB
+// and LevelDB (when no RocksDB-specific features, such as zstd compression, are
+// used). The Pebble formats carry their own magic number and version, which is
+// incremented whenever the format changes in a way older readers would
+// misinterpret.
+const (
+	TableFormatRocksDBv2 TableFormat = iota + 1
+	TableFormatPebblev1
+	nTableFormat
+
+	// TableFormatLatest is the newest table format.
+	TableFormatLatest = nTableFormat - 1
+)
+
+func (f TableFormat) String() string {
+	switch f {
+	case TableFormatRocksDBv2:
+		return "RocksDBv2"
+	case TableFormatPebblev1:
+		return "Pebblev1"
 	default:
 		return "Unknown"
 	}
@@ -86,6 +123,28 @@ type LevelOptions struct {
 	// The default value is 16.
 	BlockRestartInterval int
 
+	// BlockMinUnsharedKeyLen limits the delta encoding of keys so that at least
+	// this many trailing bytes of each key (including the 8 byte internal key
+	// trailer) are stored in its block entry, rather than shared with the
+	// previous key. Keys with very long common prefixes otherwise encode as
+	// entries which are cheap to store but expensive to decode. Capping the
+	// shared prefix trades a little space for a more uniform decode cost.
+	//
+	// The default value (0) shares the entire common prefix.
+	BlockMinUnsharedKeyLen int
+
+	// BlockPlainEncoding disables the delta encoding of keys in data blocks. A
+	// data block whose keys all have the same length, and whose values all
+	// have the same length, is written as a plain block of fixed size entries,
+	// which is binary searched by entry rather than by restart point and is
+	// cheaper to seek. Other data blocks have a restart point at every entry.
+	// Plain blocks are only written in the Pebble table formats: the option is
+	// ignored when TableFormat is TableFormatRocksDBv2, as RocksDB and LevelDB
+	// cannot read them.
+	//
+	// The default value (false) uses delta encoding.
+	BlockPlainEncoding bool
+
 	// BlockSize is the target uncompressed size in bytes of each table block.
 	//
 	// The default value is 4096.
@@ -103,6 +162,23 @@ type LevelOptions struct {
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// ZstdLevel is the zstd compression level used when Compression is
+	// ZstdCompression. Levels are interpreted as by the zstd command line tool
+	// (1 through 22), trading compression speed for ratio.
+	//
+	// The default value (0) uses level 3.
+	ZstdLevel int
+
+	// ZstdDictionary is an optional zstd dictionary, in the format produced by
+	// "zstd --train", used when Compression is ZstdCompression. Blocks
+	// compressed with a dictionary can only be decompressed if the dictionary
+	// is present in the options used to open the table. A table reader accepts
+	// the dictionaries of every level, so tables remain readable after being
+	// compacted between levels.
+	//
+	// The default value means to use no dictionary.
+	ZstdDictionary []byte
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -121,6 +197,19 @@ type LevelOptions struct {
 	// filters should be preferred except under constrained memory situations.
 	FilterType FilterType
 
+	// IndexFilter, when FilterPolicy is set and FilterType is BlockFilter, adds
+	// a table-level filter which is stored alongside the index block. A point
+	// lookup consults the index filter before searching the index, so a lookup
+	// of a key which is not in the table neither searches the index nor
+	// consults a block-level filter. Unlike the index, which only contains the
+	// separator keys between blocks, the index filter contains every key in the
+	// table, as a filter of the separator keys could not rule out the keys
+	// within a block.
+	//
+	// IndexFilter has no effect when FilterType is TableFilter, whose filter
+	// already avoids the index search.
+	IndexFilter bool
+
 	// The maximum number of bytes for the level. When the maximum number of
 	// bytes for a level is exceeded, compaction is requested.
 	MaxBytes int64
@@ -148,6 +237,9 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.ZstdLevel <= 0 {
+		o.ZstdLevel = 3
+	}
 	if o.MaxBytes <= 0 {
 		o.MaxBytes = 64 << 20 // 64 MB
 	}
@@ -161,6 +253,18 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 // apply to the DB at large; per-query options are defined by the ReadOptions
 // and WriteOptions types.
 type Options struct {
+	// BlockAlignment aligns the blocks of the sstables written by the DB, so
+	// that they can be read and written with direct I/O. Each block starts at
+	// a multiple of BlockAlignment, with zero padding between the blocks, and
+	// the table is padded before its footer so that its size is a multiple of
+	// BlockAlignment. The padding is not referenced by the block handles, so
+	// readers skip it, and tables written with an alignment are readable by
+	// any reader. The alignment is recorded in the table's properties.
+	// BlockAlignment must be a power of two.
+	//
+	// The default value (0) does not align blocks.
+	BlockAlignment int
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -179,32 +283,138 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer *Comparer
 
+	// CompactionBytesPerSecond limits the rate at which compactions write
+	// sstables, so that background I/O leaves enough bandwidth for foreground
+	// reads and writes. The limit can be changed while the DB is open with
+	// DB.SetCompactionRate.
+	//
+	// The default value (0) does not limit compactions.
+	CompactionBytesPerSecond int
+
+	// CompactionFilter is invoked for the entries written by flushes and
+	// compactions, and can drop them or change their values. See
+	// CompactionFilter.
+	//
+	// The default value (nil) keeps every entry.
+	CompactionFilter CompactionFilter
+
+	// DebugCheck enables expensive consistency checks. The commit pipeline
+	// verifies that the batches are assigned gap-free, increasing sequence
+	// numbers in the order that they are written to the WAL, and that reads
+	// never observe a partially applied batch. The sstable writer verifies
+	// that the keys of each block are strictly increasing. A failed check
+	// panics.
+	//
+	// The default value is false.
+	DebugCheck bool
+
+	// DisableWAL disables the write-ahead log. Batches are applied directly to
+	// the memtable without being written to the WAL, and Sync write options
+	// are ignored. Data which has not been flushed to sstables is lost when the
+	// DB is closed or the process crashes. This is only suitable for data that
+	// can be rebuilt, such as a cache.
+	//
+	// The default value is false.
+	DisableWAL bool
+
 	// ErrorIfDBExists is whether it is an error if the database already exists.
 	//
 	// The default value is false.
 	ErrorIfDBExists bool
 
-	// The number of files necessary to trigger an L0 compaction.
+	// EventListener provides hooks for listening to significant DB events such
+	// as skipped tables.
+	EventListener EventListener
+
+	// FlushBytesPerSecond limits the rate at which flushes write sstables.
+	// Memtables are released more slowly when flushes are limited, which can
+	// stall writes.
+	//
+	// The default value (0) does not limit flushes.
+	FlushBytesPerSecond int
+
+	// The number of files necessary to trigger an L0 compaction. This is
+	// independent of the write throttling thresholds below, and setting it
+	// lower than L0SlowdownWritesThreshold allows L0 to be compacted before
+	// writes are slowed down.
+	//
+	// The L0 thresholds must be ordered:
+	//
+	//   L0CompactionThreshold <= L0SlowdownWritesThreshold <= L0StopWritesThreshold
+	//
+	// Validate returns an error if they are not.
 	L0CompactionThreshold int
 
 	// Soft limit on the number of L0 files. Writes are slowed down when this
-	// threshold is reached.
+	// threshold is reached. Must be at least L0CompactionThreshold.
 	L0SlowdownWritesThreshold int
 
 	// Hard limit on the number of L0 files. Writes are stopped when this
-	// threshold is reached.
+	// threshold is reached. Must be at least L0SlowdownWritesThreshold.
 	L0StopWritesThreshold int
 
 	// Per-level options. Options for at least one level must be specified. The
 	// options for the last level are used for all subsequent levels.
 	Levels []LevelOptions
 
+	// Logger is used to write log messages describing significant DB activity,
+	// such as write stalls, WAL switches and compactions, and the unrecoverable
+	// errors which cause the DB to panic.
+	//
+	// The default logger discards all messages.
+	Logger Logger
+
+	// MaxKeySize is the maximum size in bytes of a key. Writes of larger keys,
+	// including the end keys of ranges, are rejected with an error.
+	//
+	// The default value (0) means keys are only limited by the requirement
+	// that a key/value pair fit within a MemTable.
+	MaxKeySize int
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
 	// The default value is 1000.
 	MaxOpenFiles int
 
+	// MaxOpenIterators is a limit on the number of iterators which are open at
+	// once. An iterator holds a reference to the version it reads, preventing
+	// the deletion of obsolete files, so a leaked iterator causes disk usage to
+	// grow without bound. Once the limit is reached, the creation of an
+	// iterator fails with ErrTooManyIterators until an open iterator is
+	// closed.
+	//
+	// The default value (0) means there is no limit.
+	MaxOpenIterators int
+
+	// MaxValueSize is the maximum size in bytes of a value. Writes of larger
+	// values are rejected with an error.
+	//
+	// The default value (0) means values are only limited by the requirement
+	// that a key/value pair fit within a MemTable.
+	MaxValueSize int
+
+	// MemTableFlushInterval bounds how long a write can remain in the mutable
+	// MemTable before it is flushed. When non-zero, the mutable MemTable is
+	// switched out and flushed once the interval has elapsed since its first
+	// write, even if it is not full.
+	//
+	// The default value (0) means MemTables are only flushed when full or when
+	// DB.Flush is called.
+	MemTableFlushInterval time.Duration
+
+	// MemTableFlushThreshold is the number of bytes of a MemTable which, once
+	// used, cause the MemTable to be switched out and flushed by the next write,
+	// provided that writes are not stopped by MemTableStopWritesThreshold or
+	// L0StopWritesThreshold. The headroom between the threshold and MemTableSize
+	// allows the writes in flight when the threshold is reached to fit in the
+	// MemTable, rather than finding it full and waiting for it to be switched
+	// out. A MemTable is still switched out when it is full.
+	//
+	// The default value is 3/4 of MemTableSize. It must not be larger than
+	// MemTableSize.
+	MemTableFlushThreshold int
+
 	// The size of a MemTable. Note that more than one MemTable can be in
 	// existence since flushing a MemTable involves creating a new one and
 	// writing the contents of the old one in the
@@ -217,16 +427,138 @@ type Options struct {
 	// the MemTable is being flushed.
 	MemTableStopWritesThreshold int
 
+	// MinFileNumber is the smallest file number the DB assigns to a new table
+	// or log file. It reserves the smaller numbers for files created by other
+	// tools, such as sstables migrated from another engine, so that they do not
+	// collide with the files the DB creates. Tables in the DB directory which
+	// are not part of the DB are deleted when it is opened, so such tables must
+	// be added by ingesting them once the DB is open. The file numbers of a DB
+	// which has already used MinFileNumber are unaffected, and the DB continues
+	// from its own file numbers when reopened without the option.
+	//
+	// The default value (0) means the DB starts numbering its files at 2. It
+	// must otherwise be at least 2.
+	MinFileNumber uint64
+
 	// Merger defines the associative merge operation to use for merging values
 	// written with {Batch,DB}.Merge.
 	//
 	// The default merger concatenates values.
 	Merger *Merger
 
+	// Mergers is a set of additional, uniquely named, merge operations which
+	// can be selected on a per-key basis by MergerSelector. Mergers is ignored
+	// if MergerSelector is nil.
+	Mergers []*Merger
+
+	// MergerSelector selects the merge operation to use for a key from
+	// Mergers. Keys for which no merger is selected use Merger.
+	//
+	// The default value (nil) means Merger is used for all keys.
+	MergerSelector MergerSelector
+
+	// MmapTables causes sstables to be memory-mapped when they are opened by
+	// the table cache. Uncompressed blocks are read directly from the mapped
+	// region rather than copied into memory, and are not added to the block
+	// cache. A mapping is released when its table is evicted from the table
+	// cache and the last iterator using the table is closed, so a table which
+	// is deleted while mapped remains readable until then. MmapTables has no
+	// effect on operating systems which do not support mmap or on Storage
+	// implementations that are not backed by the operating system.
+	//
+	// The default value is false.
+	MmapTables bool
+
+	// SkipCorruptTables is a repair mode which causes reads to treat data tables
+	// which cannot be read as empty rather than failing, so that the rest of
+	// the data can be salvaged. Skipped tables are reported to
+	// EventListener.TableSkipped. A table which becomes unreadable partway
+	// through an iteration is skipped from that point on. SkipCorruptTables
+	// never applies to the MANIFEST or WAL, nor to the inputs of a compaction,
+	// where skipping a table would silently drop its data from the DB. Tables
+	// referenced by the MANIFEST which do not exist when the DB is opened are
+	// removed from the DB and reported to EventListener.TableSkipped, rather
+	// than causing Open to fail.
+	//
+	// The default value (false) causes reads of an unreadable table to return
+	// an error.
+	SkipCorruptTables bool
+
+	// SkipCorruptWALRecords is a repair mode which causes Open to skip corrupt
+	// records wherever they appear in a WAL being replayed, resuming at the
+	// next valid record, so that the rest of the WAL can be salvaged. The
+	// writes in the skipped records are lost.
+	//
+	// The default value (false) treats a corrupt or truncated record at the
+	// tail of a WAL, such as one torn by a crash, as the end of the WAL, and
+	// causes Open to fail with a corrupt log error if corruption is followed
+	// by valid records.
+	SkipCorruptWALRecords bool
+
+	// VerifyTablesOnOpen causes Open to verify each of the live tables of the
+	// DB with sstable.Verify, which reads every block of a table and checks
+	// its checksums and structure, including the index and footer. A corrupt
+	// table is thereby detected when the DB is opened rather than by the first
+	// read which happens to touch the corrupt region, at the cost of reading
+	// the entire DB during Open. The tables are verified concurrently, with at
+	// most as many open at once as the table cache allows (see MaxOpenFiles).
+	// A corrupt table causes Open to fail, unless SkipCorruptTables is set, in
+	// which case the table is removed from the DB and reported to
+	// EventListener.TableSkipped, and its file is renamed with a ".corrupt"
+	// suffix so that it is retained for inspection.
+	//
+	// The default value is false.
+	VerifyTablesOnOpen bool
+
 	// Storage maps file names to byte storage.
 	//
 	// The default value uses the underlying operating system's file system.
 	Storage storage.Storage
+
+	// StrictWALRecovery causes Open to fail with a corrupt log error if a WAL
+	// being replayed contains any corrupt or truncated record, including a
+	// record at the tail of the WAL which was torn by a crash. Every record in
+	// the WAL is checksummed with CRC-32C over its type and payload.
+	//
+	// The default value (false) treats a corrupt or truncated record at the
+	// tail of a WAL as the end of the WAL, as a crash can tear the last write,
+	// and fails Open with a corrupt log error if corruption is followed by
+	// valid records, which a crash cannot cause. SkipCorruptWALRecords
+	// instead skips corrupt records wherever they appear. StrictWALRecovery
+	// and SkipCorruptWALRecords cannot both be set.
+	StrictWALRecovery bool
+
+	// TableFormat is the format in which new sstables are written. Existing
+	// sstables are read in whichever supported format they were written.
+	//
+	// The default value is TableFormatLatest.
+	TableFormat TableFormat
+
+	// WALDir is the directory in which the write-ahead log files are stored,
+	// such as a directory on faster storage than the tables. The tables and
+	// the MANIFEST remain in the DB directory, and the log files share the
+	// file numbers of the DB. If the WAL is moved to or from the DB directory,
+	// Open replays the logs remaining in the DB directory. The logs in a
+	// previous WALDir other than the DB directory are not searched, and Open
+	// fails with pebble.ErrMissingLog rather than losing the unflushed writes
+	// they hold.
+	//
+	// The default value ("") stores the WAL in the DB directory.
+	WALDir string
+
+	// WALStorage maps the names of the files in WALDir to byte storage.
+	//
+	// The default value uses Storage.
+	WALStorage storage.Storage
+
+	// WriteStallWarningDuration is how long a write may wait for flushes or
+	// compactions to make room for it before the stall is reported to Logger
+	// and EventListener.WriteStall. The report describes the cause of the
+	// stall and the number of files in each level, and is repeated each time
+	// the duration elapses until the write proceeds.
+	//
+	// The default value (0) disables the reports.
+	WriteStallWarningDuration time.Duration
 }
 
 // EnsureDefaults ensures that the default values for all options are set if a
@@ -241,6 +573,7 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
+	o.EventListener.EnsureDefaults()
 	if o.L0CompactionThreshold <= 0 {
 		o.L0CompactionThreshold = 4
 	}
@@ -265,12 +598,18 @@ func (o *Options) EnsureDefaults() *Options {
 			o.Levels[i] = *o.Levels[i].EnsureDefaults()
 		}
 	}
+	if o.Logger == nil {
+		o.Logger = noopLogger{}
+	}
 	if o.MaxOpenFiles == 0 {
 		o.MaxOpenFiles = 1000
 	}
 	if o.MemTableSize <= 0 {
 		o.MemTableSize = 4 << 20
 	}
+	if o.MemTableFlushThreshold <= 0 {
+		o.MemTableFlushThreshold = o.MemTableSize - o.MemTableSize/4
+	}
 	if o.MemTableStopWritesThreshold <= 0 {
 		o.MemTableStopWritesThreshold = 2
 	}
@@ -280,9 +619,116 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Storage == nil {
 		o.Storage = storage.Default
 	}
+	if o.TableFormat == 0 {
+		o.TableFormat = TableFormatLatest
+	}
+	if o.WALStorage == nil {
+		o.WALStorage = o.Storage
+	}
 	return o
 }
 
+// Validate verifies that the options are mutually consistent and that the
+// required fields are set, returning an error naming each offending field.
+// Validate is normally called after EnsureDefaults.
+func (o *Options) Validate() error {
+	var errs []string
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if o.Comparer == nil {
+		add("Comparer must be specified")
+	} else if o.Comparer.Compare == nil || o.Comparer.Name == "" {
+		add("Comparer must specify Compare and Name")
+	}
+	if o.Merger == nil {
+		add("Merger must be specified")
+	}
+	if o.MergerSelector != nil {
+		names := make(map[string]bool, len(o.Mergers))
+		for i, m := range o.Mergers {
+			switch {
+			case m == nil || m.Merge == nil || m.Name == "":
+				add("Mergers[%d] must specify Merge and Name", i)
+			case names[m.Name]:
+				add("Mergers[%d] has duplicate name %q", i, m.Name)
+			default:
+				names[m.Name] = true
+			}
+		}
+	}
+	if o.Storage == nil {
+		add("Storage must be specified")
+	}
+	if o.WALStorage == nil {
+		add("WALStorage must be specified")
+	}
+	if o.TableFormat == 0 || o.TableFormat >= nTableFormat {
+		add("TableFormat (%d) is not a known table format", o.TableFormat)
+	}
+	if len(o.Levels) == 0 {
+		add("Levels must contain at least one level")
+	}
+	if o.MaxOpenFiles <= 0 {
+		add("MaxOpenFiles (%d) must be positive", o.MaxOpenFiles)
+	}
+	if o.StrictWALRecovery && o.SkipCorruptWALRecords {
+		add("StrictWALRecovery and SkipCorruptWALRecords cannot both be set")
+	}
+	if o.BlockAlignment < 0 || o.BlockAlignment&(o.BlockAlignment-1) != 0 {
+		add("BlockAlignment (%d) must be 0 or a power of two", o.BlockAlignment)
+	}
+	if o.CompactionBytesPerSecond < 0 {
+		add("CompactionBytesPerSecond (%d) must not be negative", o.CompactionBytesPerSecond)
+	}
+	if o.FlushBytesPerSecond < 0 {
+		add("FlushBytesPerSecond (%d) must not be negative", o.FlushBytesPerSecond)
+	}
+	if o.MaxKeySize < 0 {
+		add("MaxKeySize (%d) must not be negative", o.MaxKeySize)
+	}
+	if o.MaxValueSize < 0 {
+		add("MaxValueSize (%d) must not be negative", o.MaxValueSize)
+	}
+	if o.MemTableSize <= 0 {
+		add("MemTableSize (%d) must be positive", o.MemTableSize)
+	}
+	if o.MemTableFlushThreshold <= 0 || o.MemTableFlushThreshold > o.MemTableSize {
+		add("MemTableFlushThreshold (%d) must be positive and not larger than MemTableSize (%d)",
+			o.MemTableFlushThreshold, o.MemTableSize)
+	}
+	if o.WriteStallWarningDuration < 0 {
+		add("WriteStallWarningDuration (%s) must not be negative", o.WriteStallWarningDuration)
+	}
+	if o.MemTableFlushInterval < 0 {
+		add("MemTableFlushInterval (%s) must not be negative", o.MemTableFlushInterval)
+	}
+	if o.MinFileNumber == 1 {
+		add("MinFileNumber (%d) must be 0 or at least 2", o.MinFileNumber)
+	}
+	if o.MemTableStopWritesThreshold < 2 {
+		add("MemTableStopWritesThreshold (%d) must be at least 2",
+			o.MemTableStopWritesThreshold)
+	}
+	if o.L0CompactionThreshold <= 0 {
+		add("L0CompactionThreshold (%d) must be positive", o.L0CompactionThreshold)
+	}
+	if o.L0SlowdownWritesThreshold < o.L0CompactionThreshold {
+		add("L0SlowdownWritesThreshold (%d) must be at least L0CompactionThreshold (%d)",
+			o.L0SlowdownWritesThreshold, o.L0CompactionThreshold)
+	}
+	if o.L0StopWritesThreshold < o.L0SlowdownWritesThreshold {
+		add("L0StopWritesThreshold (%d) must be at least L0SlowdownWritesThreshold (%d)",
+			o.L0StopWritesThreshold, o.L0SlowdownWritesThreshold)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("pebble/db: invalid options: %s", strings.Join(errs, "; "))
+}
+
 // Level returns the LevelOptions for the specified level.
 func (o *Options) Level(level int) LevelOptions {
 	if level < len(o.Levels) {
@@ -306,16 +752,25 @@ type IterOptions struct {
 	// return during iteration. If the iterator is seeked or iterated past this
 	// boundary the iterator will return Valid()==false. Setting LowerBound
 	// effectively truncates the key space visible to the iterator.
-	//
-	// TODO(peter): unimplemented.
 	LowerBound []byte
 	// UpperBound specifies the largest key (exclusive) that the iterator will
 	// return during iteration. If the iterator is seeked or iterated past this
 	// boundary the iterator will return Valid()==false. Setting UpperBound
 	// effectively truncates the key space visible to the iterator.
-	//
-	// TODO(peter): unimplemented.
 	UpperBound []byte
+	// AscendingSeeks is a hint that the keys passed to successive calls to
+	// SeekGE will usually be increasing, as in a merge join. When set, a seek
+	// for a key shortly after the current position steps forward from the
+	// current position rather than binary searching the table's index and
+	// data blocks. Callers with other access patterns should leave it unset
+	// to avoid paying for the extra comparisons.
+	AscendingSeeks bool
+	// DontFillCache specifies that the table blocks read by the iterator are
+	// not added to the block cache (Options.Cache). Blocks already in the cache
+	// are still used. It is intended for large scans, such as a full scan of
+	// the DB, which would otherwise evict the blocks used by point lookups and
+	// other short reads from the cache.
+	DontFillCache bool
 	// TableFilter can be used to filter the tables that are scanned during
 	// iteration based on the user properties. Return true to scan the table and
 	// false to skip scanning.
@@ -351,3 +806,43 @@ var NoSync = &WriteOptions{Sync: false}
 func (o *WriteOptions) GetSync() bool {
 	return o == nil || o.Sync
 }
+
+// MergeFunc returns the merge function to use for resolving merge operations,
+// consulting MergerSelector, if set, to choose between Merger and Mergers on a
+// per-key basis.
+func (o *Options) MergeFunc() Merge {
+	return o.mergeFunc(func(m *Merger) Merge {
+		return m.Merge
+	})
+}
+
+// PartialMergeFunc returns the merge function to use for folding merge
+// operands which have no base value beneath them, choosing the merger for a
+// key as MergeFunc does. The Merge of a merger is used in place of an unset
+// PartialMerge.
+func (o *Options) PartialMergeFunc() Merge {
+	return o.mergeFunc(func(m *Merger) Merge {
+		if m.PartialMerge != nil {
+			return m.PartialMerge
+		}
+		return m.Merge
+	})
+}
+
+func (o *Options) mergeFunc(fn func(m *Merger) Merge) Merge {
+	if o.MergerSelector == nil || len(o.Mergers) == 0 {
+		return fn(o.Merger)
+	}
+	selector := o.MergerSelector
+	defaultMerge := fn(o.Merger)
+	mergers := make(map[string]Merge, len(o.Mergers))
+	for _, m := range o.Mergers {
+		mergers[m.Name] = fn(m)
+	}
+	return func(key, oldValue, newValue, buf []byte) []byte {
+		if merge, ok := mergers[selector(key)]; ok {
+			return merge(key, oldValue, newValue, buf)
+		}
+		return defaultMerge(key, oldValue, newValue, buf)
+	}
+}
@@ -5,6 +5,7 @@
 package db
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -37,3 +38,97 @@ func TestLevelOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestOptionsValidate(t *testing.T) {
+	var opts *Options
+	if err := opts.EnsureDefaults().Validate(); err != nil {
+		t.Fatalf("default options: %v", err)
+	}
+
+	// A small MaxOpenFiles is valid, as the table cache is never smaller than
+	// a minimum size.
+	if err := (&Options{MaxOpenFiles: 20}).EnsureDefaults().Validate(); err != nil {
+		t.Fatalf("MaxOpenFiles=20: %v", err)
+	}
+
+	testCases := []struct {
+		modify func(o *Options)
+		fields []string
+	}{
+		{
+			func(o *Options) { o.MemTableStopWritesThreshold = 1 },
+			[]string{"MemTableStopWritesThreshold"},
+		},
+		{
+			func(o *Options) { o.L0StopWritesThreshold = o.L0SlowdownWritesThreshold - 1 },
+			[]string{"L0StopWritesThreshold"},
+		},
+		{
+			func(o *Options) { o.L0SlowdownWritesThreshold = o.L0CompactionThreshold - 1 },
+			[]string{"L0SlowdownWritesThreshold"},
+		},
+		{
+			func(o *Options) { o.L0CompactionThreshold = 0 },
+			[]string{"L0CompactionThreshold"},
+		},
+		{
+			func(o *Options) { o.BlockAlignment = 12 },
+			[]string{"BlockAlignment"},
+		},
+		{
+			func(o *Options) { o.MaxOpenFiles = -20 },
+			[]string{"MaxOpenFiles"},
+		},
+		{
+			func(o *Options) { o.MemTableFlushThreshold = o.MemTableSize + 1 },
+			[]string{"MemTableFlushThreshold"},
+		},
+		{
+			func(o *Options) { o.MinFileNumber = 1 },
+			[]string{"MinFileNumber"},
+		},
+		{
+			func(o *Options) { o.TableFormat = TableFormatLatest + 1 },
+			[]string{"TableFormat"},
+		},
+		{
+			func(o *Options) {
+				o.Mergers = []*Merger{DefaultMerger, DefaultMerger}
+				o.MergerSelector = func(key []byte) string { return "" }
+			},
+			[]string{"Mergers[1]"},
+		},
+		{
+			func(o *Options) {
+				o.StrictWALRecovery = true
+				o.SkipCorruptWALRecords = true
+			},
+			[]string{"StrictWALRecovery"},
+		},
+		{
+			func(o *Options) { o.WALStorage = nil },
+			[]string{"WALStorage"},
+		},
+		{
+			func(o *Options) {
+				o.Comparer = nil
+				o.Storage = nil
+				o.MaxOpenFiles = -1
+			},
+			[]string{"Comparer", "Storage", "MaxOpenFiles"},
+		},
+	}
+	for i, c := range testCases {
+		o := (&Options{}).EnsureDefaults()
+		c.modify(o)
+		err := o.Validate()
+		if err == nil {
+			t.Fatalf("%d: expected an error, but found none", i)
+		}
+		for _, f := range c.fields {
+			if !strings.Contains(err.Error(), f) {
+				t.Fatalf("%d: expected %s in error, but found %v", i, f, err)
+			}
+		}
+	}
+}
@@ -5,7 +5,11 @@
 package pebble
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sort"
+	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -19,9 +23,19 @@ const (
 )
 
 type dbIter struct {
-	cmp      db.Compare
-	merge    db.Merge
-	iter     db.InternalIterator
+	// db, batch, memtables and opts are the state captured when the iterator
+	// was created, from which Clone constructs additional iterators.
+	db        *DB
+	batch     *Batch
+	memtables []*memTable
+	opts      *db.IterOptions
+
+	cmp   db.Compare
+	split db.Split
+	merge db.Merge
+	iter  db.InternalIterator
+	// seqNum is the snapshot sequence number. Only entries with smaller
+	// sequence numbers (or batch sequence numbers) are visible.
 	seqNum   uint64
 	version  *version
 	err      error
@@ -29,8 +43,22 @@ type dbIter struct {
 	keyBuf   []byte
 	value    []byte
 	valueBuf []byte
-	valid    bool
-	pos      dbIterPos
+	// versions holds the visible versions of the user key read by
+	// findPrevEntry, whose values are stored in valueBuf.
+	versions []dbIterVersion
+	// lower and upper are the optional inclusive lower and exclusive upper
+	// bounds on the keys returned by the iterator.
+	lower []byte
+	upper []byte
+	// prefix is non-nil when the iterator was positioned by SeekPrefixGE, in
+	// which case iteration is limited to keys with the prefix.
+	prefix []byte
+	valid  bool
+	pos    dbIterPos
+	// rangeKeys holds the fragments of the range keys visible to the
+	// iterator, which are loaded by the first call to RangeKeys.
+	rangeKeys       []db.RangeKey
+	rangeKeysLoaded bool
 }
 
 var _ db.Iterator = (*dbIter)(nil)
@@ -41,13 +69,9 @@ func (i *dbIter) findNextEntry() bool {
 
 	for i.iter.Valid() {
 		key := i.iter.Key()
-		if seqNum := key.SeqNum(); seqNum > i.seqNum {
-			// Ignore entries that are newer than our snapshot sequence number,
-			// except for batch sequence numbers which are always visible.
-			if (seqNum & db.InternalKeySeqNumBatch) == 0 {
-				i.iter.Next()
-				continue
-			}
+		if !i.visible(key) {
+			i.iter.Next()
+			continue
 		}
 		switch key.Kind() {
 		case db.InternalKeyKindDelete:
@@ -63,6 +87,12 @@ func (i *dbIter) findNextEntry() bool {
 		case db.InternalKeyKindMerge:
 			return i.mergeNext()
 
+		case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+			// Range keys are only present in the iterator of an indexed batch,
+			// and are surfaced by RangeKeys rather than as point keys.
+			i.iter.Next()
+			continue
+
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
 			return false
@@ -72,87 +102,127 @@ func (i *dbIter) findNextEntry() bool {
 	return false
 }
 
+// findPrevEntry moves to the newest visible version of the user key at or
+// before the internal iterator's position, skipping user keys which are
+// deleted. The versions of a user key are not returned in a consistent order
+// during reverse iteration: the memtable returns them from newest to oldest,
+// as specified by db.InternalIterator, but an sstable returns them from
+// oldest to newest, and the merging iterator interleaves the versions from
+// its inputs. So every version of the user key is read, leaving the internal
+// iterator positioned before the user key, and the versions are then
+// resolved from newest to oldest.
 func (i *dbIter) findPrevEntry() bool {
 	i.valid = false
 	i.pos = dbIterCur
 
 	for i.iter.Valid() {
 		key := i.iter.Key()
-		if seqNum := key.SeqNum(); seqNum > i.seqNum {
-			// Ignore entries that are newer than our snapshot sequence number,
-			// except for batch sequence numbers which are always visible.
-			if (seqNum & db.InternalKeySeqNumBatch) == 0 {
-				i.iter.Prev()
-				continue
+		i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+		i.valueBuf = i.valueBuf[:0]
+		i.versions = i.versions[:0]
+		for {
+			if i.visible(key) {
+				switch key.Kind() {
+				case db.InternalKeyKindDelete, db.InternalKeyKindSet, db.InternalKeyKindMerge:
+					start := len(i.valueBuf)
+					i.valueBuf = append(i.valueBuf, i.iter.Value()...)
+					i.versions = append(i.versions, dbIterVersion{
+						trailer: key.Trailer,
+						start:   start,
+						end:     len(i.valueBuf),
+					})
+				case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+					// Range keys do not affect the point keys.
+				default:
+					i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
+					return false
+				}
+			}
+			if !i.iter.Prev() {
+				if i.err = i.iter.Error(); i.err != nil {
+					return false
+				}
+				break
+			}
+			key = i.iter.Key()
+			if i.cmp(key.UserKey, i.keyBuf) != 0 {
+				break
 			}
 		}
-		switch key.Kind() {
-		case db.InternalKeyKindDelete:
-			i.iter.PrevUserKey()
-			continue
-
-		case db.InternalKeyKindSet:
-			i.key = key.UserKey
-			i.value = i.iter.Value()
-			i.valid = true
+		i.pos = dbIterPrev
+		if i.resolveVersions() {
 			return true
-
-		case db.InternalKeyKindMerge:
-			return i.mergePrev()
-
-		default:
-			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
-			return false
 		}
 	}
 
 	return false
 }
 
-func (i *dbIter) mergeNext() bool {
-	// Save the current key and value.
-	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
-	i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
-	i.key, i.value = i.keyBuf, i.valueBuf
-	i.valid = true
+// dbIterVersion is a visible version of a user key read by findPrevEntry. Its
+// value is valueBuf[start:end].
+type dbIterVersion struct {
+	trailer    uint64
+	start, end int
+}
 
-	// Loop looking for older values for this key and merging them.
-	for {
-		i.iter.Next()
-		if !i.iter.Valid() {
-			i.pos = dbIterNext
-			return true
-		}
-		key := i.iter.Key()
-		if i.cmp(i.key, key.UserKey) != 0 {
-			// We've advanced to the next key.
-			i.pos = dbIterNext
-			return true
-		}
-		switch key.Kind() {
+// visible returns true if the entry with the specified key is visible at the
+// iterator's sequence number, which is exclusive: a snapshot taken from the
+// visible sequence number is one past the sequence number of the most
+// recently published write. The entries at the visible sequence number belong
+// to a batch which may not have been entirely applied, and are not visible
+// until it is published, so a reader never observes part of a batch. The
+// entries of an indexed batch have batch sequence numbers, which are always
+// visible.
+func (i *dbIter) visible(key db.InternalKey) bool {
+	seqNum := key.SeqNum()
+	return seqNum < i.seqNum || (seqNum&db.InternalKeySeqNumBatch) != 0
+}
+
+// resolveVersions sets the key and value of the iterator from the versions of
+// the user key in keyBuf read by findPrevEntry, returning false if the user
+// key is deleted (or has no visible versions).
+func (i *dbIter) resolveVersions() bool {
+	versions := i.versions
+	if len(versions) > 1 {
+		sort.Slice(versions, func(a, b int) bool {
+			return versions[a].trailer > versions[b].trailer
+		})
+	}
+	for j, v := range versions {
+		value := i.valueBuf[v.start:v.end]
+		switch db.InternalKeyKind(v.trailer & 0xff) {
 		case db.InternalKeyKindDelete:
-			// We've hit a deletion tombstone. Return everything up to this
-			// point.
+			if j == 0 {
+				return false
+			}
+			// We've hit a deletion tombstone. Return everything newer.
 			return true
 
 		case db.InternalKeyKindSet:
+			if j == 0 {
+				i.key, i.value = i.keyBuf, value
+				i.valid = true
+				return true
+			}
 			// We've hit a Set value. Merge with the existing value and return.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
+			i.value = i.merge(i.key, i.value, value, nil)
 			return true
 
 		case db.InternalKeyKindMerge:
+			if j == 0 {
+				i.key, i.value = i.keyBuf, value
+				i.valid = true
+				continue
+			}
 			// We've hit another Merge value. Merge with the existing value and
 			// continue looping.
-			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
-
-		default:
-			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
-			return false
+			i.value = i.merge(i.key, i.value, value, nil)
 		}
 	}
+	return i.valid
 }
 
-func (i *dbIter) mergePrev() bool {
+func (i *dbIter) mergeNext() bool {
 	// Save the current key and value.
 	i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
 	i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
@@ -161,15 +231,21 @@ func (i *dbIter) mergePrev() bool {
 
 	// Loop looking for older values for this key and merging them.
 	for {
-		i.iter.Prev()
+		i.iter.Next()
 		if !i.iter.Valid() {
-			i.pos = dbIterPrev
+			if i.err = i.iter.Error(); i.err != nil {
+				// The older values of the key could not be read, so the merged
+				// value is incomplete.
+				i.valid = false
+				return false
+			}
+			i.pos = dbIterNext
 			return true
 		}
 		key := i.iter.Key()
 		if i.cmp(i.key, key.UserKey) != 0 {
-			// We've advanced to the previous key.
-			i.pos = dbIterPrev
+			// We've advanced to the next key.
+			i.pos = dbIterNext
 			return true
 		}
 		switch key.Kind() {
@@ -188,6 +264,9 @@ func (i *dbIter) mergePrev() bool {
 			// continue looping.
 			i.value = i.merge(i.key, i.value, i.iter.Value(), nil)
 
+		case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+			// Range keys do not affect the point keys.
+
 		default:
 			i.err = fmt.Errorf("invalid internal key kind: %d", key.Kind())
 			return false
@@ -195,36 +274,102 @@ func (i *dbIter) mergePrev() bool {
 	}
 }
 
+// checkPrefix invalidates the iterator if it was positioned by SeekPrefixGE and
+// the current key does not have the prefix.
+func (i *dbIter) checkPrefix() bool {
+	if i.valid && i.prefix != nil && !bytes.HasPrefix(i.key, i.prefix) {
+		i.valid = false
+	}
+	return i.valid
+}
+
+// checkUpperBound invalidates the iterator if the current key is at or past
+// the upper bound, or does not have the SeekPrefixGE prefix.
+func (i *dbIter) checkUpperBound() bool {
+	if i.valid && i.upper != nil && i.cmp(i.key, i.upper) >= 0 {
+		i.valid = false
+	}
+	return i.checkPrefix()
+}
+
+// checkLowerBound invalidates the iterator if the current key is before the
+// lower bound, or does not have the SeekPrefixGE prefix.
+func (i *dbIter) checkLowerBound() bool {
+	if i.valid && i.lower != nil && i.cmp(i.key, i.lower) < 0 {
+		i.valid = false
+	}
+	return i.checkPrefix()
+}
+
 func (i *dbIter) SeekGE(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.prefix = nil
+	if i.lower != nil && i.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
 	i.iter.SeekGE(key)
 	i.findNextEntry()
+	i.checkUpperBound()
+}
+
+func (i *dbIter) SeekPrefixGE(key []byte) {
+	if i.err != nil {
+		return
+	}
+	if i.split == nil {
+		i.SeekGE(key)
+		return
+	}
+	i.prefix = append(i.prefix[:0], key[:i.split(key)]...)
+	if i.lower != nil && i.cmp(key, i.lower) < 0 {
+		key = i.lower
+	}
+	i.iter.SeekPrefixGE(i.prefix, key)
+	i.findNextEntry()
+	i.checkUpperBound()
 }
 
 func (i *dbIter) SeekLT(key []byte) {
 	if i.err != nil {
 		return
 	}
+	i.prefix = nil
+	if i.upper != nil && i.cmp(key, i.upper) > 0 {
+		key = i.upper
+	}
 	i.iter.SeekLT(key)
 	i.findPrevEntry()
+	i.checkLowerBound()
 }
 
 func (i *dbIter) First() {
 	if i.err != nil {
 		return
 	}
-	i.iter.First()
+	i.prefix = nil
+	if i.lower != nil {
+		i.iter.SeekGE(i.lower)
+	} else {
+		i.iter.First()
+	}
 	i.findNextEntry()
+	i.checkUpperBound()
 }
 
 func (i *dbIter) Last() {
 	if i.err != nil {
 		return
 	}
-	i.iter.Last()
+	i.prefix = nil
+	if i.upper != nil {
+		i.iter.SeekLT(i.upper)
+	} else {
+		i.iter.Last()
+	}
 	i.findPrevEntry()
+	i.checkLowerBound()
 }
 
 func (i *dbIter) Next() bool {
@@ -239,22 +384,43 @@ func (i *dbIter) Next() bool {
 		i.iter.NextUserKey()
 	case dbIterNext:
 	}
-	return i.findNextEntry()
+	i.findNextEntry()
+	return i.checkUpperBound()
 }
 
 func (i *dbIter) Prev() bool {
 	if i.err != nil {
 		return false
 	}
+	// Move the internal iterator before the current user key. The versions of
+	// the current user key are skipped one at a time, as PrevUserKey is
+	// unreliable when the versions of a user key are not returned from newest
+	// to oldest (see findPrevEntry).
 	switch i.pos {
 	case dbIterCur:
-		i.iter.PrevUserKey()
+		if !i.iter.Valid() {
+			i.iter.Prev()
+			break
+		}
+		i.keyBuf = append(i.keyBuf[:0], i.iter.Key().UserKey...)
+		i.prevUserKey()
 	case dbIterNext:
-		i.iter.PrevUserKey()
-		i.iter.PrevUserKey()
+		i.keyBuf = append(i.keyBuf[:0], i.key...)
+		i.prevUserKey()
 	case dbIterPrev:
 	}
-	return i.findPrevEntry()
+	i.findPrevEntry()
+	return i.checkLowerBound()
+}
+
+// prevUserKey moves the internal iterator to the last entry before the user
+// key in keyBuf.
+func (i *dbIter) prevUserKey() {
+	for i.iter.Prev() {
+		if i.cmp(i.iter.Key().UserKey, i.keyBuf) < 0 {
+			return
+		}
+	}
 }
 
 func (i *dbIter) Key() []byte {
@@ -269,14 +435,71 @@ func (i *dbIter) Valid() bool {
 	return i.valid
 }
 
+func (i *dbIter) RangeKeys() []db.RangeKey {
+	if !i.valid {
+		return nil
+	}
+	if !i.rangeKeysLoaded {
+		// TODO(peter): The range keys are read in their entirety when first
+		// requested. Track the range keys covering the current position as the
+		// iterator advances instead.
+		i.rangeKeysLoaded = true
+		if i.db != nil && i.version != nil {
+			var err error
+			i.rangeKeys, err = i.db.loadRangeKeys(i.batch, i.seqNum, i.memtables, i.version)
+			if err != nil {
+				i.err = err
+				i.valid = false
+				return nil
+			}
+		}
+	}
+	return findRangeKeys(i.cmp, i.rangeKeys, i.key)
+}
+
+func (i *dbIter) SetBounds(lower, upper []byte) {
+	i.lower = lower
+	i.upper = upper
+	i.prefix = nil
+	i.key = nil
+	i.value = nil
+	i.valid = false
+	i.pos = dbIterCur
+}
+
+func (i *dbIter) Clone() db.Iterator {
+	if i.err != nil {
+		return &dbIter{err: i.err}
+	}
+	if i.version == nil {
+		return &dbIter{err: errors.New("pebble: iterator is closed")}
+	}
+	if err := i.db.acquireIter(); err != nil {
+		return &dbIter{err: err}
+	}
+	// The clone holds its own reference to the version, so the version's files
+	// are not deleted until every clone has been closed.
+	i.version.ref()
+	return i.db.finishInitializingIter(
+		i.batch, i.seqNum, i.version, i.memtables, i.lower, i.upper, i.opts)
+}
+
 func (i *dbIter) Error() error {
+	if i.err == nil && i.iter != nil {
+		return i.iter.Error()
+	}
 	return i.err
 }
 
 func (i *dbIter) Close() error {
+	if i.iter != nil {
+		i.err = firstError(i.err, i.iter.Close())
+		i.iter = nil
+	}
 	if i.version != nil {
 		i.version.unref()
 		i.version = nil
+		atomic.AddInt32(&i.db.openIters, -1)
 	}
 	return i.err
 }
@@ -10,11 +10,14 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/petermattis/pebble/datadriven"
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestDBIter(t *testing.T) {
@@ -51,7 +54,10 @@ func TestDBIter(t *testing.T) {
 				return err.Error()
 			}
 
-			iter := newIter(uint64(seqNum))
+			// The entries with sequence numbers up to and including seq are
+			// visible. The iterator's snapshot sequence number is one past
+			// the most recent visible entry.
+			iter := newIter(uint64(seqNum) + 1)
 			var b bytes.Buffer
 			for _, line := range strings.Split(d.Input, "\n") {
 				parts := strings.Fields(line)
@@ -69,6 +75,28 @@ func TestDBIter(t *testing.T) {
 						return fmt.Sprintf("seek-lt <key>\n")
 					}
 					iter.SeekLT([]byte(strings.TrimSpace(parts[1])))
+				case "first":
+					iter.First()
+				case "last":
+					iter.Last()
+				case "set-bounds":
+					if len(parts) <= 1 || len(parts) > 3 {
+						return fmt.Sprintf("set-bounds lower=<lower> upper=<upper>\n")
+					}
+					var lower, upper []byte
+					for _, part := range parts[1:] {
+						arg := strings.Split(strings.TrimSpace(part), "=")
+						switch arg[0] {
+						case "lower":
+							lower = []byte(arg[1])
+						case "upper":
+							upper = []byte(arg[1])
+						default:
+							return fmt.Sprintf("set-bounds: unknown arg: %s", arg)
+						}
+					}
+					iter.SetBounds(lower, upper)
+					continue
 				case "next":
 					iter.Next()
 				case "prev":
@@ -143,3 +171,106 @@ func BenchmarkDBIterPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func TestDBIterClone(t *testing.T) {
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold: 2,
+		Storage:               storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Spread the keys across sstables and the memtable.
+	const numKeys = 1000
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if i%300 == 299 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	iter := d.NewIter(nil)
+	clones := []db.Iterator{iter.Clone(), iter.Clone()}
+	v := iter.(*dbIter).version
+	if refs := atomic.LoadInt32(&v.refs); refs < 3 {
+		t.Fatalf("expected at least 3 version refs, but found %d", refs)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Writes after the iterator was created are not visible to the clones,
+	// even once they have been flushed and compacted.
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Delete(key, nil); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if err := d.Set([]byte("extra"), nil, nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Scan the two halves of the key space concurrently.
+	mid := []byte(fmt.Sprintf("%04d", numKeys/2))
+	var wg sync.WaitGroup
+	results := make([][]string, len(clones))
+	errs := make([]error, len(clones))
+	for j := range clones {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			it := clones[j]
+			if j == 0 {
+				it.SetBounds(nil, mid)
+			} else {
+				it.SetBounds(mid, nil)
+			}
+			for it.First(); it.Valid(); it.Next() {
+				results[j] = append(results[j], string(it.Key()))
+			}
+			errs[j] = it.Close()
+		}(j)
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for j := range clones {
+		if errs[j] != nil {
+			t.Fatalf("%d: %v", j, errs[j])
+		}
+		for _, key := range results[j] {
+			seen[key]++
+		}
+	}
+	if len(seen) != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, len(seen))
+	}
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("%04d", i)
+		if n := seen[key]; n != 1 {
+			t.Fatalf("expected %s once, but found it %d times", key, n)
+		}
+	}
+	if refs := atomic.LoadInt32(&v.refs); refs != 0 {
+		t.Fatalf("expected 0 version refs, but found %d", refs)
+	}
+
+	// Cloning a closed iterator returns an error.
+	if err := iter.Clone().Close(); err == nil {
+		t.Fatalf("expected error cloning a closed iterator")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
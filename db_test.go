@@ -7,15 +7,22 @@ package pebble
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -413,3 +420,2813 @@ func TestRandomWrites(t *testing.T) {
 		t.Fatalf("db Close: %v", err)
 	}
 }
+
+func TestLargeWrites(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MemTableSize: 8 * 1024,
+		MaxKeySize:   100,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 16*1024)
+	if err := d.Set([]byte("a"), large, nil); err != ErrValueTooLarge {
+		t.Fatalf("Set: expected %v, but found %v", ErrValueTooLarge, err)
+	}
+	if err := d.Merge([]byte("a"), large, nil); err != ErrValueTooLarge {
+		t.Fatalf("Merge: expected %v, but found %v", ErrValueTooLarge, err)
+	}
+	if err := d.Set(large[:101], nil, nil); err != ErrKeyTooLarge {
+		t.Fatalf("Set: expected %v, but found %v", ErrKeyTooLarge, err)
+	}
+	if err := d.Delete(large[:101], nil); err != ErrKeyTooLarge {
+		t.Fatalf("Delete: expected %v, but found %v", ErrKeyTooLarge, err)
+	}
+
+	// The error surfaces when the entry is added to the batch, and the batch
+	// is left unmodified.
+	b := d.NewBatch()
+	if err := b.Set([]byte("a"), large, nil); err != ErrValueTooLarge {
+		t.Fatalf("Batch.Set: expected %v, but found %v", ErrValueTooLarge, err)
+	}
+	if len(b.data) != 0 {
+		t.Fatalf("expected empty batch, but found %d bytes", len(b.data))
+	}
+
+	// An entry that fits in an empty memtable is accepted, even though it
+	// requires switching out the current memtable.
+	if err := d.Set([]byte("b"), large[:4*1024], nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Set([]byte("c"), large[:6*1024], nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if v, err := d.Get([]byte("c")); err != nil {
+		t.Fatalf("Get: %v", err)
+	} else if len(v) != 6*1024 {
+		t.Fatalf("expected %d bytes, but found %d", 6*1024, len(v))
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestLargeRangeWrites(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MaxKeySize:   100,
+		MaxValueSize: 10,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// The end key of a range is limited by MaxKeySize, not MaxValueSize.
+	large := bytes.Repeat([]byte("z"), 101)
+	if err := d.DeleteRange([]byte("a"), large[:50], nil); err != nil {
+		t.Fatalf("DeleteRange: %v", err)
+	}
+	if err := d.DeleteRange([]byte("a"), large, nil); err != ErrKeyTooLarge {
+		t.Fatalf("DeleteRange: expected %v, but found %v", ErrKeyTooLarge, err)
+	}
+	if err := d.RangeKeySet([]byte("a"), large[:50], []byte("v"), nil); err != nil {
+		t.Fatalf("RangeKeySet: %v", err)
+	}
+	if err := d.RangeKeySet([]byte("a"), large, []byte("v"), nil); err != ErrKeyTooLarge {
+		t.Fatalf("RangeKeySet: expected %v, but found %v", ErrKeyTooLarge, err)
+	}
+	if err := d.RangeKeySet([]byte("a"), []byte("b"), large[:11], nil); err != ErrValueTooLarge {
+		t.Fatalf("RangeKeySet: expected %v, but found %v", ErrValueTooLarge, err)
+	}
+	if err := d.RangeKeyUnset([]byte("a"), large, nil); err != ErrKeyTooLarge {
+		t.Fatalf("RangeKeyUnset: expected %v, but found %v", ErrKeyTooLarge, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLargeBatch(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MemTableSize: 8 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Each entry fits in a memtable, but the batch as a whole does not.
+	value := bytes.Repeat([]byte("x"), 1024)
+	b := d.NewBatch()
+	for i := 0; i < 16; i++ {
+		if err := b.Set([]byte(fmt.Sprintf("%02d", i)), value, nil); err != nil {
+			t.Fatalf("Batch.Set: %v", err)
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.Commit(nil)
+	}()
+	select {
+	case err := <-errCh:
+		if err != ErrBatchTooLarge {
+			t.Fatalf("Commit: expected %v, but found %v", ErrBatchTooLarge, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out committing a batch larger than the memtable")
+	}
+
+	// None of the batch was applied, and the DB is still writable.
+	if _, err := d.Get([]byte("00")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if err := d.Set([]byte("a"), value, nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestMakeRoomForWriteBatchTooLarge(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:      storage.NewMem(),
+		MemTableSize: 8 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// A batch which is not associated with the DB is not checked as entries
+	// are added, and a single entry larger than an empty memtable reaches
+	// makeRoomForWrite. Switching memtables cannot make room for it, so it is
+	// rejected without switching.
+	var b Batch
+	if err := b.Set([]byte("a"), bytes.Repeat([]byte("x"), 16*1024), nil); err != nil {
+		t.Fatalf("Batch.Set: %v", err)
+	}
+	d.mu.Lock()
+	logNumber := d.mu.log.number
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.makeRoomForWrite(&b)
+	}()
+	select {
+	case err := <-errCh:
+		if err != ErrBatchTooLarge {
+			t.Fatalf("expected %v, but found %v", ErrBatchTooLarge, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out making room for a batch larger than the memtable")
+	}
+	if d.mu.log.number != logNumber || len(d.mu.mem.queue) != 1 {
+		t.Fatalf("expected no memtable switch, but found WAL %06d (was %06d) and %d memtables",
+			d.mu.log.number, logNumber, len(d.mu.mem.queue))
+	}
+	d.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestMergers(t *testing.T) {
+	sumMerger := &db.Merger{
+		Merge: func(key, oldValue, newValue, buf []byte) []byte {
+			a, _ := strconv.Atoi(string(oldValue))
+			b, _ := strconv.Atoi(string(newValue))
+			return strconv.AppendInt(buf, int64(a+b), 10)
+		},
+		Name: "test.sum",
+	}
+	listMerger := &db.Merger{
+		Merge: func(key, oldValue, newValue, buf []byte) []byte {
+			buf = append(append(buf, oldValue...), ',')
+			return append(buf, newValue...)
+		},
+		Name: "test.list",
+	}
+
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		Mergers: []*db.Merger{sumMerger, listMerger},
+		MergerSelector: func(key []byte) string {
+			switch {
+			case bytes.HasPrefix(key, []byte("count/")):
+				return sumMerger.Name
+			case bytes.HasPrefix(key, []byte("list/")):
+				return listMerger.Name
+			}
+			return ""
+		},
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	merge := func(key, value string) {
+		if err := d.Merge([]byte(key), []byte(value), nil); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+	}
+	merge("count/a", "1")
+	merge("count/a", "2")
+	merge("list/a", "x")
+	merge("list/a", "y")
+	merge("other", "p")
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	merge("count/a", "3")
+	merge("count/a", "4")
+	merge("list/a", "z")
+	merge("other", "q")
+
+	// The order in which operands are combined is not specified, so sort the
+	// elements of the merged lists before comparing them.
+	normalize := func(key string, value []byte) string {
+		switch {
+		case strings.HasPrefix(key, "list/"):
+			elems := strings.Split(string(value), ",")
+			sort.Strings(elems)
+			return strings.Join(elems, ",")
+		case key == "other":
+			b := []byte(value)
+			sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+			return string(b)
+		}
+		return string(value)
+	}
+	expected := map[string]string{
+		"count/a": "10",
+		"list/a":  "x,y,z",
+		"other":   "pq",
+	}
+
+	for key, want := range expected {
+		value, err := d.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		if got := normalize(key, value); got != want {
+			t.Fatalf("Get(%q): expected %q, but found %q", key, want, got)
+		}
+	}
+
+	iter := d.NewIter(nil)
+	found := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if got := normalize(key, iter.Value()); got != expected[key] {
+			t.Fatalf("iter %q: expected %q, but found %q", key, expected[key], got)
+		}
+		found++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if found != len(expected) {
+		t.Fatalf("expected %d keys, but found %d", len(expected), found)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestGetInternal(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	get := func(key string) (string, uint64, db.InternalKeyKind) {
+		t.Helper()
+		value, seqNum, kind, err := d.GetInternal([]byte(key))
+		if err != nil {
+			t.Fatalf("GetInternal(%q): %v", key, err)
+		}
+		return string(value), seqNum, kind
+	}
+	check := func(key, expectedValue string, expectedKind db.InternalKeyKind) uint64 {
+		t.Helper()
+		value, seqNum, kind := get(key)
+		if value != expectedValue || kind != expectedKind {
+			t.Fatalf("GetInternal(%q): expected %q (%d), but found %q (%d)",
+				key, expectedValue, expectedKind, value, kind)
+		}
+		return seqNum
+	}
+
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	seq1 := check("a", "1", db.InternalKeyKindSet)
+	if err := d.Set([]byte("a"), []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	seq2 := check("a", "2", db.InternalKeyKindSet)
+	if err := d.Set([]byte("a"), []byte("3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	seq3 := check("a", "3", db.InternalKeyKindSet)
+	if !(seq1 < seq2 && seq2 < seq3) {
+		t.Fatalf("expected increasing sequence numbers, but found %d, %d, %d", seq1, seq2, seq3)
+	}
+
+	if err := d.Set([]byte("b"), []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Merge([]byte("b"), []byte("y"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The merged value is the same as that returned by Get.
+	merged, err := d.Get([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqMerge := check("b", string(merged), db.InternalKeyKindMerge)
+	if seqMerge <= seq3 {
+		t.Fatalf("expected merge sequence number > %d, but found %d", seq3, seqMerge)
+	}
+
+	// The sequence numbers are preserved once the entries are in a table.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := check("a", "3", db.InternalKeyKindSet); s != seq3 {
+		t.Fatalf("expected sequence number %d after flush, but found %d", seq3, s)
+	}
+	// A flush may resolve the merge operands into a Set, but the sequence number
+	// remains that of the most recent operand.
+	if v, s, _ := get("b"); v != string(merged) || s != seqMerge {
+		t.Fatalf("expected %q#%d after flush, but found %q#%d", merged, seqMerge, v, s)
+	}
+
+	if err := d.Delete([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := d.GetInternal([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if _, _, _, err := d.GetInternal([]byte("c")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestIterSetBounds(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if i == 50 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	iter := d.NewIter(&db.IterOptions{
+		LowerBound: []byte("010"),
+		UpperBound: []byte("020"),
+	})
+
+	// Writes committed after the iterator was created are not visible, even
+	// after the bounds are changed.
+	if err := d.Set([]byte("045a"), nil, nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	scan := func(start []byte) []string {
+		var keys []string
+		for iter.SeekGE(start); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	if got := scan(nil); len(got) != 10 || got[0] != "010" || got[9] != "019" {
+		t.Fatalf("expected [010,019], but found %v", got)
+	}
+
+	for i := 0; i < 90; i += 7 {
+		lower := []byte(fmt.Sprintf("%03d", i))
+		upper := []byte(fmt.Sprintf("%03d", i+5))
+		iter.SetBounds(lower, upper)
+		if iter.Valid() {
+			t.Fatalf("expected SetBounds to invalidate the iterator")
+		}
+		got := scan([]byte("000"))
+		if len(got) != 5 || got[0] != string(lower) || got[4] != fmt.Sprintf("%03d", i+4) {
+			t.Fatalf("[%s,%s): unexpected keys %v", lower, upper, got)
+		}
+	}
+
+	iter.SetBounds(nil, nil)
+	if got := scan([]byte("045")); len(got) != 55 || got[1] != "046" {
+		t.Fatalf("expected [045,099], but found %v", got)
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestIterDontFillCache(t *testing.T) {
+	opts := &db.Options{
+		Storage: storage.NewMem(),
+		Levels: []db.LevelOptions{{
+			BlockSize:      256,
+			Compression:    db.NoCompression,
+			TargetFileSize: 1 << 20,
+		}},
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write the keys to a table below level 0, which is read using a
+	// levelIter, and overwrite half of them in a table in level 0.
+	write := func(step int) {
+		for i := 0; i < 1000; i += step {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if err := d.Set(key, bytes.Repeat(key, 4), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	write(1)
+	d.mu.Lock()
+	l0 := []uint64{d.mu.versions.currentVersion().files[0][0].fileNum}
+	d.mu.Unlock()
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	write(2)
+
+	// Reopen the DB with an empty cache.
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	c := cache.New(1 << 20)
+	opts.Cache = c
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var tableSize int64
+	for _, l := range d.Metrics().Levels {
+		tableSize += int64(l.Size)
+	}
+
+	scan := func(o *db.IterOptions) {
+		iter := d.NewIter(o)
+		n := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if n != 1000 {
+			t.Fatalf("expected 1000 keys, but found %d", n)
+		}
+	}
+
+	// The first scan opens the tables, which caches their index blocks but
+	// none of the data blocks.
+	dontFill := &db.IterOptions{DontFillCache: true}
+	scan(dontFill)
+	size := c.Size()
+	if size*4 > tableSize {
+		t.Fatalf("expected the cache to hold only the index blocks, but found %d of %d bytes",
+			size, tableSize)
+	}
+	scan(dontFill)
+	if s := c.Size(); s != size {
+		t.Fatalf("expected the cache size to remain %d, but found %d", size, s)
+	}
+	// A scan which fills the cache adds the data blocks.
+	scan(nil)
+	if s := c.Size(); s*4 < tableSize*3 {
+		t.Fatalf("expected the cache to hold the data blocks, but found %d of %d bytes",
+			s, tableSize)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestMemTableFlushInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	d, err := Open("", &db.Options{
+		Storage:               storage.NewMem(),
+		MemTableFlushInterval: interval,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	numL0 := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.versions.currentVersion().files[0])
+	}
+
+	// A slow writer never fills the memtable, but each write is flushed to L0
+	// shortly after the interval elapses.
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := d.Set([]byte(strconv.Itoa(i)), nil, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		err := try(time.Millisecond, 10*time.Second, func() error {
+			if n := numL0(); n != i+1 {
+				return fmt.Errorf("expected %d L0 tables, but found %d", i+1, n)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < interval {
+			t.Fatalf("flushed after %s, before the %s interval", elapsed, interval)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestMemTableFlushThreshold(t *testing.T) {
+	const (
+		memTableSize = 64 << 10
+		threshold    = 16 << 10
+	)
+	d, err := Open("", &db.Options{
+		Storage:                storage.NewMem(),
+		MemTableSize:           memTableSize,
+		MemTableFlushThreshold: threshold,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Each memtable is switched out by the first write after it reaches the
+	// flush threshold, well before its arena is full. The writes wait for the
+	// previous flush and compaction so that switching out the memtable never
+	// requires waiting, in which case the memtable would be filled instead.
+	value := bytes.Repeat([]byte("x"), 1024)
+	var switched int
+	for i := 0; i < 100; i++ {
+		d.mu.Lock()
+		for len(d.mu.mem.queue) > 1 || d.mu.compact.flushing || d.mu.compact.compacting {
+			d.mu.compact.cond.Wait()
+		}
+		mem := d.mu.mem.mutable
+		d.mu.Unlock()
+		if err := d.Set([]byte(fmt.Sprintf("%03d", i)), value, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		d.mu.Lock()
+		if d.mu.mem.mutable != mem {
+			switched++
+			if size := mem.skl.Arena().Size(); size < threshold || size > threshold+2*1024 {
+				t.Fatalf("expected memtable to be switched out at %d bytes, but found %d",
+					threshold, size)
+			}
+		}
+		d.mu.Unlock()
+	}
+	if switched < 5 {
+		t.Fatalf("expected at least 5 memtable switches, but found %d", switched)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%03d", i)
+		if v, err := d.Get([]byte(key)); err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("%s: expected value, but found %v", key, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestEstimateDiskUsage(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Create three level-0 tables with disjoint key ranges: [a0, a9], [b0, b9]
+	// and [c0, c9].
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("%s%d", prefix, i))
+			if err := d.Set(key, bytes.Repeat(key, 100), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[0]
+	d.mu.Unlock()
+	if len(files) != 3 {
+		t.Fatalf("expected 3 L0 tables, but found %d", len(files))
+	}
+	sizes := map[string]uint64{}
+	for _, f := range files {
+		sizes[string(f.smallest.UserKey[:1])] = f.size
+	}
+
+	testCases := []struct {
+		start, end string
+		expected   uint64
+	}{
+		{"a", "b", sizes["a"]},
+		{"b", "c", sizes["b"]},
+		{"c", "d", sizes["c"]},
+		{"a", "c", sizes["a"] + sizes["b"]},
+		{"", "z", sizes["a"] + sizes["b"] + sizes["c"]},
+		{"a0", "c9\x00", sizes["a"] + sizes["b"] + sizes["c"]},
+		{"d", "z", 0},
+		{"b", "b", 0},
+	}
+	for _, c := range testCases {
+		size, err := d.EstimateDiskUsage([]byte(c.start), []byte(c.end))
+		if err != nil {
+			t.Fatalf("EstimateDiskUsage: %v", err)
+		}
+		if size != c.expected {
+			t.Errorf("[%q, %q): expected %d, but found %d", c.start, c.end, c.expected, size)
+		}
+	}
+
+	// A partially overlapping table contributes a fraction of its size.
+	size, err := d.EstimateDiskUsage([]byte("a5"), []byte("b"))
+	if err != nil {
+		t.Fatalf("EstimateDiskUsage: %v", err)
+	}
+	if size == 0 || size >= sizes["a"] {
+		t.Errorf("expected a partial estimate in (0, %d), but found %d", sizes["a"], size)
+	}
+
+	if _, err := d.EstimateDiskUsage([]byte("b"), []byte("a")); err == nil {
+		t.Fatalf("expected error for an inverted range")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestSkipCorruptTables(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Create two level 1 tables, one containing "a" and one containing "b".
+	var fileNums []uint64
+	for _, key := range []string{"a", "b"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		meta := d.mu.versions.currentVersion().files[0][0]
+		err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+			deletedFiles: map[deletedFileEntry]bool{
+				deletedFileEntry{level: 0, fileNum: meta.fileNum}: true,
+			},
+			newFiles: []newFileEntry{
+				{level: 1, meta: meta},
+			},
+		})
+		d.mu.Unlock()
+		if err != nil {
+			t.Fatalf("logAndApply: %v", err)
+		}
+		fileNums = append(fileNums, meta.fileNum)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+
+	// Corrupt the data block of the table containing "a".
+	filename := dbFilename("", fileTypeTable, fileNums[0])
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	data := make([]byte, stat.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data[0] ^= 0xff
+	f, err = fs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	scan := func(d *DB) (string, error) {
+		var keys []string
+		iter := d.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return strings.Join(keys, " "), iter.Close()
+	}
+
+	// By default, reads of the corrupt table fail.
+	d, err = Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := d.Get([]byte("a")); err == nil || err == db.ErrNotFound {
+		t.Fatalf("expected a corruption error, but found %v", err)
+	}
+	if _, err := scan(d); err == nil {
+		t.Fatalf("expected a corruption error")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+
+	// When skipping corrupt tables, the keys in the other tables are still
+	// readable and the corrupt table is reported.
+	var skipped []uint64
+	d, err = Open("", &db.Options{
+		EventListener: db.EventListener{
+			TableSkipped: func(fileNum uint64, err error) {
+				skipped = append(skipped, fileNum)
+			},
+		},
+		SkipCorruptTables: true,
+		Storage:           fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+	if v, err := d.Get([]byte("b")); err != nil {
+		t.Fatalf("Get: %v", err)
+	} else if string(v) != "b" {
+		t.Fatalf("expected b, but found %s", v)
+	}
+	if keys, err := scan(d); err != nil {
+		t.Fatalf("scan: %v", err)
+	} else if keys != "b" {
+		t.Fatalf("expected b, but found %s", keys)
+	}
+	if len(skipped) == 0 {
+		t.Fatalf("expected the corrupt table to be reported")
+	}
+	for _, fileNum := range skipped {
+		if fileNum != fileNums[0] {
+			t.Fatalf("expected table %d to be skipped, but found %d", fileNums[0], fileNum)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+var errInjected = errors.New("injected error")
+
+// readErrorFS is a Storage whose file reads and opens fail with errInjected
+// once fail is set.
+type readErrorFS struct {
+	storage.Storage
+	fail int32 // atomic
+}
+
+func (fs *readErrorFS) Open(name string) (storage.File, error) {
+	if atomic.LoadInt32(&fs.fail) != 0 {
+		return nil, errInjected
+	}
+	f, err := fs.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readErrorFile{f, fs}, nil
+}
+
+type readErrorFile struct {
+	storage.File
+	fs *readErrorFS
+}
+
+func (f readErrorFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&f.fs.fail) != 0 {
+		return 0, errInjected
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestIterReadError(t *testing.T) {
+	testCases := []struct {
+		name string
+		// merge writes the keys as merge operands rather than values.
+		merge bool
+		// failAt is the number of keys read before the reads start failing.
+		failAt int
+	}{
+		// The reads of the data blocks of the first table fail.
+		{"block", false, 100},
+		{"merge", true, 100},
+		// The opening of the second table fails.
+		{"open", false, 500},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			fs := &readErrorFS{Storage: storage.NewMem()}
+			d, err := Open("", &db.Options{
+				Levels: []db.LevelOptions{{
+					BlockSize:      256,
+					TargetFileSize: 1 << 20,
+				}},
+				Storage: fs,
+			})
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+
+			// Create two level 1 tables of 500 keys each, spanning many blocks.
+			var fileNums []uint64
+			for _, prefix := range []string{"a", "b"} {
+				for i := 0; i < 500; i++ {
+					key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+					write := d.Set
+					if c.merge {
+						write = d.Merge
+					}
+					if err := write(key, key, nil); err != nil {
+						t.Fatalf("write: %v", err)
+					}
+				}
+				if err := d.Flush(); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+				d.mu.Lock()
+				meta := d.mu.versions.currentVersion().files[0][0]
+				err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+					deletedFiles: map[deletedFileEntry]bool{
+						deletedFileEntry{level: 0, fileNum: meta.fileNum}: true,
+					},
+					newFiles: []newFileEntry{
+						{level: 1, meta: meta},
+					},
+				})
+				d.mu.Unlock()
+				if err != nil {
+					t.Fatalf("logAndApply: %v", err)
+				}
+				fileNums = append(fileNums, meta.fileNum)
+			}
+			// Ensure that the second table is opened by the scan.
+			d.tableCache.evict(fileNums[1])
+
+			// The scan stops at the injected error, which is returned by Error
+			// and Close, and the iterator is never valid once an error occurs.
+			iter := d.NewIter(nil)
+			n := 0
+			for iter.First(); iter.Valid(); iter.Next() {
+				if err := iter.Error(); err != nil {
+					t.Fatalf("%s: valid iterator with error %v", iter.Key(), err)
+				}
+				n++
+				if n == c.failAt {
+					atomic.StoreInt32(&fs.fail, 1)
+				}
+			}
+			if n >= 1000 {
+				t.Fatalf("expected the scan to stop at the error, but found %d keys", n)
+			}
+			if err := iter.Error(); err != errInjected {
+				t.Fatalf("expected %v, but found %v", errInjected, err)
+			}
+			if err := iter.Close(); err != errInjected {
+				t.Fatalf("expected %v from Close, but found %v", errInjected, err)
+			}
+
+			atomic.StoreInt32(&fs.fail, 0)
+			if err := d.Close(); err != nil {
+				t.Fatalf("db Close: %v", err)
+			}
+		})
+	}
+}
+
+func TestAsyncFlush(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// There is nothing to flush, so the channel is already closed.
+	flushed, err := d.AsyncFlush()
+	if err != nil {
+		t.Fatalf("AsyncFlush: %v", err)
+	}
+	select {
+	case <-flushed:
+	default:
+		t.Fatalf("expected the flush of an empty memtable to have completed")
+	}
+
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	flushed, err = d.AsyncFlush()
+	if err != nil {
+		t.Fatalf("AsyncFlush: %v", err)
+	}
+	select {
+	case <-flushed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the flush")
+	}
+
+	d.mu.Lock()
+	n := len(d.mu.versions.currentVersion().files[0])
+	d.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 L0 table, but found %d", n)
+	}
+
+	// Flush of an empty memtable does not block.
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestFlushQueued(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:                     storage.NewMem(),
+		MemTableStopWritesThreshold: 4,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Hold a reference on the first memtable, as a batch being applied to it
+	// would, so that it and the memtables queued behind it cannot be flushed.
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	d.mu.Lock()
+	held := d.mu.mem.mutable
+	held.ref()
+	d.mu.Unlock()
+	for _, key := range []string{"b", "c"} {
+		if _, err := d.AsyncFlush(); err != nil {
+			t.Fatalf("AsyncFlush: %v", err)
+		}
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	queue := append([]*memTable(nil), d.mu.mem.queue...)
+	d.mu.Unlock()
+	if len(queue) != 3 {
+		t.Fatalf("expected 3 memtables, but found %d", len(queue))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Flush()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Flush to wait for the queued memtables, but it returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if held.unref() {
+		d.mu.Lock()
+		d.maybeScheduleFlush()
+		d.mu.Unlock()
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the flush")
+	}
+
+	// Every memtable queued when Flush was called has been flushed, and its data
+	// is in L0.
+	for i, mem := range queue {
+		select {
+		case <-mem.flushed:
+		default:
+			t.Fatalf("expected memtable %d to have been flushed", i)
+		}
+	}
+	d.mu.Lock()
+	n := len(d.mu.mem.queue)
+	empty := d.mu.mem.mutable.Empty()
+	d.mu.Unlock()
+	if n != 1 || !empty {
+		t.Fatalf("expected only an empty mutable memtable, but found %d memtables", n)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+			t.Fatalf("%s: expected %s, but found %q (%v)", key, key, v, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestFlushTargetFileSize(t *testing.T) {
+	const targetFileSize = 16 << 10
+	d, err := Open("", &db.Options{
+		// Avoid compactions of the flushed tables.
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+		Levels: []db.LevelOptions{{
+			TargetFileSize: targetFileSize,
+		}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const numKeys = 2000
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < numKeys; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%06d", i)), value, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[0]
+	d.mu.Unlock()
+	if len(files) <= 1 {
+		t.Fatalf("expected multiple L0 tables, but found %d", len(files))
+	}
+
+	// The tables are appropriately sized, and their key ranges are contiguous
+	// and cover every key.
+	next := 0
+	for i, f := range files {
+		if i < len(files)-1 && f.size > 2*targetFileSize {
+			t.Fatalf("table %d: size %d is much larger than the target %d", i, f.size, targetFileSize)
+		}
+		if s, e := string(f.smallest.UserKey), fmt.Sprintf("%06d", next); s != e {
+			t.Fatalf("table %d: expected smallest key %s, but found %s", i, e, s)
+		}
+		last, err := strconv.Atoi(string(f.largest.UserKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last < next {
+			t.Fatalf("table %d: inconsistent bounds %s-%s", i, f.smallest, f.largest)
+		}
+		next = last + 1
+	}
+	if next != numKeys {
+		t.Fatalf("expected the tables to end at key %d, but found %d", numKeys-1, next-1)
+	}
+
+	for i := 0; i < numKeys; i += 97 {
+		key := []byte(fmt.Sprintf("%06d", i))
+		if v, err := d.Get(key); err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		} else if !bytes.Equal(v, value) {
+			t.Fatalf("Get(%s): unexpected value", key)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("db Close: %v", err)
+	}
+}
+
+func TestGetMergedSnapshot(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		Merger: &db.Merger{
+			Merge: func(key, oldValue, newValue, buf []byte) []byte {
+				a, _ := strconv.Atoi(string(oldValue))
+				b, _ := strconv.Atoi(string(newValue))
+				return strconv.AppendInt(buf, int64(a+b), 10)
+			},
+			Name: "test.sum",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, v := range []string{"1", "2"} {
+		if err := d.Merge([]byte("a"), []byte(v), nil); err != nil {
+			t.Fatalf("Merge: %v", err)
+		}
+	}
+
+	// Capture the state read by Get, and then merge another operand and flush
+	// it, which changes both the memtables and the version.
+	d.mu.Lock()
+	snapshot := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	memtables := d.mu.mem.queue
+	d.mu.Unlock()
+	if err := d.Merge([]byte("a"), []byte("3"), nil); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// The operands are resolved as of the captured state.
+	value, err := d.getMerged([]byte("a"), snapshot, current, memtables)
+	current.unref()
+	if err != nil || string(value) != "3" {
+		t.Fatalf("expected 3, but found %q (%v)", value, err)
+	}
+	if value, err := d.Get([]byte("a")); err != nil || string(value) != "6" {
+		t.Fatalf("expected 6, but found %q (%v)", value, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestSeekPrefixGE(t *testing.T) {
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	}
+	d, err := Open("", &db.Options{
+		Comparer: &comparer,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+			FilterType:   db.TableFilter,
+		}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, k := range []string{"a@1", "a@2", "b@1", "b@2", "c@1"} {
+		if err := d.Set([]byte(k), nil, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	testCases := []struct {
+		key      string
+		expected string
+	}{
+		{"a", "a@1 a@2"},
+		{"b@", "b@1 b@2"},
+		{"b@2", "b@2"},
+		{"bb@", ""},
+		{"c", "c@1"},
+		{"d", ""},
+	}
+	for _, c := range testCases {
+		iter := d.NewIter(nil)
+		var keys []string
+		for iter.SeekPrefixGE([]byte(c.key)); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(keys, " "); got != c.expected {
+			t.Errorf("%s: expected %q, but found %q", c.key, c.expected, got)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestDisableWAL(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		DisableWAL: true,
+		Storage:    mem,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if err := d.Set(key, key, db.Sync); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Delete([]byte("000"), db.Sync); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Sequence numbers are assigned as if the batches had been logged.
+	if seqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum); seqNum != numKeys+1 {
+		t.Fatalf("expected visible sequence number %d, but found %d", numKeys+1, seqNum)
+	}
+
+	// The data is visible.
+	if _, err := d.Get([]byte("000")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	for i := 1; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%03d", i))
+		if v, err := d.Get(key); err != nil || !bytes.Equal(v, key) {
+			t.Fatalf("Get %s: expected %s, but found %s (%v)", key, key, v, err)
+		}
+	}
+
+	// No log records were written.
+	checkLogs := func() {
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, filename := range ls {
+			if ft, _, ok := parseDBFilename(filename); !ok || ft != fileTypeLog {
+				continue
+			}
+			stat, err := mem.Stat(filename)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if stat.Size() != 0 {
+				t.Fatalf("expected empty log %s, but found %d bytes", filename, stat.Size())
+			}
+		}
+	}
+	checkLogs()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkLogs()
+
+	// The unflushed data is lost on reopening.
+	d, err = Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := d.Get([]byte("001")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestNewIterAtSeqNum(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write the key three times, flushing the first two versions to sstables
+	// so that the historical reads go through both sstables and the memtable.
+	values := []string{"v1", "v2", "v3"}
+	var seqNums []uint64
+	for i, v := range values {
+		if err := d.Set([]byte("a"), []byte(v), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if i < 2 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+		seqNums = append(seqNums, atomic.LoadUint64(&d.mu.versions.visibleSeqNum))
+	}
+
+	get := func(seqNum uint64) (string, error) {
+		iter := d.NewIterAtSeqNum(seqNum, nil)
+		var s string
+		for iter.First(); iter.Valid(); iter.Next() {
+			s += fmt.Sprintf("%s:%s ", iter.Key(), iter.Value())
+		}
+		return strings.TrimSpace(s), iter.Close()
+	}
+	for i, seqNum := range seqNums {
+		s, err := get(seqNum)
+		if err != nil {
+			t.Fatalf("%d: %v", seqNum, err)
+		}
+		if expected := "a:" + values[i]; s != expected {
+			t.Fatalf("%d: expected %q, but found %q", seqNum, expected, s)
+		}
+	}
+
+	// Nothing is visible before the first write.
+	if s, err := get(seqNums[0] - 1); err != nil || s != "" {
+		t.Fatalf("expected nothing, but found %q (%v)", s, err)
+	}
+
+	// Sequence numbers which have not been written yet are rejected.
+	if _, err := get(seqNums[2] + 1); err == nil {
+		t.Fatalf("expected error for a future sequence number")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestReverseComparer(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		Comparer:              db.ReverseComparer,
+		L0CompactionThreshold: 2,
+		Storage:               mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write, overwrite and delete random keys across several flushes, so that
+	// the keys end up in the memtable, in L0 and in the compacted levels.
+	//
+	// TODO(peter): Each key is written at most once per flush as tables
+	// containing multiple versions of a key are not handled by reverse
+	// iteration (see blockIter.PrevUserKey).
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	model := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		for _, k := range rng.Perm(1000)[:200] {
+			key := fmt.Sprintf("%04d", k)
+			if rng.Intn(10) == 0 {
+				if err := d.Delete([]byte(key), nil); err != nil {
+					t.Fatalf("Delete: %v", err)
+				}
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("%s.%d", key, i)
+			if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			model[key] = value
+		}
+		if i < 7 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+	d.mu.Lock()
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	current := d.mu.versions.currentVersion()
+	if err := current.checkOrdering(d.cmp); err != nil {
+		d.mu.Unlock()
+		t.Fatalf("version ordering: %v", err)
+	}
+	var compacted int
+	for level := 1; level < numLevels; level++ {
+		compacted += len(current.files[level])
+	}
+	d.mu.Unlock()
+	if compacted == 0 {
+		t.Fatalf("expected compacted tables")
+	}
+
+	// The keys sorted in descending byte order.
+	var keys []string
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	check := func(d *DB) {
+		t.Helper()
+
+		for _, k := range keys {
+			v, err := d.Get([]byte(k))
+			if err != nil || string(v) != model[k] {
+				t.Fatalf("Get %s: expected %s, but found %s (%v)", k, model[k], v, err)
+			}
+		}
+
+		iter := d.NewIter(nil)
+		var forward []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			if v := string(iter.Value()); v != model[string(iter.Key())] {
+				t.Fatalf("%s: expected %s, but found %s", iter.Key(), model[string(iter.Key())], v)
+			}
+			forward = append(forward, string(iter.Key()))
+		}
+		if strings.Join(forward, ",") != strings.Join(keys, ",") {
+			t.Fatalf("expected forward iteration\n%s\nbut found\n%s", keys, forward)
+		}
+		var backward []string
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			backward = append(backward, string(iter.Key()))
+		}
+		for i, j := 0, len(backward)-1; i < j; i, j = i+1, j-1 {
+			backward[i], backward[j] = backward[j], backward[i]
+		}
+		if strings.Join(backward, ",") != strings.Join(keys, ",") {
+			t.Fatalf("expected backward iteration\n%s\nbut found\n%s", keys, backward)
+		}
+
+		// Seeks use the reverse ordering: SeekGE finds the first key which is
+		// <= the seek key in byte order.
+		search := func(key string) int {
+			return sort.Search(len(keys), func(i int) bool { return keys[i] <= key })
+		}
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("%04d", rng.Intn(1000))
+			iter.SeekGE([]byte(key))
+			expected := "."
+			if j := search(key); j < len(keys) {
+				expected = keys[j]
+			}
+			found := "."
+			if iter.Valid() {
+				found = string(iter.Key())
+			}
+			if expected != found {
+				t.Fatalf("SeekGE(%s): expected %s, but found %s", key, expected, found)
+			}
+
+			iter.SeekLT([]byte(key))
+			expected = "."
+			if j := search(key); j > 0 {
+				expected = keys[j-1]
+			}
+			found = "."
+			if iter.Valid() {
+				found = string(iter.Key())
+			}
+			if expected != found {
+				t.Fatalf("SeekLT(%s): expected %s, but found %s", key, expected, found)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		// The disk usage of a range is bounded by the usage of the whole
+		// keyspace, which begins at the largest key in byte order.
+		all, err := d.EstimateDiskUsage([]byte("9999"), []byte("/"))
+		if err != nil {
+			t.Fatalf("EstimateDiskUsage: %v", err)
+		}
+		part, err := d.EstimateDiskUsage([]byte("0700"), []byte("0300"))
+		if err != nil {
+			t.Fatalf("EstimateDiskUsage: %v", err)
+		}
+		if all == 0 || part == 0 || part >= all {
+			t.Fatalf("expected 0 < %d < %d", part, all)
+		}
+	}
+	check(d)
+
+	// The ordering is preserved when the DB is reopened.
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(d)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestMVCCComparer(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Comparer: db.MVCCComparer,
+		Levels: []db.LevelOptions{{
+			BlockSize:      128,
+			TargetFileSize: 1 << 20,
+		}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write 5 versions of each of 50 user keys, in random order, through an
+	// indexed batch, with some versions flushed to L0 and some left in the
+	// memtable. The small blocks produce many index separators.
+	const versions = 5
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var writes [][2]int
+	for k := 0; k < 50; k++ {
+		for ts := 1; ts <= versions; ts++ {
+			writes = append(writes, [2]int{k, ts})
+		}
+	}
+	rng.Shuffle(len(writes), func(i, j int) {
+		writes[i], writes[j] = writes[j], writes[i]
+	})
+	mvccKey := func(k, ts int) []byte {
+		return db.MakeMVCCKey(nil, []byte(fmt.Sprintf("key%02d", k)), uint64(ts))
+	}
+	for i := 0; i < len(writes); i += 50 {
+		b := d.NewIndexedBatch()
+		for _, w := range writes[i : i+50] {
+			if err := b.Set(mvccKey(w[0], w[1]), []byte(fmt.Sprintf("%d@%d", w[0], w[1])), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Apply(b, nil); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		if i < 150 {
+			if err := d.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	// Forward and backward iteration visit the user keys in ascending order and
+	// the versions of each user key newest first.
+	var expected []string
+	for k := 0; k < 50; k++ {
+		for ts := versions; ts >= 1; ts-- {
+			expected = append(expected, fmt.Sprintf("%d@%d", k, ts))
+		}
+	}
+	iter := d.NewIter(nil)
+	var forward []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		forward = append(forward, string(iter.Value()))
+	}
+	if strings.Join(forward, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected forward iteration\n%s\nbut found\n%s", expected, forward)
+	}
+	var backward []string
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		backward = append(backward, string(iter.Value()))
+	}
+	for i, j := 0, len(backward)-1; i < j; i, j = i+1, j-1 {
+		backward[i], backward[j] = backward[j], backward[i]
+	}
+	if strings.Join(backward, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected backward iteration\n%s\nbut found\n%s", expected, backward)
+	}
+
+	// Seeking to a timestamp finds the newest version no newer than it, and
+	// seeking above the newest version finds the newest version.
+	for k := 0; k < 50; k++ {
+		for ts := 1; ts <= versions+1; ts++ {
+			want := ts
+			if want > versions {
+				want = versions
+			}
+			if iter.SeekGE(mvccKey(k, ts)); !iter.Valid() || string(iter.Value()) != fmt.Sprintf("%d@%d", k, want) {
+				t.Fatalf("seek %d@%d: expected %d@%d, but found %q", k, ts, k, want, iter.Value())
+			}
+		}
+		if v, err := d.Get(mvccKey(k, 3)); err != nil || string(v) != fmt.Sprintf("%d@3", k) {
+			t.Fatalf("Get %d@3: found %q (%v)", k, v, err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const numKeys = 100
+	const numGens = 10
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%03d", i))
+	}
+	write := func(gen int) error {
+		for i := 0; i < numKeys; i++ {
+			if err := d.Set(key(i), []byte(fmt.Sprintf("key%03d-gen%d", i, gen)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(0); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Overwrite the keys and flush them in the background, which also
+	// triggers compactions of level 0, while the values are read.
+	errCh := make(chan error, 1)
+	go func() {
+		for gen := 1; gen <= numGens; gen++ {
+			if err := write(gen); err != nil {
+				errCh <- err
+				return
+			}
+			if err := d.Flush(); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	type read struct {
+		value    []byte
+		expected string
+	}
+	var reads []read
+	for done := false; !done; {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+		}
+		i := len(reads) % numKeys
+		value, err := d.Get(key(i))
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		valueCopy, err := d.GetCopy(key(i))
+		if err != nil {
+			t.Fatalf("GetCopy: %v", err)
+		}
+		prefix := fmt.Sprintf("key%03d-gen", i)
+		if !strings.HasPrefix(string(value), prefix) || !strings.HasPrefix(string(valueCopy), prefix) {
+			t.Fatalf("expected %s*, but found %s and %s", prefix, value, valueCopy)
+		}
+		reads = append(reads, read{value, string(value)}, read{valueCopy, string(valueCopy)})
+	}
+
+	// The values are unchanged by the flushes and compactions which happened
+	// after they were read.
+	for _, r := range reads {
+		if string(r.value) != r.expected {
+			t.Fatalf("expected %s, but found %s", r.expected, r.value)
+		}
+	}
+
+	// Modifying a copy does not modify the DB's value.
+	for i := 0; i < numKeys; i++ {
+		valueCopy, err := d.GetCopy(key(i))
+		if err != nil {
+			t.Fatalf("GetCopy: %v", err)
+		}
+		for j := range valueCopy {
+			valueCopy[j] = 'x'
+		}
+		expected := fmt.Sprintf("key%03d-gen%d", i, numGens)
+		if value, err := d.Get(key(i)); err != nil || string(value) != expected {
+			t.Fatalf("expected %s, but found %s (%v)", expected, value, err)
+		}
+	}
+	if _, err := d.GetCopy([]byte("missing")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	b := d.NewBatch()
+	if err := b.Set([]byte("b"), []byte("2"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := d.Get([]byte("a")); err != ErrClosed {
+		t.Fatalf("Get: expected ErrClosed, but found %v", err)
+	}
+	if _, err := d.GetCopy([]byte("a")); err != ErrClosed {
+		t.Fatalf("GetCopy: expected ErrClosed, but found %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("2"), nil); err != ErrClosed {
+		t.Fatalf("Set: expected ErrClosed, but found %v", err)
+	}
+	if err := d.Delete([]byte("a"), nil); err != ErrClosed {
+		t.Fatalf("Delete: expected ErrClosed, but found %v", err)
+	}
+	if err := b.Commit(nil); err != ErrClosed {
+		t.Fatalf("Commit: expected ErrClosed, but found %v", err)
+	}
+	if err := d.Flush(); err != ErrClosed {
+		t.Fatalf("Flush: expected ErrClosed, but found %v", err)
+	}
+	iter := d.NewIter(nil)
+	if iter.First(); iter.Valid() {
+		t.Fatalf("expected an invalid iterator")
+	}
+	if err := iter.Close(); err != ErrClosed {
+		t.Fatalf("NewIter: expected ErrClosed, but found %v", err)
+	}
+
+	// Close may be called repeatedly.
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// blockingFS is a Storage whose writes to tables block once block is set,
+// until release is closed. blocked is closed by the first blocked write.
+type blockingFS struct {
+	storage.Storage
+	block       int32 // atomic
+	blockedOnce sync.Once
+	blocked     chan struct{}
+	release     chan struct{}
+}
+
+func (fs *blockingFS) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if fileType, _, ok := parseDBFilename(filepath.Base(name)); ok && fileType == fileTypeTable {
+		return blockingFile{f, fs}, nil
+	}
+	return f, nil
+}
+
+type blockingFile struct {
+	storage.File
+	fs *blockingFS
+}
+
+func (f blockingFile) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&f.fs.block) != 0 {
+		f.fs.blockedOnce.Do(func() { close(f.fs.blocked) })
+		<-f.fs.release
+	}
+	return f.File.Write(p)
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	mem := storage.NewMem()
+	fs := &blockingFS{
+		Storage: mem,
+		blocked: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	opts := &db.Options{
+		Storage:                   fs,
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%03d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	var l0 []uint64
+	d.mu.Lock()
+	for _, f := range d.mu.versions.currentVersion().files[0] {
+		l0 = append(l0, f.fileNum)
+	}
+	d.mu.Unlock()
+
+	// A compaction blocked writing its output does not finish within the
+	// timeout, so it is canceled and the DB is closed without it.
+	atomic.StoreInt32(&fs.block, 1)
+	compactErr := make(chan error, 1)
+	go func() {
+		compactErr <- d.CompactFiles(l0)
+	}()
+	<-fs.blocked
+	start := time.Now()
+	if err := d.CloseWithTimeout(10 * time.Millisecond); err != ErrCloseTimedOut {
+		t.Fatalf("expected %v, but found %v", ErrCloseTimedOut, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("CloseWithTimeout took %s", elapsed)
+	}
+	if _, err := d.Get([]byte("000")); err != ErrClosed {
+		t.Fatalf("expected %v, but found %v", ErrClosed, err)
+	}
+
+	// Once unblocked, the compaction stops without installing its outputs,
+	// and deletes them.
+	close(fs.release)
+	if err := <-compactErr; err != errCanceled {
+		t.Fatalf("expected %v, but found %v", errCanceled, err)
+	}
+	list, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []uint64
+	for _, filename := range list {
+		if fileType, fileNum, ok := parseDBFilename(filename); ok && fileType == fileTypeTable {
+			tables = append(tables, fileNum)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	if fmt.Sprint(tables) != fmt.Sprint(l0) {
+		t.Fatalf("expected tables %v, but found %v", l0, tables)
+	}
+
+	// The DB reopens with the data of the uncompacted tables.
+	atomic.StoreInt32(&fs.block, 0)
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if v, err := d.Get([]byte("050")); err != nil || string(v) != "1" {
+		t.Fatalf("expected 1, but found %s (%v)", v, err)
+	}
+
+	// Without background work, CloseWithTimeout closes the DB as Close does.
+	if err := d.CloseWithTimeout(time.Second); err != nil {
+		t.Fatalf("CloseWithTimeout: %v", err)
+	}
+}
+
+func TestMaxOpenIterators(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:          storage.NewMem(),
+		MaxOpenIterators: 3,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	open := func() int {
+		return d.Metrics().Iterators.Open
+	}
+
+	// The iterators, including clones and those of indexed batches, count
+	// towards the limit until they are closed.
+	b := d.NewIndexedBatch()
+	iters := []db.Iterator{d.NewIter(nil), b.NewIter(nil)}
+	iters = append(iters, iters[0].Clone())
+	for i, iter := range iters {
+		if err := iter.Error(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if n := open(); n != 3 {
+		t.Fatalf("expected 3 open iterators, but found %d", n)
+	}
+
+	// Exceeding the limit fails.
+	for _, iter := range []db.Iterator{d.NewIter(nil), iters[0].Clone()} {
+		if iter.First(); iter.Valid() {
+			t.Fatalf("expected iterator to be invalid")
+		}
+		if err := iter.Error(); !errors.Is(err, ErrTooManyIterators) {
+			t.Fatalf("expected ErrTooManyIterators, but found %v", err)
+		}
+		if err := iter.Close(); !errors.Is(err, ErrTooManyIterators) {
+			t.Fatalf("expected ErrTooManyIterators, but found %v", err)
+		}
+	}
+	if n := open(); n != 3 {
+		t.Fatalf("expected 3 open iterators, but found %d", n)
+	}
+
+	// Closing an iterator, even more than once, releases a single slot.
+	for i := 0; i < 2; i++ {
+		if err := iters[1].Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	if n := open(); n != 2 {
+		t.Fatalf("expected 2 open iterators, but found %d", n)
+	}
+	iters[1] = d.NewIter(nil)
+	if iters[1].First(); !iters[1].Valid() {
+		t.Fatalf("expected a valid iterator, but found %v", iters[1].Error())
+	}
+	for _, iter := range iters {
+		if err := iter.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	if n := open(); n != 0 {
+		t.Fatalf("expected 0 open iterators, but found %d", n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestMmapTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-mmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := Open(dir, &db.Options{
+		Levels: []db.LevelOptions{{
+			Compression: db.NoCompression,
+		}},
+		MmapTables: true,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := d.Set(key, []byte(fmt.Sprintf("val%03d", i)), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	iter := d.NewIter(nil)
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if expected := fmt.Sprintf("val%03d", n); string(iter.Value()) != expected {
+			t.Fatalf("expected %s, but found %s", expected, iter.Value())
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, n)
+	}
+
+	// Values returned by Get remain valid after the table is unmapped.
+	value, err := d.Get([]byte("key050"))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if string(value) != "val050" {
+		t.Fatalf("expected val050, but found %s", value)
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const numSets, numDeletes = 30, 10
+	var rawKeySize, rawValueSize uint64
+	for i := 0; i < numSets; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		value := []byte(fmt.Sprintf("value%d", i))
+		if err := d.Set(key, value, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		rawKeySize += uint64(len(key) + 8)
+		rawValueSize += uint64(len(value))
+	}
+	for i := 0; i < numDeletes; i++ {
+		key := []byte(fmt.Sprintf("key%02d", numSets+i))
+		if err := d.Delete(key, nil); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		rawKeySize += uint64(len(key) + 8)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	check := func(d *DB) {
+		t.Helper()
+		d.mu.Lock()
+		files := d.mu.versions.currentVersion().files[0]
+		d.mu.Unlock()
+		if len(files) != 1 {
+			t.Fatalf("expected 1 L0 file, but found %d", len(files))
+		}
+		m := files[0]
+		if m.numEntries != numSets+numDeletes {
+			t.Fatalf("expected %d entries, but found %d", numSets+numDeletes, m.numEntries)
+		}
+		if m.numDeletions != numDeletes {
+			t.Fatalf("expected %d deletions, but found %d", numDeletes, m.numDeletions)
+		}
+		if m.numRangeDeletions != 0 {
+			t.Fatalf("expected 0 range deletions, but found %d", m.numRangeDeletions)
+		}
+		if m.rawKeySize != rawKeySize {
+			t.Fatalf("expected raw key size %d, but found %d", rawKeySize, m.rawKeySize)
+		}
+		if m.rawValueSize != rawValueSize {
+			t.Fatalf("expected raw value size %d, but found %d", rawValueSize, m.rawValueSize)
+		}
+	}
+	check(d)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The stats survive a restart.
+	d, err = Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(d)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Fatalf(format string, args ...interface{}) {
+	l.Infof("fatal: "+format, args...)
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetricsTombstones(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write 100 keys to one level 0 table, and delete half of them in a
+	// second.
+	var l0 []uint64
+	for _, del := range []bool{false, true} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if !del {
+				err = d.Set(key, key, nil)
+			} else if i%2 == 0 {
+				err = d.Delete(key, nil)
+			}
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	d.mu.Lock()
+	for _, f := range d.mu.versions.currentVersion().files[0] {
+		l0 = append(l0, f.fileNum)
+	}
+	d.mu.Unlock()
+
+	m := d.Metrics().Levels[0]
+	if m.NumFiles != 2 || m.NumEntries != 150 || m.NumDeletions != 50 || m.NumRangeDeletions != 0 {
+		t.Fatalf("expected 2 files, 150 entries and 50 deletions, but found %+v", m)
+	}
+	if r := m.TombstoneRatio(); r != 0.5 {
+		t.Fatalf("expected tombstone ratio 0.5, but found %.2f", r)
+	}
+
+	// Compacting the tables into level 1, the bottom-most level containing
+	// data, drops the tombstones and the keys they delete.
+	if err := d.CompactFiles(l0); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	metrics := d.Metrics()
+	if m := metrics.Levels[0]; m.NumFiles != 0 || m.TombstoneRatio() != 0 {
+		t.Fatalf("expected an empty level 0, but found %+v", m)
+	}
+	m = metrics.Levels[1]
+	if m.NumFiles != 1 || m.NumEntries != 50 || m.NumDeletions != 0 {
+		t.Fatalf("expected 1 file of 50 entries and no tombstones, but found %+v", m)
+	}
+	if r := m.TombstoneRatio(); r != 0 {
+		t.Fatalf("expected tombstone ratio 0, but found %.2f", r)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestMetricsCompaction(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		infos []db.CompactionInfo
+	)
+	compactions := func() []db.CompactionInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]db.CompactionInfo(nil), infos...)
+	}
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		EventListener: db.EventListener{
+			CompactionEnd: func(info db.CompactionInfo) {
+				mu.Lock()
+				infos = append(infos, info)
+				mu.Unlock()
+			},
+		},
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write two level 0 tables, the second overwriting half of the 100 keys
+	// of the first.
+	for _, n := range []int{100, 50} {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := d.Set(key, bytes.Repeat([]byte("v"), 100), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	metrics := d.Metrics()
+	l0 := metrics.Levels[0]
+	if l0.NumFiles != 2 {
+		t.Fatalf("expected 2 level 0 files, but found %d", l0.NumFiles)
+	}
+	if metrics.Compact.Count != 0 {
+		t.Fatalf("expected no compactions, but found %d", metrics.Compact.Count)
+	}
+	fileNums := func(level int) []uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var fileNums []uint64
+		for _, f := range d.mu.versions.currentVersion().files[level] {
+			fileNums = append(fileNums, f.fileNum)
+		}
+		return fileNums
+	}
+
+	// The compaction reads both tables and writes the 100 live keys.
+	if err := d.CompactFiles(fileNums(0)); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	metrics = d.Metrics()
+	l1 := metrics.Levels[1]
+	got := compactions()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 compaction, but found %d", len(got))
+	}
+	info := got[0]
+	if info.Level != 0 || info.InputBytes != l0.Size || info.InputLevelBytes != l0.Size ||
+		info.OutputBytes != l1.Size || info.Duration <= 0 {
+		t.Fatalf("expected L0 compaction of %d bytes into %d bytes, but found %+v",
+			l0.Size, l1.Size, info)
+	}
+	// Half of the input was overwritten, so the output is about two thirds of
+	// the input.
+	if wa := info.WriteAmp(); wa < 0.5 || wa > 0.8 {
+		t.Fatalf("expected write amplification of about 0.67, but found %.2f", wa)
+	}
+	if ra := info.ReadAmp(); ra != 1 {
+		t.Fatalf("expected read amplification 1, but found %.2f", ra)
+	}
+	c := metrics.Compact
+	if c.Count != 1 || c.InputBytes != info.InputBytes || c.InputLevelBytes != info.InputLevelBytes ||
+		c.OutputBytes != info.OutputBytes || c.Duration != info.Duration {
+		t.Fatalf("expected compaction totals matching %+v, but found %+v", info, c)
+	}
+
+	// Compacting level 1 into level 2 reads and rewrites the same data.
+	if err := d.CompactFiles(fileNums(1)); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	got = compactions()
+	if len(got) != 2 || got[1].Level != 1 || got[1].InputBytes != l1.Size {
+		t.Fatalf("expected an L1 compaction of %d bytes, but found %+v", l1.Size, got)
+	}
+	c = d.Metrics().Compact
+	if c.Count != 2 || c.InputBytes != info.InputBytes+got[1].InputBytes ||
+		c.OutputBytes != info.OutputBytes+got[1].OutputBytes {
+		t.Fatalf("expected compaction totals of %+v and %+v, but found %+v", info, got[1], c)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLoggerWriteStall(t *testing.T) {
+	logger := &testLogger{}
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold:     2,
+		L0SlowdownWritesThreshold: 2,
+		Logger:                    logger,
+		Storage:                   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Prevent compactions from draining L0 while the tables accumulate.
+	d.mu.Lock()
+	d.mu.compact.compacting = true
+	d.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%d", i)), nil, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if !logger.contains("switched to WAL") {
+		t.Fatalf("expected a WAL switch to be logged, but found %q", logger.lines)
+	}
+	if logger.contains("L0 slowdown writes threshold") {
+		t.Fatalf("unexpected write stall before the write: %q", logger.lines)
+	}
+	if err := d.Set([]byte("a"), nil, nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if !logger.contains("L0 slowdown writes threshold") {
+		t.Fatalf("expected a write stall to be logged, but found %q", logger.lines)
+	}
+
+	d.mu.Lock()
+	d.mu.compact.compacting = false
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestWriteStallWatchdog(t *testing.T) {
+	logger := &testLogger{}
+	stalls := make(chan db.WriteStallInfo, 100)
+	d, err := Open("", &db.Options{
+		EventListener: db.EventListener{
+			WriteStall: func(info db.WriteStallInfo) {
+				select {
+				case stalls <- info:
+				default:
+				}
+			},
+		},
+		Logger:                    logger,
+		MemTableSize:              64 << 10,
+		Storage:                   storage.NewMem(),
+		WriteStallWarningDuration: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Block the flush scheduler so that the memtable queue fills up.
+	d.mu.Lock()
+	d.mu.compact.flushing = true
+	d.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		value := make([]byte, 1<<10)
+		for i := 0; i < 1000; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("%04d", i)), value, nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case info := <-stalls:
+		if !strings.Contains(info.Reason, "memtable queue full") {
+			t.Fatalf("expected a memtable stall, but found %q", info.Reason)
+		}
+		if info.Duration < 10*time.Millisecond {
+			t.Fatalf("expected a stall of at least 10ms, but found %s", info.Duration)
+		}
+		if len(info.LevelFiles) != numLevels {
+			t.Fatalf("expected %d levels, but found %v", numLevels, info.LevelFiles)
+		}
+	case err := <-done:
+		t.Fatalf("expected the writes to stall, but they completed: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for a write stall warning")
+	}
+	if !logger.contains("write stalled for") {
+		t.Fatalf("expected a write stall to be logged, but found %q", logger.lines)
+	}
+
+	// Unblock the flushes, allowing the writes to complete.
+	d.mu.Lock()
+	d.mu.compact.flushing = false
+	d.maybeScheduleFlush()
+	d.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Once the writes have completed, the stall is no longer reported.
+	for len(stalls) > 0 {
+		<-stalls
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(stalls); n != 0 {
+		t.Fatalf("expected no stall warnings after the stall ended, but found %d", n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLastReadAmplification(t *testing.T) {
+	// The L0 thresholds are high enough that the flushed tables are not
+	// compacted, so they stack up in L0.
+	d, err := Open("", &db.Options{
+		Storage:                   storage.NewMem(),
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	numL0 := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.mu.versions.currentVersion().files[0])
+	}
+
+	last := 0
+	for i := 0; i < 8; i++ {
+		// Each table spans [a,z], so every table overlaps m.
+		for _, k := range []string{"a", "z"} {
+			if err := d.Set([]byte(k), []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		n := numL0()
+		if n != i+1 {
+			t.Fatalf("expected %d L0 tables, but found %d", i+1, n)
+		}
+
+		// A missing key is searched for in the memtable and every L0 table.
+		if _, err := d.Get([]byte("m")); err != db.ErrNotFound {
+			t.Fatalf("expected not found, but found %v", err)
+		}
+		readAmp := d.LastReadAmplification()
+		if readAmp != 1+n {
+			t.Fatalf("expected read amplification %d, but found %d", 1+n, readAmp)
+		}
+		if readAmp <= last {
+			t.Fatalf("expected read amplification to grow past %d, but found %d", last, readAmp)
+		}
+		last = readAmp
+
+		// A key in the newest table is found after searching the memtable and
+		// that table.
+		if _, err := d.Get([]byte("a")); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if readAmp := d.LastReadAmplification(); readAmp != 2 {
+			t.Fatalf("expected read amplification 2, but found %d", readAmp)
+		}
+
+		// An iterator merges the memtable and every L0 table.
+		iter := d.NewIter(nil)
+		if readAmp := d.LastReadAmplification(); readAmp != 1+n {
+			t.Fatalf("expected iterator read amplification %d, but found %d", 1+n, readAmp)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compacting L0 into L1 lowers the read amplification.
+	d.mu.Lock()
+	var fileNums []uint64
+	for _, f := range d.mu.versions.currentVersion().files[0] {
+		fileNums = append(fileNums, f.fileNum)
+	}
+	d.mu.Unlock()
+	if err := d.CompactFiles(fileNums); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	if _, err := d.Get([]byte("m")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if readAmp := d.LastReadAmplification(); readAmp >= last {
+		t.Fatalf("expected read amplification below %d after compaction, but found %d", last, readAmp)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestApplyAtSeqNum(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		DebugCheck: true,
+		Storage:    fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	seqNums := func() (logSeqNum, visibleSeqNum uint64) {
+		return atomic.LoadUint64(&d.mu.versions.logSeqNum),
+			atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	}
+	apply := func(seqNum uint64, kvs ...string) error {
+		b := d.NewBatch()
+		for i := 0; i < len(kvs); i += 2 {
+			b.Set([]byte(kvs[i]), []byte(kvs[i+1]), nil)
+		}
+		return d.ApplyAtSeqNum(b, seqNum, nil)
+	}
+	// get reads key at the specified sequence number.
+	get := func(key string, seqNum uint64) string {
+		iter := d.newIterInternal(nil, seqNum, nil)
+		defer iter.Close()
+		iter.SeekGE([]byte(key))
+		if !iter.Valid() || string(iter.Key()) != key {
+			return "<not found>"
+		}
+		return string(iter.Value())
+	}
+
+	if err := d.Set([]byte("a"), []byte("0"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	logSeqNum, _ := seqNums()
+
+	// The imported batches are applied at the prescribed sequence numbers,
+	// skipping the sequence numbers in between.
+	if err := apply(100, "a", "1", "b", "1"); err != nil {
+		t.Fatalf("ApplyAtSeqNum: %v", err)
+	}
+	if l, v := seqNums(); l != 102 || v != 102 {
+		t.Fatalf("expected sequence numbers 102/102, but found %d/%d", l, v)
+	}
+	if err := apply(200, "a", "2"); err != nil {
+		t.Fatalf("ApplyAtSeqNum: %v", err)
+	}
+	for _, c := range []struct {
+		key    string
+		seqNum uint64
+		value  string
+	}{
+		{"a", logSeqNum, "0"},
+		{"a", 100, "0"},
+		{"a", 101, "1"},
+		{"a", 200, "1"},
+		{"a", 201, "2"},
+		{"b", 101, "<not found>"},
+		{"b", 102, "1"},
+	} {
+		if v := get(c.key, c.seqNum); v != c.value {
+			t.Fatalf("%s@%d: expected %s, but found %s", c.key, c.seqNum, c.value, v)
+		}
+	}
+
+	// The sequence numbers do not move backwards.
+	for _, seqNum := range []uint64{0, 150, 200} {
+		if err := apply(seqNum, "a", "3"); !errors.Is(err, ErrInvalidSeqNum) {
+			t.Fatalf("%d: expected %v, but found %v", seqNum, ErrInvalidSeqNum, err)
+		}
+	}
+	if l, v := seqNums(); l != 201 || v != 201 {
+		t.Fatalf("expected sequence numbers 201/201, but found %d/%d", l, v)
+	}
+
+	// The next sequence number itself is valid, and batches applied afterward
+	// follow the imported ones.
+	if err := apply(201, "c", "1"); err != nil {
+		t.Fatalf("ApplyAtSeqNum: %v", err)
+	}
+	if err := d.Set([]byte("d"), []byte("1"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if l, v := seqNums(); l != 203 || v != 203 {
+		t.Fatalf("expected sequence numbers 203/203, but found %d/%d", l, v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The batches are recovered from the WAL at their sequence numbers.
+	d, err = Open("", &db.Options{
+		DebugCheck: true,
+		Storage:    fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if l, v := seqNums(); l != 203 || v != 203 {
+		t.Fatalf("expected sequence numbers 203/203, but found %d/%d", l, v)
+	}
+	s := d.SSTables()
+	var keys []string
+	for _, level := range s.Levels {
+		for _, info := range level {
+			r, err := s.Open(info.FileNum)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			iter := r.NewIter(nil)
+			for iter.First(); iter.Valid(); iter.Next() {
+				keys = append(keys, fmt.Sprintf("%s#%d:%s", iter.Key().UserKey, iter.Key().SeqNum(), iter.Value()))
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Fields(fmt.Sprintf("a#%d:0 a#100:1 a#200:2 b#101:1 c#201:1 d#202:1", logSeqNum-1))
+	sort.Strings(keys)
+	sort.Strings(expected)
+	if got := strings.Join(keys, " "); got != strings.Join(expected, " ") {
+		t.Fatalf("expected %s, but found %s", expected, got)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestIterSameUserKeyAcrossLevels(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	set := func(key, value string) {
+		t.Helper()
+		if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	flush := func() {
+		t.Helper()
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	// The oldest version of "k" is in L1, two newer versions are in
+	// overlapping L0 tables, and the newest version is in the memtable. The
+	// sequence number following each version is recorded.
+	var seqNums []uint64
+	logSeqNum := func() uint64 {
+		return atomic.LoadUint64(&d.mu.versions.logSeqNum)
+	}
+	set("a", "a1")
+	set("k", "k1")
+	set("z", "z1")
+	flush()
+	seqNums = append(seqNums, logSeqNum())
+	d.mu.Lock()
+	meta := d.mu.versions.currentVersion().files[0][0]
+	err = d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{
+			deletedFileEntry{level: 0, fileNum: meta.fileNum}: true,
+		},
+		newFiles: []newFileEntry{
+			{level: 1, meta: meta},
+		},
+	})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("logAndApply: %v", err)
+	}
+	set("b", "b2")
+	set("k", "k2")
+	set("y", "y2")
+	flush()
+	seqNums = append(seqNums, logSeqNum())
+	set("c", "c3")
+	set("k", "k3-old")
+	set("k", "k3")
+	set("x", "x3")
+	flush()
+	seqNums = append(seqNums, logSeqNum())
+	set("k", "k4")
+	seqNums = append(seqNums, logSeqNum())
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files
+	if len(files[0]) != 2 || len(files[1]) != 1 {
+		t.Fatalf("expected 2 L0 tables and 1 L1 table, but found %d and %d",
+			len(files[0]), len(files[1]))
+	}
+	d.mu.Unlock()
+
+	// At each sequence number, iteration in either direction and Get return
+	// only the newest visible version of "k".
+	for i, seqNum := range seqNums {
+		others := [][]string{
+			{"a:a1"},
+			{"a:a1", "b:b2"},
+			{"a:a1", "b:b2", "c:c3"},
+			{"a:a1", "b:b2", "c:c3"},
+		}[i]
+		after := [][]string{
+			{"z:z1"},
+			{"y:y2", "z:z1"},
+			{"x:x3", "y:y2", "z:z1"},
+			{"x:x3", "y:y2", "z:z1"},
+		}[i]
+		expected := strings.Join(append(append(others, fmt.Sprintf("k:k%d", i+1)), after...), " ")
+
+		iter := d.NewIterAtSeqNum(seqNum, nil)
+		var keys []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if got := strings.Join(keys, " "); got != expected {
+			t.Fatalf("%d: forward: expected %s, but found %s", seqNum, expected, got)
+		}
+		keys = keys[:0]
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			keys = append([]string{fmt.Sprintf("%s:%s", iter.Key(), iter.Value())}, keys...)
+		}
+		if got := strings.Join(keys, " "); got != expected {
+			t.Fatalf("%d: reverse: expected %s, but found %s", seqNum, expected, got)
+		}
+		value := fmt.Sprintf("k%d", i+1)
+		for _, seek := range []func() bool{
+			func() bool { iter.SeekGE([]byte("k")); return iter.Valid() },
+			func() bool { iter.SeekLT([]byte("l")); return iter.Valid() },
+			func() bool { iter.SeekGE([]byte("j")); return iter.Next() && iter.Prev() },
+			func() bool { iter.SeekLT([]byte("l")); return iter.Prev() && iter.Next() },
+		} {
+			if !seek() || string(iter.Key()) != "k" || string(iter.Value()) != value {
+				t.Fatalf("%d: seek: expected k:%s, but found %s:%s (valid=%t)",
+					seqNum, value, iter.Key(), iter.Value(), iter.Valid())
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := d.Get([]byte("k")); err != nil || string(v) != "k4" {
+		t.Fatalf("expected k4, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
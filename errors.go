@@ -0,0 +1,102 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors returned when opening a DB fails. The returned errors describe
+// the failure in detail, and match one of these errors (and the underlying
+// cause of the failure, if any) when tested with errors.Is.
+var (
+	// ErrMissingCurrent is returned when the CURRENT file, which names the
+	// current manifest, does not exist. The DB has either not been created or
+	// was lost.
+	ErrMissingCurrent = errors.New("pebble: missing CURRENT file")
+
+	// ErrCorruptManifest is returned when the CURRENT file or the manifest it
+	// names is missing, malformed or inconsistent.
+	ErrCorruptManifest = errors.New("pebble: corrupt manifest")
+
+	// ErrComparerMismatch is returned when the DB was created with a comparer
+	// other than db.Options.Comparer.
+	ErrComparerMismatch = errors.New("pebble: comparer mismatch")
+
+	// ErrDBExists is returned when the DB already exists and
+	// db.Options.ErrorIfDBExists is set.
+	ErrDBExists = errors.New("pebble: database already exists")
+
+	// ErrCorruptLog is returned when a log file being replayed contains a
+	// record that is not a valid batch.
+	ErrCorruptLog = errors.New("pebble: corrupt log file")
+
+	// ErrMissingLog is returned when neither the log file named by the
+	// manifest, which holds the writes not yet flushed to tables, nor a newer
+	// log is found. This happens when db.Options.WALDir is changed from a
+	// directory other than the DB directory, which is not searched for logs.
+	ErrMissingLog = errors.New("pebble: missing log file")
+
+	// ErrMissingTables is returned when tables referenced by the manifest do
+	// not exist, unless db.Options.SkipCorruptTables is set.
+	ErrMissingTables = errors.New("pebble: missing tables")
+
+	// ErrCorruptTables is returned when tables fail verification, which is
+	// only performed if db.Options.VerifyTablesOnOpen is set, unless
+	// db.Options.SkipCorruptTables is set.
+	ErrCorruptTables = errors.New("pebble: corrupt tables")
+)
+
+// ErrClosed is returned by the methods of a DB which has been closed.
+var ErrClosed = errors.New("pebble: closed")
+
+// ErrCloseTimedOut is returned by DB.CloseWithTimeout when the DB was closed
+// without waiting for a flush or compaction, which was canceled.
+var ErrCloseTimedOut = errors.New("pebble: close timed out, background work canceled")
+
+// errCanceled is the error of a flush or compaction which was canceled by
+// DB.CloseWithTimeout.
+var errCanceled = errors.New("pebble: background work canceled")
+
+// ErrTooManyIterators is the error of an iterator created while
+// db.Options.MaxOpenIterators iterators are open.
+var ErrTooManyIterators = errors.New("pebble: too many open iterators")
+
+// Error is an error of a specific kind, such as ErrCorruptManifest, with a
+// detailed message and an optional underlying cause.
+type Error struct {
+	// Kind is the sentinel error describing the failure.
+	Kind error
+	// Err is the underlying cause of the failure, or nil.
+	Err error
+	msg string
+}
+
+// newError returns an *Error of the specified kind, wrapping cause, with the
+// message described by format and args.
+func newError(kind, cause error, format string, args ...interface{}) error {
+	return &Error{
+		Kind: kind,
+		Err:  cause,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// Is returns true if target is the kind of e. It is used by errors.Is.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying cause of e. It is used by errors.Is and
+// errors.As.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
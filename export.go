@@ -0,0 +1,95 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// ScanToSSTable writes a standalone sstable containing the live keys in the
+// range [start,end) to w. The keys are read from a consistent view of the DB
+// as of the call, as by NewIter: merge operands are resolved and deletions are
+// applied, with the tombstones themselves omitted, so the sstable holds a
+// single SET for each live key. Every key is written with a sequence number of
+// zero, which makes the sstable suitable for ingestion into another DB with
+// Ingest. A nil start or end leaves the range unbounded on that side. Range
+// keys are not exported.
+//
+// The sstable is written using the DB's options for L0 and the DB's comparer,
+// with which it must be read. ScanToSSTable does not close w.
+func (d *DB) ScanToSSTable(start, end []byte, w io.Writer) error {
+	seqNum := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+	iter := d.newIterInternal(nil, seqNum, &db.IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	tw := sstable.NewWriter(&exportFile{w: w}, d.opts, d.opts.Level(0))
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := tw.Add(db.MakeInternalKey(iter.Key(), 0, db.InternalKeyKindSet), iter.Value()); err != nil {
+			tw.Close()
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		tw.Close()
+		return err
+	}
+	return tw.Close()
+}
+
+// exportFile adapts the io.Writer passed to ScanToSSTable to the
+// storage.File required by sstable.Writer. The file is write-only, and
+// syncing and closing it are no-ops.
+type exportFile struct {
+	w    io.Writer
+	size int64
+}
+
+func (f *exportFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *exportFile) Read(p []byte) (int, error) {
+	return 0, errors.New("pebble: export file is write-only")
+}
+
+func (f *exportFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("pebble: export file is write-only")
+}
+
+func (f *exportFile) Close() error {
+	return nil
+}
+
+func (f *exportFile) Sync() error {
+	return nil
+}
+
+func (f *exportFile) Stat() (os.FileInfo, error) {
+	return exportFileInfo{size: f.size}, nil
+}
+
+// exportFileInfo is the os.FileInfo of an exportFile, which only knows the
+// number of bytes written.
+type exportFileInfo struct {
+	size int64
+}
+
+func (fi exportFileInfo) Name() string       { return "export" }
+func (fi exportFileInfo) Size() int64        { return fi.size }
+func (fi exportFileInfo) Mode() os.FileMode  { return 0 }
+func (fi exportFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi exportFileInfo) IsDir() bool        { return false }
+func (fi exportFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,142 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestScanToSSTable(t *testing.T) {
+	src, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Write a mix of sets, overwrites, merges and deletions, some of which are
+	// flushed to L0 and some of which remain in the memtable.
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := src.Set([]byte(k), []byte(k+"1"), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := src.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	steps := []func() error{
+		func() error { return src.Set([]byte("c"), []byte("c2"), nil) },
+		func() error { return src.Delete([]byte("d"), nil) },
+		func() error { return src.Merge([]byte("m"), []byte("m1"), nil) },
+		func() error { return src.Delete([]byte("g"), nil) },
+		func() error { return src.Set([]byte("z"), []byte("z1"), nil) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if i == 1 {
+			if err := src.Flush(); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+		}
+	}
+
+	// The export holds the keys seen by an iterator over the range.
+	scan := func(iter db.Iterator) string {
+		var keys []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	expected := scan(src.NewIter(&db.IterOptions{
+		LowerBound: []byte("b"),
+		UpperBound: []byte("z"),
+	}))
+	if expected != "b:b1 c:c2 e:e1 f:f1 h:h1 m:m1" {
+		t.Fatalf("unexpected keys: %s", expected)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ScanToSSTable([]byte("b"), []byte("z"), &buf); err != nil {
+		t.Fatalf("ScanToSSTable: %v", err)
+	}
+
+	// Writes after the export are not included.
+	if err := src.Set([]byte("n"), []byte("n1"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := src.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The sstable holds a single SET with a zero sequence number for each live
+	// key in the range.
+	fs := storage.NewMem()
+	f, err := fs.Create("export.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("export.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sstable.NewReader(f, 0, nil)
+	iter := r.NewIter(nil)
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key.SeqNum() != 0 || key.Kind() != db.InternalKeyKindSet {
+			t.Fatalf("expected %s#0,SET, but found %s", key.UserKey, key)
+		}
+		keys = append(keys, fmt.Sprintf("%s:%s", key.UserKey, iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(keys, " "); s != expected {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+
+	// The sstable can be ingested into another DB.
+	dst, err := Open("db", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := dst.Set([]byte("a"), []byte("dst"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := dst.Ingest([]string{"export.sst"}); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	if s := scan(dst.NewIter(nil)); s != "a:dst "+expected {
+		t.Fatalf("expected a:dst %s, but found %s", expected, s)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
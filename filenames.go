@@ -75,19 +75,13 @@ func parseDBFilename(filename string) (fileType fileType, fileNum uint64, ok boo
 	return 0, 0, false
 }
 
+// setCurrentFile points CURRENT at the manifest with the specified file number.
+// CURRENT is replaced atomically, so that a crash leaves it naming either the
+// old or the new manifest. The directory is synced so that the update is
+// durable: CURRENT must not revert to naming a manifest which may be deleted.
 func setCurrentFile(dirname string, fs storage.Storage, fileNum uint64) error {
 	newFilename := dbFilename(dirname, fileTypeCurrent, fileNum)
-	oldFilename := fmt.Sprintf("%s.%06d.dbtmp", newFilename, fileNum)
-	fs.Remove(oldFilename)
-	f, err := fs.Create(oldFilename)
-	if err != nil {
-		return err
-	}
-	if _, err := fmt.Fprintf(f, "MANIFEST-%06d\n", fileNum); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	return fs.Rename(oldFilename, newFilename)
+	tmpFilename := fmt.Sprintf("%s.%06d.dbtmp", newFilename, fileNum)
+	return storage.ReplaceFile(fs, newFilename, tmpFilename,
+		[]byte(fmt.Sprintf("MANIFEST-%06d\n", fileNum)))
 }
@@ -5,8 +5,16 @@
 package pebble
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestParseDBFilename(t *testing.T) {
@@ -66,3 +74,197 @@ func TestFilenameRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+var errCrash = errors.New("crash")
+
+// crashFS simulates a crash at the crashAt'th operation on CURRENT, including
+// its temporary file, or on a directory. The operations before the crash take
+// effect, a crashing write writes only half of its data, and every operation
+// after the crash fails.
+type crashFS struct {
+	storage.Storage
+
+	mu      sync.Mutex
+	ops     int
+	crashAt int
+	crashed bool
+}
+
+// op returns errCrash if the DB has crashed, or if the operation on name is the
+// one at which it crashes.
+func (fs *crashFS) op(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return errCrash
+	}
+	if name != "" && !strings.HasPrefix(filepath.Base(name), "CURRENT") {
+		return nil
+	}
+	fs.ops++
+	if fs.ops == fs.crashAt {
+		fs.crashed = true
+		return errCrash
+	}
+	return nil
+}
+
+func (fs *crashFS) Create(name string) (storage.File, error) {
+	if err := fs.op(name); err != nil {
+		return nil, err
+	}
+	f, err := fs.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return crashFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *crashFS) Link(oldname, newname string) error {
+	if err := fs.op(newname); err != nil {
+		return err
+	}
+	return fs.Storage.Link(oldname, newname)
+}
+
+func (fs *crashFS) OpenDir(name string) (storage.File, error) {
+	if err := fs.op(""); err != nil {
+		return nil, err
+	}
+	f, err := fs.Storage.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return crashFile{File: f, fs: fs}, nil
+}
+
+func (fs *crashFS) Remove(name string) error {
+	if err := fs.op(name); err != nil {
+		return err
+	}
+	return fs.Storage.Remove(name)
+}
+
+func (fs *crashFS) Rename(oldname, newname string) error {
+	if err := fs.op(newname); err != nil {
+		return err
+	}
+	return fs.Storage.Rename(oldname, newname)
+}
+
+// crashFile is a file of a crashFS. A name of "" denotes a directory.
+type crashFile struct {
+	storage.File
+	fs   *crashFS
+	name string
+}
+
+func (f crashFile) Write(p []byte) (int, error) {
+	if err := f.fs.op(f.name); err != nil {
+		if err == errCrash && len(p) > 1 {
+			// The crash tears the write.
+			f.File.Write(p[:len(p)/2])
+		}
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f crashFile) Sync() error {
+	if err := f.fs.op(f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f crashFile) Close() error {
+	if err := f.fs.op(f.name); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+func TestSetCurrentFileCrash(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: mem,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("1"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	readCurrent := func() string {
+		f, err := mem.Open(dbFilename("", fileTypeCurrent, 0))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Opening the DB writes a new manifest and points CURRENT at it. Crashing at
+	// each operation of the CURRENT update leaves CURRENT naming either the old
+	// or the new manifest, both of which are valid.
+	var manifests []string
+	for crashAt := 1; ; crashAt++ {
+		fs := &crashFS{Storage: mem, crashAt: crashAt}
+		d, err := Open("", &db.Options{
+			Storage: fs,
+		})
+		crashed := err != nil
+		if crashed && err != errCrash && !strings.Contains(err.Error(), errCrash.Error()) {
+			t.Fatalf("%d: Open: %v", crashAt, err)
+		}
+		if !crashed {
+			// The DB opened before the crash point, so it is not crashed when
+			// closed.
+			fs.mu.Lock()
+			fs.crashAt = 0
+			fs.mu.Unlock()
+			if err := d.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+		}
+
+		current := readCurrent()
+		var fileNum uint64
+		if _, err := fmt.Sscanf(current, "MANIFEST-%06d\n", &fileNum); err != nil ||
+			current != fmt.Sprintf("MANIFEST-%06d\n", fileNum) {
+			t.Fatalf("%d: torn CURRENT: %q", crashAt, current)
+		}
+		if _, err := mem.Stat(dbFilename("", fileTypeManifest, fileNum)); err != nil {
+			t.Fatalf("%d: CURRENT names a missing manifest: %v", crashAt, err)
+		}
+		manifests = append(manifests, current)
+
+		d, err = Open("", &db.Options{
+			Storage: mem,
+		})
+		if err != nil {
+			t.Fatalf("%d: Open after crash: %v", crashAt, err)
+		}
+		if v, err := d.Get([]byte("a")); err != nil || string(v) != "1" {
+			t.Fatalf("%d: expected 1, but found %s (%v)", crashAt, v, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if !crashed {
+			break
+		}
+	}
+	if len(manifests) < 3 {
+		t.Fatalf("expected at least 3 crash points, but found %d", len(manifests))
+	}
+}
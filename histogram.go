@@ -0,0 +1,101 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/petermattis/pebble/sstable"
+)
+
+// KeyHistogram returns approximate quantile keys of the sstables of the
+// current version, which divide the data into the specified number of buckets
+// of roughly equal size: the i'th key is the key at the i/buckets quantile,
+// for i in [1,buckets). The keys are suitable as split points, such as for
+// sharding the DB.
+//
+// The distribution of the keys is sampled from the index blocks of the
+// sstables, without reading their data blocks: each data block contributes
+// its separator key, weighted by the block's share of the size of its table,
+// so that the tables of every level are weighted by their size. The precision
+// of the quantiles is therefore limited by the size of the data blocks. Fewer
+// than buckets-1 keys are returned if there are too few data blocks to tell
+// the quantiles apart, and none if the DB has no sstables. Data in the
+// memtables is not included.
+func (d *DB) KeyHistogram(buckets int) ([][]byte, error) {
+	if buckets < 1 {
+		return nil, fmt.Errorf("pebble: invalid number of buckets: %d", buckets)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	current.ref()
+	d.mu.Unlock()
+	defer current.unref()
+
+	type sample struct {
+		key    []byte
+		weight float64
+	}
+	var samples []sample
+	var total float64
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			var blocks []sstable.DataBlockInfo
+			err := d.tableCache.withReader(f, func(r *sstable.Reader) error {
+				var err error
+				blocks, err = r.DataBlocks()
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			// The weights of the blocks of a table sum to the size of the
+			// table, which also includes its index and meta blocks. If the
+			// index does not record the sizes of the blocks, the blocks are
+			// weighted evenly.
+			var blockBytes uint64
+			for _, b := range blocks {
+				blockBytes += b.Size
+			}
+			for _, b := range blocks {
+				w := float64(f.size) / float64(len(blocks))
+				if blockBytes > 0 {
+					w = float64(f.size) * float64(b.Size) / float64(blockBytes)
+				}
+				samples = append(samples, sample{key: b.Separator.UserKey, weight: w})
+				total += w
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return d.cmp(samples[i].key, samples[j].key) < 0
+	})
+
+	// The data preceding a separator key is the data of its block and of the
+	// blocks sorted before it, so the quantile q is at the first separator
+	// whose cumulative weight reaches q*total.
+	var keys [][]byte
+	var cum float64
+	j := 0
+	for q := 1; q < buckets; q++ {
+		target := total * float64(q) / float64(buckets)
+		for j < len(samples)-1 && cum+samples[j].weight < target {
+			cum += samples[j].weight
+			j++
+		}
+		key := samples[j].key
+		if len(keys) > 0 && d.cmp(keys[len(keys)-1], key) >= 0 {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
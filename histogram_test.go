@@ -0,0 +1,113 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestKeyHistogram(t *testing.T) {
+	// Automatic compactions are disabled by the L0 thresholds, so that the
+	// tables are only compacted by CompactFiles.
+	d, err := Open("", &db.Options{
+		Storage:                   storage.NewMem(),
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+		Levels: []db.LevelOptions{{
+			BlockSize:      1024,
+			Compression:    db.NoCompression,
+			TargetFileSize: 64 << 10,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if _, err := d.KeyHistogram(0); err == nil {
+		t.Fatalf("expected error for 0 buckets")
+	}
+	if keys, err := d.KeyHistogram(10); err != nil || keys != nil {
+		t.Fatalf("expected no keys, but found %q (%v)", keys, err)
+	}
+
+	// Write a uniform distribution of keys, half of which are compacted out of
+	// level 0 before the other half is written, so that the keys are spread
+	// across levels.
+	const n = 10000
+	value := bytes.Repeat([]byte("v"), 100)
+	write := func(start, end int) {
+		for i := start; i < end; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("key%05d", i)), value, nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			if (i+1)%1000 == 0 {
+				if err := d.Flush(); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+		}
+	}
+	write(n/2, n)
+	d.mu.Lock()
+	var fileNums []uint64
+	for _, f := range d.mu.versions.currentVersion().files[0] {
+		fileNums = append(fileNums, f.fileNum)
+	}
+	d.mu.Unlock()
+	if err := d.CompactFiles(fileNums); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	write(0, n/2)
+	d.mu.Lock()
+	var levels int
+	for _, files := range d.mu.versions.currentVersion().files {
+		if len(files) > 0 {
+			levels++
+		}
+	}
+	d.mu.Unlock()
+	if levels < 2 {
+		t.Fatalf("expected tables in multiple levels, but found %d", levels)
+	}
+
+	const buckets = 10
+	keys, err := d.KeyHistogram(buckets)
+	if err != nil {
+		t.Fatalf("KeyHistogram: %v", err)
+	}
+	if len(keys) != buckets-1 {
+		t.Fatalf("expected %d keys, but found %q", buckets-1, keys)
+	}
+	for i, key := range keys {
+		if !bytes.HasPrefix(key, []byte("key")) || len(key) < 8 {
+			t.Fatalf("unexpected key %q", key)
+		}
+		v, err := strconv.Atoi(string(key[3:8]))
+		if err != nil {
+			t.Fatalf("unexpected key %q", key)
+		}
+		// Each data block holds about 9 keys, and a table about 500 keys.
+		expected := (i + 1) * n / buckets
+		if v < expected-n/50 || v > expected+n/50 {
+			t.Fatalf("%d: expected key near %05d, but found %q (%q)", i, expected, key, keys)
+		}
+	}
+
+	// A single bucket has no split points.
+	if keys, err := d.KeyHistogram(1); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys, but found %q (%v)", keys, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
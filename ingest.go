@@ -202,6 +202,10 @@ func (d *DB) Ingest(paths []string) error {
 	if err := ingestLink(d.opts.Storage, d.dirname, paths, meta); err != nil {
 		return err
 	}
+	if err := d.dataDir.Sync(); err != nil {
+		ingestCleanup(d.opts.Storage, d.dirname, meta)
+		return err
+	}
 
 	var mem *memTable
 	prepareLocked := func() {
@@ -0,0 +1,11 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build invariants
+
+package pebble
+
+// invariantsEnabled is true when the "invariants" build tag is specified,
+// enabling expensive consistency checks which are intended for testing.
+const invariantsEnabled = true
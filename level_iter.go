@@ -5,12 +5,14 @@
 package pebble
 
 import (
+	"bytes"
 	"sort"
 
 	"github.com/petermattis/pebble/db"
 )
 
 type levelIter struct {
+	opts    *db.IterOptions
 	cmp     db.Compare
 	index   int
 	iter    db.InternalIterator
@@ -22,13 +24,18 @@ type levelIter struct {
 // levelIter implements the db.InternalIterator interface.
 var _ db.InternalIterator = (*levelIter)(nil)
 
-func newLevelIter(cmp db.Compare, newIter tableNewIter, files []fileMetadata) *levelIter {
+func newLevelIter(
+	opts *db.IterOptions, cmp db.Compare, newIter tableNewIter, files []fileMetadata,
+) *levelIter {
 	l := &levelIter{}
-	l.init(cmp, newIter, files)
+	l.init(opts, cmp, newIter, files)
 	return l
 }
 
-func (l *levelIter) init(cmp db.Compare, newIter tableNewIter, files []fileMetadata) {
+func (l *levelIter) init(
+	opts *db.IterOptions, cmp db.Compare, newIter tableNewIter, files []fileMetadata,
+) {
+	l.opts = opts
 	l.cmp = cmp
 	l.index = -1
 	l.newIter = newIter
@@ -59,7 +66,8 @@ func (l *levelIter) findFileLT(key []byte) int {
 
 func (l *levelIter) loadFile(index int) bool {
 	if l.index == index {
-		return true
+		// The file may have failed to open.
+		return l.iter != nil
 	}
 	if l.iter != nil {
 		l.err = l.iter.Close()
@@ -72,31 +80,94 @@ func (l *levelIter) loadFile(index int) bool {
 	if l.index < 0 || l.index >= len(l.files) {
 		return false
 	}
-	l.iter, l.err = l.newIter(&l.files[l.index])
+	l.iter, l.err = l.newIter(&l.files[l.index], l.opts)
 	return l.err == nil
 }
 
+// skipEmptyFileForward advances past files which contain no entries, such as
+// corrupt files which are being skipped (see Options.SkipCorruptTables),
+// positioning the iterator at the first entry of the next non-empty file.
+// Returns whether the iterator is valid.
+func (l *levelIter) skipEmptyFileForward() bool {
+	for !l.iter.Valid() {
+		if l.iter.Error() != nil || !l.loadFile(l.index+1) {
+			return false
+		}
+		l.iter.First()
+	}
+	return true
+}
+
+// skipEmptyFileBackward is the reverse of skipEmptyFileForward, positioning
+// the iterator at the last entry of the previous non-empty file.
+func (l *levelIter) skipEmptyFileBackward() bool {
+	for !l.iter.Valid() {
+		if l.iter.Error() != nil || !l.loadFile(l.index-1) {
+			return false
+		}
+		l.iter.Last()
+	}
+	return true
+}
+
 func (l *levelIter) SeekGE(key []byte) {
 	if l.loadFile(l.findFileGE(key)) {
 		l.iter.SeekGE(key)
+		l.skipEmptyFileForward()
+	}
+}
+
+func (l *levelIter) SeekPrefixGE(prefix, key []byte) {
+	// The files are checked for keys with the prefix using their metadata
+	// before they are opened. The first file which might contain a key >= key
+	// contains none with the prefix if every key in it is < key, or its
+	// smallest key is > key and does not have the prefix. In that case no file
+	// contains such a key, and the level is exhausted without opening a file.
+	index := l.findFileGE(key)
+	if index >= 0 {
+		f := &l.files[index]
+		if l.cmp(f.largest.UserKey, key) < 0 ||
+			(l.cmp(f.smallest.UserKey, key) > 0 && !bytes.HasPrefix(f.smallest.UserKey, prefix)) {
+			index = len(l.files)
+		}
+	}
+	if !l.loadFile(index) {
+		return
+	}
+	l.iter.SeekPrefixGE(prefix, key)
+	// The keys with the prefix may span multiple files. If the current file
+	// does not contain the prefix, move on to the next file as long as it
+	// might.
+	for !l.iter.Valid() && l.iter.Error() == nil {
+		if l.index+1 >= len(l.files) ||
+			!bytes.HasPrefix(l.files[l.index+1].smallest.UserKey, prefix) {
+			return
+		}
+		if !l.loadFile(l.index + 1) {
+			return
+		}
+		l.iter.SeekPrefixGE(prefix, key)
 	}
 }
 
 func (l *levelIter) SeekLT(key []byte) {
 	if l.loadFile(l.findFileLT(key)) {
 		l.iter.SeekLT(key)
+		l.skipEmptyFileBackward()
 	}
 }
 
 func (l *levelIter) First() {
 	if l.loadFile(0) {
 		l.iter.First()
+		l.skipEmptyFileForward()
 	}
 }
 
 func (l *levelIter) Last() {
 	if l.loadFile(len(l.files) - 1) {
 		l.iter.Last()
+		l.skipEmptyFileBackward()
 	}
 }
 
@@ -109,7 +180,7 @@ func (l *levelIter) Next() bool {
 			// The iterator was positioned off the beginning of the level. Position
 			// at the first entry.
 			l.iter.First()
-			return true
+			return l.skipEmptyFileForward()
 		}
 		return false
 	}
@@ -119,13 +190,28 @@ func (l *levelIter) Next() bool {
 	// Current file was exhausted. Move to the next file.
 	if l.loadFile(l.index + 1) {
 		l.iter.First()
-		return true
+		return l.skipEmptyFileForward()
 	}
 	return false
 }
 
 func (l *levelIter) NextUserKey() bool {
-	return l.Next()
+	if l.err != nil {
+		return false
+	}
+	if l.iter == nil {
+		return l.Next()
+	}
+	if l.iter.NextUserKey() {
+		return true
+	}
+	// Current file was exhausted. A user key is never split across the files
+	// of a level, so the first entry of the next file has a larger user key.
+	if l.loadFile(l.index + 1) {
+		l.iter.First()
+		return l.skipEmptyFileForward()
+	}
+	return false
 }
 
 func (l *levelIter) Prev() bool {
@@ -137,7 +223,7 @@ func (l *levelIter) Prev() bool {
 			// The iterator was positioned off the end of the level. Position at the
 			// last entry.
 			l.iter.Last()
-			return true
+			return l.skipEmptyFileBackward()
 		}
 		return false
 	}
@@ -147,7 +233,7 @@ func (l *levelIter) Prev() bool {
 	// Current file was exhausted. Move to the previous file.
 	if l.loadFile(l.index - 1) {
 		l.iter.Last()
-		return true
+		return l.skipEmptyFileBackward()
 	}
 	return false
 }
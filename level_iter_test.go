@@ -22,7 +22,7 @@ func TestLevelIter(t *testing.T) {
 	var iters []*fakeIter
 	var files []fileMetadata
 
-	newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+	newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
 		f := *iters[meta.fileNum]
 		return &f, nil
 	}
@@ -54,7 +54,7 @@ func TestLevelIter(t *testing.T) {
 
 		case "iter":
 			iter := &levelIter{}
-			iter.init(db.DefaultComparer.Compare, newIter, files)
+			iter.init(nil, db.DefaultComparer.Compare, newIter, files)
 			defer iter.Close()
 			return runInternalIterCmd(d, iter)
 
@@ -66,8 +66,75 @@ func TestLevelIter(t *testing.T) {
 	})
 }
 
+func TestLevelIterSeekPrefixGE(t *testing.T) {
+	// Each file holds the keys of a single prefix, except the last two, which
+	// share the prefix "m".
+	var iters []*fakeIter
+	var files []fileMetadata
+	for _, line := range []string{
+		"a1 a2", "c1 c2", "e1 e2", "g1 g2", "i1 i2", "k1 k2", "m1 m2", "m3 n1",
+	} {
+		f := &fakeIter{}
+		for _, key := range strings.Fields(line) {
+			f.keys = append(f.keys, db.MakeInternalKey([]byte(key), 1, db.InternalKeyKindSet))
+			f.vals = append(f.vals, []byte(key))
+		}
+		iters = append(iters, f)
+		files = append(files, fileMetadata{
+			fileNum:  uint64(len(files)),
+			smallest: f.keys[0],
+			largest:  f.keys[len(f.keys)-1],
+		})
+	}
+
+	var opened []uint64
+	newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
+		opened = append(opened, meta.fileNum)
+		f := *iters[meta.fileNum]
+		return &f, nil
+	}
+
+	testCases := []struct {
+		prefix, key string
+		want        string
+		opened      string
+	}{
+		// Only the file containing the prefix is opened.
+		{"e", "e", "e1", "[2]"},
+		{"e", "e2", "e2", "[2]"},
+		// The keys with the prefix precede key.
+		{"e", "e3", "", "[]"},
+		// No file contains the prefix.
+		{"b", "b", "", "[]"},
+		{"0", "0", "", "[]"},
+		{"o", "o", "", "[]"},
+		// The keys with the prefix span two files, of which only the one
+		// containing keys >= key is opened.
+		{"m", "m15", "m2", "[6]"},
+		{"m", "m25", "m3", "[7]"},
+	}
+	for _, c := range testCases {
+		opened = nil
+		iter := newLevelIter(nil, db.DefaultComparer.Compare, newIter, files)
+		iter.SeekPrefixGE([]byte(c.prefix), []byte(c.key))
+		var got string
+		if iter.Valid() {
+			got = string(iter.Key().UserKey)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Fatalf("%s,%s: expected %q, but found %q", c.prefix, c.key, c.want, got)
+		}
+		if s := fmt.Sprint(opened); s != c.opened {
+			t.Fatalf("%s,%s: expected %s opened, but found %s", c.prefix, c.key, c.opened, s)
+		}
+	}
+}
+
 func buildLevelIterTables(
-	b *testing.B, blockSize, restartInterval, count int,
+	b *testing.B, blockSize, restartInterval, count, targetSize int,
 ) ([]*sstable.Reader, []fileMetadata, [][]byte) {
 	mem := storage.NewMem()
 	files := make([]storage.File, count)
@@ -91,9 +158,8 @@ func buildLevelIterTables(
 
 	var keys [][]byte
 	var i int
-	const targetSize = 2 << 20
 	for _, w := range writers {
-		for ; w.EstimatedSize() < targetSize; i++ {
+		for ; w.EstimatedSize() < uint64(targetSize); i++ {
 			key := []byte(fmt.Sprintf("%08d", i))
 			keys = append(keys, key)
 			ikey := db.MakeInternalKey(key, 0, db.InternalKeyKindSet)
@@ -137,12 +203,12 @@ func BenchmarkLevelIterSeekGE(b *testing.B) {
 				for _, count := range []int{5} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
-							readers, files, keys := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+							readers, files, keys := buildLevelIterTables(b, blockSize, restartInterval, count, 2<<20)
+							newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 							rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 							b.ResetTimer()
@@ -164,12 +230,12 @@ func BenchmarkLevelIterNext(b *testing.B) {
 				for _, count := range []int{5} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
-							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count, 2<<20)
+							newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
@@ -193,12 +259,12 @@ func BenchmarkLevelIterPrev(b *testing.B) {
 				for _, count := range []int{5} {
 					b.Run(fmt.Sprintf("count=%d", count),
 						func(b *testing.B) {
-							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count)
-							newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+							readers, files, _ := buildLevelIterTables(b, blockSize, restartInterval, count, 2<<20)
+							newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
 								return readers[meta.fileNum].NewIter(nil), nil
 							}
 							l := &levelIter{}
-							l.init(db.DefaultComparer.Compare, newIter, files)
+							l.init(nil, db.DefaultComparer.Compare, newIter, files)
 
 							b.ResetTimer()
 							for i := 0; i < b.N; i++ {
@@ -212,3 +278,31 @@ func BenchmarkLevelIterPrev(b *testing.B) {
 			})
 	}
 }
+
+func BenchmarkLevelIterScanSmallTables(b *testing.B) {
+	// A scan of a level of many small tables opens an iterator for each
+	// table.
+	const blockSize = 32 << 10
+	const restartInterval = 16
+	readers, files, keys := buildLevelIterTables(b, blockSize, restartInterval, 200, 1<<10)
+	newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
+		return readers[meta.fileNum].NewIter(nil), nil
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := &levelIter{}
+		l.init(nil, db.DefaultComparer.Compare, newIter, files)
+		n := 0
+		for l.First(); l.Valid(); l.Next() {
+			n++
+		}
+		if err := l.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if n != len(keys) {
+			b.Fatalf("expected %d keys, but found %d", len(keys), n)
+		}
+	}
+}
@@ -30,6 +30,11 @@ type memTable struct {
 	reserved  uint32
 	refs      int32
 	flushed   chan struct{}
+	// rangeKeySkl holds the range keys, which are kept separate from the point
+	// keys in skl. It shares skl's arena.
+	rangeKeySkl arenaskl.Skiplist
+	// The number of range keys in rangeKeySkl. Updated atomically.
+	numRangeKeys int32
 }
 
 // newMemTable returns a new MemTable.
@@ -42,6 +47,7 @@ func newMemTable(o *db.Options) *memTable {
 	}
 	arena := arenaskl.NewArena(uint32(o.MemTableSize), 0)
 	m.skl.Reset(arena, m.cmp)
+	m.rangeKeySkl.Reset(arena, m.cmp)
 	m.emptySize = m.skl.Size()
 	return m
 }
@@ -114,13 +120,44 @@ func (m *memTable) prepare(batch *Batch) error {
 }
 
 func (m *memTable) apply(batch *Batch, seqNum uint64) error {
+	// While the keys of the batch are increasing, each key is positioned using
+	// the position of the previous key, which makes applying a batch of sorted
+	// keys, such as during a bulk load, cheaper than searching for each
+	// key. Once a key is out of order, the remaining keys are searched for.
+	var ins arenaskl.Inserter
+	var prevKey db.InternalKey
+	sorted := true
 	startSeqNum := seqNum
-	for iter := batch.iter(); ; seqNum++ {
+	for iter := batch.iter(); ; {
 		kind, ukey, value, ok := iter.next()
 		if !ok {
 			break
 		}
-		if err := m.skl.Add(db.MakeInternalKey(ukey, seqNum, kind), value); err != nil {
+		if kind == db.InternalKeyKindLogData {
+			// LogData does not modify the keyspace, nor consume a sequence
+			// number.
+			continue
+		}
+		ikey := db.MakeInternalKey(ukey, seqNum, kind)
+		seqNum++
+		if isRangeKeyKind(kind) {
+			if err := m.rangeKeySkl.Add(ikey, value); err != nil {
+				return err
+			}
+			atomic.AddInt32(&m.numRangeKeys, 1)
+			continue
+		}
+		if sorted && prevKey.UserKey != nil && db.InternalCompare(m.cmp, prevKey, ikey) >= 0 {
+			sorted = false
+		}
+		if sorted {
+			if err := ins.Add(&m.skl, ikey, value); err != nil {
+				return err
+			}
+			prevKey = ikey
+			continue
+		}
+		if err := m.skl.Add(ikey, value); err != nil {
 			return err
 		}
 	}
@@ -140,6 +177,29 @@ func (m *memTable) NewIter(o *db.IterOptions) db.InternalIterator {
 	}
 }
 
+// newRangeKeyIter returns an iterator over the range keys in the memtable.
+func (m *memTable) newRangeKeyIter() db.InternalIterator {
+	return &memTableIter{
+		cmp:  m.cmp,
+		iter: m.rangeKeySkl.NewIter(),
+	}
+}
+
+// newFlushIter returns an iterator over both the point keys and the range
+// keys in the memtable, which is used to write the memtable to an sstable.
+func (m *memTable) newFlushIter() db.InternalIterator {
+	if !m.hasRangeKeys() {
+		return m.NewIter(nil)
+	}
+	return newMergingIter(m.cmp, m.NewIter(nil), m.newRangeKeyIter())
+}
+
+// hasRangeKeys returns whether any range keys have been applied to the
+// memtable.
+func (m *memTable) hasRangeKeys() bool {
+	return atomic.LoadInt32(&m.numRangeKeys) > 0
+}
+
 func (m *memTable) Close() error {
 	return nil
 }
@@ -211,6 +271,10 @@ func (t *memTableIter) SeekGE(key []byte) {
 	t.iter.SeekGE(key)
 }
 
+func (t *memTableIter) SeekPrefixGE(prefix, key []byte) {
+	t.SeekGE(key)
+}
+
 func (t *memTableIter) SeekLT(key []byte) {
 	t.clearPrevCache()
 	t.iter.SeekLT(key)
@@ -7,6 +7,7 @@ package pebble
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -228,6 +229,54 @@ func TestMemTableIter(t *testing.T) {
 	})
 }
 
+func TestMemTableApplySorted(t *testing.T) {
+	// A batch of sorted keys and a batch of the same keys in random order,
+	// including several versions of some keys, produce the same memtable.
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var keys []string
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, fmt.Sprintf("%06d", i/(1+i%3)))
+	}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	build := func(keys []string) string {
+		var b Batch
+		for _, k := range keys {
+			_ = b.Set([]byte(k), []byte(k), nil)
+		}
+		m := newMemTable(nil)
+		if err := m.prepare(&b); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.apply(&b, 1); err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		iter := m.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s\n", iter.Key().UserKey, iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	expected := build(sorted)
+	if n := strings.Count(expected, "\n"); n != len(keys) {
+		t.Fatalf("expected %d entries, but found %d", len(keys), n)
+	}
+	for i := 0; i < 5; i++ {
+		rng.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+		if result := build(keys); result != expected {
+			t.Fatalf("expected\n%s\nbut found\n%s", expected, result)
+		}
+	}
+}
+
 func buildMemTable(b *testing.B) (*memTable, [][]byte) {
 	m := newMemTable(nil)
 	var keys [][]byte
@@ -279,3 +328,39 @@ func BenchmarkMemTableIterPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func BenchmarkMemTableApply(b *testing.B) {
+	for _, sorted := range []bool{true, false} {
+		b.Run(fmt.Sprintf("sorted=%t", sorted), func(b *testing.B) {
+			// Each batch fills the memtable.
+			var batch Batch
+			var keys []int
+			for i := 0; i < 10000; i++ {
+				keys = append(keys, i)
+			}
+			if !sorted {
+				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+				rng.Shuffle(len(keys), func(i, j int) {
+					keys[i], keys[j] = keys[j], keys[i]
+				})
+			}
+			for _, i := range keys {
+				_ = batch.Set([]byte(fmt.Sprintf("%08d", i)), nil, nil)
+			}
+			opts := &db.Options{MemTableSize: int(batch.memTableSize) + 1<<10}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m := newMemTable(opts)
+				if err := m.prepare(&batch); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := m.apply(&batch, 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -132,6 +132,8 @@ func (m *mergingIter) initHeap() {
 				iter: t,
 				key:  t.Key(),
 			})
+		} else if err := t.Error(); err != nil {
+			m.err = err
 		}
 	}
 	m.heap.init()
@@ -242,6 +244,13 @@ func (m *mergingIter) SeekGE(key []byte) {
 	m.initMinHeap()
 }
 
+func (m *mergingIter) SeekPrefixGE(prefix, key []byte) {
+	for _, t := range m.iters {
+		t.SeekPrefixGE(prefix, key)
+	}
+	m.initMinHeap()
+}
+
 func (m *mergingIter) SeekLT(key []byte) {
 	for _, t := range m.iters {
 		t.SeekLT(key)
@@ -357,6 +366,8 @@ func (m *mergingIter) NextUserKey() bool {
 	} else if cur.NextUserKey() {
 		m.heap.items[0].key = cur.Key()
 		m.heap.fix(0)
+	} else if m.err = cur.Error(); m.err != nil {
+		return false
 	} else {
 		m.heap.pop()
 	}
@@ -467,6 +478,8 @@ func (m *mergingIter) PrevUserKey() bool {
 	} else if cur.PrevUserKey() {
 		m.heap.items[0].key = cur.Key()
 		m.heap.fix(0)
+	} else if m.err = cur.Error(); m.err != nil {
+		return false
 	} else {
 		m.heap.pop()
 	}
@@ -503,7 +516,7 @@ func (m *mergingIter) Error() error {
 
 func (m *mergingIter) Close() error {
 	for i := range m.iters {
-		m.iters[i].Close()
+		m.err = firstError(m.err, m.iters[i].Close())
 	}
 	m.iters = nil
 	m.heap.items = nil
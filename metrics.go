@@ -0,0 +1,103 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// LevelMetrics holds the metrics for the tables of a level of the LSM. The
+// entry counts come from the statistics recorded for each table as it is
+// written, and do not include the entries of tables which were not written by
+// the DB, such as ingested tables.
+type LevelMetrics struct {
+	// The number of tables in the level.
+	NumFiles int
+	// The total size of the tables in the level, in bytes.
+	Size uint64
+	// The number of entries in the tables, including tombstones.
+	NumEntries uint64
+	// The number of point deletion tombstones in the tables.
+	NumDeletions uint64
+	// The number of range deletion tombstones in the tables.
+	NumRangeDeletions uint64
+}
+
+// TombstoneRatio returns the ratio of the number of tombstones in the level to
+// the number of other entries. A high ratio indicates that reads of the level
+// spend much of their time skipping deleted data, and that a compaction of the
+// level would reclaim space. It returns +Inf for a level which contains only
+// tombstones, and 0 for an empty level.
+func (m *LevelMetrics) TombstoneRatio() float64 {
+	tombstones := m.NumDeletions + m.NumRangeDeletions
+	if tombstones == 0 {
+		return 0
+	}
+	if m.NumEntries <= tombstones {
+		return math.Inf(1)
+	}
+	return float64(tombstones) / float64(m.NumEntries-tombstones)
+}
+
+// Metrics holds metrics for various subsystems of the DB.
+type Metrics struct {
+	Compact struct {
+		// The number of candidate compactions waiting for the compaction
+		// worker.
+		QueueDepth int
+		// The totals of the compactions which rewrote tables, as reported to
+		// EventListener.CompactionEnd. The steady-state write amplification of
+		// compactions is OutputBytes / InputLevelBytes.
+		Count           int64
+		InputBytes      uint64
+		InputLevelBytes uint64
+		OutputBytes     uint64
+		Duration        time.Duration
+	}
+	Iterators struct {
+		// The number of iterators which have been created and not yet closed.
+		Open int
+	}
+	// Levels holds the metrics for each level of the LSM of the current
+	// version, indexed by level.
+	Levels     [numLevels]LevelMetrics
+	TableCache struct {
+		// The maximum number of sstable readers the table cache will hold open.
+		Size int
+		// The number of sstable readers currently open. This may exceed Size
+		// if readers evicted from the cache are still in use by iterators.
+		OpenFiles int64
+	}
+}
+
+// Metrics returns metrics about the DB.
+func (d *DB) Metrics() *Metrics {
+	m := &Metrics{}
+	m.Iterators.Open = int(atomic.LoadInt32(&d.openIters))
+	d.mu.Lock()
+	m.Compact.QueueDepth = d.mu.compact.queue.len()
+	m.Compact.Count = d.mu.compact.count
+	m.Compact.InputBytes = d.mu.compact.total.InputBytes
+	m.Compact.InputLevelBytes = d.mu.compact.total.InputLevelBytes
+	m.Compact.OutputBytes = d.mu.compact.total.OutputBytes
+	m.Compact.Duration = d.mu.compact.total.Duration
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		l := &m.Levels[level]
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			l.NumFiles++
+			l.Size += f.size
+			l.NumEntries += f.numEntries
+			l.NumDeletions += f.numDeletions
+			l.NumRangeDeletions += f.numRangeDeletions
+		}
+	}
+	d.mu.Unlock()
+	m.TableCache.Size, m.TableCache.OpenFiles = d.tableCache.metrics()
+	return m
+}
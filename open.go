@@ -11,11 +11,14 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/petermattis/pebble/arenaskl"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/rate"
 	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -59,15 +62,19 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	const defaultBurst = 1 << 20                  // 1 MB
 
 	opts = opts.EnsureDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 	d := &DB{
 		dirname:           dirname,
 		opts:              opts,
 		cmp:               opts.Comparer.Compare,
-		merge:             opts.Merger.Merge,
+		merge:             opts.MergeFunc(),
 		inlineKey:         opts.Comparer.InlineKey,
+		partialMerge:      opts.PartialMergeFunc(),
 		commitController:  newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
-		compactController: newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
-		flushController:   newController(rate.NewLimiter(rate.Inf, defaultBurst)),
+		compactController: newController(rate.NewLimiter(rateLimit(opts.CompactionBytesPerSecond), defaultBurst)),
+		flushController:   newController(rate.NewLimiter(rateLimit(opts.FlushBytesPerSecond), defaultBurst)),
 	}
 	tableCacheSize := opts.MaxOpenFiles - numNonTableCacheFiles
 	if tableCacheSize < minTableCacheSize {
@@ -75,20 +82,26 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	}
 	d.tableCache.init(dirname, opts.Storage, d.opts, tableCacheSize)
 	d.newIter = d.tableCache.newIter
+	if opts.SkipCorruptTables {
+		d.newIter = d.tableCache.newSkipCorruptIter
+	}
 	d.commit = newCommitPipeline(commitEnv{
 		mu:            &d.mu.Mutex,
 		logSeqNum:     &d.mu.versions.logSeqNum,
 		visibleSeqNum: &d.mu.versions.visibleSeqNum,
 		controller:    d.commitController,
+		debugCheck:    opts.DebugCheck,
 		apply:         d.commitApply,
 		sync:          d.commitSync,
 		write:         d.commitWrite,
 	})
 	d.mu.mem.cond.L = &d.mu.Mutex
 	d.mu.mem.mutable = newMemTable(d.opts)
+	d.maxEntrySize = d.mu.mem.mutable.skl.Arena().Capacity() - d.mu.mem.mutable.emptySize
 	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 	d.mu.compact.cond.L = &d.mu.Mutex
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
+	d.mu.compact.queue.init(maxCompactionQueueLen)
 	// TODO(peter): This initialization is funky.
 	d.mu.versions.versions.mu = &d.mu.Mutex
 
@@ -110,6 +123,37 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 			fileLock.Close()
 		}
 	}()
+	dataDir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if dataDir != nil {
+			dataDir.Close()
+		}
+	}()
+	d.dataDir = dataDir
+
+	d.walDirname = opts.WALDir
+	if d.walDirname == "" {
+		d.walDirname = dirname
+	}
+	walFS := opts.WALStorage
+	if d.walSeparate() {
+		if err := walFS.MkdirAll(d.walDirname, 0755); err != nil {
+			return nil, err
+		}
+	}
+	walDir, err := walFS.OpenDir(d.walDirname)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if walDir != nil {
+			walDir.Close()
+		}
+	}()
+	d.walDir = walDir
 
 	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
 		// Create the DB if it did not already exist.
@@ -119,7 +163,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	} else if err != nil {
 		return nil, fmt.Errorf("pebble: database %q: %v", dirname, err)
 	} else if opts.ErrorIfDBExists {
-		return nil, fmt.Errorf("pebble: database %q already exists", dirname)
+		return nil, newError(ErrDBExists, nil, "pebble: database %q already exists", dirname)
 	}
 
 	// Load the version set.
@@ -128,29 +172,111 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		return nil, err
 	}
 
-	// Replay any newer log files than the ones named in the manifest.
+	// Check that the tables of the current version exist, so that a missing
+	// table is reported now rather than by the first read of it.
 	var ve versionEdit
-	ls, err := fs.List(dirname)
+	missing, err := findMissingTables(fs, dirname, d.mu.versions.currentVersion())
 	if err != nil {
 		return nil, err
 	}
+	if len(missing) > 0 {
+		if !opts.SkipCorruptTables {
+			fileNums := make([]string, len(missing))
+			for i := range missing {
+				fileNums[i] = fmt.Sprintf("%06d", missing[i].fileNum)
+			}
+			return nil, newError(ErrMissingTables, nil,
+				"pebble: manifest for DB %q references missing tables: %s",
+				dirname, strings.Join(fileNums, ", "))
+		}
+		// Remove the missing tables from the DB, which treats them as empty.
+		ve.deletedFiles = make(map[deletedFileEntry]bool, len(missing))
+		for _, e := range missing {
+			ve.deletedFiles[e] = true
+			opts.EventListener.TableSkipped(e.fileNum, newError(ErrMissingTables, nil,
+				"pebble: table %06d is missing", e.fileNum))
+		}
+	}
 
-	type fileNumAndName struct {
+	// Verify the tables of the current version, so that a corrupt table is
+	// reported now rather than by the first read of the corrupt region.
+	var corrupt []deletedFileEntry
+	if opts.VerifyTablesOnOpen {
+		var errs []error
+		corrupt, errs = findCorruptTables(fs, dirname, d.mu.versions.currentVersion(),
+			opts, missing, tableCacheSize)
+		if len(corrupt) > 0 {
+			if !opts.SkipCorruptTables {
+				fileNums := make([]string, len(corrupt))
+				for i := range corrupt {
+					fileNums[i] = fmt.Sprintf("%06d", corrupt[i].fileNum)
+				}
+				return nil, newError(ErrCorruptTables, errs[0],
+					"pebble: DB %q contains corrupt tables: %s: %v",
+					dirname, strings.Join(fileNums, ", "), errs[0])
+			}
+			// Remove the corrupt tables from the DB, which treats them as empty.
+			// The files are renamed once the DB no longer references them.
+			if ve.deletedFiles == nil {
+				ve.deletedFiles = make(map[deletedFileEntry]bool, len(corrupt))
+			}
+			for i, e := range corrupt {
+				ve.deletedFiles[e] = true
+				opts.EventListener.TableSkipped(e.fileNum, newError(ErrCorruptTables, errs[i],
+					"pebble: table %06d is corrupt: %v", e.fileNum, errs[i]))
+			}
+		}
+	}
+
+	// Replay any newer log files than the ones named in the manifest. The logs
+	// are found in the WAL directory, and in the DB directory if the WAL has
+	// been moved from there.
+	type logDir struct {
+		fs      storage.Storage
+		dirname string
+	}
+	logDirs := []logDir{{walFS, d.walDirname}}
+	if d.walSeparate() {
+		logDirs = append(logDirs, logDir{fs, dirname})
+	}
+	type fileNumAndPath struct {
 		num  uint64
-		name string
+		fs   storage.Storage
+		path string
 	}
-	var logFiles []fileNumAndName
-	for _, filename := range ls {
-		ft, fn, ok := parseDBFilename(filename)
-		if ok && ft == fileTypeLog && (fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber) {
-			logFiles = append(logFiles, fileNumAndName{fn, filename})
+	var logFiles []fileNumAndPath
+	var foundCurrent bool
+	seen := make(map[uint64]bool)
+	for _, dir := range logDirs {
+		ls, err := dir.fs.List(dir.dirname)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range ls {
+			ft, fn, ok := parseDBFilename(filename)
+			if ok && ft == fileTypeLog && !seen[fn] &&
+				(fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber) {
+				seen[fn] = true
+				foundCurrent = foundCurrent || fn >= d.mu.versions.logNumber
+				logFiles = append(logFiles, fileNumAndPath{fn, dir.fs, filepath.Join(dir.dirname, filename)})
+			}
 		}
 	}
+	// The log named by the manifest is created when the DB is opened or the
+	// memtable is switched, and is only deleted once a newer log is named by
+	// the manifest. A DB written by RocksDB may name a log which was never
+	// created, but still has a newer log. The absence of any log at least as
+	// new as the one named by the manifest means that the logs were not found.
+	if n := d.mu.versions.logNumber; n != 0 && !foundCurrent {
+		return nil, newError(ErrMissingLog, nil,
+			"pebble: log %06d of DB %q is not in WAL directory %q, which may have been changed",
+			n, dirname, d.walDirname)
+	}
 	sort.Slice(logFiles, func(i, j int) bool {
 		return logFiles[i].num < logFiles[j].num
 	})
 	for _, lf := range logFiles {
-		maxSeqNum, err := d.replayWAL(&ve, fs, filepath.Join(dirname, lf.name))
+		maxSeqNum, err := d.replayWAL(&ve, lf.fs, lf.path)
 		if err != nil {
 			return nil, err
 		}
@@ -164,10 +290,13 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	// Create an empty .log file.
 	ve.logNumber = d.mu.versions.nextFileNum()
 	d.mu.log.number = ve.logNumber
-	logFile, err := fs.Create(dbFilename(dirname, fileTypeLog, ve.logNumber))
+	logFile, err := walFS.Create(dbFilename(d.walDirname, fileTypeLog, ve.logNumber))
 	if err != nil {
 		return nil, err
 	}
+	if err := d.walDir.Sync(); err != nil {
+		return nil, err
+	}
 	d.mu.log.LogWriter = record.NewLogWriter(logFile)
 
 	// Write a new manifest to disk.
@@ -175,15 +304,116 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		return nil, err
 	}
 
+	// Quarantine the corrupt tables before they are deleted as obsolete. The
+	// renamed files are not recognized as DB files, and are left alone.
+	for _, e := range corrupt {
+		filename := dbFilename(dirname, fileTypeTable, e.fileNum)
+		if err := fs.Rename(filename, filename+".corrupt"); err != nil {
+			opts.Logger.Infof("unable to quarantine corrupt table %06d: %v", e.fileNum, err)
+		}
+	}
+
 	d.deleteObsoleteFiles()
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
 
 	d.fileLock, fileLock = fileLock, nil
+	dataDir, walDir = nil, nil
 	return d, nil
 }
 
-// replayWAL replays the edits in the specified log file.
+// findMissingTables returns the tables of v which do not exist in the DB
+// directory, in file number order.
+func findMissingTables(
+	fs storage.Storage, dirname string, v *version,
+) ([]deletedFileEntry, error) {
+	var missing []deletedFileEntry
+	for level := range v.files {
+		for _, f := range v.files[level] {
+			_, err := fs.Stat(dbFilename(dirname, fileTypeTable, f.fileNum))
+			if os.IsNotExist(err) {
+				missing = append(missing, deletedFileEntry{level: level, fileNum: f.fileNum})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].fileNum < missing[j].fileNum
+	})
+	return missing, nil
+}
+
+// findCorruptTables verifies the tables of v which are not in missing using
+// sstable.Verify, returning the tables which fail verification and their
+// errors, in file number order. At most parallelism tables are verified
+// concurrently.
+func findCorruptTables(
+	fs storage.Storage, dirname string, v *version, opts *db.Options,
+	missing []deletedFileEntry, parallelism int,
+) ([]deletedFileEntry, []error) {
+	skip := make(map[uint64]bool, len(missing))
+	for _, e := range missing {
+		skip[e.fileNum] = true
+	}
+
+	type result struct {
+		entry deletedFileEntry
+		err   error
+	}
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for level := range v.files {
+		for _, f := range v.files[level] {
+			if skip[f.fileNum] {
+				continue
+			}
+			e := deletedFileEntry{level: level, fileNum: f.fileNum}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if err := verifyTable(fs, dbFilename(dirname, fileTypeTable, e.fileNum), opts); err != nil {
+					mu.Lock()
+					results = append(results, result{e, err})
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].entry.fileNum < results[j].entry.fileNum
+	})
+	corrupt := make([]deletedFileEntry, len(results))
+	errs := make([]error, len(results))
+	for i := range results {
+		corrupt[i], errs[i] = results[i].entry, results[i].err
+	}
+	return corrupt, errs
+}
+
+// verifyTable verifies the table in the specified file with sstable.Verify.
+func verifyTable(fs storage.Storage, filename string, opts *db.Options) error {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return err
+	}
+	_, err = sstable.Verify(f, opts)
+	return firstError(err, f.Close())
+}
+
+// replayWAL replays the edits in the specified log file, which is read from
+// fs. The tables flushed from the replayed edits are written to the DB
+// directory.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
@@ -198,11 +428,18 @@ func (d *DB) replayWAL(
 	}
 	defer file.Close()
 
+	mode := record.TolerateTailMode
+	switch {
+	case d.opts.StrictWALRecovery:
+		mode = record.StrictMode
+	case d.opts.SkipCorruptWALRecords:
+		mode = record.RecoverMode
+	}
 	var (
 		b   Batch
 		buf bytes.Buffer
 		mem *memTable
-		rr  = record.NewReader(file)
+		rr  = record.NewReader(file, mode)
 	)
 	for {
 		r, err := rr.Next()
@@ -210,15 +447,24 @@ func (d *DB) replayWAL(
 			break
 		}
 		if err != nil {
+			if mode != record.RecoverMode {
+				return 0, newError(ErrCorruptLog, err,
+					"pebble: corrupt log file %q: %v", filename, err)
+			}
 			return 0, err
 		}
 		_, err = io.Copy(&buf, r)
 		if err != nil {
-			return 0, err
+			// The record is corrupt or was torn by a crash. The next call to
+			// Next returns the error in StrictMode, and in TolerateTailMode
+			// unless the record was at the tail of the log, in which case it
+			// returns io.EOF. In RecoverMode it skips to the next valid record.
+			buf.Reset()
+			continue
 		}
 
 		if buf.Len() < batchHeaderLen {
-			return 0, fmt.Errorf("pebble: corrupt log file %q", filename)
+			return 0, newError(ErrCorruptLog, nil, "pebble: corrupt log file %q", filename)
 		}
 		b = Batch{}
 		b.data = buf.Bytes()
@@ -253,15 +499,18 @@ func (d *DB) replayWAL(
 	}
 
 	if mem != nil && !mem.Empty() {
-		meta, err := d.writeLevel0Table(fs, mem.NewIter(nil))
+		metas, err := d.writeLevel0Table(d.opts.Storage, mem.newFlushIter())
 		if err != nil {
 			return 0, err
 		}
-		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
-		// Strictly speaking, it's too early to delete meta.fileNum from d.pendingOutputs,
-		// but we are replaying the log file, which happens before Open returns, so there
-		// is no possibility of deleteObsoleteFiles being called concurrently here.
-		delete(d.mu.compact.pendingOutputs, meta.fileNum)
+		for _, meta := range metas {
+			ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
+			// Strictly speaking, it's too early to delete meta.fileNum from
+			// d.pendingOutputs, but we are replaying the log file, which happens
+			// before Open returns, so there is no possibility of
+			// deleteObsoleteFiles being called concurrently here.
+			delete(d.mu.compact.pendingOutputs, meta.fileNum)
+		}
 	}
 
 	return maxSeqNum, nil
@@ -5,14 +5,24 @@
 package pebble
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/record"
+	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -45,6 +55,168 @@ func TestErrorIfDBExists(t *testing.T) {
 	}
 }
 
+func TestOpenErrors(t *testing.T) {
+	// create returns a storage containing a freshly created DB, and the name
+	// of its manifest.
+	create := func() (storage.Storage, string) {
+		fs := storage.NewMem()
+		d, err := Open("", &db.Options{Storage: fs})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		f, err := fs.Open("CURRENT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		buf := make([]byte, 100)
+		n, _ := f.Read(buf)
+		return fs, strings.TrimSuffix(string(buf[:n]), "\n")
+	}
+	writeFile := func(fs storage.Storage, name string, data []byte) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		setup    func() (storage.Storage, *db.Options)
+		expected error
+	}{
+		{
+			"db-exists",
+			func() (storage.Storage, *db.Options) {
+				fs, _ := create()
+				return fs, &db.Options{ErrorIfDBExists: true}
+			},
+			ErrDBExists,
+		},
+		{
+			"comparer-mismatch",
+			func() (storage.Storage, *db.Options) {
+				fs, _ := create()
+				return fs, &db.Options{Comparer: db.ReverseComparer}
+			},
+			ErrComparerMismatch,
+		},
+		{
+			"empty-current",
+			func() (storage.Storage, *db.Options) {
+				fs, _ := create()
+				writeFile(fs, "CURRENT", nil)
+				return fs, &db.Options{}
+			},
+			ErrCorruptManifest,
+		},
+		{
+			"malformed-current",
+			func() (storage.Storage, *db.Options) {
+				fs, manifest := create()
+				writeFile(fs, "CURRENT", []byte(manifest))
+				return fs, &db.Options{}
+			},
+			ErrCorruptManifest,
+		},
+		{
+			"missing-manifest",
+			func() (storage.Storage, *db.Options) {
+				fs, manifest := create()
+				if err := fs.Remove(manifest); err != nil {
+					t.Fatal(err)
+				}
+				return fs, &db.Options{}
+			},
+			ErrCorruptManifest,
+		},
+		{
+			"corrupt-manifest",
+			func() (storage.Storage, *db.Options) {
+				fs, manifest := create()
+				writeFile(fs, manifest, []byte("not a manifest"))
+				return fs, &db.Options{}
+			},
+			ErrCorruptManifest,
+		},
+		{
+			"corrupt-log",
+			func() (storage.Storage, *db.Options) {
+				fs, _ := create()
+				// A valid record which is too short to be a batch.
+				f, err := fs.Create(dbFilename("", fileTypeLog, 100))
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := record.NewWriter(f)
+				if _, err := w.WriteRecord([]byte("short")); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return fs, &db.Options{}
+			},
+			ErrCorruptLog,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			fs, opts := c.setup()
+			opts.Storage = fs
+			d, err := Open("", opts)
+			if err == nil {
+				d.Close()
+				t.Fatalf("expected %v, but found no error", c.expected)
+			}
+			if !errors.Is(err, c.expected) {
+				t.Fatalf("expected %v, but found %v", c.expected, err)
+			}
+			var e *Error
+			if !errors.As(err, &e) || e.Kind != c.expected {
+				t.Fatalf("expected *Error of kind %v, but found %#v", c.expected, err)
+			}
+		})
+	}
+
+	// A missing CURRENT file is reported by versionSet.load, wrapping the
+	// underlying not-exist error. Open creates the DB in that case.
+	var vs versionSet
+	opts := (&db.Options{Storage: storage.NewMem()}).EnsureDefaults()
+	err := vs.load("", opts)
+	if !errors.Is(err, ErrMissingCurrent) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %v, but found %v", ErrMissingCurrent, err)
+	}
+	if s := err.Error(); !strings.Contains(s, "CURRENT") {
+		t.Fatalf("expected error mentioning CURRENT, but found %q", s)
+	}
+}
+
+func TestOpenInvalidOptions(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage:                     storage.NewMem(),
+		MemTableStopWritesThreshold: 1,
+	})
+	if d != nil {
+		defer d.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "MemTableStopWritesThreshold") {
+		t.Fatalf("expected invalid options error, but found %v", err)
+	}
+}
+
 func TestNewDBFilenames(t *testing.T) {
 	fooBar := filepath.Join("foo", "bar")
 	fs := storage.NewMem()
@@ -73,6 +245,450 @@ func TestNewDBFilenames(t *testing.T) {
 	}
 }
 
+func TestMinFileNumber(t *testing.T) {
+	fs := storage.NewMem()
+	if err := fs.MkdirAll("migrate", 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	// Pre-place a table numbered 100, as written by a migration tool.
+	migrated := filepath.Join("migrate", "000100.sst")
+	f, err := fs.Create(migrated)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	if err := w.Add(db.MakeInternalKey([]byte("m"), 0, db.InternalKeyKindSet), []byte("m")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	checkFileNums := func() {
+		t.Helper()
+		ls, err := fs.List("db")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, name := range ls {
+			var fileNum uint64
+			if n, _ := fmt.Sscanf(name, "MANIFEST-%d", &fileNum); n == 0 {
+				_, fileNum, _ = parseDBFilename(name)
+			}
+			if fileNum != 0 && fileNum <= 100 {
+				t.Fatalf("expected file numbers above 100, but found %s in %v", name, ls)
+			}
+		}
+	}
+
+	// The DB continues from its own file numbers when reopened without
+	// MinFileNumber.
+	for _, minFileNumber := range []uint64{101, 0} {
+		d, err := Open("db", &db.Options{
+			MinFileNumber: minFileNumber,
+			Storage:       fs,
+		})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := d.Set([]byte(fmt.Sprint(minFileNumber)), nil, nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if minFileNumber != 0 {
+			if err := d.Ingest([]string{migrated}); err != nil {
+				t.Fatalf("Ingest: %v", err)
+			}
+		}
+		if v, err := d.Get([]byte("m")); err != nil || string(v) != "m" {
+			t.Fatalf("expected migrated key, but found %q (%v)", v, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkFileNums()
+	}
+}
+
+func TestOpenMissingTables(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var fileNums []uint64
+	for _, key := range []string{"a", "b"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		files := d.mu.versions.currentVersion().files[0]
+		fileNums = append(fileNums, files[len(files)-1].fileNum)
+		d.mu.Unlock()
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := fs.Remove(dbFilename("", fileTypeTable, fileNums[0])); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	_, err = Open("", &db.Options{
+		Storage: fs,
+	})
+	if !errors.Is(err, ErrMissingTables) ||
+		!strings.Contains(err.Error(), fmt.Sprintf("%06d", fileNums[0])) {
+		t.Fatalf("expected missing table %06d error, but found %v", fileNums[0], err)
+	}
+
+	// In repair mode, the missing table is reported and treated as empty.
+	var skipped []uint64
+	d, err = Open("", &db.Options{
+		EventListener: db.EventListener{
+			TableSkipped: func(fileNum uint64, err error) {
+				skipped = append(skipped, fileNum)
+			},
+		},
+		SkipCorruptTables: true,
+		Storage:           fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != fileNums[0] {
+		t.Fatalf("expected table %06d to be skipped, but found %v", fileNums[0], skipped)
+	}
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected a to be not found, but found %v", err)
+	}
+	if v, err := d.Get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The missing table was removed from the DB.
+	d, err = Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestOpenVerifyTables(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var fileNums []uint64
+	for _, key := range []string{"a", "b"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		files := d.mu.versions.currentVersion().files[0]
+		fileNums = append(fileNums, files[len(files)-1].fileNum)
+		d.mu.Unlock()
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Corrupt the data block of the table containing "a".
+	filename := dbFilename("", fileTypeTable, fileNums[0])
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	data[0] ^= 0xff
+	f, err = fs.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Without verification, the corruption goes unnoticed until "a" is read.
+	d, err = Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if v, err := d.Get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// With verification, Open fails.
+	_, err = Open("", &db.Options{
+		Storage:            fs,
+		VerifyTablesOnOpen: true,
+	})
+	if !errors.Is(err, ErrCorruptTables) ||
+		!strings.Contains(err.Error(), fmt.Sprintf("%06d", fileNums[0])) ||
+		strings.Contains(err.Error(), fmt.Sprintf("%06d", fileNums[1])) {
+		t.Fatalf("expected corrupt table %06d error, but found %v", fileNums[0], err)
+	}
+
+	// In repair mode, the corrupt table is reported, removed from the DB and
+	// quarantined.
+	var skipped []uint64
+	d, err = Open("", &db.Options{
+		EventListener: db.EventListener{
+			TableSkipped: func(fileNum uint64, err error) {
+				if !errors.Is(err, ErrCorruptTables) {
+					t.Errorf("expected corrupt table error, but found %v", err)
+				}
+				skipped = append(skipped, fileNum)
+			},
+		},
+		SkipCorruptTables:  true,
+		Storage:            fs,
+		VerifyTablesOnOpen: true,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != fileNums[0] {
+		t.Fatalf("expected table %06d to be skipped, but found %v", fileNums[0], skipped)
+	}
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected a to be not found, but found %v", err)
+	}
+	if v, err := d.Get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %q (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := fs.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to not exist, but found %v", filename, err)
+	}
+	if _, err := fs.Stat(filename + ".corrupt"); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// The remaining tables verify.
+	d, err = Open("", &db.Options{
+		Storage:            fs,
+		VerifyTablesOnOpen: true,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestLogDataReplay(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	b := d.NewBatch()
+	b.Set([]byte("a"), []byte("1"), nil)
+	b.LogData([]byte("marker1"), nil)
+	b.Set([]byte("b"), []byte("2"), nil)
+	if err := d.Apply(b, nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := d.LogData([]byte("marker2"), nil); err != nil {
+		t.Fatalf("LogData: %v", err)
+	}
+	if err := d.Set([]byte("c"), []byte("3"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A reader of the WAL observes the markers in order with the data.
+	ls, err := fs.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sort.Strings(ls)
+	var ops []string
+	for _, name := range ls {
+		if ft, _, ok := parseDBFilename(name); !ok || ft != fileTypeLog {
+			continue
+		}
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		rr := record.NewReader(f, record.StrictMode)
+		for {
+			r, err := rr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			repr, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			err = NewBatchFromRepr(repr).Iterate(func(kind db.InternalKeyKind, key, value []byte) error {
+				ops = append(ops, fmt.Sprintf("%d:%s", kind, key))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Iterate: %v", err)
+			}
+		}
+		f.Close()
+	}
+	expected := []string{"1:a", "3:marker1", "1:b", "3:marker2", "1:c"}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("expected %v, but found %v", expected, ops)
+	}
+
+	// Replaying the WAL applies the data, and the markers do not consume
+	// sequence numbers.
+	d, err = Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if v, err := d.Get([]byte(key)); err != nil || string(v) != value {
+			t.Fatalf("%s: expected %s, but found %q (%v)", key, value, v, err)
+		}
+	}
+	if s := atomic.LoadUint64(&d.mu.versions.logSeqNum); s != 3 {
+		t.Fatalf("expected log sequence number 3, but found %d", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	// open creates a DB holding the keys a, b and c in its WAL, each with a
+	// value which spans more than one block of the WAL, flips the byte at
+	// offset off of the WAL (from the end of the WAL if off is negative), and
+	// reopens the DB with opts, returning the keys which are found.
+	open := func(off int64, opts db.Options) (string, error) {
+		fs := storage.NewMem()
+		d, err := Open("", &db.Options{
+			Storage: fs,
+		})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			if err := d.Set([]byte(k), bytes.Repeat([]byte(k), 40<<10), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		name := dbFilename("", fileTypeLog, d.mu.log.number)
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		f.Close()
+		if off < 0 {
+			off += int64(len(data))
+		}
+		data[off] ^= 0x01
+		if f, err = fs.Create(name); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		f.Close()
+
+		opts.Storage = fs
+		d, err = Open("", &opts)
+		if err != nil {
+			return "", err
+		}
+		var keys []string
+		iter := d.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return strings.Join(keys, " "), nil
+	}
+
+	// A flipped byte in the first record fails Open by default and when
+	// StrictWALRecovery is set, and is skipped when SkipCorruptWALRecords is
+	// set.
+	for i, opts := range []db.Options{{}, {StrictWALRecovery: true}} {
+		if _, err := open(100, opts); !errors.Is(err, ErrCorruptLog) {
+			t.Fatalf("%d: expected %v, but found %v", i, ErrCorruptLog, err)
+		}
+	}
+	if keys, err := open(100, db.Options{SkipCorruptWALRecords: true}); err != nil || keys != "b c" {
+		t.Fatalf("expected b c, but found %q (%v)", keys, err)
+	}
+
+	// A flipped byte in the last record is the end of the WAL, unless
+	// StrictWALRecovery is set.
+	for i, opts := range []db.Options{{}, {SkipCorruptWALRecords: true}} {
+		if keys, err := open(-1, opts); err != nil || keys != "a b" {
+			t.Fatalf("%d: expected a b, but found %q (%v)", i, keys, err)
+		}
+	}
+	if _, err := open(-1, db.Options{StrictWALRecovery: true}); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected %v, but found %v", ErrCorruptLog, err)
+	}
+}
+
 func TestOpenCloseOpenClose(t *testing.T) {
 	opts := &db.Options{
 		Storage: storage.NewMem(),
@@ -146,3 +762,214 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+// syncDirTestFS records the files created and renamed in a Storage and the
+// syncs of its directories.
+type syncDirTestFS struct {
+	storage.Storage
+
+	mu  sync.Mutex
+	ops []string
+}
+
+func (fs *syncDirTestFS) record(op string) {
+	fs.mu.Lock()
+	fs.ops = append(fs.ops, op)
+	fs.mu.Unlock()
+}
+
+func (fs *syncDirTestFS) Create(name string) (storage.File, error) {
+	fs.record("create " + filepath.Base(name))
+	return fs.Storage.Create(name)
+}
+
+func (fs *syncDirTestFS) Rename(oldname, newname string) error {
+	fs.record("rename " + filepath.Base(newname))
+	return fs.Storage.Rename(oldname, newname)
+}
+
+func (fs *syncDirTestFS) OpenDir(name string) (storage.File, error) {
+	f, err := fs.Storage.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return syncDirTestFile{f, fs}, nil
+}
+
+type syncDirTestFile struct {
+	storage.File
+	fs *syncDirTestFS
+}
+
+func (f syncDirTestFile) Sync() error {
+	f.fs.record("sync-dir")
+	return f.File.Sync()
+}
+
+func TestSyncDir(t *testing.T) {
+	fs := &syncDirTestFS{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("b"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The directory is synced after CURRENT is renamed and after each log and
+	// table is created, before any other file is created or renamed.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var renames, logs, tables int
+	for i, op := range fs.ops {
+		var pending bool
+		switch {
+		case op == "rename CURRENT":
+			renames++
+			pending = true
+		case strings.HasPrefix(op, "create ") && strings.HasSuffix(op, ".log"):
+			logs++
+			pending = true
+		case strings.HasPrefix(op, "create ") && strings.HasSuffix(op, ".sst"):
+			tables++
+			pending = true
+		}
+		if !pending {
+			continue
+		}
+		synced := false
+		for _, next := range fs.ops[i+1:] {
+			if next == "sync-dir" {
+				synced = true
+				break
+			}
+			if strings.HasPrefix(next, "create ") || strings.HasPrefix(next, "rename ") {
+				break
+			}
+		}
+		if !synced {
+			t.Fatalf("expected directory sync after %q, but found:\n%s",
+				op, strings.Join(fs.ops, "\n"))
+		}
+	}
+	if renames < 2 || logs < 2 || tables != 1 {
+		t.Fatalf("expected at least 2 CURRENT renames, 2 logs and 1 table, but found %d, %d and %d:\n%s",
+			renames, logs, tables, strings.Join(fs.ops, "\n"))
+	}
+}
+
+func TestOpenWALDir(t *testing.T) {
+	fs, walFS := storage.NewMem(), storage.NewMem()
+
+	// logNums returns the numbers of the log files in dirname.
+	logNums := func(fs storage.Storage, dirname string) []uint64 {
+		ls, err := fs.List(dirname)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		var nums []uint64
+		for _, name := range ls {
+			if ft, fn, ok := parseDBFilename(name); ok && ft == fileTypeLog {
+				nums = append(nums, fn)
+			}
+		}
+		return nums
+	}
+	check := func(d *DB, keys ...string) {
+		for _, key := range keys {
+			if v, err := d.Get([]byte(key)); err != nil || string(v) != key {
+				t.Fatalf("%s: expected %s, but found %q (%v)", key, key, v, err)
+			}
+		}
+	}
+
+	// Write a key to a WAL in the DB directory, and then move the WAL to a
+	// directory in walFS. Opening the DB replays the log remaining in the DB
+	// directory, which is then removed.
+	d, err := Open("db", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), db.Sync); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	opts := &db.Options{
+		Storage:    fs,
+		WALDir:     "wal",
+		WALStorage: walFS,
+	}
+	d, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(d, "a")
+	if nums := logNums(fs, "db"); len(nums) != 0 {
+		t.Fatalf("expected no logs in the DB directory, but found %d", nums)
+	}
+
+	// Writes are logged to the WAL directory, sharing the file numbers of the
+	// DB, and are recovered from there.
+	if err := d.Set([]byte("b"), []byte("b"), db.Sync); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	nums := logNums(walFS, "wal")
+	if len(nums) != 1 {
+		t.Fatalf("expected 1 log in the WAL directory, but found %d", nums)
+	}
+	names, err := fs.List("db")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	for _, name := range names {
+		if _, fn, ok := parseDBFilename(name); ok && fn == nums[0] {
+			t.Fatalf("log %06d shares its file number with %s", nums[0], name)
+		}
+	}
+	d, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(d, "a", "b")
+	if n := logNums(walFS, "wal"); len(n) != 1 || n[0] == nums[0] {
+		t.Fatalf("expected the replayed log %06d to be replaced, but found %d", nums[0], n)
+	}
+
+	// Opening the DB with the WAL in another directory, or back in the DB
+	// directory, fails rather than losing the unflushed writes in the log.
+	if err := d.Set([]byte("c"), []byte("c"), db.Sync); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, o := range []*db.Options{
+		{Storage: fs, WALDir: "wal2", WALStorage: walFS},
+		{Storage: fs},
+	} {
+		if _, err := Open("db", o); !errors.Is(err, ErrMissingLog) {
+			t.Fatalf("WALDir=%q: expected %v, but found %v", o.WALDir, ErrMissingLog, err)
+		}
+	}
+	d, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	check(d, "a", "b", "c")
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -5,9 +5,20 @@
 package ptable
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"unsafe"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/db"
+)
+
+// The codec of a page, stored in the byte following the column type.
+const (
+	noCompressionPageCodec     = 0
+	snappyCompressionPageCodec = 1
 )
 
 type columnWriter struct {
@@ -17,6 +28,18 @@ type columnWriter struct {
 	nulls     nullBitmapBuilder
 	count     int32
 	nullCount int32
+	// compression is the compression applied to the column's page by
+	// blockWriter.Finish.
+	compression db.Compression
+	// compressed holds the compressed page during blockWriter.Finish, or is
+	// empty if the page is stored uncompressed.
+	compressed []byte
+	// sorted is true if the values put to the column are required to be
+	// non-decreasing, with NULLs first. See blockWriter.SetSorted.
+	sorted bool
+	// lastStart is the offset within data of the last non-NULL value of a
+	// sorted bytes column.
+	lastStart int32
 }
 
 func (w *columnWriter) reset() {
@@ -25,6 +48,7 @@ func (w *columnWriter) reset() {
 	w.nulls = w.nulls[:0]
 	w.count = 0
 	w.nullCount = 0
+	w.lastStart = 0
 }
 
 func (w *columnWriter) grow(n int) []byte {
@@ -56,6 +80,7 @@ func (w *columnWriter) putInt8(v int8) {
 		panic("int8 column value expected")
 	}
 	w.data = append(w.data, byte(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
@@ -65,6 +90,7 @@ func (w *columnWriter) putInt16(v int16) {
 		panic("int16 column value expected")
 	}
 	binary.LittleEndian.PutUint16(w.grow(2), uint16(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
@@ -74,6 +100,7 @@ func (w *columnWriter) putInt32(v int32) {
 		panic("int32 column value expected")
 	}
 	binary.LittleEndian.PutUint32(w.grow(4), uint32(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
@@ -83,6 +110,7 @@ func (w *columnWriter) putInt64(v int64) {
 		panic("int64 column value expected")
 	}
 	binary.LittleEndian.PutUint64(w.grow(8), uint64(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
@@ -92,6 +120,7 @@ func (w *columnWriter) putFloat32(v float32) {
 		panic("float32 column value expected")
 	}
 	binary.LittleEndian.PutUint32(w.grow(4), math.Float32bits(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
@@ -101,22 +130,49 @@ func (w *columnWriter) putFloat64(v float64) {
 		panic("float64 column value expected")
 	}
 	binary.LittleEndian.PutUint64(w.grow(8), math.Float64bits(v))
+	w.checkSorted()
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
 
 func (w *columnWriter) putBytes(v []byte) {
+	if w.ctype.fixedBytes() {
+		w.putFixedBytes(v)
+		return
+	}
 	if w.ctype != ColumnTypeBytes {
 		panic("bytes column value expected")
 	}
+	start := int32(len(w.data))
+	if w.sorted && w.count > w.nullCount && bytes.Compare(w.data[w.lastStart:start], v) > 0 {
+		panic("pebble/ptable: value out of order in sorted column")
+	}
+	w.lastStart = start
 	w.data = append(w.data, v...)
 	w.offsets = append(w.offsets, int32(len(w.data)))
 	w.nulls = w.nulls.set(int(w.count), false)
 	w.count++
 }
 
+func (w *columnWriter) putFixedBytes(v []byte) {
+	if len(v) != int(w.ctype.Width()) {
+		panic(fmt.Sprintf("pebble/ptable: %d byte value put to %s column", len(v), w.ctype))
+	}
+	w.data = append(w.data, v...)
+	w.checkSorted()
+	w.nulls = w.nulls.set(int(w.count), false)
+	w.count++
+}
+
 func (w *columnWriter) putNull() {
+	if w.sorted && w.count > w.nullCount {
+		panic("pebble/ptable: NULL after non-NULL value in sorted column")
+	}
 	w.nulls = w.nulls.set(int(w.count), true)
+	if w.ctype == ColumnTypeBool {
+		// The value bitmap is indexed by row, so it must cover the NULL rows.
+		w.data = (Bitmap)(w.data).set(int(w.count), false)
+	}
 	if w.ctype.Width() <= 0 {
 		w.offsets = append(w.offsets, int32(len(w.data)))
 	}
@@ -124,6 +180,42 @@ func (w *columnWriter) putNull() {
 	w.nullCount++
 }
 
+// checkSorted checks that the value just appended to a sorted fixed width
+// column is not less than the previous value. NULLs do not occupy space in
+// data, so the previous value is the previous non-NULL value.
+func (w *columnWriter) checkSorted() {
+	width := int(w.ctype.Width())
+	n := len(w.data)
+	if !w.sorted || n < 2*width {
+		return
+	}
+	a, b := w.data[n-2*width:n-width], w.data[n-width:]
+	var c int
+	switch w.ctype {
+	case ColumnTypeInt8:
+		c = compareInt64(int64(int8(a[0])), int64(int8(b[0])))
+	case ColumnTypeInt16:
+		c = compareInt64(int64(int16(binary.LittleEndian.Uint16(a))), int64(int16(binary.LittleEndian.Uint16(b))))
+	case ColumnTypeInt32:
+		c = compareInt64(int64(int32(binary.LittleEndian.Uint32(a))), int64(int32(binary.LittleEndian.Uint32(b))))
+	case ColumnTypeInt64:
+		c = compareInt64(int64(binary.LittleEndian.Uint64(a)), int64(binary.LittleEndian.Uint64(b)))
+	case ColumnTypeFloat32:
+		c = compareFloat64(float64(math.Float32frombits(binary.LittleEndian.Uint32(a))),
+			float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	case ColumnTypeFloat64:
+		c = compareFloat64(math.Float64frombits(binary.LittleEndian.Uint64(a)),
+			math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	default:
+		if w.ctype.fixedBytes() {
+			c = bytes.Compare(a, b)
+		}
+	}
+	if c > 0 {
+		panic("pebble/ptable: value out of order in sorted column")
+	}
+}
+
 func align(offset, val int32) int32 {
 	return (offset + val - 1) & ^(val - 1)
 }
@@ -132,6 +224,9 @@ func (w *columnWriter) encode(offset int32, buf []byte) int32 {
 	// The column type.
 	buf[offset] = byte(w.ctype)
 	offset++
+	// The page codec.
+	buf[offset] = noCompressionPageCodec
+	offset++
 	// The NULL-bitmap.
 	if w.nullCount == 0 {
 		buf[offset] = 0 // no NULL-bitmap
@@ -150,7 +245,7 @@ func (w *columnWriter) encode(offset int32, buf []byte) int32 {
 	offset = align(offset, w.ctype.Alignment())
 	offset += int32(copy(buf[offset:], w.data))
 	// The offsets for variable width data.
-	if w.ctype.Width() <= 0 {
+	if w.ctype.Width() <= 0 && w.count > 0 {
 		offset = align(offset, 4)
 		dest := (*[1 << 31]int32)(unsafe.Pointer(&buf[offset]))[:w.count:w.count]
 		copy(dest, w.offsets)
@@ -163,6 +258,8 @@ func (w *columnWriter) size(offset int32) int32 {
 	startOffset := offset
 	// The column type.
 	offset++
+	// The page codec.
+	offset++
 	// The NULL-bitmap.
 	offset++
 	if w.nullCount > 0 {
@@ -191,6 +288,9 @@ func pageOffsetPos(i int) int32 {
 type blockWriter struct {
 	cols []columnWriter
 	buf  []byte
+	// scratch holds the uncompressed encoding of a page which is compressed by
+	// Finish.
+	scratch []byte
 }
 
 func (w *blockWriter) init(s []ColumnType) {
@@ -206,24 +306,99 @@ func (w *blockWriter) reset() {
 	}
 }
 
+// SetCompression sets the compression applied to the specified column's page
+// by Finish. Each column is compressed independently, and a page which does
+// not compress well is stored uncompressed. Columns are not compressed by
+// default (DefaultCompression and NoCompression). Only NoCompression and
+// SnappyCompression are supported.
+//
+// TODO(peter): support ZstdCompression.
+func (w *blockWriter) SetCompression(col int, c db.Compression) {
+	switch c {
+	case db.DefaultCompression, db.NoCompression, db.SnappyCompression:
+	default:
+		panic(fmt.Sprintf("pebble/ptable: unsupported column compression: %s", c))
+	}
+	w.cols[col].compression = c
+}
+
+// SetSorted marks the specified column as sorted: its non-NULL values must be
+// put in non-decreasing order, following any NULLs, which is the order
+// assumed by Vec.SearchInt64, Vec.SearchFloat64 and Vec.SearchBytes. A put
+// which violates the order panics. SetSorted must be called before any values
+// are put to the column, and only numeric and bytes columns can be sorted.
+func (w *blockWriter) SetSorted(col int) {
+	c := &w.cols[col]
+	if c.ctype == ColumnTypeBool {
+		panic("pebble/ptable: bool column cannot be sorted")
+	}
+	if c.count > 0 {
+		panic("pebble/ptable: column must be marked sorted before values are put")
+	}
+	c.sorted = true
+}
+
+// compress compresses the page for col, if its compression calls for it,
+// leaving the compressed page in col.compressed.
+func (w *blockWriter) compress(col *columnWriter) {
+	col.compressed = col.compressed[:0]
+	if col.compression != db.SnappyCompression {
+		return
+	}
+	// The page is compressed in its uncompressed encoding at offset 0, which
+	// preserves the alignment of the column data when the page is decompressed
+	// into an aligned buffer.
+	size := col.size(0)
+	if int32(cap(w.scratch)) < size {
+		w.scratch = make([]byte, size)
+	}
+	w.scratch = w.scratch[:size]
+	col.encode(0, w.scratch)
+	compressed := snappy.Encode(col.compressed[:cap(col.compressed)], w.scratch)
+	if len(compressed) >= len(w.scratch)-len(w.scratch)/8 {
+		// Not worth compressing.
+		col.compressed = compressed[:0]
+		return
+	}
+	col.compressed = compressed
+}
+
 func (w *blockWriter) Finish() []byte {
-	size := w.Size()
+	n := len(w.cols)
+	size := blockHeaderSize(n)
+	for i := range w.cols {
+		col := &w.cols[i]
+		w.compress(col)
+		if len(col.compressed) > 0 {
+			size += 2 + int32(len(col.compressed))
+		} else {
+			size += col.size(size)
+		}
+	}
 	if int32(cap(w.buf)) < size {
 		w.buf = make([]byte, size)
 	}
 	w.buf = w.buf[:size]
-	n := len(w.cols)
 	binary.LittleEndian.PutUint32(w.buf[0:], uint32(n))
 	binary.LittleEndian.PutUint32(w.buf[4:], uint32(w.cols[0].count))
 	pageOffset := blockHeaderSize(n)
 	for i := range w.cols {
 		col := &w.cols[i]
 		binary.LittleEndian.PutUint32(w.buf[pageOffsetPos(i):], uint32(pageOffset))
-		pageOffset = col.encode(pageOffset, w.buf)
+		if len(col.compressed) > 0 {
+			w.buf[pageOffset] = byte(col.ctype)
+			w.buf[pageOffset+1] = snappyCompressionPageCodec
+			pageOffset += 2
+			pageOffset += int32(copy(w.buf[pageOffset:], col.compressed))
+		} else {
+			pageOffset = col.encode(pageOffset, w.buf)
+		}
 	}
 	return w.buf
 }
 
+// Size returns the size of the block which would be returned by Finish if none
+// of its columns were compressed.
 func (w *blockWriter) Size() int32 {
 	size := blockHeaderSize(len(w.cols))
 	for i := range w.cols {
@@ -256,6 +431,10 @@ func (w *blockWriter) PutRow(row RowReader) {
 			col.putFloat64(row.Float64(i))
 		case ColumnTypeBytes:
 			col.putBytes(row.Bytes(i))
+		default:
+			if col.ctype.fixedBytes() {
+				col.putFixedBytes(row.Bytes(i))
+			}
 		}
 	}
 }
@@ -292,6 +471,15 @@ func (w *blockWriter) PutBytes(col int, v []byte) {
 	w.cols[col].putBytes(v)
 }
 
+// PutUUID puts a value to a uuid column. It is equivalent to PutBytes(col,
+// v[:]).
+func (w *blockWriter) PutUUID(col int, v [16]byte) {
+	if w.cols[col].ctype != ColumnTypeUUID {
+		panic("uuid column value expected")
+	}
+	w.cols[col].putFixedBytes(v[:])
+}
+
 func (w *blockWriter) PutNull(col int) {
 	w.cols[col].putNull()
 }
@@ -308,6 +496,8 @@ func (w *blockWriter) PutNull(col int) {
 // +---------------------------------------------------------------+
 // | <bytes> | NULL-bitmap | val1 | val2 | ... | pos (4) | pos (4) |
 // +---------------------------------------------------------------+
+// | <uuid>  | NULL-bitmap | val1 (16) | val2 (16) | ...             |
+// +---------------------------------------------------------------+
 // | ...                                                           |
 // +---------------------------------------------------------------+
 //
@@ -315,11 +505,19 @@ func (w *blockWriter) PutNull(col int) {
 // columnar layout: all of the values for a column are stored
 // contiguously. Column types have either fixed-width values, or
 // variable-width. All variable-width values are stored in the "bytes" column
-// type and it is up to higher levels to interpret.
+// type and it is up to higher levels to interpret. Byte values of a known width
+// are better stored in the "uuid" (16 bytes) or fixed width "bytes(N)" column
+// types, whose values are stored contiguously, like the values of an int64
+// column, without an array of offsets.
 //
 // The data for a column is stored within a "page". The first byte in a page
-// specifies the column type. Fixed width pages are then followed by a
-// NULL-bitmap with 1-bit per row indicating whether the column at that row is
+// specifies the column type and the second byte the page codec, which is
+// either none or snappy. A snappy page is followed by the snappy compression
+// of the entire uncompressed page (including its column type and codec
+// bytes), encoded as though it started at offset 0 so that decompressing it
+// into an aligned buffer preserves the alignment of the column data. The
+// remainder of this description applies to uncompressed pages. Fixed width
+// pages are then followed by a NULL-bitmap with 1-bit per row indicating whether the column at that row is
 // null or not. Following the NULL-bitmap is the column data itself. The data
 // is aligned to the required alignment of the column type (4 for int32, 8 for
 // int64, etc) so that it can be accessed directly without decoding.
@@ -339,11 +537,24 @@ func (w *blockWriter) PutNull(col int) {
 // the end of each column value within the concatenated data. For example,
 // offset[0] is the end of the first row's column data. A negative offset
 // indicates a null value.
+//
+// Creating a Block parses only the block header. The layout of a column is
+// computed the first time the column is accessed, and retained for the
+// lifetime of the Block, as are the decompressed pages of compressed columns,
+// so reading a few columns of a wide block does not touch the pages of the
+// other columns. A Block is not safe for concurrent use.
 type Block struct {
 	start unsafe.Pointer
 	len   int32
 	cols  int32
 	rows  int32
+	// vecs holds the layout of each column which has been accessed, indexed
+	// by column. The layout of a column which has not been accessed has a nil
+	// start pointer.
+	vecs []Vec
+	// decoded holds the decompressed pages of compressed columns, indexed by
+	// column. It is nil if no compressed column has been accessed.
+	decoded [][]byte
 }
 
 // NewBlock return a new Block configured to read from the specified
@@ -360,6 +571,51 @@ func (r *Block) init(data []byte) {
 	r.len = int32(len(data))
 	r.cols = int32(binary.LittleEndian.Uint32(data[0:]))
 	r.rows = int32(binary.LittleEndian.Uint32(data[4:]))
+	for i := range r.vecs {
+		r.vecs[i] = Vec{}
+	}
+	for i := range r.decoded {
+		r.decoded[i] = r.decoded[i][:0]
+	}
+}
+
+// BlockHeader describes the schema and layout of a block without reading any
+// of its column data. It allows a reader to inspect the schema of a block
+// before deciding which of its columns to materialize.
+type BlockHeader struct {
+	// Rows is the number of rows in the block.
+	Rows int32
+	// Types holds the type of each column.
+	Types ColumnTypes
+	// offsets holds the offset of the page of each column, followed by the
+	// size of the block.
+	offsets []int32
+}
+
+// ReadBlockHeader parses the header of the block in data, which must be
+// formatted as to the block layout specification. Only the column-offset
+// directory and the type of each column, which is the first byte of its page,
+// are read.
+func ReadBlockHeader(data []byte) BlockHeader {
+	cols := int(binary.LittleEndian.Uint32(data[0:]))
+	h := BlockHeader{
+		Rows:    int32(binary.LittleEndian.Uint32(data[4:])),
+		Types:   make(ColumnTypes, cols),
+		offsets: make([]int32, cols+1),
+	}
+	for col := 0; col < cols; col++ {
+		h.offsets[col] = int32(binary.LittleEndian.Uint32(data[pageOffsetPos(col):]))
+		h.Types[col] = ColumnType(data[h.offsets[col]])
+	}
+	h.offsets[cols] = int32(len(data))
+	return h
+}
+
+// PageSize returns the number of bytes of the block occupied by the page of
+// the specified column, which is the size of the compressed page if the column
+// is compressed.
+func (h *BlockHeader) PageSize(col int) int {
+	return int(h.offsets[col+1] - h.offsets[col])
 }
 
 func (r *Block) pageStart(col int) int32 {
@@ -385,27 +641,141 @@ func (r *Block) Column(col int) Vec {
 	if col < 0 || int32(col) >= r.cols {
 		panic("invalid column")
 	}
+	if int32(len(r.vecs)) < r.cols {
+		r.vecs = append(r.vecs, make([]Vec, int(r.cols)-len(r.vecs))...)
+	}
+	if v := &r.vecs[col]; v.start != nil {
+		return *v
+	}
+	r.vecs[col] = r.column(col)
+	return r.vecs[col]
+}
 
+// column computes the layout of the specified column.
+func (r *Block) column(col int) Vec {
 	start := r.pageStart(col)
-	data := r.pointer(start)
+	end := r.pageStart(col + 1)
+	base := r.start
+	if *(*byte)(r.pointer(start + 1)) != noCompressionPageCodec {
+		page := r.decompress(col, start, end)
+		base, start, end = unsafe.Pointer(&page[0]), 0, int32(len(page))
+	}
+	pointer := func(offset int32) unsafe.Pointer {
+		return unsafe.Pointer(uintptr(base) + uintptr(offset))
+	}
 
 	var v Vec
 	v.N = r.rows
 	// The column type.
-	v.Type = *(*ColumnType)(data)
+	v.Type = *(*ColumnType)(pointer(start))
+	start++
+	// The page codec.
 	start++
 	// The NULL-bitmap.
-	if *(*byte)(r.pointer(start)) == 0 {
+	if *(*byte)(pointer(start)) == 0 {
 		start++
 	} else {
+		start++
 		start = align(start, 4)
-		v.ptr = r.pointer(start)
+		v.ptr = pointer(start)
 		start += 4 * (int32(r.rows+15) / 16)
 	}
 	// The column values.
 	start = align(start, v.Type.Alignment())
-	v.start = r.pointer(start)
-	// The end of the offsets for variable width data.
-	v.end = r.pointer(r.pageStart(col + 1))
+	if start < end {
+		v.start = pointer(start)
+	} else {
+		// The column has no values, and pointer(start) would point past the end
+		// of the block, which the GC may interpret as a pointer to the following
+		// object. Any pointer into the block suffices for empty slices.
+		v.start = base
+	}
+	// The offsets for variable width data, which end the page.
+	if v.Type.Width() <= 0 && v.N > 0 {
+		v.offsets = pointer(end - 4*v.N)
+	}
 	return v
 }
+
+// decompress returns the uncompressed page for col, which is stored
+// compressed in [start,end), decompressing it on first use. The returned page
+// is 8-byte aligned.
+func (r *Block) decompress(col int, start, end int32) []byte {
+	if int32(len(r.decoded)) < r.cols {
+		r.decoded = append(r.decoded, make([][]byte, int(r.cols)-len(r.decoded))...)
+	}
+	if d := r.decoded[col]; len(d) > 0 {
+		return d
+	}
+	codec := *(*byte)(r.pointer(start + 1))
+	if codec != snappyCompressionPageCodec {
+		panic(fmt.Sprintf("pebble/ptable: unknown page codec: %d", codec))
+	}
+	compressed := r.data()[start+2 : end]
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		panic(fmt.Sprintf("pebble/ptable: corrupt compressed page: %v", err))
+	}
+	// The page is decompressed into the memory of a []uint64 to guarantee its
+	// alignment.
+	buf := r.decoded[col]
+	if cap(buf) < n {
+		words := make([]uint64, (n+7)/8)
+		buf = (*[1 << 31]byte)(unsafe.Pointer(&words[0]))[: len(words)*8 : len(words)*8]
+	}
+	buf = buf[:n]
+	if _, err := snappy.Decode(buf, compressed); err != nil {
+		panic(fmt.Sprintf("pebble/ptable: corrupt compressed page: %v", err))
+	}
+	r.decoded[col] = buf
+	return buf
+}
+
+// BlocksEqual returns true if the blocks a and b hold the same data: the same
+// schema, the same number of rows, and the same values (including NULLs) in
+// every row. Unlike bytes.Equal, BlocksEqual ignores the encoding of the data,
+// such as whether a column is compressed. Floating point values are equal only
+// if they have identical bit patterns, so -0 is not equal to +0 and a NaN is
+// equal to a NaN with the same bits.
+func BlocksEqual(a, b []byte) bool {
+	x, y := NewBlock(a), NewBlock(b)
+	if x.cols != y.cols || x.rows != y.rows {
+		return false
+	}
+	for col := 0; col < int(x.cols); col++ {
+		if !vecsEqual(x.Column(col), y.Column(col)) {
+			return false
+		}
+	}
+	return true
+}
+
+func vecsEqual(a, b Vec) bool {
+	if a.Type != b.Type || a.N != b.N {
+		return false
+	}
+	for i := 0; i < int(a.N); i++ {
+		ai, bi := a.Null(i), b.Null(i)
+		if ai || bi {
+			if ai != bi {
+				return false
+			}
+			continue
+		}
+		switch a.Type {
+		case ColumnTypeFloat32:
+			if math.Float32bits(a.Float32()[a.Rank(i)]) != math.Float32bits(b.Float32()[b.Rank(i)]) {
+				return false
+			}
+		case ColumnTypeFloat64:
+			if math.Float64bits(a.Float64()[a.Rank(i)]) != math.Float64bits(b.Float64()[b.Rank(i)]) {
+				return false
+			}
+		default:
+			if compareRows(a, i, b, i) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
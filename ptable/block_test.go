@@ -6,11 +6,14 @@ package ptable
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"testing"
 	"time"
 	"unsafe"
+
+	"github.com/petermattis/pebble/db"
 )
 
 func randBlock(rng *rand.Rand, rows int, schema []ColumnType) ([]byte, []interface{}) {
@@ -216,6 +219,527 @@ func TestBlockWriterNullValues(t *testing.T) {
 	}
 }
 
+func TestBlockColumnCompression(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// Column 0 holds compressible bytes, column 1 holds int64s and column 2
+	// holds incompressible bytes. Columns 0 and 2 request snappy compression,
+	// but only column 0 compresses well enough to be stored compressed.
+	const rows = 1000
+	var w blockWriter
+	w.init([]ColumnType{ColumnTypeBytes, ColumnTypeInt64, ColumnTypeBytes})
+	w.SetCompression(0, db.SnappyCompression)
+	w.SetCompression(2, db.SnappyCompression)
+	random := make([][]byte, rows)
+	for i := 0; i < rows; i++ {
+		if i%7 == 0 {
+			w.PutNull(0)
+		} else {
+			w.PutBytes(0, []byte(fmt.Sprintf("compressible-value-%04d", i%100)))
+		}
+		w.PutInt64(1, int64(i)*3)
+		random[i] = make([]byte, 16)
+		rng.Read(random[i])
+		w.PutBytes(2, random[i])
+	}
+	uncompressedSize := w.Size()
+	data := w.Finish()
+	if int32(len(data)) >= uncompressedSize {
+		t.Fatalf("expected block smaller than %d bytes, but found %d", uncompressedSize, len(data))
+	}
+
+	b := NewBlock(data)
+	for col, expected := range []byte{snappyCompressionPageCodec, noCompressionPageCodec, noCompressionPageCodec} {
+		if codec := data[b.pageStart(col)+1]; codec != expected {
+			t.Fatalf("%d: expected page codec %d, but found %d", col, expected, codec)
+		}
+	}
+	decoded := func(col int) bool {
+		return col < len(b.decoded) && len(b.decoded[col]) > 0
+	}
+
+	// Accessing the uncompressed columns does not decompress column 0.
+	ints := b.Column(1).Int64()
+	for i := 0; i < rows; i++ {
+		if ints[i] != int64(i)*3 {
+			t.Fatalf("%d: expected %d, but found %d", i, int64(i)*3, ints[i])
+		}
+	}
+	randomCol := b.Column(2).Bytes()
+	for i := 0; i < rows; i++ {
+		if v := randomCol.At(i); !reflect.DeepEqual(v, random[i]) {
+			t.Fatalf("%d: expected %x, but found %x", i, random[i], v)
+		}
+	}
+	if decoded(0) {
+		t.Fatalf("expected column 0 to not be decompressed")
+	}
+
+	check := func() {
+		col := b.Column(0)
+		bytes := col.Bytes()
+		for i := 0; i < rows; i++ {
+			if null := col.Null(i); null != (i%7 == 0) {
+				t.Fatalf("%d: expected null %t, but found %t", i, i%7 == 0, null)
+			}
+			if i%7 == 0 {
+				continue
+			}
+			expected := fmt.Sprintf("compressible-value-%04d", i%100)
+			if v := string(bytes.At(i)); v != expected {
+				t.Fatalf("%d: expected %q, but found %q", i, expected, v)
+			}
+		}
+	}
+	check()
+	if !decoded(0) || decoded(1) || decoded(2) {
+		t.Fatalf("expected only column 0 to be decompressed")
+	}
+	// The decompressed page is retained.
+	page := &b.decoded[0][0]
+	check()
+	if &b.decoded[0][0] != page {
+		t.Fatalf("expected column 0 to be decompressed once")
+	}
+}
+
+func TestBlocksEqual(t *testing.T) {
+	schema := []ColumnType{
+		ColumnTypeBool,
+		ColumnTypeInt8,
+		ColumnTypeInt16,
+		ColumnTypeInt32,
+		ColumnTypeInt64,
+		ColumnTypeFloat32,
+		ColumnTypeFloat64,
+		ColumnTypeBytes,
+	}
+
+	// build returns a block of repetitive data containing NULLs in every
+	// column, with every column compressed if compression is true. In row 100,
+	// column nullCol is NULL and the value in column changeCol is changed.
+	build := func(compression bool, nullCol, changeCol int) []byte {
+		var w blockWriter
+		w.init(schema)
+		if compression {
+			for col := range schema {
+				w.SetCompression(col, db.SnappyCompression)
+			}
+		}
+		for row := 0; row < 500; row++ {
+			for col := range schema {
+				if row%11 == 0 || (row == 100 && col == nullCol) {
+					w.PutNull(col)
+					continue
+				}
+				v := row % 10
+				if row == 100 && col == changeCol {
+					v++
+				}
+				switch schema[col] {
+				case ColumnTypeBool:
+					w.PutBool(col, v%2 == 0)
+				case ColumnTypeInt8:
+					w.PutInt8(col, int8(v))
+				case ColumnTypeInt16:
+					w.PutInt16(col, int16(v))
+				case ColumnTypeInt32:
+					w.PutInt32(col, int32(v))
+				case ColumnTypeInt64:
+					w.PutInt64(col, int64(v))
+				case ColumnTypeFloat32:
+					w.PutFloat32(col, float32(v))
+				case ColumnTypeFloat64:
+					w.PutFloat64(col, float64(v))
+				case ColumnTypeBytes:
+					w.PutBytes(col, []byte(fmt.Sprintf("value-%d", v)))
+				}
+			}
+		}
+		return append([]byte(nil), w.Finish()...)
+	}
+
+	raw := build(false, -1, -1)
+	compressed := build(true, -1, -1)
+	b := NewBlock(compressed)
+	for col := range schema {
+		if schema[col] == ColumnTypeBool {
+			// The bool page is too small to be worth compressing.
+			continue
+		}
+		if codec := compressed[b.pageStart(col)+1]; codec != snappyCompressionPageCodec {
+			t.Fatalf("%s: expected page codec %d, but found %d", schema[col], snappyCompressionPageCodec, codec)
+		}
+	}
+	if !BlocksEqual(raw, compressed) || !BlocksEqual(compressed, raw) {
+		t.Fatalf("expected raw and compressed blocks to be equal")
+	}
+
+	// A block which differs in a single value or a single NULL is not equal,
+	// however it is encoded.
+	for col := range schema {
+		for _, other := range [][]byte{
+			build(false, col, -1),
+			build(true, col, -1),
+			build(false, -1, col),
+			build(true, -1, col),
+		} {
+			if BlocksEqual(raw, other) || BlocksEqual(other, compressed) {
+				t.Fatalf("%s: expected blocks to not be equal", schema[col])
+			}
+		}
+	}
+
+	// Blocks with different schemas or numbers of rows are not equal.
+	var w blockWriter
+	w.init([]ColumnType{ColumnTypeInt64})
+	w.PutInt64(0, 1)
+	one := append([]byte(nil), w.Finish()...)
+	w.init([]ColumnType{ColumnTypeFloat64})
+	w.PutFloat64(0, 1)
+	if BlocksEqual(one, w.Finish()) {
+		t.Fatalf("expected blocks with different schemas to not be equal")
+	}
+	w.init([]ColumnType{ColumnTypeInt64})
+	w.PutInt64(0, 1)
+	w.PutInt64(0, 1)
+	if BlocksEqual(one, w.Finish()) {
+		t.Fatalf("expected blocks with different numbers of rows to not be equal")
+	}
+
+	// Floating point values are compared bitwise.
+	w.init([]ColumnType{ColumnTypeFloat64})
+	w.PutFloat64(0, 0)
+	zero := append([]byte(nil), w.Finish()...)
+	w.init([]ColumnType{ColumnTypeFloat64})
+	w.PutFloat64(0, math.Copysign(0, -1))
+	if BlocksEqual(zero, w.Finish()) {
+		t.Fatalf("expected -0 and +0 to not be equal")
+	}
+	w.init([]ColumnType{ColumnTypeFloat64})
+	w.PutFloat64(0, math.NaN())
+	nan := append([]byte(nil), w.Finish()...)
+	if !BlocksEqual(nan, nan) {
+		t.Fatalf("expected NaN to equal itself")
+	}
+}
+
+func TestReadBlockHeader(t *testing.T) {
+	// A wide block, with a mix of column types, some of them compressed.
+	const cols = 200
+	const rows = 100
+	schema := make([]ColumnType, cols)
+	for col := range schema {
+		schema[col] = []ColumnType{ColumnTypeInt64, ColumnTypeBytes, ColumnTypeInt32}[col%3]
+	}
+	var w blockWriter
+	w.init(schema)
+	for col := 0; col < cols; col += 7 {
+		w.SetCompression(col, db.SnappyCompression)
+	}
+	for row := 0; row < rows; row++ {
+		for col := range schema {
+			switch schema[col] {
+			case ColumnTypeInt64:
+				w.PutInt64(col, int64(row*col))
+			case ColumnTypeBytes:
+				w.PutBytes(col, []byte(fmt.Sprint(row*col)))
+			case ColumnTypeInt32:
+				w.PutInt32(col, int32(row))
+			}
+		}
+	}
+	data := append([]byte(nil), w.Finish()...)
+
+	h := ReadBlockHeader(data)
+	if h.Rows != rows {
+		t.Fatalf("expected %d rows, but found %d", rows, h.Rows)
+	}
+	if !reflect.DeepEqual(ColumnTypes(schema), h.Types) {
+		t.Fatalf("expected schema %s, but found %s", ColumnTypes(schema), h.Types)
+	}
+	size := int(blockHeaderSize(cols))
+	for col := range schema {
+		size += h.PageSize(col)
+	}
+	if size != len(data) {
+		t.Fatalf("expected the pages to cover the %d byte block, but found %d bytes", len(data), size)
+	}
+
+	// Overwriting everything but the column type of each page does not affect
+	// the header, which shows that parsing the header reads none of the
+	// column data.
+	b := NewBlock(data)
+	garbage := append([]byte(nil), data...)
+	for col := range schema {
+		start := b.pageStart(col)
+		for i := start + 1; i < start+int32(h.PageSize(col)); i++ {
+			garbage[i] = 0xff
+		}
+	}
+	if h2 := ReadBlockHeader(garbage); !reflect.DeepEqual(h, h2) {
+		t.Fatalf("expected header\n%+v\nbut found\n%+v", h, h2)
+	}
+
+	// Nor does a Block read the pages of the columns which are not accessed.
+	// Other than the pages of column 2 and of column 154, a compressed bytes
+	// column, the block is garbage.
+	garbage = append([]byte(nil), data...)
+	for col := range schema {
+		if col == 2 || col == 154 {
+			continue
+		}
+		start := b.pageStart(col)
+		for i := start; i < start+int32(h.PageSize(col)); i++ {
+			garbage[i] = 0xff
+		}
+	}
+	g := NewBlock(garbage)
+	for _, col := range []int{2, 154} {
+		for i := 0; i < 2; i++ {
+			// The layout is computed on the first access and reused.
+			if v, expected := g.Column(col), b.Column(col); v.Type != expected.Type || v.N != expected.N {
+				t.Fatalf("column %d: expected %s[%d], but found %s[%d]", col, expected.Type, expected.N, v.Type, v.N)
+			}
+		}
+	}
+	if v := g.Column(2).Int32(); !reflect.DeepEqual(v, b.Column(2).Int32()) {
+		t.Fatalf("column 2: unexpected values %v", v)
+	}
+	for row := 0; row < rows; row++ {
+		if v, expected := string(g.Column(154).Bytes().At(row)), fmt.Sprint(row*154); v != expected {
+			t.Fatalf("column 154, row %d: expected %s, but found %s", row, expected, v)
+		}
+	}
+	if g.vecs[0].start != nil || g.vecs[3].start != nil {
+		t.Fatalf("expected the layout of the columns which were not accessed to be uncomputed")
+	}
+}
+
+func TestVecSearch(t *testing.T) {
+	// Each column holds 2 NULLs followed by the values 10, 20, 20, 20, 30, 40,
+	// 40.
+	vals := []int{10, 20, 20, 20, 30, 40, 40}
+	const nulls = 2
+	schema := []ColumnType{
+		ColumnTypeInt8,
+		ColumnTypeInt16,
+		ColumnTypeInt32,
+		ColumnTypeInt64,
+		ColumnTypeFloat32,
+		ColumnTypeFloat64,
+		ColumnTypeBytes,
+	}
+	var w blockWriter
+	w.init(schema)
+	for col := range schema {
+		w.SetSorted(col)
+		for i := 0; i < nulls; i++ {
+			w.PutNull(col)
+		}
+		for _, v := range vals {
+			switch schema[col] {
+			case ColumnTypeInt8:
+				w.PutInt8(col, int8(v))
+			case ColumnTypeInt16:
+				w.PutInt16(col, int16(v))
+			case ColumnTypeInt32:
+				w.PutInt32(col, int32(v))
+			case ColumnTypeInt64:
+				w.PutInt64(col, int64(v))
+			case ColumnTypeFloat32:
+				w.PutFloat32(col, float32(v))
+			case ColumnTypeFloat64:
+				w.PutFloat64(col, float64(v))
+			case ColumnTypeBytes:
+				w.PutBytes(col, []byte(fmt.Sprint(v)))
+			}
+		}
+	}
+	b := NewBlock(w.Finish())
+
+	testCases := []struct {
+		x        int
+		expected int
+	}{
+		{0, 2},  // before every value
+		{10, 2}, // the first value
+		{15, 3}, // absent
+		{20, 3}, // the first of the duplicates
+		{25, 6},
+		{30, 6},
+		{40, 7},
+		{50, 9}, // after every value
+	}
+	for col := range schema {
+		v := b.Column(col)
+		for _, c := range testCases {
+			var row int
+			switch schema[col] {
+			case ColumnTypeFloat32, ColumnTypeFloat64:
+				row = v.SearchFloat64(float64(c.x))
+			case ColumnTypeBytes:
+				// The values are all 2 digits, so their lexicographic order matches
+				// their numeric order.
+				row = v.SearchBytes([]byte(fmt.Sprintf("%02d", c.x)))
+			default:
+				row = v.SearchInt64(int64(c.x))
+			}
+			if row != c.expected {
+				t.Fatalf("%s: search %d: expected row %d, but found %d", schema[col], c.x, c.expected, row)
+			}
+		}
+	}
+
+	// A column containing only NULLs.
+	w.init([]ColumnType{ColumnTypeInt64, ColumnTypeBytes})
+	for col := 0; col < 2; col++ {
+		w.SetSorted(col)
+		w.PutNull(col)
+	}
+	b = NewBlock(w.Finish())
+	if row := b.Column(0).SearchInt64(math.MinInt64); row != 1 {
+		t.Fatalf("expected row 1, but found %d", row)
+	}
+	if row := b.Column(1).SearchBytes(nil); row != 1 {
+		t.Fatalf("expected row 1, but found %d", row)
+	}
+}
+
+func TestBlockWriterSorted(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expected panic", name)
+			}
+		}()
+		fn()
+	}
+
+	var w blockWriter
+	w.init([]ColumnType{ColumnTypeInt32, ColumnTypeFloat64, ColumnTypeBytes, ColumnTypeBool})
+	for col := 0; col < 3; col++ {
+		w.SetSorted(col)
+	}
+	expectPanic("bool", func() { w.SetSorted(3) })
+
+	// Equal values, and values following NULLs, are permitted.
+	w.PutNull(0)
+	w.PutInt32(0, -5)
+	w.PutInt32(0, -5)
+	w.PutInt32(0, 7)
+	expectPanic("int32", func() { w.PutInt32(0, 6) })
+	w.PutFloat64(1, 1.5)
+	w.PutFloat64(1, 2.5)
+	expectPanic("float64", func() { w.PutFloat64(1, -1) })
+	expectPanic("null", func() { w.PutNull(1) })
+	w.PutNull(2)
+	w.PutBytes(2, []byte("b"))
+	w.PutBytes(2, []byte("ba"))
+	expectPanic("bytes", func() { w.PutBytes(2, []byte("b")) })
+	expectPanic("put", func() { w.SetSorted(2) })
+
+	// Unsorted columns are not checked.
+	w.init([]ColumnType{ColumnTypeInt32})
+	w.PutInt32(0, 7)
+	w.PutInt32(0, 6)
+	w.PutNull(0)
+}
+
+func TestVecAggregates(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, nullProb := range []float64{0, 0.25, 0.5, 1} {
+		t.Run(fmt.Sprintf("null=%.2f", nullProb), func(t *testing.T) {
+			var w blockWriter
+			w.init([]ColumnType{ColumnTypeInt64})
+			var vals []int64
+			const rows = 1000
+			for i := 0; i < rows; i++ {
+				if rng.Float64() < nullProb {
+					w.PutNull(0)
+					vals = append(vals, 0)
+				} else {
+					v := rng.Int63n(2000) - 1000
+					w.PutInt64(0, v)
+					vals = append(vals, v)
+				}
+			}
+			r := NewBlock(w.Finish())
+			col := r.Column(0)
+
+			var count int
+			var sum, min, max int64
+			for i := 0; i < int(col.N); i++ {
+				if col.Null(i) {
+					continue
+				}
+				v := vals[i]
+				if count == 0 || v < min {
+					min = v
+				}
+				if count == 0 || v > max {
+					max = v
+				}
+				sum += v
+				count++
+			}
+
+			if n := col.CountNonNull(); n != count {
+				t.Fatalf("expected %d non-NULL values, but found %d", count, n)
+			}
+			if s := col.SumInt64(); s != sum {
+				t.Fatalf("expected sum %d, but found %d", sum, s)
+			}
+			if m, ok := col.MinInt64(); ok != (count > 0) || m != min {
+				t.Fatalf("expected min %d (%t), but found %d (%t)", min, count > 0, m, ok)
+			}
+			if m, ok := col.MaxInt64(); ok != (count > 0) || m != max {
+				t.Fatalf("expected max %d (%t), but found %d (%t)", max, count > 0, m, ok)
+			}
+		})
+	}
+}
+
+func TestVecInt64WithNulls(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for _, nullProb := range []float64{0, 0.01, 0.5, 1} {
+		t.Run(fmt.Sprintf("null=%.2f", nullProb), func(t *testing.T) {
+			var ranks []int32
+			// Include row counts which are not a multiple of the 16 rows covered
+			// by each word of the NULL bitmap.
+			for _, rows := range []int{1, 15, 16, 17, 1000} {
+				var w blockWriter
+				w.init([]ColumnType{ColumnTypeInt64})
+				for i := 0; i < rows; i++ {
+					if rng.Float64() < nullProb {
+						w.PutNull(0)
+					} else {
+						w.PutInt64(0, rng.Int63())
+					}
+				}
+				col := NewBlock(w.Finish()).Column(0)
+
+				var vals []int64
+				vals, ranks = col.Int64WithNulls(ranks)
+				if len(ranks) != rows {
+					t.Fatalf("expected %d ranks, but found %d", rows, len(ranks))
+				}
+				for i := 0; i < rows; i++ {
+					if r := col.Rank(i); int(ranks[i]) != r {
+						t.Fatalf("%d: expected rank %d, but found %d", i, r, ranks[i])
+					}
+				}
+				if expected := col.Int64(); len(vals) != len(expected) {
+					t.Fatalf("expected %d values, but found %d", len(expected), len(vals))
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkBlock(b *testing.B) {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	blocks := make([][]byte, 128)
@@ -286,4 +810,178 @@ func BenchmarkBlock(b *testing.B) {
 			fmt.Println(sum)
 		}
 	})
+
+	b.Run("sum", func(b *testing.B) {
+		var sum int64
+		for i := 0; i < b.N; {
+			r := NewBlock(blocks[rng.Intn(len(blocks))])
+			col := r.Column(0)
+			sum += col.SumInt64()
+			i += int(col.N)
+		}
+		if testing.Verbose() {
+			fmt.Println(sum)
+		}
+	})
+}
+
+// BenchmarkBlockSparseNulls compares iterating over the values of a column
+// with a few NULLs using Rank and using the ranks of Int64WithNulls.
+func BenchmarkBlockSparseNulls(b *testing.B) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	blocks := make([][]byte, 128)
+	for i := range blocks {
+		var w blockWriter
+		w.init([]ColumnType{ColumnTypeInt64})
+		for j := 0; j < 4096; j++ {
+			if rng.Intn(100) == 0 {
+				w.PutNull(0)
+			} else {
+				w.PutInt64(0, rng.Int63())
+			}
+		}
+		blocks[i] = w.Finish()
+	}
+
+	b.Run("rank", func(b *testing.B) {
+		var sum int64
+		for i, k := 0, 0; i < b.N; i += k {
+			r := NewBlock(blocks[rng.Intn(len(blocks))])
+			col := r.Column(0)
+			vals := col.Int64()
+
+			k = int(col.N)
+			if k > b.N-i {
+				k = b.N - i
+			}
+			for j := 0; j < k; j++ {
+				if r := col.Rank(j); r >= 0 {
+					sum += vals[r]
+				}
+			}
+		}
+		if testing.Verbose() {
+			fmt.Println(sum)
+		}
+	})
+
+	b.Run("ranks", func(b *testing.B) {
+		var sum int64
+		var ranks []int32
+		for i, k := 0, 0; i < b.N; i += k {
+			r := NewBlock(blocks[rng.Intn(len(blocks))])
+			var vals []int64
+			vals, ranks = r.Column(0).Int64WithNulls(ranks)
+
+			k = len(ranks)
+			if k > b.N-i {
+				k = b.N - i
+			}
+			for _, r := range ranks[:k] {
+				if r >= 0 {
+					sum += vals[r]
+				}
+			}
+		}
+		if testing.Verbose() {
+			fmt.Println(sum)
+		}
+	})
+}
+
+func TestBlockFixedBytes(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	fixed5 := ColumnTypeFixedBytes(5)
+	if s := fixed5.String(); s != "bytes(5)" {
+		t.Fatalf("expected bytes(5), but found %s", s)
+	}
+	if w := fixed5.Width(); w != 5 {
+		t.Fatalf("expected width 5, but found %d", w)
+	}
+	if w := ColumnType(ColumnTypeUUID).Width(); w != 16 {
+		t.Fatalf("expected width 16, but found %d", w)
+	}
+
+	const rows = 1000
+	var w blockWriter
+	w.init([]ColumnType{ColumnTypeUUID, fixed5})
+	var uuids [][16]byte
+	var vals [][]byte
+	for i := 0; i < rows; i++ {
+		var u [16]byte
+		if rng.Intn(4) == 0 {
+			w.PutNull(0)
+		} else {
+			rng.Read(u[:])
+			w.PutUUID(0, u)
+		}
+		uuids = append(uuids, u)
+
+		var v []byte
+		if rng.Intn(4) == 0 {
+			w.PutNull(1)
+		} else {
+			v = make([]byte, 5)
+			rng.Read(v)
+			w.PutBytes(1, v)
+		}
+		vals = append(vals, v)
+	}
+	data := w.Finish()
+	r := NewBlock(data)
+
+	col := r.Column(0)
+	got := col.UUID()
+	for i := 0; i < rows; i++ {
+		j := col.Rank(i)
+		if (j < 0) != (uuids[i] == [16]byte{}) {
+			t.Fatalf("%d: unexpected NULL: %t", i, j < 0)
+		}
+		if j >= 0 && got[j] != uuids[i] {
+			t.Fatalf("%d: expected %x, but found %x", i, uuids[i], got[j])
+		}
+		if j >= 0 && string(col.FixedBytes().At(j)) != string(uuids[i][:]) {
+			t.Fatalf("%d: expected %x, but found %x", i, uuids[i], col.FixedBytes().At(j))
+		}
+	}
+
+	col = r.Column(1)
+	fb := col.FixedBytes()
+	for i := 0; i < rows; i++ {
+		j := col.Rank(i)
+		if (j < 0) != (vals[i] == nil) {
+			t.Fatalf("%d: unexpected NULL: %t", i, j < 0)
+		}
+		if j >= 0 && string(fb.At(j)) != string(vals[i]) {
+			t.Fatalf("%d: expected %x, but found %x", i, vals[i], fb.At(j))
+		}
+	}
+	if !BlocksEqual(data, data) {
+		t.Fatalf("expected block to equal itself")
+	}
+
+	// A value of the wrong width panics.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic")
+			}
+		}()
+		w.PutBytes(1, []byte("abc"))
+	}()
+
+	// Storing the same values in a bytes column requires an offset per row.
+	var fixedW, bytesW blockWriter
+	fixedW.init([]ColumnType{ColumnTypeUUID})
+	bytesW.init([]ColumnType{ColumnTypeBytes})
+	for i := range uuids {
+		fixedW.PutUUID(0, uuids[i])
+		bytesW.PutBytes(0, uuids[i][:])
+	}
+	fixedSize, bytesSize := len(fixedW.Finish()), len(bytesW.Finish())
+	if fixedSize+4*rows > bytesSize {
+		t.Fatalf("expected uuid column (%d bytes) to be at least %d bytes smaller than bytes column (%d bytes)",
+			fixedSize, 4*rows, bytesSize)
+	}
 }
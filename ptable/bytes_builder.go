@@ -0,0 +1,117 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+// ByteColumnBuilder builds a block containing a single ColumnTypeBytes column
+// from a stream of byte payloads. It is intended for append-only workloads
+// such as log ingestion where the values are never accessed while the column
+// is being built. The payload for a row is written directly to the column's
+// buffer using one or more calls to Write followed by a call to EndRow, which
+// avoids materializing each row as a separate []byte.
+//
+// The zero value is ready to use. The block returned by Finish has the same
+// format as a block created by blockWriter and is read using NewBlock and
+// Block.Column(0).Bytes().
+type ByteColumnBuilder struct {
+	w blockWriter
+	// end is the offset within the column data of the end of the last
+	// completed row. Data beyond end belongs to the row being written.
+	end int32
+}
+
+func (b *ByteColumnBuilder) col() *columnWriter {
+	if b.w.cols == nil {
+		b.w.init([]ColumnType{ColumnTypeBytes})
+	}
+	return &b.w.cols[0]
+}
+
+// Grow ensures the builder has space for another rows rows containing a total
+// of n bytes without further allocation.
+func (b *ByteColumnBuilder) Grow(rows, n int) {
+	col := b.col()
+	if cap(col.data)-len(col.data) < n {
+		data := make([]byte, len(col.data), len(col.data)+n)
+		copy(data, col.data)
+		col.data = data
+	}
+	if cap(col.offsets)-len(col.offsets) < rows {
+		offsets := make([]int32, len(col.offsets), len(col.offsets)+rows)
+		copy(offsets, col.offsets)
+		col.offsets = offsets
+	}
+}
+
+// Write appends p to the payload of the current row. It implements io.Writer
+// and never returns an error.
+func (b *ByteColumnBuilder) Write(p []byte) (int, error) {
+	col := b.col()
+	col.data = append(col.data, p...)
+	return len(p), nil
+}
+
+// WriteString appends s to the payload of the current row. It implements
+// io.StringWriter and never returns an error.
+func (b *ByteColumnBuilder) WriteString(s string) (int, error) {
+	col := b.col()
+	col.data = append(col.data, s...)
+	return len(s), nil
+}
+
+// EndRow completes the current row. The row's value is the concatenation of
+// the payloads written since the previous row was completed, which may be
+// empty.
+func (b *ByteColumnBuilder) EndRow() {
+	col := b.col()
+	b.end = int32(len(col.data))
+	col.offsets = append(col.offsets, b.end)
+	col.nulls = col.nulls.set(int(col.count), false)
+	col.count++
+}
+
+// PutNull appends a NULL row. It is an error to call PutNull while a row is
+// partially written.
+func (b *ByteColumnBuilder) PutNull() {
+	col := b.col()
+	if int32(len(col.data)) != b.end {
+		panic("pebble/ptable: NULL row appended to partially written row")
+	}
+	col.putNull()
+}
+
+// Rows returns the number of completed rows.
+func (b *ByteColumnBuilder) Rows() int {
+	return int(b.col().count)
+}
+
+// Size returns the size of the block which would be returned by Finish.
+func (b *ByteColumnBuilder) Size() int32 {
+	col := b.col()
+	pending := col.data
+	col.data = col.data[:b.end]
+	size := b.w.Size()
+	col.data = pending
+	return size
+}
+
+// Finish returns a block containing the completed rows. Data written for a
+// row which has not been completed by EndRow is not included. The returned
+// block is only valid until the next call to Reset.
+func (b *ByteColumnBuilder) Finish() []byte {
+	col := b.col()
+	pending := col.data
+	col.data = col.data[:b.end]
+	block := b.w.Finish()
+	col.data = pending
+	return block
+}
+
+// Reset discards all of the rows in the builder, retaining the allocated
+// buffers for reuse.
+func (b *ByteColumnBuilder) Reset() {
+	b.col()
+	b.w.reset()
+	b.end = 0
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestByteColumnBuilder(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var b ByteColumnBuilder
+	for _, rows := range []int{0, 1, 10, 1000} {
+		t.Run(fmt.Sprintf("rows=%d", rows), func(t *testing.T) {
+			b.Reset()
+
+			// Build the same column using ByteColumnBuilder and blockWriter. Each
+			// row is written to the builder in up to 3 pieces.
+			var w blockWriter
+			w.init([]ColumnType{ColumnTypeBytes})
+			expected := make([][]byte, rows)
+			for i := range expected {
+				if rng.Intn(10) == 0 {
+					b.PutNull()
+					w.PutNull(0)
+					continue
+				}
+				v := make([]byte, rng.Intn(50))
+				rng.Read(v)
+				expected[i] = v
+				for len(v) > 0 {
+					n := 1 + rng.Intn(len(v))
+					b.Write(v[:n])
+					v = v[n:]
+				}
+				b.EndRow()
+				w.PutBytes(0, expected[i])
+			}
+			// A partially written row is not included in the block.
+			b.WriteString("pending")
+
+			if b.Rows() != rows {
+				t.Fatalf("expected %d rows, but found %d", rows, b.Rows())
+			}
+			if size := w.Size(); b.Size() != size {
+				t.Fatalf("expected size %d, but found %d", size, b.Size())
+			}
+			block := b.Finish()
+			if !bytes.Equal(block, w.Finish()) {
+				t.Fatalf("block differs from blockWriter block")
+			}
+
+			col := NewBlock(block).Column(0)
+			if col.Type != ColumnTypeBytes || int(col.N) != rows {
+				t.Fatalf("expected %d %s rows, but found %d %s", rows, ColumnType(ColumnTypeBytes), col.N, col.Type)
+			}
+			vals := col.Bytes()
+			for i := range expected {
+				if col.Null(i) != (expected[i] == nil) {
+					t.Fatalf("%d: expected null=%t, but found %t", i, expected[i] == nil, col.Null(i))
+				}
+				if expected[i] != nil && !bytes.Equal(expected[i], vals.At(i)) {
+					t.Fatalf("%d: expected %x, but found %x", i, expected[i], vals.At(i))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkByteColumnBuilder(b *testing.B) {
+	// Each row is a log line composed of a sequence number and a payload.
+	const rows = 4096
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	payloads := make([][]byte, rows)
+	for i := range payloads {
+		payloads[i] = make([]byte, 50+rng.Intn(200))
+		rng.Read(payloads[i])
+	}
+
+	b.Run("put-bytes", func(b *testing.B) {
+		var w blockWriter
+		w.init([]ColumnType{ColumnTypeBytes})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.reset()
+			lines := make([][]byte, rows)
+			for j := range lines {
+				line := strconv.AppendInt(nil, int64(j), 10)
+				lines[j] = append(line, payloads[j]...)
+			}
+			for j := range lines {
+				w.PutBytes(0, lines[j])
+			}
+			w.Finish()
+		}
+	})
+
+	b.Run("builder", func(b *testing.B) {
+		var w ByteColumnBuilder
+		var scratch [20]byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.Reset()
+			for j := 0; j < rows; j++ {
+				w.Write(strconv.AppendInt(scratch[:0], int64(j), 10))
+				w.Write(payloads[j])
+				w.EndRow()
+			}
+			w.Finish()
+		}
+	})
+}
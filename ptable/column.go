@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"math/bits"
+	"sort"
 	"unsafe"
 )
 
@@ -203,10 +204,30 @@ const (
 	// width data that can be applied to any fixed-width data type? This would
 	// allow modeling both []int8, []int64, and []float64.
 	ColumnTypeBytes = 8
-	// TODO(peter): decimal, uuid, ipaddr, timestamp, time, timetz, duration,
+	// ColumnTypeUUID holds 16-byte values, such as UUIDs. See
+	// ColumnTypeFixedBytes.
+	ColumnTypeUUID = 9
+	// TODO(peter): decimal, ipaddr, timestamp, time, timetz, duration,
 	// collated string, tuple.
 )
 
+// columnTypeFixedBytes is the bit set in the column types returned by
+// ColumnTypeFixedBytes. The low 7 bits hold the width minus one.
+const columnTypeFixedBytes = 0x80
+
+// ColumnTypeFixedBytes returns the column type for byte values of the
+// specified width, which must be in the range [1,128]. Unlike ColumnTypeBytes,
+// the values of a fixed width bytes column are stored contiguously without an
+// array of offsets, and are accessed by rank like the other fixed width types
+// (see Vec.FixedBytes). Values are put using PutBytes and must have exactly
+// the column's width.
+func ColumnTypeFixedBytes(width int) ColumnType {
+	if width < 1 || width > 128 {
+		panic(fmt.Sprintf("pebble/ptable: invalid fixed bytes width: %d", width))
+	}
+	return ColumnType(columnTypeFixedBytes | (width - 1))
+}
+
 var columnTypeAlignment = []int32{
 	ColumnTypeInvalid: 0,
 	ColumnTypeBool:    1,
@@ -217,6 +238,7 @@ var columnTypeAlignment = []int32{
 	ColumnTypeFloat32: 4,
 	ColumnTypeFloat64: 8,
 	ColumnTypeBytes:   1,
+	ColumnTypeUUID:    1,
 }
 
 var columnTypeName = []string{
@@ -229,6 +251,7 @@ var columnTypeName = []string{
 	ColumnTypeFloat32: "float32",
 	ColumnTypeFloat64: "float64",
 	ColumnTypeBytes:   "bytes",
+	ColumnTypeUUID:    "uuid",
 }
 
 var columnTypeWidth = []int32{
@@ -241,23 +264,39 @@ var columnTypeWidth = []int32{
 	ColumnTypeFloat32: 4,
 	ColumnTypeFloat64: 8,
 	ColumnTypeBytes:   -1,
+	ColumnTypeUUID:    16,
 }
 
 // Alignment ...
 func (t ColumnType) Alignment() int32 {
+	if t&columnTypeFixedBytes != 0 {
+		return 1
+	}
 	return columnTypeAlignment[t]
 }
 
 // String ...
 func (t ColumnType) String() string {
+	if t&columnTypeFixedBytes != 0 {
+		return fmt.Sprintf("bytes(%d)", t.Width())
+	}
 	return columnTypeName[t]
 }
 
 // Width ...
 func (t ColumnType) Width() int32 {
+	if t&columnTypeFixedBytes != 0 {
+		return int32(t&^columnTypeFixedBytes) + 1
+	}
 	return columnTypeWidth[t]
 }
 
+// fixedBytes returns true if the column type holds fixed width byte values:
+// ColumnTypeUUID or a type returned by ColumnTypeFixedBytes.
+func (t ColumnType) fixedBytes() bool {
+	return t == ColumnTypeUUID || t&columnTypeFixedBytes != 0
+}
+
 // ColumnTypes ...
 type ColumnTypes []ColumnType
 
@@ -295,17 +334,18 @@ type Vec struct {
 	N    int32      // the number of elements in the bitmap
 	Type ColumnType // the type of vector elements
 	NullBitmap
-	start unsafe.Pointer // pointer to start of the column data
-	end   unsafe.Pointer // pointer to the end of column data
+	start   unsafe.Pointer // pointer to start of the column data
+	offsets unsafe.Pointer // pointer to the offsets for variable width data
 }
 
-// Bool returns the vec data as a boolean bitmap. The bitmap should not be
-// mutated.
+// Bool returns the vec data as a boolean bitmap. Unlike the other fixed width
+// types, the bitmap is indexed by row rather than by rank, and the bits for
+// NULL rows are clear. The bitmap should not be mutated.
 func (v Vec) Bool() Bitmap {
 	if v.Type != ColumnTypeBool {
 		panic("vec does not hold bool data")
 	}
-	n := (v.count(int(v.N)) + 7) / 8
+	n := (int(v.N) + 7) / 8
 	return Bitmap((*[1 << 31]byte)(v.start)[:n:n])
 }
 
@@ -345,6 +385,115 @@ func (v Vec) Int64() []int64 {
 	return (*[1 << 31]int64)(v.start)[:n:n]
 }
 
+// CountNonNull returns the number of non-NULL values in the vec.
+func (v Vec) CountNonNull() int {
+	if v.N == 0 {
+		return 0
+	}
+	return v.count(int(v.N))
+}
+
+// SumInt64 returns the sum of the non-NULL values in an int64 vec, or 0 if
+// every value is NULL. The sum wraps on overflow. The non-NULL values are
+// stored contiguously, so the sum is computed without consulting the NULL
+// bitmap.
+func (v Vec) SumInt64() int64 {
+	var sum int64
+	for _, x := range v.Int64() {
+		sum += x
+	}
+	return sum
+}
+
+// MinInt64 returns the minimum of the non-NULL values in an int64 vec. The
+// returned bool is false if every value is NULL. Unlike the statistics stored
+// for a column, the minimum is computed over the values in the vec.
+func (v Vec) MinInt64() (int64, bool) {
+	vals := v.Int64()
+	if len(vals) == 0 {
+		return 0, false
+	}
+	min := vals[0]
+	for _, x := range vals[1:] {
+		if x < min {
+			min = x
+		}
+	}
+	return min, true
+}
+
+// MaxInt64 returns the maximum of the non-NULL values in an int64 vec. The
+// returned bool is false if every value is NULL. Unlike the statistics stored
+// for a column, the maximum is computed over the values in the vec.
+func (v Vec) MaxInt64() (int64, bool) {
+	vals := v.Int64()
+	if len(vals) == 0 {
+		return 0, false
+	}
+	max := vals[0]
+	for _, x := range vals[1:] {
+		if x > max {
+			max = x
+		}
+	}
+	return max, true
+}
+
+// Int64WithNulls returns the vec data as []int64, along with the index in the
+// returned slice of the value of each row, or -1 for NULL rows. The indexes
+// are computed for all of the rows at once from the NULL bitmap and its lookup
+// table, which is cheaper than invoking Rank for each row of a vec containing
+// NULLs (the values of a vec without NULLs are best accessed directly using
+// Int64, see NullBitmap.Empty). The indexes are
+// stored in ranks if it has sufficient capacity, and in a newly allocated
+// slice otherwise. The pattern to iterate over the non-NULL values in a vector
+// is:
+//
+//   vals, ranks := vec.Int64WithNulls(ranks)
+//   for i := range ranks {
+//     if j := ranks[i]; j >= 0 {
+//       v := vals[j]
+//       // process v
+//     }
+//   }
+func (v Vec) Int64WithNulls(ranks []int32) ([]int64, []int32) {
+	vals := v.Int64()
+	n := int(v.N)
+	if cap(ranks) < n {
+		ranks = make([]int32, n)
+	}
+	ranks = ranks[:n]
+	if v.Empty() {
+		for i := range ranks {
+			ranks[i] = int32(i)
+		}
+		return vals, ranks
+	}
+	for i := 0; i < n; i += 16 {
+		val := *(*uint32)(unsafe.Pointer(uintptr(v.ptr) + (uintptr(i)>>4)<<2))
+		rank := int32(val >> 16)
+		word := ranks[i:]
+		if len(word) > 16 {
+			word = word[:16]
+		}
+		if uint16(val) == 0 {
+			// Fast path for the common case of 16 non-NULL rows.
+			for j := range word {
+				word[j] = rank + int32(j)
+			}
+			continue
+		}
+		for j := range word {
+			// Branch-free: the rank of a NULL row is -1, and the rank is only
+			// advanced past non-NULL rows.
+			null := int32(val>>uint(j)) & 1
+			word[j] = rank | -null
+			rank += 1 - null
+		}
+	}
+	return vals, ranks
+}
+
 // Float32 returns the vec data as []float32. The slice should not be mutated.
 func (v Vec) Float32() []float32 {
 	if v.Type != ColumnTypeFloat32 {
@@ -369,13 +518,118 @@ func (v Vec) Bytes() Bytes {
 	if v.Type != ColumnTypeBytes {
 		panic("vec does not hold bytes data")
 	}
-	if uintptr(v.end)%4 != 0 {
+	if uintptr(v.offsets)%4 != 0 {
 		panic("expected offsets data to be 4-byte aligned")
 	}
-	n := v.N
 	return Bytes{
-		count:   int(n),
+		count:   int(v.N),
 		data:    v.start,
-		offsets: unsafe.Pointer(uintptr(v.end) - uintptr(n*4)),
+		offsets: v.offsets,
+	}
+}
+
+// FixedBytes holds an array of fixed width byte values stored contiguously.
+type FixedBytes struct {
+	count int
+	width int
+	data  unsafe.Pointer
+}
+
+// Len returns the number of values.
+func (b FixedBytes) Len() int {
+	return b.count
+}
+
+// At returns the []byte at index i. The returned slice should not be mutated.
+func (b FixedBytes) At(i int) []byte {
+	if i < 0 || i >= b.count {
+		panic(fmt.Sprintf("pebble/ptable: index out of range: %d", i))
+	}
+	start := i * b.width
+	end := start + b.width
+	return (*[1 << 31]byte)(b.data)[start:end:end]
+}
+
+// FixedBytes returns the vec data of a uuid or fixed width bytes vec as
+// FixedBytes. Like the other fixed width types, and unlike Bytes, the values
+// are indexed by rank. The underlying data should not be mutated.
+func (v Vec) FixedBytes() FixedBytes {
+	if !v.Type.fixedBytes() {
+		panic("vec does not hold fixed bytes data")
+	}
+	return FixedBytes{
+		count: v.count(int(v.N)),
+		width: int(v.Type.Width()),
+		data:  v.start,
 	}
 }
+
+// UUID returns the vec data as [][16]byte. The slice should not be mutated.
+func (v Vec) UUID() [][16]byte {
+	if v.Type != ColumnTypeUUID {
+		panic("vec does not hold uuid data")
+	}
+	n := v.count(int(v.N))
+	return (*[1 << 27][16]byte)(v.start)[:n:n]
+}
+
+// SearchInt64 returns the first row of a sorted int8, int16, int32 or int64
+// vec whose value is >= x, or N if there is no such row. The vec must be
+// sorted as by blockWriter.SetSorted: NULLs first, followed by the non-NULL
+// values in non-decreasing order. NULLs sort before every value, so the
+// returned row is never NULL (unless it is N). The row contains x if x is
+// present in the vec, in which case it is the first such row.
+func (v Vec) SearchInt64(x int64) int {
+	var at func(i int) int64
+	switch v.Type {
+	case ColumnTypeInt8:
+		vals := v.Int8()
+		at = func(i int) int64 { return int64(vals[i]) }
+	case ColumnTypeInt16:
+		vals := v.Int16()
+		at = func(i int) int64 { return int64(vals[i]) }
+	case ColumnTypeInt32:
+		vals := v.Int32()
+		at = func(i int) int64 { return int64(vals[i]) }
+	case ColumnTypeInt64:
+		vals := v.Int64()
+		at = func(i int) int64 { return vals[i] }
+	default:
+		panic("vec does not hold integer data")
+	}
+	// The non-NULL values are stored contiguously and follow the NULLs, so the
+	// search is over the values, and the row is the rank offset by the number
+	// of NULLs.
+	n := v.count(int(v.N))
+	i := sort.Search(n, func(i int) bool { return at(i) >= x })
+	return i + int(v.N) - n
+}
+
+// SearchFloat64 returns the first row of a sorted float32 or float64 vec
+// whose value is >= x, or N if there is no such row. See SearchInt64.
+func (v Vec) SearchFloat64(x float64) int {
+	var at func(i int) float64
+	switch v.Type {
+	case ColumnTypeFloat32:
+		vals := v.Float32()
+		at = func(i int) float64 { return float64(vals[i]) }
+	case ColumnTypeFloat64:
+		vals := v.Float64()
+		at = func(i int) float64 { return vals[i] }
+	default:
+		panic("vec does not hold float data")
+	}
+	n := v.count(int(v.N))
+	i := sort.Search(n, func(i int) bool { return at(i) >= x })
+	return i + int(v.N) - n
+}
+
+// SearchBytes returns the first row of a sorted bytes vec whose value is >= x
+// in lexicographic order, or N if there is no such row. See SearchInt64.
+func (v Vec) SearchBytes(x []byte) int {
+	vals := v.Bytes()
+	nulls := int(v.N) - v.count(int(v.N))
+	return sort.Search(int(v.N), func(i int) bool {
+		return i >= nulls && bytes.Compare(vals.At(i), x) >= 0
+	})
+}
@@ -0,0 +1,384 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+type mergingIterItem struct {
+	index int // the index of the block in MergingIter.blocks
+	row   int // the current row within the block
+}
+
+type mergingIterHeap struct {
+	blocks []*Block
+	col    int
+	dir    ColumnDirection
+	// reverse is true if the heap orders the rows in the reverse of the merged
+	// sequence, as is done by MergingIter.Last and MergingIter.Prev.
+	reverse bool
+	items   []mergingIterItem
+}
+
+func (h *mergingIterHeap) len() int {
+	return len(h.items)
+}
+
+// compare compares the rows a and b by their position in the merged sequence.
+func (h *mergingIterHeap) compare(a, b *mergingIterItem) int {
+	c := compareRows(h.blocks[a.index].Column(h.col), a.row, h.blocks[b.index].Column(h.col), b.row)
+	if h.dir == Descending {
+		c = -c
+	}
+	if c != 0 {
+		return c
+	}
+	// Rows with equal sort column values are output in block order, and in
+	// row order within a block.
+	if c = compareInt64(int64(a.index), int64(b.index)); c != 0 {
+		return c
+	}
+	return compareInt64(int64(a.row), int64(b.row))
+}
+
+func (h *mergingIterHeap) less(i, j int) bool {
+	c := h.compare(&h.items[i], &h.items[j])
+	if h.reverse {
+		return c > 0
+	}
+	return c < 0
+}
+
+func (h *mergingIterHeap) swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+// init, fix, pop, up and down are copied from the go stdlib.
+func (h *mergingIterHeap) init() {
+	// heapify
+	n := h.len()
+	for i := n/2 - 1; i >= 0; i-- {
+		h.down(i, n)
+	}
+}
+
+func (h *mergingIterHeap) fix(i int) {
+	if !h.down(i, h.len()) {
+		h.up(i)
+	}
+}
+
+func (h *mergingIterHeap) pop() *mergingIterItem {
+	n := h.len() - 1
+	h.swap(0, n)
+	h.down(0, n)
+	item := &h.items[n]
+	h.items = h.items[:n]
+	return item
+}
+
+func (h *mergingIterHeap) up(j int) {
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !h.less(j, i) {
+			break
+		}
+		h.swap(i, j)
+		j = i
+	}
+}
+
+func (h *mergingIterHeap) down(i0, n int) bool {
+	i := i0
+	for {
+		j1 := 2*i + 1
+		if j1 >= n || j1 < 0 { // j1 < 0 after int overflow
+			break
+		}
+		j := j1 // left child
+		if j2 := j1 + 1; j2 < n && h.less(j2, j1) {
+			j = j2 // = 2*i + 2  // right child
+		}
+		if !h.less(j, i) {
+			break
+		}
+		h.swap(i, j)
+		i = j
+	}
+	return i > i0
+}
+
+// compareRows compares the value at row i of a to the value at row j of b,
+// which must have the same column type. A NULL value compares less than every
+// non-NULL value and equal to another NULL value.
+func compareRows(a Vec, i int, b Vec, j int) int {
+	ai, bj := a.Null(i), b.Null(j)
+	switch {
+	case ai && bj:
+		return 0
+	case ai:
+		return -1
+	case bj:
+		return +1
+	}
+
+	switch a.Type {
+	case ColumnTypeBool:
+		x, y := a.Bool().Get(i), b.Bool().Get(j)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return +1
+	case ColumnTypeInt8:
+		return compareInt64(int64(a.Int8()[a.Rank(i)]), int64(b.Int8()[b.Rank(j)]))
+	case ColumnTypeInt16:
+		return compareInt64(int64(a.Int16()[a.Rank(i)]), int64(b.Int16()[b.Rank(j)]))
+	case ColumnTypeInt32:
+		return compareInt64(int64(a.Int32()[a.Rank(i)]), int64(b.Int32()[b.Rank(j)]))
+	case ColumnTypeInt64:
+		return compareInt64(a.Int64()[a.Rank(i)], b.Int64()[b.Rank(j)])
+	case ColumnTypeFloat32:
+		return compareFloat64(float64(a.Float32()[a.Rank(i)]), float64(b.Float32()[b.Rank(j)]))
+	case ColumnTypeFloat64:
+		return compareFloat64(a.Float64()[a.Rank(i)], b.Float64()[b.Rank(j)])
+	case ColumnTypeBytes:
+		return bytes.Compare(a.Bytes().At(i), b.Bytes().At(j))
+	}
+	if a.Type.fixedBytes() {
+		return bytes.Compare(a.FixedBytes().At(a.Rank(i)), b.FixedBytes().At(b.Rank(j)))
+	}
+	panic(fmt.Sprintf("pebble/ptable: unknown column type: %s", a.Type))
+}
+
+func compareInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return +1
+	}
+	return 0
+}
+
+func compareFloat64(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return +1
+	}
+	return 0
+}
+
+// MergingIter iterates over the rows of a set of blocks which share a schema
+// and are each sorted on the same column, presenting the rows as a single
+// sequence sorted on that column. This is the columnar analog of the
+// mergingIter used for sstables.
+//
+// NULL values in the sort column sort before all non-NULL values in an
+// Ascending sort and after them in a Descending sort. Rows with equal sort
+// column values (including NULLs) are returned in the order of their blocks,
+// and in row order within a block. The rows are returned in the reverse of
+// this order when iterating with Last and Prev, so NULLs are returned last when
+// iterating backward over an Ascending sort.
+//
+// MergingIter implements RowReader for the current row, which allows the
+// merged rows to be written to a new block.
+type MergingIter struct {
+	heap mergingIterHeap
+	cur  mergingIterItem
+	// valid is true iff cur is positioned at a row.
+	valid bool
+}
+
+// NewMergingIter returns an iterator merging the rows of blocks sorted on
+// column col in the direction dir. The blocks must share a schema and may
+// contain differing numbers of rows.
+func NewMergingIter(blocks []*Block, col int, dir ColumnDirection) *MergingIter {
+	for i := range blocks {
+		if blocks[i].Column(col).Type != blocks[0].Column(col).Type {
+			panic(fmt.Sprintf("pebble/ptable: sort column type mismatch: %s != %s",
+				blocks[i].Column(col).Type, blocks[0].Column(col).Type))
+		}
+	}
+	return &MergingIter{
+		heap: mergingIterHeap{
+			blocks: blocks,
+			col:    col,
+			dir:    dir,
+			items:  make([]mergingIterItem, 0, len(blocks)),
+		},
+	}
+}
+
+// initHeap fills the heap with the row of each block specified by row,
+// omitting the blocks for which row is out of range, ordering the heap for
+// iteration in the specified direction.
+func (m *MergingIter) initHeap(reverse bool, row func(index int, b *Block) int) {
+	m.heap.reverse = reverse
+	m.heap.items = m.heap.items[:0]
+	for i, b := range m.heap.blocks {
+		if r := row(i, b); r >= 0 && r < int(b.rows) {
+			m.heap.items = append(m.heap.items, mergingIterItem{index: i, row: r})
+		}
+	}
+	m.heap.init()
+}
+
+// switchDir repositions the heap at the rows of each block adjacent to the
+// current row, after it when switching to forward iteration and before it when
+// switching to reverse iteration.
+func (m *MergingIter) switchDir(reverse bool) {
+	m.initHeap(reverse, func(index int, b *Block) int {
+		if index == m.cur.index {
+			if reverse {
+				return m.cur.row - 1
+			}
+			return m.cur.row + 1
+		}
+		// Find the first row of the block after the current row.
+		after := sort.Search(int(b.rows), func(row int) bool {
+			return m.heap.compare(&mergingIterItem{index: index, row: row}, &m.cur) > 0
+		})
+		if reverse {
+			return after - 1
+		}
+		return after
+	})
+}
+
+// First moves the iterator to the first row of the merged sequence.
+func (m *MergingIter) First() {
+	m.initHeap(false, func(int, *Block) int { return 0 })
+	m.step()
+}
+
+// Last moves the iterator to the last row of the merged sequence.
+func (m *MergingIter) Last() {
+	m.initHeap(true, func(_ int, b *Block) int { return int(b.rows) - 1 })
+	m.step()
+}
+
+// Next moves the iterator to the next row of the merged sequence.
+func (m *MergingIter) Next() {
+	if !m.valid {
+		return
+	}
+	if m.heap.reverse {
+		m.switchDir(false)
+	}
+	m.step()
+}
+
+// Prev moves the iterator to the previous row of the merged sequence.
+func (m *MergingIter) Prev() {
+	if !m.valid {
+		return
+	}
+	if !m.heap.reverse {
+		m.switchDir(true)
+	}
+	m.step()
+}
+
+// step moves the iterator to the row at the top of the heap, and advances the
+// block containing it in the direction of the heap.
+func (m *MergingIter) step() {
+	if m.heap.len() == 0 {
+		m.valid = false
+		return
+	}
+	m.cur = m.heap.items[0]
+	m.valid = true
+	item := &m.heap.items[0]
+	if m.heap.reverse {
+		item.row--
+	} else {
+		item.row++
+	}
+	if item.row >= 0 && item.row < int(m.heap.blocks[item.index].rows) {
+		m.heap.fix(0)
+	} else {
+		m.heap.pop()
+	}
+}
+
+// Valid returns true if the iterator is positioned at a valid row and false
+// otherwise.
+func (m *MergingIter) Valid() bool {
+	return m.valid
+}
+
+// Block returns the block containing the current row.
+func (m *MergingIter) Block() *Block {
+	return m.heap.blocks[m.cur.index]
+}
+
+// Row returns the index of the current row within Block().
+func (m *MergingIter) Row() int {
+	return m.cur.row
+}
+
+func (m *MergingIter) column(col int) Vec {
+	return m.heap.blocks[m.cur.index].Column(col)
+}
+
+// Null returns true if the current row's value for column col is NULL.
+func (m *MergingIter) Null(col int) bool {
+	return m.column(col).Null(m.cur.row)
+}
+
+// Bool returns the current row's value for the bool column col.
+func (m *MergingIter) Bool(col int) bool {
+	return m.column(col).Bool().Get(m.cur.row)
+}
+
+// Int8 returns the current row's value for the int8 column col.
+func (m *MergingIter) Int8(col int) int8 {
+	v := m.column(col)
+	return v.Int8()[v.Rank(m.cur.row)]
+}
+
+// Int16 returns the current row's value for the int16 column col.
+func (m *MergingIter) Int16(col int) int16 {
+	v := m.column(col)
+	return v.Int16()[v.Rank(m.cur.row)]
+}
+
+// Int32 returns the current row's value for the int32 column col.
+func (m *MergingIter) Int32(col int) int32 {
+	v := m.column(col)
+	return v.Int32()[v.Rank(m.cur.row)]
+}
+
+// Int64 returns the current row's value for the int64 column col.
+func (m *MergingIter) Int64(col int) int64 {
+	v := m.column(col)
+	return v.Int64()[v.Rank(m.cur.row)]
+}
+
+// Float32 returns the current row's value for the float32 column col.
+func (m *MergingIter) Float32(col int) float32 {
+	v := m.column(col)
+	return v.Float32()[v.Rank(m.cur.row)]
+}
+
+// Float64 returns the current row's value for the float64 column col.
+func (m *MergingIter) Float64(col int) float64 {
+	v := m.column(col)
+	return v.Float64()[v.Rank(m.cur.row)]
+}
+
+// Bytes returns the current row's value for the bytes column col. The returned
+// slice should not be mutated.
+func (m *MergingIter) Bytes(col int) []byte {
+	return m.column(col).Bytes().At(m.cur.row)
+}
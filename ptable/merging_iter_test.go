@@ -0,0 +1,205 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sortedBlocks returns blocks with the specified row counts, plus up to 4
+// NULLs each, sorted on column 0 in direction dir with values in [0,n). Column
+// 1 identifies the row. It also returns the total number of rows.
+func sortedBlocks(
+	rng *rand.Rand, schema []ColumnType, dir ColumnDirection, n int64, rowCounts []int,
+) ([]*Block, int) {
+	var blocks []*Block
+	total := 0
+	for i, rows := range rowCounts {
+		vals := make([]int64, rows)
+		for j := range vals {
+			vals[j] = rng.Int63n(n)
+		}
+		sort.Slice(vals, func(a, b int) bool {
+			if dir == Descending {
+				return vals[a] > vals[b]
+			}
+			return vals[a] < vals[b]
+		})
+		nulls := rng.Intn(5)
+
+		var w blockWriter
+		w.init(schema)
+		row := 0
+		put := func(j int, null bool) {
+			if null {
+				w.PutNull(0)
+			} else {
+				w.PutInt64(0, vals[j])
+			}
+			w.PutBytes(1, []byte(fmt.Sprintf("%d/%d", i, row)))
+			row++
+		}
+		// NULLs sort before non-NULL values in an Ascending sort and after
+		// them in a Descending sort.
+		if dir == Ascending {
+			for j := 0; j < nulls; j++ {
+				put(0, true)
+			}
+		}
+		for j := range vals {
+			put(j, false)
+		}
+		if dir == Descending {
+			for j := 0; j < nulls; j++ {
+				put(0, true)
+			}
+		}
+		blocks = append(blocks, NewBlock(w.Finish()))
+		total += rows + nulls
+	}
+	return blocks, total
+}
+
+func TestMergingIter(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	schema := []ColumnType{ColumnTypeInt64, ColumnTypeBytes}
+
+	for _, dir := range []ColumnDirection{Ascending, Descending} {
+		t.Run(fmt.Sprintf("dir=%d", dir), func(t *testing.T) {
+			// Build three blocks with differing row counts, each sorted on column 0
+			// in direction dir.
+			blocks, total := sortedBlocks(rng, schema, dir, 100, []int{100, 7, 250})
+
+			// Merge the blocks into a single block via RowReader.
+			var w blockWriter
+			w.init(schema)
+			seen := make(map[string]bool)
+			iter := NewMergingIter(blocks, 0, dir)
+			for iter.First(); iter.Valid(); iter.Next() {
+				id := string(iter.Bytes(1))
+				if string(iter.Block().Column(1).Bytes().At(iter.Row())) != id {
+					t.Fatalf("Block/Row mismatch at %s", id)
+				}
+				if seen[id] {
+					t.Fatalf("duplicate row %s", id)
+				}
+				seen[id] = true
+				w.PutRow(iter)
+			}
+			if len(seen) != total {
+				t.Fatalf("expected %d rows, but found %d", total, len(seen))
+			}
+
+			merged := NewBlock(w.Finish())
+			col := merged.Column(0)
+			if int(col.N) != total {
+				t.Fatalf("expected %d rows, but found %d", total, col.N)
+			}
+			for i := 1; i < int(col.N); i++ {
+				c := compareRows(col, i-1, col, i)
+				if dir == Descending {
+					c = -c
+				}
+				if c > 0 {
+					t.Fatalf("rows %d and %d are out of order", i-1, i)
+				}
+			}
+		})
+	}
+}
+
+func TestMergingIterEmpty(t *testing.T) {
+	var w1, w2 blockWriter
+	w1.init([]ColumnType{ColumnTypeInt64})
+	w1.PutInt64(0, 1)
+	one := NewBlock(w1.Finish())
+	w2.init([]ColumnType{ColumnTypeInt64})
+	empty := NewBlock(w2.Finish())
+
+	iter := NewMergingIter(nil, 0, Ascending)
+	if iter.First(); iter.Valid() {
+		t.Fatalf("expected no rows")
+	}
+
+	iter = NewMergingIter([]*Block{empty, one, empty}, 0, Ascending)
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if v := iter.Int64(0); v != 1 {
+			t.Fatalf("expected 1, but found %d", v)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 row, but found %d", n)
+	}
+}
+
+func TestMergingIterReverse(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	schema := []ColumnType{ColumnTypeInt64, ColumnTypeBytes}
+
+	for _, dir := range []ColumnDirection{Ascending, Descending} {
+		for _, rowCounts := range [][]int{{50}, {100, 0, 7, 250}} {
+			t.Run(fmt.Sprintf("dir=%d/blocks=%d", dir, len(rowCounts)), func(t *testing.T) {
+				// The small range of values creates runs of equal values which span
+				// the blocks.
+				blocks, total := sortedBlocks(rng, schema, dir, 10, rowCounts)
+				iter := NewMergingIter(blocks, 0, dir)
+				var forward []string
+				for iter.First(); iter.Valid(); iter.Next() {
+					forward = append(forward, string(iter.Bytes(1)))
+				}
+				if len(forward) != total {
+					t.Fatalf("expected %d rows, but found %d", total, len(forward))
+				}
+
+				// A reverse scan returns the rows of a forward scan in the reverse
+				// order, including the order of NULLs and of equal values.
+				i := len(forward)
+				for iter.Last(); iter.Valid(); iter.Prev() {
+					i--
+					if id := string(iter.Bytes(1)); i < 0 || id != forward[i] {
+						t.Fatalf("%d: expected %s, but found %s", i, forward[i], id)
+					}
+				}
+				if i != 0 {
+					t.Fatalf("expected %d rows, but found %d", total, total-i)
+				}
+
+				// Switching directions returns the adjacent rows.
+				iter.First()
+				i = 0
+				for j := 0; j < 1000; j++ {
+					if rng.Intn(2) == 0 {
+						iter.Next()
+						i++
+					} else {
+						iter.Prev()
+						i--
+					}
+					if i < 0 || i >= total {
+						if iter.Valid() {
+							t.Fatalf("%d: expected an invalid iterator", i)
+						}
+						if i < 0 {
+							iter.First()
+							i = 0
+						} else {
+							iter.Last()
+							i = total - 1
+						}
+					}
+					if id := string(iter.Bytes(1)); id != forward[i] {
+						t.Fatalf("%d: expected %s, but found %s", i, forward[i], id)
+					}
+				}
+			})
+		}
+	}
+}
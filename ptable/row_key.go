@@ -0,0 +1,114 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// rowKeyNull is the tag of a NULL value in a row key. The tag of a non-NULL
+// value is its column type, which is never 0, so a NULL value sorts before
+// all non-NULL values of the column, as in compareRows.
+const rowKeyNull = 0
+
+// RowKey appends an encoding of the values of the columns cols at the
+// specified row to buf and returns the extended buffer. Two rows have equal
+// keys if and only if their values for cols are equal, treating NULL as equal
+// to NULL and distinct from every other value, including zero and empty
+// bytes. The keys are byte-comparable: comparing the keys of two rows with
+// bytes.Compare orders them by the values of cols in ascending order (with
+// NULLs first), so the keys are suitable for use as map keys or as sstable
+// keys.
+//
+// Each value is encoded as a tag byte, which is 0 for NULL and the column
+// type otherwise, followed by the value for non-NULL values:
+//
+//   bool:    1 byte, 0 or 1
+//   int:     big-endian with the sign bit inverted, in the column's width
+//   float:   big-endian IEEE 754 bits, inverted for negative values and with
+//            the sign bit inverted otherwise; -0 is encoded as +0
+//   bytes:   the bytes with 0x00 escaped as 0x00 0xff, terminated by 0x00 0x01
+//   uuid:    the bytes, unescaped as every value has the column's width; the
+//            same applies to fixed width bytes
+func (r *Block) RowKey(row int, cols []int, buf []byte) []byte {
+	for _, col := range cols {
+		v := r.Column(col)
+		if v.Null(row) {
+			buf = append(buf, rowKeyNull)
+			continue
+		}
+		buf = append(buf, byte(v.Type))
+		switch v.Type {
+		case ColumnTypeBool:
+			if v.Bool().Get(row) {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case ColumnTypeInt8:
+			buf = append(buf, uint8(v.Int8()[v.Rank(row)])^0x80)
+		case ColumnTypeInt16:
+			var tmp [2]byte
+			binary.BigEndian.PutUint16(tmp[:], uint16(v.Int16()[v.Rank(row)])^(1<<15))
+			buf = append(buf, tmp[:]...)
+		case ColumnTypeInt32:
+			var tmp [4]byte
+			binary.BigEndian.PutUint32(tmp[:], uint32(v.Int32()[v.Rank(row)])^(1<<31))
+			buf = append(buf, tmp[:]...)
+		case ColumnTypeInt64:
+			buf = appendRowKeyUint64(buf, uint64(v.Int64()[v.Rank(row)])^(1<<63))
+		case ColumnTypeFloat32:
+			f := v.Float32()[v.Rank(row)]
+			if f == 0 {
+				f = 0 // normalize -0
+			}
+			b := math.Float32bits(f)
+			if b&(1<<31) != 0 {
+				b = ^b
+			} else {
+				b ^= 1 << 31
+			}
+			var tmp [4]byte
+			binary.BigEndian.PutUint32(tmp[:], b)
+			buf = append(buf, tmp[:]...)
+		case ColumnTypeFloat64:
+			f := v.Float64()[v.Rank(row)]
+			if f == 0 {
+				f = 0 // normalize -0
+			}
+			b := math.Float64bits(f)
+			if b&(1<<63) != 0 {
+				b = ^b
+			} else {
+				b ^= 1 << 63
+			}
+			buf = appendRowKeyUint64(buf, b)
+		case ColumnTypeBytes:
+			for _, c := range v.Bytes().At(row) {
+				if c == 0 {
+					buf = append(buf, 0x00, 0xff)
+				} else {
+					buf = append(buf, c)
+				}
+			}
+			buf = append(buf, 0x00, 0x01)
+		default:
+			if v.Type.fixedBytes() {
+				buf = append(buf, v.FixedBytes().At(v.Rank(row))...)
+				continue
+			}
+			panic(fmt.Sprintf("pebble/ptable: unknown column type: %s", v.Type))
+		}
+	}
+	return buf
+}
+
+func appendRowKeyUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
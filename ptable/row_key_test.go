@@ -0,0 +1,149 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package ptable
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBlockRowKey(t *testing.T) {
+	schema := []ColumnType{
+		ColumnTypeBool,
+		ColumnTypeInt8,
+		ColumnTypeInt16,
+		ColumnTypeInt32,
+		ColumnTypeInt64,
+		ColumnTypeFloat32,
+		ColumnTypeFloat64,
+		ColumnTypeBytes,
+	}
+	allCols := []int{0, 1, 2, 3, 4, 5, 6, 7}
+
+	// Rows 0 and 1 contain identical values, row 2 contains the zero value of
+	// each column, row 3 contains NULLs and row 4 contains -0 for the floats.
+	var w blockWriter
+	w.init(schema)
+	for i := 0; i < 2; i++ {
+		w.PutBool(0, true)
+		w.PutInt8(1, -3)
+		w.PutInt16(2, 300)
+		w.PutInt32(3, -70000)
+		w.PutInt64(4, 1<<40)
+		w.PutFloat32(5, 1.5)
+		w.PutFloat64(6, -2.5)
+		w.PutBytes(7, []byte("a\x00b"))
+	}
+	w.PutBool(0, false)
+	w.PutInt8(1, 0)
+	w.PutInt16(2, 0)
+	w.PutInt32(3, 0)
+	w.PutInt64(4, 0)
+	w.PutFloat32(5, 0)
+	w.PutFloat64(6, 0)
+	w.PutBytes(7, nil)
+	for col := range schema {
+		w.PutNull(col)
+	}
+	w.PutBool(0, false)
+	w.PutInt8(1, 0)
+	w.PutInt16(2, 0)
+	w.PutInt32(3, 0)
+	w.PutInt64(4, 0)
+	w.PutFloat32(5, float32(math.Copysign(0, -1)))
+	w.PutFloat64(6, math.Copysign(0, -1))
+	w.PutBytes(7, []byte{})
+	b := NewBlock(w.Finish())
+
+	key := func(row int, cols []int) []byte {
+		return b.RowKey(row, cols, nil)
+	}
+	if k0, k1 := key(0, allCols), key(1, allCols); !bytes.Equal(k0, k1) {
+		t.Fatalf("expected identical keys for identical rows, but found %x and %x", k0, k1)
+	}
+	if k0, k2 := key(0, allCols), key(2, allCols); bytes.Equal(k0, k2) {
+		t.Fatalf("expected distinct keys for distinct rows, but found %x", k0)
+	}
+	if k2, k4 := key(2, allCols), key(4, allCols); !bytes.Equal(k2, k4) {
+		t.Fatalf("expected -0 and +0 to have identical keys, but found %x and %x", k2, k4)
+	}
+	for _, col := range allCols {
+		cols := []int{col}
+		if bytes.Equal(key(2, cols), key(3, cols)) {
+			t.Fatalf("%s: expected NULL and zero to have distinct keys", schema[col])
+		}
+		// NULL sorts before the zero value.
+		if bytes.Compare(key(3, cols), key(2, cols)) >= 0 {
+			t.Fatalf("%s: expected NULL to sort before zero", schema[col])
+		}
+	}
+	// Keys are appended to buf.
+	if k := b.RowKey(0, []int{7}, []byte("prefix")); !bytes.HasPrefix(k, []byte("prefix")) {
+		t.Fatalf("expected key to be appended to buf, but found %x", k)
+	}
+}
+
+func TestBlockRowKeyOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, ctype := range []ColumnType{
+		ColumnTypeBool,
+		ColumnTypeInt8,
+		ColumnTypeInt16,
+		ColumnTypeInt32,
+		ColumnTypeInt64,
+		ColumnTypeFloat32,
+		ColumnTypeFloat64,
+		ColumnTypeBytes,
+	} {
+		t.Run(ctype.String(), func(t *testing.T) {
+			// Signed values (and float values of both signs) are required to
+			// check the ordering of the encodings.
+			const rows = 200
+			var w blockWriter
+			w.init([]ColumnType{ctype})
+			for i := 0; i < rows; i++ {
+				if rng.Intn(10) == 0 {
+					w.PutNull(0)
+					continue
+				}
+				switch ctype {
+				case ColumnTypeBool:
+					w.PutBool(0, rng.Intn(2) == 0)
+				case ColumnTypeInt8:
+					w.PutInt8(0, int8(rng.Uint32()))
+				case ColumnTypeInt16:
+					w.PutInt16(0, int16(rng.Uint32()))
+				case ColumnTypeInt32:
+					w.PutInt32(0, int32(rng.Uint32()))
+				case ColumnTypeInt64:
+					w.PutInt64(0, int64(rng.Uint64()))
+				case ColumnTypeFloat32:
+					w.PutFloat32(0, float32(rng.NormFloat64()))
+				case ColumnTypeFloat64:
+					w.PutFloat64(0, rng.NormFloat64()*1e10)
+				case ColumnTypeBytes:
+					v := make([]byte, rng.Intn(4))
+					for j := range v {
+						v[j] = byte(rng.Intn(3)) // small alphabet to exercise 0x00
+					}
+					w.PutBytes(0, v)
+				}
+			}
+			b := NewBlock(w.Finish())
+			col := b.Column(0)
+			for i := 0; i < rows; i++ {
+				j := rng.Intn(rows)
+				expected := compareRows(col, i, col, j)
+				actual := bytes.Compare(b.RowKey(i, []int{0}, nil), b.RowKey(j, []int{0}, nil))
+				if expected != actual {
+					t.Fatalf("rows %d and %d: expected comparison %d, but found %d", i, j, expected, actual)
+				}
+			}
+		})
+	}
+}
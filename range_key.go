@@ -0,0 +1,211 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// Range keys are stored in the batch, memtable and sstables as internal keys
+// of kind InternalKeyKindRangeKeySet or InternalKeyKindRangeKeyUnset. The user
+// key of the internal key is the start key of the range and the value is the
+// varint-string end key of the range followed by the range key's value. Range
+// keys are kept separate from the point keys: memtables store them in their
+// own skiplist and sstables in their own block, so point iteration never sees
+// them (with the exception of indexed batches, whose iterator is filtered by
+// dbIter).
+
+// encodeRangeKeyValue returns the value stored for a range key with the given
+// end key and value.
+func encodeRangeKeyValue(end, value []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(end)+len(value))
+	n := binary.PutUvarint(buf, uint64(len(end)))
+	n += copy(buf[n:], end)
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+// decodeRangeKeyValue decodes a value encoded by encodeRangeKeyValue.
+func decodeRangeKeyValue(v []byte) (end, value []byte, ok bool) {
+	n, m := binary.Uvarint(v)
+	if m <= 0 || n > uint64(len(v)-m) {
+		return nil, nil, false
+	}
+	v = v[m:]
+	return v[:n], v[n:], true
+}
+
+// isRangeKeyKind returns whether kind is one of the range key kinds.
+func isRangeKeyKind(kind db.InternalKeyKind) bool {
+	return kind == db.InternalKeyKindRangeKeySet || kind == db.InternalKeyKindRangeKeyUnset
+}
+
+var errCorruptRangeKey = errors.New("pebble: corrupt range key")
+
+// rangeKeyEntry is a range key read from a batch, memtable or sstable.
+type rangeKeyEntry struct {
+	start, end []byte
+	value      []byte
+	seqNum     uint64
+	kind       db.InternalKeyKind
+}
+
+// collectRangeKeys appends the range keys in iter which are visible at the
+// snapshot sequence number seqNum to entries, and closes iter. Entries other
+// than range keys are ignored. The returned entries do not alias the
+// iterator's memory.
+func collectRangeKeys(
+	iter db.InternalIterator, seqNum uint64, entries []rangeKeyEntry,
+) ([]rangeKeyEntry, error) {
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !isRangeKeyKind(key.Kind()) {
+			continue
+		}
+		if s := key.SeqNum(); s >= seqNum && (s&db.InternalKeySeqNumBatch) == 0 {
+			continue
+		}
+		end, value, ok := decodeRangeKeyValue(iter.Value())
+		if !ok {
+			iter.Close()
+			return entries, errCorruptRangeKey
+		}
+		buf := make([]byte, 0, len(key.UserKey)+len(end)+len(value))
+		buf = append(buf, key.UserKey...)
+		buf = append(buf, end...)
+		buf = append(buf, value...)
+		e := rangeKeyEntry{seqNum: key.SeqNum(), kind: key.Kind()}
+		e.start = buf[:len(key.UserKey):len(key.UserKey)]
+		buf = buf[len(key.UserKey):]
+		e.end = buf[:len(end):len(end)]
+		e.value = buf[len(end):]
+		entries = append(entries, e)
+	}
+	return entries, iter.Close()
+}
+
+// fragmentRangeKeys resolves a set of possibly overlapping range keys into the
+// sorted, non-overlapping fragments which are set. Within each fragment the
+// range key with the largest sequence number wins: a newer RangeKeySet
+// replaces the value of an older one and a newer RangeKeyUnset removes it.
+// Adjacent fragments from the same range key are coalesced.
+//
+// TODO(peter): This considers every range key for each fragment, which is
+// quadratic. A sweep over the sorted start and end keys would be linear in the
+// number of fragments.
+func fragmentRangeKeys(cmp db.Compare, entries []rangeKeyEntry) []db.RangeKey {
+	if len(entries) == 0 {
+		return nil
+	}
+	bounds := make([][]byte, 0, 2*len(entries))
+	for i := range entries {
+		e := &entries[i]
+		if cmp(e.start, e.end) >= 0 {
+			continue
+		}
+		bounds = append(bounds, e.start, e.end)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return cmp(bounds[i], bounds[j]) < 0
+	})
+	n := 0
+	for i := range bounds {
+		if n > 0 && cmp(bounds[n-1], bounds[i]) == 0 {
+			continue
+		}
+		bounds[n] = bounds[i]
+		n++
+	}
+	bounds = bounds[:n]
+
+	var frags []db.RangeKey
+	last := -1
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		winner := -1
+		for j := range entries {
+			e := &entries[j]
+			if cmp(e.start, start) > 0 || cmp(e.end, end) < 0 {
+				continue
+			}
+			if winner == -1 || e.seqNum > entries[winner].seqNum {
+				winner = j
+			}
+		}
+		if winner == -1 || entries[winner].kind != db.InternalKeyKindRangeKeySet {
+			last = -1
+			continue
+		}
+		if last == winner {
+			frags[len(frags)-1].End = end
+			continue
+		}
+		frags = append(frags, db.RangeKey{
+			Start: start,
+			End:   end,
+			Value: entries[winner].value,
+		})
+		last = winner
+	}
+	return frags
+}
+
+// findRangeKeys returns the fragment in frags which contains key, or nil if
+// no fragment contains key.
+func findRangeKeys(cmp db.Compare, frags []db.RangeKey, key []byte) []db.RangeKey {
+	j := sort.Search(len(frags), func(j int) bool {
+		return cmp(key, frags[j].End) < 0
+	})
+	if j == len(frags) || cmp(key, frags[j].Start) < 0 {
+		return nil
+	}
+	return frags[j : j+1]
+}
+
+// loadRangeKeys returns the fragments of the range keys visible at the
+// snapshot sequence number seqNum in the batch (which may be nil), memtables
+// and the tables of current.
+func (d *DB) loadRangeKeys(
+	batch *Batch, seqNum uint64, memtables []*memTable, current *version,
+) ([]db.RangeKey, error) {
+	var entries []rangeKeyEntry
+	var err error
+	if batch != nil {
+		if entries, err = collectRangeKeys(batch.newInternalIter(nil), seqNum, entries); err != nil {
+			return nil, err
+		}
+	}
+	for _, mem := range memtables {
+		if !mem.hasRangeKeys() {
+			continue
+		}
+		if entries, err = collectRangeKeys(mem.newRangeKeyIter(), seqNum, entries); err != nil {
+			return nil, err
+		}
+	}
+	for level := range current.files {
+		for i := range current.files[level] {
+			f := &current.files[level][i]
+			if !f.mayContainRangeKeys() {
+				continue
+			}
+			iter, err := d.tableCache.newRangeKeyIter(f)
+			if err != nil {
+				return nil, err
+			}
+			if iter == nil {
+				continue
+			}
+			if entries, err = collectRangeKeys(iter, seqNum, entries); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fragmentRangeKeys(d.cmp, entries), nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestFragmentRangeKeys(t *testing.T) {
+	set := func(start, end string, seqNum uint64, value string) rangeKeyEntry {
+		return rangeKeyEntry{
+			start:  []byte(start),
+			end:    []byte(end),
+			value:  []byte(value),
+			seqNum: seqNum,
+			kind:   db.InternalKeyKindRangeKeySet,
+		}
+	}
+	unset := func(start, end string, seqNum uint64) rangeKeyEntry {
+		return rangeKeyEntry{
+			start:  []byte(start),
+			end:    []byte(end),
+			seqNum: seqNum,
+			kind:   db.InternalKeyKindRangeKeyUnset,
+		}
+	}
+
+	testCases := []struct {
+		entries  []rangeKeyEntry
+		expected string
+	}{
+		{nil, ""},
+		{[]rangeKeyEntry{set("a", "c", 1, "1")}, "[a,c)=1"},
+		{[]rangeKeyEntry{set("c", "a", 1, "1")}, ""},
+		{[]rangeKeyEntry{unset("a", "c", 1)}, ""},
+		// A newer range key replaces the overlapping portion of an older one.
+		{[]rangeKeyEntry{set("a", "e", 1, "1"), set("b", "c", 2, "2")}, "[a,b)=1 [b,c)=2 [c,e)=1"},
+		{[]rangeKeyEntry{set("a", "e", 2, "1"), set("b", "c", 1, "2")}, "[a,e)=1"},
+		{[]rangeKeyEntry{set("a", "c", 1, "1"), set("b", "d", 2, "2")}, "[a,b)=1 [b,d)=2"},
+		{[]rangeKeyEntry{set("a", "c", 1, "1"), set("c", "d", 2, "2")}, "[a,c)=1 [c,d)=2"},
+		{[]rangeKeyEntry{set("a", "c", 2, "1"), set("c", "d", 1, "1")}, "[a,c)=1 [c,d)=1"},
+		// An unset removes the overlapping portion of older range keys.
+		{[]rangeKeyEntry{set("a", "e", 1, "1"), unset("b", "c", 2)}, "[a,b)=1 [c,e)=1"},
+		{[]rangeKeyEntry{unset("b", "c", 1), set("a", "e", 2, "1")}, "[a,e)=1"},
+		{[]rangeKeyEntry{set("a", "e", 1, "1"), unset("a", "f", 2), set("d", "f", 3, "3")}, "[d,f)=3"},
+	}
+	for _, c := range testCases {
+		var buf bytes.Buffer
+		for _, f := range fragmentRangeKeys(bytes.Compare, c.entries) {
+			fmt.Fprintf(&buf, "[%s,%s)=%s ", f.Start, f.End, f.Value)
+		}
+		if s := strings.TrimSpace(buf.String()); s != c.expected {
+			t.Errorf("expected %q, but found %q", c.expected, s)
+		}
+	}
+}
+
+func TestRangeKeys(t *testing.T) {
+	mem := storage.NewMem()
+	opts := &db.Options{
+		L0CompactionThreshold: 2,
+		Storage:               mem,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const keys = "abcdefghijklmnopqrstuvwxyz"
+	for i := range keys {
+		if err := d.Set([]byte(keys[i:i+1]), []byte(keys[i:i+1]), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	set := func(start, end, value string) {
+		t.Helper()
+		if err := d.RangeKeySet([]byte(start), []byte(end), []byte(value), nil); err != nil {
+			t.Fatalf("RangeKeySet: %v", err)
+		}
+	}
+	unset := func(start, end string) {
+		t.Helper()
+		if err := d.RangeKeyUnset([]byte(start), []byte(end), nil); err != nil {
+			t.Fatalf("RangeKeyUnset: %v", err)
+		}
+	}
+	flush := func() {
+		t.Helper()
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	// The first two flushes are compacted out of L0, the third remains in L0
+	// and the last range key is in the memtable.
+	set("b", "h", "1")
+	flush()
+	set("d", "f", "2")
+	flush()
+	d.mu.Lock()
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	compacted := len(d.mu.versions.currentVersion().files[1])
+	d.mu.Unlock()
+	if compacted == 0 {
+		t.Fatalf("expected compacted tables")
+	}
+	set("g", "p", "3")
+	unset("k", "m")
+	flush()
+	set("r", "t", "4")
+
+	// scan returns the range keys at each key found by iterating forward and
+	// then backward, checking that the range keys do not appear as point keys.
+	scan := func(iter db.Iterator) string {
+		t.Helper()
+		format := func() string {
+			key := string(iter.Key())
+			if string(iter.Value()) != key {
+				t.Fatalf("expected value %s, but found %s", key, iter.Value())
+			}
+			var buf bytes.Buffer
+			buf.WriteString(key)
+			for _, r := range iter.RangeKeys() {
+				fmt.Fprintf(&buf, "[%s,%s)=%s", r.Start, r.End, r.Value)
+			}
+			return buf.String()
+		}
+		var forward, backward []string
+		for iter.First(); iter.Valid(); iter.Next() {
+			forward = append(forward, format())
+		}
+		for iter.Last(); iter.Valid(); iter.Prev() {
+			backward = append([]string{format()}, backward...)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, b := strings.Join(forward, " "), strings.Join(backward, " ")
+		if f != b {
+			t.Fatalf("forward and backward iteration differ:\n%s\n%s", f, b)
+		}
+		return f
+	}
+
+	expected := "a b[b,d)=1 c[b,d)=1 d[d,f)=2 e[d,f)=2 f[f,g)=1 g[g,k)=3 h[g,k)=3 " +
+		"i[g,k)=3 j[g,k)=3 k l m[m,p)=3 n[m,p)=3 o[m,p)=3 p q r[r,t)=4 s[r,t)=4 " +
+		"t u v w x y z"
+	if s := scan(d.NewIter(nil)); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+	if v, err := d.Get([]byte("b")); err != nil || string(v) != "b" {
+		t.Fatalf("expected b, but found %s (%v)", v, err)
+	}
+
+	// The range keys in an indexed batch are visible to its iterator.
+	b := d.NewIndexedBatch()
+	if err := b.RangeKeyUnset([]byte("a"), []byte("c"), nil); err != nil {
+		t.Fatalf("RangeKeyUnset: %v", err)
+	}
+	if err := b.RangeKeySet([]byte("x"), []byte("z"), []byte("5"), nil); err != nil {
+		t.Fatalf("RangeKeySet: %v", err)
+	}
+	if v, err := b.Get([]byte("x")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %s (%v)", v, err)
+	}
+	batchExpected := "a b c[c,d)=1" + strings.TrimPrefix(expected, "a b[b,d)=1 c[b,d)=1")
+	batchExpected = strings.Replace(batchExpected, "x y", "x[x,z)=5 y[x,z)=5", 1)
+	if s := scan(b.NewIter(nil)); s != batchExpected {
+		t.Fatalf("expected\n%s\nbut found\n%s", batchExpected, s)
+	}
+
+	// The range keys survive a restart, which replays the memtable's range keys
+	// from the WAL.
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if s := scan(d.NewIter(nil)); s != expected {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCompactionGrandparentRangeKeys(t *testing.T) {
+	d, err := Open("", &db.Options{
+		L0CompactionThreshold:     100,
+		L0SlowdownWritesThreshold: 100,
+		L0StopWritesThreshold:     100,
+		Storage:                   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// flushTo flushes the memtable and moves the flushed table to level.
+	flushTo := func(level int) {
+		t.Helper()
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		f := d.mu.versions.currentVersion().files[0][0]
+		err := d.mu.versions.logAndApply(d.opts, d.dirname, &versionEdit{
+			deletedFiles: map[deletedFileEntry]bool{
+				deletedFileEntry{level: 0, fileNum: f.fileNum}: true,
+			},
+			newFiles: []newFileEntry{
+				{level: level, meta: f},
+			},
+		})
+		if err != nil {
+			t.Fatalf("logAndApply: %v", err)
+		}
+	}
+
+	// The grandparent table in level 3 holds a range key which overlaps the
+	// level 1 and level 2 tables.
+	if err := d.RangeKeySet([]byte("c"), []byte("e"), []byte("1"), nil); err != nil {
+		t.Fatalf("RangeKeySet: %v", err)
+	}
+	flushTo(3)
+	for _, key := range []string{"b", "d"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	flushTo(2)
+	if err := d.Set([]byte("c"), []byte("c"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	flushTo(1)
+
+	// compact compacts the level 1 and level 2 tables, and returns the number
+	// of range keys in the level 2 outputs.
+	compact := func() uint64 {
+		t.Helper()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		v := d.mu.versions.currentVersion()
+		c := &compaction{
+			version: v,
+			level:   1,
+		}
+		c.inputs[0] = v.files[1]
+		c.inputs[1] = v.files[2]
+		c.inputs[2] = v.files[3]
+		ve, pendingOutputs, err := d.compactDiskTables(c)
+		if err != nil {
+			t.Fatalf("compactDiskTables: %v", err)
+		}
+		err = d.mu.versions.logAndApply(d.opts, d.dirname, ve)
+		for _, fileNum := range pendingOutputs {
+			delete(d.mu.compact.pendingOutputs, fileNum)
+		}
+		if err != nil {
+			t.Fatalf("logAndApply: %v", err)
+		}
+		var n uint64
+		for _, f := range d.mu.versions.currentVersion().files[2] {
+			n += f.numRangeKeys
+		}
+		return n
+	}
+	if n := compact(); n != 0 {
+		t.Fatalf("expected no range keys in level 2, but found %d", n)
+	}
+
+	// A second compaction of the output, which overlaps the same grandparent,
+	// must also succeed.
+	if err := d.Set([]byte("c"), []byte("c"), nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	flushTo(1)
+	if n := compact(); n != 0 {
+		t.Fatalf("expected no range keys in level 2, but found %d", n)
+	}
+
+	var keys []string
+	iter := d.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		for _, r := range iter.RangeKeys() {
+			key += fmt.Sprintf("[%s,%s)=%s", r.Start, r.End, r.Value)
+		}
+		keys = append(keys, key)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, expected := strings.Join(keys, " "), "b c[c,e)=1 d[c,e)=1"; s != expected {
+		t.Fatalf("expected %s, but found %s", expected, s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
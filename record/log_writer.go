@@ -34,9 +34,10 @@ type LogWriter struct {
 	s syncer
 	// blockNumber is the zero based block number for the current block.
 	blockNumber int64
-	// err is any accumulated error. TODO(peter): This needs to be protected in
-	// some fashion. Perhaps using atomic.Value.
-	err error
+	// err is any accumulated error, stored as a logWriterErr. It is accessed
+	// atomically as it is set by Flush and Sync, which may be called
+	// concurrently with WriteRecord.
+	err atomic.Value
 	// block is the current block being written. Protected by flusher.Mutex.
 	block *block
 	free  chan *block
@@ -149,7 +150,7 @@ func (w *LogWriter) queueBlock() {
 	f.pending = append(f.pending, w.block)
 	w.block = nextBlock
 	f.ready.Signal()
-	w.err = w.flusher.err
+	w.setErr(w.flusher.err)
 	f.Unlock()
 
 	w.blockNumber++
@@ -170,10 +171,27 @@ func (w *LogWriter) Close() error {
 			return err
 		}
 	}
-	w.err = errors.New("pebble/record: closed LogWriter")
+	w.setErr(errors.New("pebble/record: closed LogWriter"))
 	return nil
 }
 
+// logWriterErr wraps the error stored in LogWriter.err, as an atomic.Value
+// cannot store a nil error.
+type logWriterErr struct {
+	err error
+}
+
+// getErr returns the accumulated error.
+func (w *LogWriter) getErr() error {
+	e, _ := w.err.Load().(logWriterErr)
+	return e.err
+}
+
+// setErr sets the accumulated error.
+func (w *LogWriter) setErr(err error) {
+	w.err.Store(logWriterErr{err})
+}
+
 func (w *LogWriter) closed() bool {
 	w.flusher.Lock()
 	closed := w.flusher.closed
@@ -183,6 +201,14 @@ func (w *LogWriter) closed() bool {
 
 // Flush flushes unwritten data. May be called concurrently with Write, Sync
 // and itself.
+//
+// Flush writes every record which was completely written by a call to
+// WriteRecord which returned before Flush was called, including a record in a
+// partially filled block, to the underlying writer: both the blocks queued for
+// the flush loop and the filled portion of the current block are written
+// before Flush returns. The unflushed remainder of the current block is
+// written by a later flush, so a block may be written to the underlying
+// writer in several pieces, but its bytes are never written twice.
 func (w *LogWriter) Flush() error {
 	w.flushMu.Lock()
 	defer w.flushMu.Unlock()
@@ -190,11 +216,11 @@ func (w *LogWriter) Flush() error {
 }
 
 func (w *LogWriter) flushLocked() error {
-	if w.err != nil {
+	if err := w.getErr(); err != nil {
 		if w.closed() {
 			return nil
 		}
-		return w.err
+		return err
 	}
 
 	w.flusher.Lock()
@@ -228,21 +254,27 @@ func (w *LogWriter) flushLocked() error {
 
 	// Release the flush loop.
 	w.flusher.Lock()
-	w.err = err
+	w.setErr(err)
 	w.flusher.err = err
 	w.flusher.flushing = false
 	w.flusher.done.Signal()
 	w.flusher.Unlock()
 
 	if w.f != nil {
-		w.err = w.f.Flush()
-		return w.err
+		err = w.f.Flush()
+		w.setErr(err)
+		return err
 	}
 	return nil
 }
 
 // Sync flushes unwritten data and synchronizes the underlying file. May be
 // called concurrently with Write, Flush and itself.
+//
+// When Sync returns without error, every record written by a call to
+// WriteRecord which returned before Sync was called is durable, even if it did
+// not fill its block. This is the durability guarantee of the WAL, which syncs
+// the log after writing the records of a batch.
 func (w *LogWriter) Sync() error {
 	w.flushMu.Lock()
 	defer w.flushMu.Unlock()
@@ -255,22 +287,24 @@ func (w *LogWriter) Sync() error {
 	}
 
 	if w.s != nil {
-		w.err = w.s.Sync()
-		if w.err != nil {
+		err := w.s.Sync()
+		w.setErr(err)
+		if err != nil {
 			if w.closed() {
 				return nil
 			}
 		}
-		return w.err
+		return err
 	}
 	return nil
 }
 
 // WriteRecord writes a complete record. Returns the offset just past the end
-// of the record.
+// of the record. The record is buffered, and is only guaranteed to have been
+// written to the underlying writer after a subsequent call to Flush or Sync.
 func (w *LogWriter) WriteRecord(p []byte) (int64, error) {
-	if w.err != nil {
-		return -1, w.err
+	if err := w.getErr(); err != nil {
+		return -1, err
 	}
 
 	for i := 0; len(p) > 0; i++ {
@@ -278,7 +312,7 @@ func (w *LogWriter) WriteRecord(p []byte) (int64, error) {
 	}
 
 	offset := w.blockNumber*blockSize + int64(w.block.written)
-	return offset, w.err
+	return offset, w.getErr()
 }
 
 func (w *LogWriter) emitFragment(n int, p []byte) []byte {
@@ -21,7 +21,7 @@
 // Example code:
 //	func read(r io.Reader) ([]string, error) {
 //		var ss []string
-//		records := record.NewReader(r)
+//		records := record.NewReader(r, record.StrictMode)
 //		for {
 //			rec, err := records.Next()
 //			if err == io.EOF {
@@ -29,13 +29,13 @@
 //			}
 //			if err != nil {
 //				log.Printf("recovering from %v", err)
-//				r.Recover()
+//				records.Recover()
 //				continue
 //			}
 //			s, err := ioutil.ReadAll(rec)
 //			if err != nil {
 //				log.Printf("recovering from %v", err)
-//				r.Recover()
+//				records.Recover()
 //				continue
 //			}
 //			ss = append(ss, string(s))
@@ -72,7 +72,12 @@
 //
 // The wire format allows for limited recovery in the face of data corruption:
 // on a format error (such as a checksum mismatch), the reader moves to the
-// next block and looks for the next full or first chunk.
+// next block and looks for the next full or first chunk. A Reader created in
+// StrictMode returns such errors to the caller, who may choose to call
+// Recover. A Reader created in RecoverMode performs the recovery itself,
+// keeping track of the number of bytes and records skipped. A Reader created
+// in TolerateTailMode treats corruption at the tail of the stream as the end
+// of the stream, and returns corruption followed by valid chunks as an error.
 package record // import "github.com/petermattis/pebble/record"
 
 // The C++ Level-DB code calls this the log, but it has been renamed to record
@@ -110,6 +115,32 @@ var (
 	ErrNoLastRecord = errors.New("pebble/record: no last record exists")
 )
 
+// ReaderMode controls how a Reader handles corrupt or truncated chunks.
+type ReaderMode int
+
+const (
+	// StrictMode causes a Reader to return an error upon encountering a
+	// checksum or framing mismatch. This is appropriate for files such as the
+	// MANIFEST where any corruption is fatal.
+	StrictMode ReaderMode = iota
+	// RecoverMode causes a Reader to skip to the next valid record upon
+	// encountering a checksum or framing mismatch, including a torn record at
+	// the end of the file. This is appropriate for replaying a WAL after a
+	// crash. The amount of data skipped is available via SkippedBytes and
+	// SkippedRecords.
+	RecoverMode
+	// TolerateTailMode causes a Reader to treat a checksum or framing
+	// mismatch which is not followed by any valid chunk, such as a torn write
+	// at the end of the file, as the end of the file. A mismatch which is
+	// followed by a valid chunk in a later block is returned as an error, as
+	// in StrictMode. As in RecoverMode, the rest of the block holding a
+	// mismatch cannot be trusted. This is appropriate for replaying a WAL
+	// where only the tail of the file can have been torn by a crash, and
+	// corruption elsewhere must not be silently skipped. Determining whether
+	// a mismatch is at the tail requires reading the rest of the file.
+	TolerateTailMode
+)
+
 type flusher interface {
 	Flush() error
 }
@@ -122,6 +153,8 @@ type syncer interface {
 type Reader struct {
 	// r is the underlying reader.
 	r io.Reader
+	// mode controls the handling of corrupt chunks.
+	mode ReaderMode
 	// seq is the sequence number of the current record.
 	seq int
 	// buf[i:j] is the unread portion of the current chunk's payload.
@@ -138,14 +171,60 @@ type Reader struct {
 	last bool
 	// err is any accumulated error.
 	err error
+	// skippedBytes and skippedRecords track the data discarded while
+	// resyncing in RecoverMode.
+	skippedBytes   int64
+	skippedRecords int
 	// buf is the buffer.
 	buf [blockSize]byte
 }
 
-// NewReader returns a new reader.
-func NewReader(r io.Reader) *Reader {
+// NewReader returns a new reader which handles corruption according to mode.
+func NewReader(r io.Reader, mode ReaderMode) *Reader {
 	return &Reader{
-		r: r,
+		r:    r,
+		mode: mode,
+	}
+}
+
+// SkippedBytes returns the number of bytes discarded due to corruption while
+// reading in RecoverMode, or at the tail of the file in TolerateTailMode.
+func (r *Reader) SkippedBytes() int64 {
+	return r.skippedBytes
+}
+
+// SkippedRecords returns the number of corrupt or truncated records discarded
+// while reading in RecoverMode, or at the tail of the file in
+// TolerateTailMode.
+func (r *Reader) SkippedRecords() int {
+	return r.skippedRecords
+}
+
+// resync discards the remainder of the current block, starting at offset
+// start, and marks the reader as recovering so that the next full or first
+// chunk is returned.
+func (r *Reader) resync(start int) {
+	if start < r.n {
+		r.skippedBytes += int64(r.n - start)
+	}
+	r.skippedRecords++
+	r.recovering = true
+	r.i, r.j, r.last = r.n, r.n, false
+}
+
+// tail is called in TolerateTailMode upon encountering the corrupt chunk
+// starting at offset start. It reads ahead for a valid full or first chunk in
+// a later block, returning err if one is found and io.EOF if the corruption
+// extends to the end of the file. Either way, no further chunks can be read.
+func (r *Reader) tail(start int, err error) error {
+	r.resync(start)
+	switch next := r.nextChunk(true); next {
+	case nil:
+		return err
+	case io.EOF:
+		return io.EOF
+	default:
+		return next
 	}
 }
 
@@ -154,6 +233,7 @@ func NewReader(r io.Reader) *Reader {
 func (r *Reader) nextChunk(wantFirst bool) error {
 	for {
 		if r.j+headerSize <= r.n {
+			start := r.j
 			checksum := binary.LittleEndian.Uint32(r.buf[r.j+0 : r.j+4])
 			length := binary.LittleEndian.Uint16(r.buf[r.j+4 : r.j+6])
 			chunkType := r.buf[r.j+6]
@@ -169,27 +249,49 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 					r.Recover()
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk")
+				err := errors.New("pebble/record: invalid chunk")
+				if r.mode == TolerateTailMode {
+					return r.tail(start, err)
+				}
+				return err
 			}
 
+			// Corruption is only resynced when looking for the start of a
+			// record. A corrupt chunk in the middle of a record is returned to
+			// the caller so that a partial record is never surfaced.
+			resync := wantFirst && (r.recovering || r.mode == RecoverMode)
+
 			r.i = r.j + headerSize
 			r.j = r.j + headerSize + int(length)
 			if r.j > r.n {
-				if r.recovering {
-					r.Recover()
+				if resync {
+					r.resync(start)
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (length overflows block)")
+				err := errors.New("pebble/record: invalid chunk (length overflows block)")
+				if r.mode == TolerateTailMode {
+					return r.tail(start, err)
+				}
+				return err
 			}
 			if checksum != crc.New(r.buf[r.i-1:r.j]).Value() {
-				if r.recovering {
-					r.Recover()
+				if resync {
+					r.resync(start)
 					continue
 				}
-				return errors.New("pebble/record: invalid chunk (checksum mismatch)")
+				err := errors.New("pebble/record: invalid chunk (checksum mismatch)")
+				if r.mode == TolerateTailMode {
+					return r.tail(start, err)
+				}
+				return err
 			}
 			if wantFirst {
 				if chunkType != fullChunkType && chunkType != firstChunkType {
+					if r.recovering || r.mode == RecoverMode {
+						// An orphaned middle or last chunk belongs to a record
+						// whose first chunk was discarded.
+						r.skippedBytes += int64(r.j - start)
+					}
 					continue
 				}
 			}
@@ -199,8 +301,24 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 		}
 		if r.n < blockSize && r.started {
 			if r.j != r.n {
+				if r.mode != StrictMode {
+					// A torn chunk header at the end of the file. If we're in
+					// the middle of a record in RecoverMode, the record is
+					// accounted for when the caller moves on to the next
+					// record.
+					r.skippedBytes += int64(r.n - r.j)
+					if wantFirst || r.mode == TolerateTailMode {
+						r.skippedRecords++
+					}
+					r.i, r.j = r.n, r.n
+					return io.EOF
+				}
 				return io.ErrUnexpectedEOF
 			}
+			if !wantFirst && r.mode == TolerateTailMode {
+				// The record was truncated before its last chunk.
+				r.skippedRecords++
+			}
 			return io.EOF
 		}
 		n, err := io.ReadFull(r.r, r.buf[:])
@@ -217,7 +335,13 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 func (r *Reader) Next() (io.Reader, error) {
 	r.seq++
 	if r.err != nil {
-		return nil, r.err
+		if r.mode != RecoverMode || r.err == io.EOF {
+			return nil, r.err
+		}
+		// The previous record was corrupt or truncated. Discard the rest of
+		// the current block and continue with the next valid record.
+		r.err = nil
+		r.resync(r.j)
 	}
 	r.i = r.j
 	r.err = r.nextChunk(true)
@@ -313,6 +437,15 @@ func (x singleReader) Read(p []byte) (int, error) {
 			return 0, io.EOF
 		}
 		if r.err = r.nextChunk(false); r.err != nil {
+			if r.err == io.EOF {
+				// The record was truncated before its last chunk. In
+				// TolerateTailMode the truncated record is the end of the
+				// file, so r.err is left as io.EOF for Next to return.
+				if r.mode == TolerateTailMode {
+					return 0, io.ErrUnexpectedEOF
+				}
+				r.err = io.ErrUnexpectedEOF
+			}
 			return 0, r.err
 		}
 	}
@@ -32,7 +32,7 @@ func big(partial string, n int) string {
 // This includes decoding an empty stream.
 func TestZeroBlocks(t *testing.T) {
 	for i := 0; i < 3; i++ {
-		r := NewReader(bytes.NewReader(make([]byte, i*blockSize)))
+		r := NewReader(bytes.NewReader(make([]byte, i*blockSize)), StrictMode)
 		if _, err := r.Next(); err != io.EOF {
 			t.Fatalf("%d blocks: got %v, want %v", i, err, io.EOF)
 		}
@@ -58,7 +58,7 @@ func testGenerator(t *testing.T, reset func(), gen func() (string, bool)) {
 	}
 
 	reset()
-	r := NewReader(buf)
+	r := NewReader(buf, StrictMode)
 	for {
 		s, ok := gen()
 		if !ok {
@@ -204,7 +204,7 @@ func TestFlush(t *testing.T) {
 		t.Fatalf("buffer length #5: got %d want %d", got, want)
 	}
 	// Check that reading those records give the right lengths.
-	r := NewReader(buf)
+	r := NewReader(buf, StrictMode)
 	wants := []int64{1, 2, 10000, 40000}
 	for i, want := range wants {
 		rr, _ := r.Next()
@@ -234,7 +234,7 @@ func TestNonExhaustiveRead(t *testing.T) {
 		t.Fatalf("Close: %v", err)
 	}
 
-	r := NewReader(buf)
+	r := NewReader(buf, StrictMode)
 	for i := 0; i < n; i++ {
 		rr, _ := r.Next()
 		_, err := io.ReadFull(rr, p)
@@ -262,7 +262,7 @@ func TestStaleReader(t *testing.T) {
 		t.Fatalf("Close: %v\n", err)
 	}
 
-	r := NewReader(buf)
+	r := NewReader(buf, StrictMode)
 	r0, err := r.Next()
 	if err != nil {
 		t.Fatalf("reader.Next: %v", err)
@@ -361,7 +361,7 @@ func TestRecoverNoOp(t *testing.T) {
 		t.Fatalf("makeTestRecords: %v", err)
 	}
 
-	r := NewReader(bytes.NewReader(recs.buf))
+	r := NewReader(bytes.NewReader(recs.buf), StrictMode)
 	_, err = r.Next()
 	if err != nil || r.err != nil {
 		t.Fatalf("reader.Next: %v reader.err: %v", err, r.err)
@@ -392,7 +392,7 @@ func TestBasicRecover(t *testing.T) {
 	corruptBlock(recs.buf, 1)
 
 	underlyingReader := bytes.NewReader(recs.buf)
-	r := NewReader(underlyingReader)
+	r := NewReader(underlyingReader, StrictMode)
 
 	// The first record r0 should be read just fine.
 	r0, err := r.Next()
@@ -458,7 +458,7 @@ func TestRecoverSingleBlock(t *testing.T) {
 
 	// The first record should fail, but only when we read deeper beyond the
 	// first block.
-	r := NewReader(bytes.NewReader(recs.buf))
+	r := NewReader(bytes.NewReader(recs.buf), StrictMode)
 	r0, err := r.Next()
 	if err != nil {
 		t.Fatalf("Next: %v", err)
@@ -516,7 +516,7 @@ func TestRecoverMultipleBlocks(t *testing.T) {
 	corruptBlock(recs.buf, 5)
 
 	// The first record should fail, but only when we read deeper beyond the first block.
-	r := NewReader(bytes.NewReader(recs.buf))
+	r := NewReader(bytes.NewReader(recs.buf), StrictMode)
 	r0, err := r.Next()
 	if err != nil {
 		t.Fatalf("Next: %v", err)
@@ -553,7 +553,7 @@ func TestRecoverMultipleBlocks(t *testing.T) {
 // last record will be corrupted. It will then try Recover and verify that EOF
 // is returned.
 func verifyLastBlockRecover(recs *testRecords) error {
-	r := NewReader(bytes.NewReader(recs.buf))
+	r := NewReader(bytes.NewReader(recs.buf), StrictMode)
 	// Loop to one element larger than the number of records to verify EOF.
 	for i := 0; i < len(recs.records)+1; i++ {
 		_, err := r.Next()
@@ -620,6 +620,198 @@ func TestRecoverLastCompleteBlock(t *testing.T) {
 	}
 }
 
+// readAllRecords reads every record from buf using the specified mode,
+// returning the records read and the first error encountered, if any.
+func readAllRecords(buf []byte, mode ReaderMode) (*Reader, [][]byte, error) {
+	r := NewReader(bytes.NewReader(buf), mode)
+	var recs [][]byte
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return r, recs, nil
+		}
+		if err != nil {
+			return r, recs, err
+		}
+		data, err := ioutil.ReadAll(rec)
+		if err != nil {
+			if mode != StrictMode {
+				continue
+			}
+			return r, recs, err
+		}
+		recs = append(recs, data)
+	}
+}
+
+func TestReaderModeTornTail(t *testing.T) {
+	recs, err := makeTestRecords(
+		blockSize/4,
+		blockSize/4,
+		// The last record spans two blocks.
+		blockSize,
+	)
+	if err != nil {
+		t.Fatalf("makeTestRecords: %v", err)
+	}
+
+	// Truncate the file in the middle of the last record.
+	torn := len(recs.buf) - 100
+	buf := recs.buf[:torn]
+
+	if _, _, err := readAllRecords(buf, StrictMode); err == nil {
+		t.Fatal("strict: expected an error reading a torn record, got nil")
+	}
+
+	r, got, err := readAllRecords(buf, RecoverMode)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("recover: got %d records, want 2", len(got))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], recs.records[i]) {
+			t.Fatalf("recover: unexpected data in record %d", i)
+		}
+	}
+	if n := r.SkippedRecords(); n != 1 {
+		t.Fatalf("recover: skipped %d records, want 1", n)
+	}
+
+	// Truncate the file in the middle of a chunk header.
+	buf = recs.buf[:recs.offsets[2]+3]
+	if _, _, err := readAllRecords(buf, StrictMode); err != io.ErrUnexpectedEOF {
+		t.Fatalf("strict: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	r, got, err = readAllRecords(buf, RecoverMode)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("recover: got %d records, want 2", len(got))
+	}
+	if n := r.SkippedBytes(); n != 3 {
+		t.Fatalf("recover: skipped %d bytes, want 3", n)
+	}
+	if n := r.SkippedRecords(); n != 1 {
+		t.Fatalf("recover: skipped %d records, want 1", n)
+	}
+}
+
+func TestReaderModeMidFileCorruption(t *testing.T) {
+	recs, err := makeTestRecords(
+		blockSize-headerSize,
+		blockSize-headerSize,
+		blockSize-headerSize,
+	)
+	if err != nil {
+		t.Fatalf("makeTestRecords: %v", err)
+	}
+
+	// Corrupt the checksum of the second record.
+	corruptBlock(recs.buf, 1)
+
+	_, got, err := readAllRecords(recs.buf, StrictMode)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("strict: expected a checksum mismatch, got %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("strict: got %d records, want 1", len(got))
+	}
+
+	r, got, err := readAllRecords(recs.buf, RecoverMode)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("recover: got %d records, want 2", len(got))
+	}
+	if !bytes.Equal(got[0], recs.records[0]) || !bytes.Equal(got[1], recs.records[2]) {
+		t.Fatal("recover: unexpected record data")
+	}
+	if n := r.SkippedBytes(); n != blockSize {
+		t.Fatalf("recover: skipped %d bytes, want %d", n, blockSize)
+	}
+	if n := r.SkippedRecords(); n != 1 {
+		t.Fatalf("recover: skipped %d records, want 1", n)
+	}
+}
+
+func TestReaderModeTolerateTail(t *testing.T) {
+	recs, err := makeTestRecords(
+		blockSize-headerSize,
+		blockSize-headerSize,
+		// The last record spans two blocks.
+		blockSize,
+	)
+	if err != nil {
+		t.Fatalf("makeTestRecords: %v", err)
+	}
+	check := func(name string, buf []byte, want int) {
+		_, got, err := readAllRecords(buf, TolerateTailMode)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != want {
+			t.Fatalf("%s: got %d records, want %d", name, len(got), want)
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], recs.records[i]) {
+				t.Fatalf("%s: unexpected data in record %d", name, i)
+			}
+		}
+	}
+
+	// Torn writes at the tail are the end of the file.
+	check("torn record", recs.buf[:len(recs.buf)-100], 2)
+	check("torn header", recs.buf[:recs.offsets[2]+3], 2)
+	check("torn chunk", recs.buf[:recs.offsets[2]+headerSize+10], 2)
+
+	// A flipped byte in the tail record is the end of the file, whether it is
+	// in the first or the last chunk of the record.
+	for _, off := range []int64{recs.offsets[2] + headerSize, int64(len(recs.buf)) - 1} {
+		buf := append([]byte(nil), recs.buf...)
+		buf[off] ^= 0x01
+		check(fmt.Sprintf("flipped byte at %d", off), buf, 2)
+	}
+
+	// A flipped byte in a record followed by valid records is an error.
+	buf := append([]byte(nil), recs.buf...)
+	buf[blockSize+headerSize+10] ^= 0x01
+	_, got, err := readAllRecords(buf, TolerateTailMode)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d records, want 1", len(got))
+	}
+
+	// A record with a corrupt last chunk is not returned, and the error is
+	// returned if valid records follow in a later block.
+	recs, err = makeTestRecords(
+		blockSize,
+		blockSize,
+		blockSize/4,
+	)
+	if err != nil {
+		t.Fatalf("makeTestRecords: %v", err)
+	}
+	buf = append([]byte(nil), recs.buf...)
+	buf[blockSize+headerSize] ^= 0x01
+	r := NewReader(bytes.NewReader(buf), TolerateTailMode)
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if _, err := ioutil.ReadAll(rec); err == nil {
+		t.Fatal("expected an error reading a corrupt record, got nil")
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
+
 func TestSeekRecord(t *testing.T) {
 	recs, err := makeTestRecords(
 		// The first record will consume 3 entire blocks but a fraction of the 4th.
@@ -637,7 +829,7 @@ func TestSeekRecord(t *testing.T) {
 		t.Fatalf("makeTestRecords: %v", err)
 	}
 
-	r := NewReader(bytes.NewReader(recs.buf))
+	r := NewReader(bytes.NewReader(recs.buf), StrictMode)
 	// Seek to a valid block offset, but within a multiblock record. This should cause the next call to
 	// Next after SeekRecord to return the next valid FIRST/FULL chunk of the subsequent record.
 	err = r.SeekRecord(blockSize)
@@ -763,6 +955,62 @@ func TestNoLastRecordOffset(t *testing.T) {
 	}
 }
 
+func TestLogWriterSync(t *testing.T) {
+	f, err := ioutil.TempFile("", "pebble-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w := NewLogWriter(f)
+	defer w.Close()
+
+	// The records are a small record which leaves the first block partially
+	// filled, a record which leaves too little room in the first block for
+	// another chunk (so the block is queued for flushing), a small record in
+	// the second block and a record spanning several blocks. After each record
+	// is synced, reading the file from a separate file descriptor returns every
+	// record written so far.
+	records := []string{
+		"small",
+		big("fill", blockSize-2*headerSize-len("small")),
+		"second",
+		big("multi", 3*blockSize),
+	}
+	for n, rec := range records {
+		if _, err := w.WriteRecord([]byte(rec)); err != nil {
+			t.Fatalf("%d: WriteRecord: %v", n, err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatalf("%d: Sync: %v", n, err)
+		}
+
+		g, err := os.Open(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(g, StrictMode)
+		for i := 0; i <= n; i++ {
+			rr, err := r.Next()
+			if err != nil {
+				t.Fatalf("%d: record %d: Next: %v", n, i, err)
+			}
+			data, err := ioutil.ReadAll(rr)
+			if err != nil {
+				t.Fatalf("%d: record %d: ReadAll: %v", n, i, err)
+			}
+			if string(data) != records[i] {
+				t.Fatalf("%d: record %d: expected %q, but found %q", n, i, short(records[i]), short(string(data)))
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("%d: expected EOF, but found %v", n, err)
+		}
+		if err := g.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkRecordWrite(b *testing.B) {
 	for _, size := range []int{8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
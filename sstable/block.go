@@ -5,8 +5,10 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sort"
 	"unsafe"
 
@@ -22,22 +24,79 @@ func uvarintLen(v uint32) int {
 	return i + 1
 }
 
+// plainBlockFlag is set in the trailing uint32 of a plain block, in place of
+// the number of restart points. The number of restart points of a
+// prefix-compressed block never approaches 1<<31.
+const plainBlockFlag = 1 << 31
+
+// plainBlockTrailerLen is the length of the trailer of a plain block: the key
+// length, the value length and the number of entries (with plainBlockFlag
+// set), each as a uint32.
+const plainBlockTrailerLen = 12
+
+// plainEntryHeaderLen returns the length of the entry header (the shared,
+// unshared and value length varints) of an entry in a plain block.
+func plainEntryHeaderLen(keyLen, valLen int) int {
+	return 1 + uvarintLen(uint32(keyLen)) + uvarintLen(uint32(valLen))
+}
+
 type blockWriter struct {
 	restartInterval int
-	nEntries        int
-	buf             []byte
-	restarts        []uint32
-	curKey          []byte
-	prevKey         []byte
-	tmp             [50]byte
+	// plain disables prefix compression: every entry is stored with a zero
+	// shared prefix. If, in addition, every key has the same length and every
+	// value has the same length, the entries have a fixed size and finish
+	// omits the restart points, writing a plain block trailer instead (see
+	// plainBlockFlag). Such a block can be binary searched by entry index,
+	// which makes seeks cheaper than in a prefix-compressed block. A plain
+	// block with differing key or value lengths is written as a regular block
+	// with a restart point at every entry. The data blocks of a table are plain
+	// when db.LevelOptions.BlockPlainEncoding is set.
+	//
+	// TODO(peter): Index blocks would benefit from plain blocks, but their
+	// separators and block handles are not of uniform length.
+	plain bool
+	// plainKeyLen and plainValLen are the key and value length of the first
+	// entry of a plain block, and plainUniform is true if every entry matched
+	// them.
+	plainKeyLen  int
+	plainValLen  int
+	plainUniform bool
+	// minUnsharedLen is the minimum number of bytes of each key which are
+	// stored in the entry rather than shared with the previous key. Zero means
+	// that the entire common prefix is shared. See
+	// db.LevelOptions.BlockMinUnsharedKeyLen.
+	minUnsharedLen int
+	nEntries       int
+	buf            []byte
+	restarts       []uint32
+	curKey         []byte
+	prevKey        []byte
+	tmp            [50]byte
+	// compare, if set, is used to check that each key added to the block is
+	// greater than the previous key. It is set if db.Options.DebugCheck is
+	// set.
+	compare db.Compare
 }
 
 func (w *blockWriter) store(keySize int, value []byte) {
 	shared := 0
-	if w.nEntries%w.restartInterval == 0 {
+	if w.plain {
+		if w.nEntries == 0 {
+			w.plainKeyLen, w.plainValLen, w.plainUniform = keySize, len(value), true
+		} else if keySize != w.plainKeyLen || len(value) != w.plainValLen {
+			w.plainUniform = false
+		}
+		w.restarts = append(w.restarts, uint32(len(w.buf)))
+	} else if w.nEntries%w.restartInterval == 0 {
 		w.restarts = append(w.restarts, uint32(len(w.buf)))
 	} else {
 		shared = db.SharedPrefixLen(w.curKey, w.prevKey)
+		if max := keySize - w.minUnsharedLen; w.minUnsharedLen > 0 && shared > max {
+			shared = max
+			if shared < 0 {
+				shared = 0
+			}
+		}
 	}
 
 	n := binary.PutUvarint(w.tmp[0:], uint64(shared))
@@ -51,6 +110,13 @@ func (w *blockWriter) store(keySize int, value []byte) {
 }
 
 func (w *blockWriter) add(key db.InternalKey, value []byte) {
+	if w.compare != nil && w.nEntries > 0 {
+		// A duplicate or out of order key would break the binary search
+		// performed by SeekGE and the iteration performed by Prev.
+		if prevKey := db.DecodeInternalKey(w.curKey); db.InternalCompare(w.compare, prevKey, key) >= 0 {
+			panic(fmt.Sprintf("pebble/table: block key %s added after %s", key, prevKey))
+		}
+	}
 	w.curKey, w.prevKey = w.prevKey, w.curKey
 
 	size := key.Size()
@@ -63,7 +129,20 @@ func (w *blockWriter) add(key db.InternalKey, value []byte) {
 	w.store(size, value)
 }
 
+func (w *blockWriter) isPlain() bool {
+	return w.plain && w.plainUniform && w.nEntries > 0
+}
+
 func (w *blockWriter) finish() []byte {
+	if w.isPlain() {
+		tmp := w.tmp[:plainBlockTrailerLen]
+		binary.LittleEndian.PutUint32(tmp[0:], uint32(w.plainKeyLen))
+		binary.LittleEndian.PutUint32(tmp[4:], uint32(w.plainValLen))
+		binary.LittleEndian.PutUint32(tmp[8:], uint32(w.nEntries)|plainBlockFlag)
+		w.buf = append(w.buf, tmp...)
+		return w.buf
+	}
+
 	// Write the restart points to the buffer.
 	if w.nEntries == 0 {
 		// Every block must have at least one restart point.
@@ -91,6 +170,9 @@ func (w *blockWriter) reset() {
 }
 
 func (w *blockWriter) estimatedSize() int {
+	if w.isPlain() {
+		return len(w.buf) + plainBlockTrailerLen
+	}
 	return len(w.buf) + 4*(len(w.restarts)+1)
 }
 
@@ -108,13 +190,22 @@ type blockIter struct {
 	restarts     int
 	numRestarts  int
 	globalSeqNum uint64
-	ptr          unsafe.Pointer
-	data         []byte
-	key, val     []byte
-	ikey         db.InternalKey
-	cached       []blockEntry
-	cachedBuf    []byte
-	err          error
+	// trySeekUsingNext enables the SeekGE fast path for monotonically
+	// increasing seek keys. See seekGEUsingNext.
+	trySeekUsingNext bool
+	// plainStride is the size of each entry of a plain block, or zero if the
+	// block is prefix-compressed. For a plain block, restarts is the offset of
+	// the end of the entries and numRestarts is zero.
+	plainStride int
+	plainKeyLen int
+	plainHdrLen int
+	ptr         unsafe.Pointer
+	data        []byte
+	key, val    []byte
+	ikey        db.InternalKey
+	cached      []blockEntry
+	cachedBuf   []byte
+	err         error
 }
 
 // blockIter implements the db.InternalIterator interface.
@@ -131,8 +222,26 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 		return errors.New("pebble/table: invalid table (block has no restart points)")
 	}
 	i.cmp = cmp
-	i.restarts = len(block) - 4*(1+numRestarts)
-	i.numRestarts = numRestarts
+	if numRestarts&plainBlockFlag != 0 {
+		if len(block) < plainBlockTrailerLen {
+			return errors.New("pebble/table: invalid table (plain block is too small)")
+		}
+		numEntries := numRestarts &^ plainBlockFlag
+		keyLen := int(binary.LittleEndian.Uint32(block[len(block)-plainBlockTrailerLen:]))
+		valLen := int(binary.LittleEndian.Uint32(block[len(block)-plainBlockTrailerLen+4:]))
+		i.plainKeyLen = keyLen
+		i.plainHdrLen = plainEntryHeaderLen(keyLen, valLen)
+		i.plainStride = i.plainHdrLen + keyLen + valLen
+		if numEntries == 0 || numEntries*i.plainStride != len(block)-plainBlockTrailerLen {
+			return errors.New("pebble/table: invalid table (plain block size mismatch)")
+		}
+		i.restarts = numEntries * i.plainStride
+		i.numRestarts = 0
+	} else {
+		i.plainStride = 0
+		i.restarts = len(block) - 4*(1+numRestarts)
+		i.numRestarts = numRestarts
+	}
 	i.globalSeqNum = globalSeqNum
 	i.ptr = unsafe.Pointer(&block[0])
 	i.data = block
@@ -141,16 +250,50 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 	} else {
 		i.key = i.key[:0]
 	}
+	// Leave the iterator unpositioned so that a stale position from a previous
+	// block is not mistaken for a valid one.
+	i.offset, i.nextOffset = i.restarts, i.restarts
 	i.val = nil
 	i.clearCache()
 	return nil
 }
 
+// invalidate positions the iterator such that it contains no entries: it is
+// not valid, and both Next and Prev return false.
+func (i *blockIter) invalidate() {
+	i.clearCache()
+	i.offset = 0
+	i.nextOffset = 0
+	i.restarts = 0
+	i.numRestarts = 0
+	i.plainStride = 0
+	i.data = nil
+	i.val = nil
+}
+
 func (i *blockIter) readEntry() {
+	if i.plainStride != 0 {
+		// The entries of a plain block have a fixed layout and no shared prefix.
+		start := i.offset + i.plainHdrLen
+		i.key = append(i.key[:0], i.data[start:start+i.plainKeyLen]...)
+		i.key = i.key[:len(i.key):len(i.key)]
+		i.val = i.data[start+i.plainKeyLen : i.offset+i.plainStride]
+		i.nextOffset = i.offset + i.plainStride
+		return
+	}
 	ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(i.offset))
-	shared, ptr := decodeVarint(ptr)
-	unshared, ptr := decodeVarint(ptr)
-	value, ptr := decodeVarint(ptr)
+	shared, ptr, ok := decodeShortVarint(ptr)
+	if !ok {
+		shared, ptr = decodeVarint(ptr)
+	}
+	unshared, ptr, ok := decodeShortVarint(ptr)
+	if !ok {
+		unshared, ptr = decodeVarint(ptr)
+	}
+	value, ptr, ok := decodeShortVarint(ptr)
+	if !ok {
+		value, ptr = decodeVarint(ptr)
+	}
 	i.key = append(i.key[:shared], getBytes(ptr, int(unshared))...)
 	i.key = i.key[:len(i.key):len(i.key)]
 	ptr = unsafe.Pointer(uintptr(ptr) + uintptr(unshared))
@@ -175,6 +318,20 @@ func (i *blockIter) clearCache() {
 	i.cachedBuf = i.cachedBuf[:0]
 }
 
+// plainKey returns the key of the j'th entry of a plain block.
+func (i *blockIter) plainKey(j int) db.InternalKey {
+	start := j*i.plainStride + i.plainHdrLen
+	return db.DecodeInternalKey(i.data[start : start+i.plainKeyLen])
+}
+
+// plainSearch returns the index of the first entry of a plain block for which
+// f returns true, or the number of entries if there is no such entry.
+func (i *blockIter) plainSearch(f func(key db.InternalKey) bool) int {
+	return sort.Search(i.restarts/i.plainStride, func(j int) bool {
+		return f(i.plainKey(j))
+	})
+}
+
 func (i *blockIter) cacheEntry() {
 	i.cachedBuf = append(i.cachedBuf, i.key...)
 	i.cached = append(i.cached, blockEntry{
@@ -188,6 +345,22 @@ func (i *blockIter) cacheEntry() {
 // package.
 func (i *blockIter) SeekGE(key []byte) {
 	ikey := db.MakeSearchKey(key)
+	if i.trySeekUsingNext && i.seekGEUsingNext(ikey) {
+		return
+	}
+
+	if i.plainStride != 0 {
+		index := i.plainSearch(func(key db.InternalKey) bool {
+			return db.InternalCompare(i.cmp, ikey, key) <= 0
+		})
+		i.offset = index * i.plainStride
+		if i.offset < i.restarts {
+			i.loadEntry()
+		} else {
+			i.nextOffset = i.offset
+		}
+		return
+	}
 
 	// Find the index of the smallest restart point whose key is > the key
 	// sought; index will be numRestarts if there is no such restart point.
@@ -198,8 +371,13 @@ func (i *blockIter) SeekGE(key []byte) {
 		// The varint encoding of 0 occupies 1 byte.
 		ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(offset+1))
 		// Decode the key at that restart point, and compare it to the key sought.
-		v1, ptr := decodeVarint(ptr)
-		_, ptr = decodeVarint(ptr)
+		v1, ptr, ok := decodeShortVarint(ptr)
+		if !ok {
+			v1, ptr = decodeVarint(ptr)
+		}
+		if _, ptr, ok = decodeShortVarint(ptr); !ok {
+			_, ptr = decodeVarint(ptr)
+		}
 		s := getBytes(ptr, int(v1))
 		return db.InternalCompare(i.cmp, ikey, db.DecodeInternalKey(s)) < 0
 	})
@@ -221,11 +399,57 @@ func (i *blockIter) SeekGE(key []byte) {
 	}
 }
 
+// maxSeekUsingNextSteps is the number of entries seekGEUsingNext steps over
+// before giving up and falling back to a binary search.
+const maxSeekUsingNextSteps = 8
+
+// seekGEUsingNext attempts to position the iterator at the first key >= ikey
+// by stepping forward from the current position, which avoids a binary search
+// of the restart points when successive seek keys are increasing. It returns
+// false, leaving the iterator at an arbitrary position, if the current key is
+// after ikey or if the key sought is not found within maxSeekUsingNextSteps
+// entries. Otherwise the iterator is positioned at the key sought, or is
+// exhausted if there is no such key in the block.
+func (i *blockIter) seekGEUsingNext(ikey db.InternalKey) bool {
+	if !i.Valid() || db.InternalCompare(i.cmp, i.ikey, ikey) > 0 {
+		return false
+	}
+	for n := 0; n < maxSeekUsingNextSteps; n++ {
+		if db.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
+			return true
+		}
+		if !i.Next() {
+			return true
+		}
+	}
+	return false
+}
+
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *blockIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *blockIter) SeekLT(key []byte) {
 	ikey := db.MakeSearchKey(key)
 
+	if i.plainStride != 0 {
+		index := i.plainSearch(func(key db.InternalKey) bool {
+			return db.InternalCompare(i.cmp, ikey, key) <= 0
+		})
+		if index == 0 {
+			i.offset = -1
+			i.nextOffset = 0
+			return
+		}
+		i.offset = (index - 1) * i.plainStride
+		i.loadEntry()
+		return
+	}
+
 	// Find the index of the smallest restart point whose key is >= the key
 	// sought; index will be numRestarts if there is no such restart point.
 	i.offset = 0
@@ -235,8 +459,13 @@ func (i *blockIter) SeekLT(key []byte) {
 		// The varint encoding of 0 occupies 1 byte.
 		ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(offset+1))
 		// Decode the key at that restart point, and compare it to the key sought.
-		v1, ptr := decodeVarint(ptr)
-		_, ptr = decodeVarint(ptr)
+		v1, ptr, ok := decodeShortVarint(ptr)
+		if !ok {
+			v1, ptr = decodeVarint(ptr)
+		}
+		if _, ptr, ok = decodeShortVarint(ptr); !ok {
+			_, ptr = decodeVarint(ptr)
+		}
 		s := getBytes(ptr, int(v1))
 		return db.InternalCompare(i.cmp, ikey, db.DecodeInternalKey(s)) <= 0
 	})
@@ -288,6 +517,12 @@ func (i *blockIter) First() {
 
 // Last implements InternalIterator.Last, as documented in the pebble/db package.
 func (i *blockIter) Last() {
+	if i.plainStride != 0 {
+		i.offset = i.restarts - i.plainStride
+		i.loadEntry()
+		return
+	}
+
 	// Seek forward from the last restart point.
 	i.offset = int(binary.LittleEndian.Uint32(i.data[i.restarts+4*(i.numRestarts-1):]))
 
@@ -316,28 +551,103 @@ func (i *blockIter) Next() bool {
 }
 
 // NextUserKey implements InternalIterator.NextUserKey, as documented in the
-// pebble/db package.
+// pebble/db package. If the block is exhausted, Key continues to return the
+// last entry in the block, which has the same user key as the entry at which
+// NextUserKey was called.
 func (i *blockIter) NextUserKey() bool {
-	// TODO(peter): An sstable might contain multiple versions of the same
-	// user-key. Such keys will have 8 bytes or fewer of unshared key.
-	return i.Next()
+	if !i.Valid() {
+		return i.Next()
+	}
+	if i.plainStride != 0 {
+		// The key of the current entry is not modified by Next.
+		start := i.offset + i.plainHdrLen
+		userKey := i.data[start : start+len(i.ikey.UserKey)]
+		for i.Next() {
+			if !bytes.Equal(userKey, i.ikey.UserKey) {
+				return true
+			}
+		}
+		return false
+	}
+	// Reading an entry overwrites i.key, so whether the next entry has the
+	// same user key is determined from its encoding before it is read.
+	for {
+		i.offset = i.nextOffset
+		if !i.Valid() {
+			return false
+		}
+		same := i.sameUserKey()
+		i.loadEntry()
+		if !same {
+			return true
+		}
+	}
+}
+
+// sameUserKey returns whether the key of the entry at i.offset, which follows
+// the entry whose key is i.key, has the same user key as i.key. A version of
+// the user key usually shares the whole user key with the previous entry,
+// leaving 8 bytes of unshared key, but an entry at a restart point shares
+// nothing.
+func (i *blockIter) sameUserKey() bool {
+	n := len(i.key) - 8
+	if n < 0 {
+		return false
+	}
+	ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(i.offset))
+	shared, ptr, ok := decodeShortVarint(ptr)
+	if !ok {
+		shared, ptr = decodeVarint(ptr)
+	}
+	unshared, ptr, ok := decodeShortVarint(ptr)
+	if !ok {
+		unshared, ptr = decodeVarint(ptr)
+	}
+	if int(shared)+int(unshared) != len(i.key) {
+		return false
+	}
+	if int(shared) >= n {
+		return true
+	}
+	_, ptr, ok = decodeShortVarint(ptr)
+	if !ok {
+		_, ptr = decodeVarint(ptr)
+	}
+	return bytes.Equal(i.key[shared:n], getBytes(ptr, n-int(shared)))
 }
 
 // Prev implements InternalIterator.Prev, as documented in the pebble/db
 // package.
 func (i *blockIter) Prev() bool {
+	if i.plainStride != 0 {
+		if i.offset <= 0 {
+			i.offset = -1
+			i.nextOffset = 0
+			return false
+		}
+		i.offset -= i.plainStride
+		i.loadEntry()
+		return true
+	}
+
 	if n := len(i.cached) - 1; n > 0 && i.cached[n].offset == i.offset {
 		i.nextOffset = i.offset
 		e := &i.cached[n-1]
 		i.offset = e.offset
-		i.key = e.key
+		// Copy the key rather than aliasing cachedBuf. readEntry appends to
+		// i.key in place, which would otherwise overwrite the cached keys (and
+		// be overwritten by subsequent calls to cacheEntry).
+		i.key = append(i.key[:0], e.key...)
+		i.key = i.key[:len(i.key):len(i.key)]
 		i.val = e.val
 		i.decodeInternalKey()
 		i.cached = i.cached[:n]
 		return true
 	}
 
-	if i.offset == 0 {
+	if i.offset <= 0 {
+		// We're either positioned at the first entry or have already iterated
+		// before it.
 		i.offset = -1
 		i.nextOffset = 0
 		return false
@@ -371,7 +681,8 @@ func (i *blockIter) Prev() bool {
 // pebble/db package.
 func (i *blockIter) PrevUserKey() bool {
 	// TODO(peter): An sstable might contain multiple versions of the same
-	// user-key. Such keys will have 8 bytes or fewer of unshared key.
+	// user-key, which Prev returns from the oldest to the newest rather than
+	// from the newest to the oldest as the memtable does.
 	return i.Prev()
 }
 
@@ -404,3 +715,13 @@ func (i *blockIter) Close() error {
 	i.val = nil
 	return i.err
 }
+
+// resetForReuse returns an unpositioned blockIter which retains the buffers of
+// i, for reuse once i is no longer used.
+func (i *blockIter) resetForReuse() blockIter {
+	return blockIter{
+		key:       i.key[:0],
+		cached:    i.cached[:0],
+		cachedBuf: i.cachedBuf[:0],
+	}
+}
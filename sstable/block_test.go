@@ -6,8 +6,10 @@ package sstable
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -204,14 +206,403 @@ func TestBlockIter2(t *testing.T) {
 	}
 }
 
+// checkIterDirections verifies that iterating backward over iter produces the
+// exact reverse of iterating forward, from every seek position, and that a
+// random sequence of operations matches a model of the iterator's position.
+// The keys are the user keys contained in iter, in increasing order.
+// checkIterDirections checks that iter contains exactly keys, which must be
+// sorted according to cmp, by interleaving seeks with forward and backward
+// steps.
+func checkIterDirections(t *testing.T, cmp db.Compare, iter db.InternalIterator, keys []string) {
+	t.Helper()
+
+	check := func(op string, pos int) {
+		t.Helper()
+		if pos < 0 || pos >= len(keys) {
+			if iter.Valid() {
+				t.Fatalf("%s: expected invalid iterator, but found %s", op, iter.Key().UserKey)
+			}
+			return
+		}
+		if !iter.Valid() {
+			t.Fatalf("%s: expected %s, but found invalid iterator", op, keys[pos])
+		}
+		if got := string(iter.Key().UserKey); got != keys[pos] {
+			t.Fatalf("%s: expected %s, but found %s", op, keys[pos], got)
+		}
+	}
+	// search returns the index of the first key which is >= key.
+	search := func(key string) int {
+		return sort.Search(len(keys), func(i int) bool {
+			return cmp([]byte(keys[i]), []byte(key)) >= 0
+		})
+	}
+
+	iter.Last()
+	for j := len(keys) - 1; j >= -1; j-- {
+		check(fmt.Sprintf("last+prev(%d)", len(keys)-1-j), j)
+		iter.Prev()
+	}
+
+	for j := range keys {
+		iter.SeekGE([]byte(keys[j]))
+		for k := j; k >= -1; k-- {
+			check(fmt.Sprintf("seek-ge(%s)+prev(%d)", keys[j], j-k), k)
+			iter.Prev()
+		}
+		// The iterator stays before the first key, and Next moves it back onto
+		// the first key.
+		check(fmt.Sprintf("seek-ge(%s)+prev", keys[j]), -1)
+		iter.Next()
+		check(fmt.Sprintf("seek-ge(%s)+prev+next", keys[j]), 0)
+
+		iter.SeekLT([]byte(keys[j]))
+		check(fmt.Sprintf("seek-lt(%s)", keys[j]), j-1)
+		iter.Next()
+		check(fmt.Sprintf("seek-lt(%s)+next", keys[j]), j)
+	}
+
+	// seekKey returns an existing key, a key between two keys, or a key
+	// before the first or after the last key.
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+	seekKey := func() string {
+		switch j := rng.Intn(len(keys) + 2); {
+		case j == len(keys):
+			return ""
+		case j == len(keys)+1:
+			return "~"
+		case rng.Intn(2) == 0:
+			return keys[j] + "x"
+		default:
+			return keys[j]
+		}
+	}
+
+	var ops []string
+	pos := len(keys)
+	iter.Last()
+	iter.Next()
+	for i := 0; i < 10000; i++ {
+		switch rng.Intn(10) {
+		case 0:
+			key := seekKey()
+			ops = append(ops, "seek-ge "+key)
+			iter.SeekGE([]byte(key))
+			pos = search(key)
+		case 1:
+			key := seekKey()
+			ops = append(ops, "seek-lt "+key)
+			iter.SeekLT([]byte(key))
+			pos = search(key) - 1
+		case 2, 3, 4, 5:
+			ops = append(ops, "next")
+			iter.Next()
+			if pos < len(keys) {
+				pos++
+			}
+		default:
+			ops = append(ops, "prev")
+			iter.Prev()
+			if pos >= 0 {
+				pos--
+			}
+		}
+		if n := len(ops); n > 20 {
+			ops = ops[n-20:]
+		}
+		check(strings.Join(ops, ","), pos)
+	}
+}
+
+func TestBlockIterDirections(t *testing.T) {
+	for _, c := range []*db.Comparer{db.DefaultComparer, db.ReverseComparer} {
+		var keys []string
+		for i := 0; i < 37; i++ {
+			keys = append(keys, fmt.Sprintf("%04d", i*3))
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return c.Compare([]byte(keys[i]), []byte(keys[j])) < 0
+		})
+
+		for _, r := range []int{1, 2, 3, 4, 16, 64} {
+			t.Run(fmt.Sprintf("%s/restart=%d", c.Name, r), func(t *testing.T) {
+				w := &blockWriter{restartInterval: r}
+				for _, k := range keys {
+					w.add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte(k))
+				}
+				iter, err := newBlockIter(c.Compare, w.finish())
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkIterDirections(t, c.Compare, iter, keys)
+			})
+		}
+	}
+}
+
+func TestBlockWriterMinUnsharedKeyLen(t *testing.T) {
+	// Pathological keys which share a long common prefix.
+	prefix := strings.Repeat("x", 4<<10)
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("%s%04d", prefix, i*3))
+	}
+
+	for _, minUnshared := range []int{0, 1, 8, 12, 64, 8 << 10} {
+		t.Run(fmt.Sprintf("min-unshared=%d", minUnshared), func(t *testing.T) {
+			w := &blockWriter{restartInterval: 16, minUnsharedLen: minUnshared}
+			for _, k := range keys {
+				w.add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte(k))
+			}
+			b := w.finish()
+
+			entries, err := decodeBlock(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(keys) {
+				t.Fatalf("expected %d entries, but found %d", len(keys), len(entries))
+			}
+			for i, e := range entries {
+				shared, _ := binary.Uvarint(b[e.offset:])
+				unshared := uint64(len(e.key)) - shared
+				if minUnshared == 0 {
+					if i%16 != 0 && shared < uint64(len(prefix)) {
+						t.Fatalf("entry %d: expected the common prefix to be shared, but shared %d",
+							i, shared)
+					}
+				} else if unshared < uint64(minUnshared) && shared != 0 {
+					t.Fatalf("entry %d: %d unshared bytes is less than the minimum %d",
+						i, unshared, minUnshared)
+				}
+			}
+
+			iter, err := newBlockIter(bytes.Compare, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIterDirections(t, bytes.Compare, iter, keys)
+			for i, k := range keys {
+				iter.SeekGE([]byte(k))
+				if !iter.Valid() || string(iter.Key().UserKey) != k {
+					t.Fatalf("SeekGE(keys[%d]) did not find the key", i)
+				}
+				iter.SeekGE([]byte(k + "\x00"))
+				if i+1 == len(keys) {
+					if iter.Valid() {
+						t.Fatalf("SeekGE(keys[%d]+\\x00): expected exhausted iterator", i)
+					}
+				} else if !iter.Valid() || string(iter.Key().UserKey) != keys[i+1] {
+					t.Fatalf("SeekGE(keys[%d]+\\x00) did not find keys[%d]", i, i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockWriterDebugCheck(t *testing.T) {
+	add := func(w *blockWriter, keys ...string) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		for _, k := range keys {
+			w.add(db.ParseInternalKey(k), nil)
+		}
+		return nil
+	}
+
+	for _, test := range []struct {
+		keys     []string
+		expected string
+	}{
+		{[]string{"a.SET.2", "a.SET.1", "b.SET.3"}, ""},
+		{[]string{"a.SET.1", "a.SET.1"}, "pebble/table: block key a#1,1 added after a#1,1"},
+		{[]string{"a.SET.1", "a.SET.2"}, "pebble/table: block key a#2,1 added after a#1,1"},
+		{[]string{"a.SET.1", "c.SET.1", "b.SET.1"}, "pebble/table: block key b#1,1 added after c#1,1"},
+	} {
+		for _, restartInterval := range []int{1, 16} {
+			w := &blockWriter{restartInterval: restartInterval, compare: db.DefaultComparer.Compare}
+			err := add(w, test.keys...)
+			if s := fmt.Sprint(err); (err == nil) != (test.expected == "") || (err != nil && s != test.expected) {
+				t.Fatalf("%s: expected %q, but found %q", test.keys, test.expected, s)
+			}
+
+			// Without a comparer, the keys are not checked.
+			w = &blockWriter{restartInterval: restartInterval}
+			if err := add(w, test.keys...); err != nil {
+				t.Fatalf("%s: expected no check, but found %v", test.keys, err)
+			}
+		}
+	}
+
+	// A block which has been reset may start with any key.
+	w := &blockWriter{restartInterval: 16, compare: db.DefaultComparer.Compare}
+	if err := add(w, "b.SET.1"); err != nil {
+		t.Fatal(err)
+	}
+	w.finish()
+	w.reset()
+	if err := add(w, "a.SET.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockWriterPlain(t *testing.T) {
+	for _, c := range []*db.Comparer{db.DefaultComparer, db.ReverseComparer} {
+		// Uniform length keys and values produce a plain block.
+		var keys []string
+		for i := 0; i < 37; i++ {
+			keys = append(keys, fmt.Sprintf("%04d", i*3))
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return c.Compare([]byte(keys[i]), []byte(keys[j])) < 0
+		})
+		// Keys of differing lengths fall back to a regular block.
+		var mixed []string
+		for i := 0; i < 37; i++ {
+			mixed = append(mixed, fmt.Sprint(i*3))
+		}
+		sort.Slice(mixed, func(i, j int) bool {
+			return c.Compare([]byte(mixed[i]), []byte(mixed[j])) < 0
+		})
+
+		for _, test := range []struct {
+			keys  []string
+			plain bool
+		}{
+			{keys, true},
+			{mixed, false},
+			{keys[:1], true},
+		} {
+			t.Run(fmt.Sprintf("%s/%d-keys/plain=%t", c.Name, len(test.keys), test.plain), func(t *testing.T) {
+				w := &blockWriter{plain: true}
+				for _, k := range test.keys {
+					w.add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte(k))
+				}
+				if n := w.estimatedSize(); n != len(w.finish()) {
+					t.Fatalf("expected estimated size %d, but found %d", len(w.buf), n)
+				}
+				b := w.buf
+
+				trailer := binary.LittleEndian.Uint32(b[len(b)-4:])
+				if plain := trailer&plainBlockFlag != 0; plain != test.plain {
+					t.Fatalf("expected plain=%t, but found %t", test.plain, plain)
+				}
+				entries, err := decodeBlock(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != len(test.keys) {
+					t.Fatalf("expected %d entries, but found %d", len(test.keys), len(entries))
+				}
+				for i, e := range entries {
+					if shared, _ := binary.Uvarint(b[e.offset:]); shared != 0 {
+						t.Fatalf("entry %d: expected no shared prefix, but found %d", i, shared)
+					}
+					if string(e.val) != test.keys[i] {
+						t.Fatalf("entry %d: expected %s, but found %s", i, test.keys[i], e.val)
+					}
+				}
+
+				iter, err := newBlockIter(c.Compare, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkIterDirections(t, c.Compare, iter, test.keys)
+				for iter.First(); iter.Valid(); iter.Next() {
+					if !bytes.Equal(iter.Key().UserKey, iter.Value()) {
+						t.Fatalf("expected %s, but found %s", iter.Key().UserKey, iter.Value())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBlockIterNextUserKey(t *testing.T) {
+	// Key i has i%5+1 versions, written from the newest to the oldest.
+	var keys []db.InternalKey
+	for i := 0; i < 40; i++ {
+		userKey := []byte(fmt.Sprintf("%04d", i))
+		for j := i % 5; j >= 0; j-- {
+			keys = append(keys, db.MakeInternalKey(userKey, uint64(j), db.InternalKeyKindSet))
+		}
+	}
+
+	for _, w := range []*blockWriter{
+		{restartInterval: 1},
+		{restartInterval: 3},
+		{restartInterval: 16},
+		{restartInterval: 16, plain: true},
+	} {
+		t.Run(fmt.Sprintf("restart=%d/plain=%t", w.restartInterval, w.plain), func(t *testing.T) {
+			for _, k := range keys {
+				w.add(k, []byte("v"))
+			}
+			iter, err := newBlockIter(db.DefaultComparer.Compare, w.finish())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Starting from the first version of each user key, NextUserKey
+			// moves to the newest version of the next user key.
+			n := 0
+			for iter.First(); iter.Valid(); iter.NextUserKey() {
+				expected := fmt.Sprintf("%04d#%d,1", n, n%5)
+				if s := iter.Key().String(); s != expected {
+					t.Fatalf("expected %s, but found %s", expected, s)
+				}
+				n++
+			}
+			if n != 40 {
+				t.Fatalf("expected 40 user keys, but found %d", n)
+			}
+
+			// Starting from the oldest version of a user key.
+			for i := 1; i < 39; i++ {
+				iter.SeekGE([]byte(fmt.Sprintf("%04d", i)))
+				for iter.Key().SeqNum() != 0 {
+					iter.Next()
+				}
+				if !iter.NextUserKey() {
+					t.Fatalf("%04d: expected a next user key", i)
+				}
+				expected := fmt.Sprintf("%04d#%d,1", i+1, (i+1)%5)
+				if s := iter.Key().String(); s != expected {
+					t.Fatalf("%04d: expected %s, but found %s", i, expected, s)
+				}
+			}
+
+			// The versions of the last user key exhaust the block.
+			iter.SeekGE([]byte("0039"))
+			if iter.NextUserKey() {
+				t.Fatalf("expected exhausted iterator, but found %s", iter.Key())
+			}
+		})
+	}
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
-		b.Run(fmt.Sprintf("restart=%d", restartInterval),
+	for _, c := range []struct {
+		name            string
+		restartInterval int
+		plain           bool
+	}{
+		{"restart=16", 16, false},
+		{"restart=1", 1, false},
+		{"plain", 0, true},
+	} {
+		b.Run(c.name,
 			func(b *testing.B) {
 				w := &blockWriter{
-					restartInterval: restartInterval,
+					restartInterval: c.restartInterval,
+					plain:           c.plain,
 				}
 
 				var ikey db.InternalKey
@@ -246,6 +637,117 @@ func BenchmarkBlockIterSeekGE(b *testing.B) {
 	}
 }
 
+func TestBlockIterSeekGEUsingNext(t *testing.T) {
+	w := &blockWriter{restartInterval: 16}
+	var keys [][]byte
+	for i := 0; i < 1000; i += 2 {
+		key := []byte(fmt.Sprintf("%05d", i))
+		keys = append(keys, key)
+		w.add(db.InternalKey{UserKey: key}, nil)
+	}
+	block := w.finish()
+
+	var comparisons int
+	cmp := func(a, b []byte) int {
+		comparisons++
+		return bytes.Compare(a, b)
+	}
+
+	// seek performs a series of ascending seeks, including seeks for keys
+	// between and past the keys in the block, and returns the keys found and
+	// the number of comparisons performed.
+	seek := func(trySeekUsingNext bool) ([]string, int) {
+		it, err := newBlockIter(cmp, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it.trySeekUsingNext = trySeekUsingNext
+		comparisons = 0
+		var found []string
+		for i := 0; i <= 1001; i++ {
+			it.SeekGE([]byte(fmt.Sprintf("%05d", i)))
+			if it.Valid() {
+				found = append(found, string(it.Key().UserKey))
+			} else {
+				found = append(found, ".")
+			}
+		}
+		return found, comparisons
+	}
+
+	expected, binaryComparisons := seek(false)
+	found, nextComparisons := seek(true)
+	if e, f := strings.Join(expected, " "), strings.Join(found, " "); e != f {
+		t.Fatalf("expected\n%s\nbut found\n%s", e, f)
+	}
+	if nextComparisons >= binaryComparisons {
+		t.Fatalf("expected fewer than %d comparisons, but found %d",
+			binaryComparisons, nextComparisons)
+	}
+
+	// A seek backwards falls back to the binary search.
+	it, err := newBlockIter(bytes.Compare, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.trySeekUsingNext = true
+	it.SeekGE([]byte("00500"))
+	it.SeekGE([]byte("00101"))
+	if !it.Valid() || string(it.Key().UserKey) != "00102" {
+		t.Fatalf("expected 00102, but found %s", it.Key().UserKey)
+	}
+}
+
+func BenchmarkBlockIterSeekGEAscending(b *testing.B) {
+	const blockSize = 32 << 10
+
+	for _, trySeekUsingNext := range []bool{false, true} {
+		b.Run(fmt.Sprintf("try-seek-using-next=%t", trySeekUsingNext),
+			func(b *testing.B) {
+				w := &blockWriter{
+					restartInterval: 16,
+				}
+
+				var ikey db.InternalKey
+				var keys [][]byte
+				for i := 0; w.estimatedSize() < blockSize; i++ {
+					key := []byte(fmt.Sprintf("%05d", i))
+					keys = append(keys, key)
+					ikey.UserKey = key
+					w.add(ikey, nil)
+				}
+
+				var comparisons int
+				cmp := func(a, b []byte) int {
+					comparisons++
+					return bytes.Compare(a, b)
+				}
+				it, err := newBlockIter(cmp, w.finish())
+				if err != nil {
+					b.Fatal(err)
+				}
+				it.trySeekUsingNext = trySeekUsingNext
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// Seek to every other key, restarting from the beginning of the
+					// block when the end is reached.
+					k := keys[(2*i)%len(keys)]
+					it.SeekGE(k)
+					if testing.Verbose() {
+						if !it.Valid() {
+							b.Fatal("expected to find key")
+						}
+						if !bytes.Equal(k, it.Key().UserKey) {
+							b.Fatalf("expected %s, but found %s", k, it.Key().UserKey)
+						}
+					}
+				}
+				b.ReportMetric(float64(comparisons)/float64(b.N), "cmps/op")
+			})
+	}
+}
+
 func BenchmarkBlockIterSeekLT(b *testing.B) {
 	const blockSize = 32 << 10
 
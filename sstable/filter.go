@@ -150,6 +150,11 @@ func (f *blockFilterWriter) policyName() string {
 	return f.policy.Name()
 }
 
+// indexFilterPrefix is the prefix of the metaindex name of the index filter
+// block. The index filter is a table-level filter of every user key in a table
+// written with block-level filters. See db.LevelOptions.IndexFilter.
+const indexFilterPrefix = "pebble.indexfilter."
+
 type tableFilterReader struct {
 	policy db.FilterPolicy
 	data   []byte
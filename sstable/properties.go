@@ -51,6 +51,9 @@ func init() {
 // automatically populated during sstable creation and load from the properties
 // meta block when an sstable is opened.
 type Properties struct {
+	// The alignment of the blocks in this table, or 0 if the blocks are not
+	// aligned (see db.Options.BlockAlignment).
+	BlockAlignment uint64 `prop:"pebble.block.alignment"`
 	// ID of column family for this SST file, corresponding to the CF identified
 	// by column_family_name.
 	ColumnFamilyID uint64 `prop:"rocksdb.column.family.id"`
@@ -95,6 +98,9 @@ type Properties struct {
 	NumEntries uint64 `prop:"rocksdb.num.entries"`
 	// the number of range deletions in this table.
 	NumRangeDeletions uint64 `prop:"rocksdb.num.range-deletions"`
+	// The number of range keys in this table. Range keys are stored in their
+	// own block and are not included in NumEntries.
+	NumRangeKeys uint64 `prop:"pebble.num.range-keys"`
 	// Timestamp of the earliest key. 0 if unknown.
 	OldestKeyTime uint64 `prop:"rocksdb.oldest.key.time"`
 	// The name of the prefix extractor used in this table. Empty if no prefix
@@ -240,6 +246,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		m[k] = []byte(v)
 	}
 
+	if p.BlockAlignment != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.BlockAlignment), p.BlockAlignment)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.ColumnFamilyID), p.ColumnFamilyID)
 	if p.ColumnFamilyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ColumnFamilyName), p.ColumnFamilyName)
@@ -276,6 +285,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	if p.NumRangeDeletions != 0 {
 		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeDeletions), p.NumRangeDeletions)
 	}
+	if p.NumRangeKeys != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.NumRangeKeys), p.NumRangeKeys)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.OldestKeyTime), p.OldestKeyTime)
 	if p.PrefixExtractorName != "" {
 		p.saveString(m, unsafe.Offsetof(p.PrefixExtractorName), p.PrefixExtractorName)
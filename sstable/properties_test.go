@@ -77,6 +77,7 @@ func TestPropertiesLoad(t *testing.T) {
 
 func TestPropertiesSave(t *testing.T) {
 	expected := &Properties{
+		BlockAlignment:         21,
 		ColumnFamilyID:         1,
 		ColumnFamilyName:       "column family name",
 		ComparatorName:         "comparator name",
@@ -96,6 +97,7 @@ func TestPropertiesSave(t *testing.T) {
 		NumDataBlocks:          12,
 		NumEntries:             13,
 		NumRangeDeletions:      14,
+		NumRangeKeys:           20,
 		OldestKeyTime:          15,
 		PrefixExtractorName:    "prefix extractor name",
 		PrefixFiltering:        true,
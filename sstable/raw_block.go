@@ -144,6 +144,12 @@ func (i *rawBlockIter) SeekGE(key []byte) {
 	}
 }
 
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package.
+func (i *rawBlockIter) SeekPrefixGE(prefix, key []byte) {
+	i.SeekGE(key)
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *rawBlockIter) SeekLT(key []byte) {
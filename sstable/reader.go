@@ -10,8 +10,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/crc"
 	"github.com/petermattis/pebble/db"
@@ -53,13 +56,31 @@ type Iter struct {
 	index  blockIter
 	data   blockIter
 	err    error
+	// trySeekUsingNext is set from IterOptions.AscendingSeeks. See
+	// blockIter.seekGEUsingNext.
+	trySeekUsingNext bool
+	// fillCache is false if IterOptions.DontFillCache is set.
+	fillCache bool
+	// userKey holds a copy of the user key skipped by NextUserKey when its
+	// versions continue into the next block.
+	userKey []byte
 }
 
 // Iter implements the db.InternalIterator interface.
 var _ db.InternalIterator = (*Iter)(nil)
 
+// iterPool holds closed Iters for reuse, so that scans which open many tables
+// do not allocate an Iter, and the key buffers of its block iterators, for
+// every table.
+var iterPool = sync.Pool{
+	New: func() interface{} {
+		return &Iter{}
+	},
+}
+
 func (i *Iter) init(r *Reader) error {
 	i.reader = r
+	i.fillCache = true
 	i.err = i.index.init(r.compare, r.index, r.Properties.GlobalSeqNum)
 	return i.err
 }
@@ -79,7 +100,7 @@ func (i *Iter) loadBlock() bool {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
-	block, err := i.reader.readBlock(h)
+	block, err := i.reader.readBlock(h, i.fillCache)
 	if err != nil {
 		i.err = err
 		return false
@@ -116,7 +137,7 @@ func (i *Iter) seekBlock(key []byte, f *blockFilterReader) bool {
 		i.err = db.ErrNotFound
 		return false
 	}
-	block, err := i.reader.readBlock(h)
+	block, err := i.reader.readBlock(h, i.fillCache)
 	if err != nil {
 		i.err = err
 		return false
@@ -137,12 +158,51 @@ func (i *Iter) SeekGE(key []byte) {
 		return
 	}
 
+	// If the key sought is in the current data block, ahead of the current
+	// position, there is no need to search the index or reload the block.
+	if i.trySeekUsingNext && i.data.seekGEUsingNext(db.MakeSearchKey(key)) && i.data.Valid() {
+		return
+	}
+
 	i.index.SeekGE(key)
+	if !i.index.Valid() {
+		// The key sought is past the last key in the table.
+		i.seekPastEnd()
+		return
+	}
 	if i.loadBlock() {
 		i.data.SeekGE(key)
+		if !i.data.Valid() {
+			// The index contains separator keys which may lie between user-keys
+			// (see SeekLT). If the key sought is larger than the last key in the
+			// block but smaller than the separator, we want the first key from
+			// the next data block.
+			i.Next()
+		}
 	}
 }
 
+// SeekPrefixGE implements InternalIterator.SeekPrefixGE, as documented in the
+// pebble/db package. If the table was written with a prefix filter which does
+// not contain the prefix, the iterator is exhausted without reading any data
+// blocks.
+func (i *Iter) SeekPrefixGE(prefix, key []byte) {
+	if i.err != nil {
+		return
+	}
+
+	r := i.reader
+	if r.tableFilter != nil && r.Properties.PrefixFiltering && !r.tableFilter.mayContain(prefix) {
+		// Position the index iterator past its last entry and clear the data
+		// block. A subsequent Prev will step back onto the last block in the
+		// table, while Next leaves the iterator exhausted.
+		i.index.offset, i.index.nextOffset = i.index.restarts, i.index.restarts
+		i.data.invalidate()
+		return
+	}
+	i.SeekGE(key)
+}
+
 // SeekLT implements InternalIterator.SeekLT, as documented in the pebble/db
 // package.
 func (i *Iter) SeekLT(key []byte) {
@@ -168,7 +228,12 @@ func (i *Iter) SeekLT(key []byte) {
 			// be chosen as "compleu". The SeekGE in the index block will then point
 			// us to the block containing "complexion". If this happens, we want the
 			// last key from the previous data block.
-			i.index.Prev()
+			if !i.index.Prev() {
+				// All of the keys in the table are larger than the key sought.
+				// Leave the index positioned at the first block (see Prev).
+				i.index.Next()
+				return
+			}
 			if i.loadBlock() {
 				i.data.Last()
 			}
@@ -202,6 +267,71 @@ func (i *Iter) Last() {
 	}
 }
 
+// SeekOrdinal moves the iterator to the n'th (zero-based) entry in the table,
+// or exhausts the iterator if the table has n or fewer entries. The entries are
+// internal keys, so multiple versions of a user key are counted separately,
+// and range keys are not counted.
+//
+// The position is exact if the table records the number of entries in each of
+// its data blocks, which tables written in the TableFormatPebblev1 format do.
+// Otherwise the position is estimated by assuming that every data block holds
+// the average number of entries per block (rounded up), in which case the
+// ordinal of the entry found differs from n by the difference between the
+// actual and the estimated number of entries in the blocks preceding the n'th
+// entry's estimated block. The error is small for tables whose keys and values
+// are uniformly sized, as their blocks are evenly filled.
+func (i *Iter) SeekOrdinal(n uint64) {
+	if i.err != nil {
+		return
+	}
+
+	r := i.reader
+	var block, start uint64
+	if cum := r.blockEntries; cum != nil && uint64(len(cum)) == r.Properties.NumDataBlocks {
+		block = uint64(sort.Search(len(cum), func(j int) bool {
+			return cum[j] > n
+		}))
+		if block == uint64(len(cum)) {
+			i.seekPastEnd()
+			return
+		}
+		if block > 0 {
+			start = cum[block-1]
+		}
+	} else {
+		numEntries, numBlocks := r.Properties.NumEntries, r.Properties.NumDataBlocks
+		if n >= numEntries || numBlocks == 0 {
+			i.seekPastEnd()
+			return
+		}
+		perBlock := (numEntries + numBlocks - 1) / numBlocks
+		block = n / perBlock
+		start = block * perBlock
+	}
+
+	i.index.First()
+	for j := uint64(0); j < block && i.index.Valid(); j++ {
+		i.index.Next()
+	}
+	if !i.loadBlock() {
+		return
+	}
+	i.data.First()
+	for j := start; j < n && i.Valid(); j++ {
+		i.Next()
+	}
+}
+
+// seekPastEnd positions the iterator past the end of the last block, which is
+// the same state as a forward iteration which has exhausted the table.
+func (i *Iter) seekPastEnd() {
+	i.index.Last()
+	if i.loadBlock() {
+		i.data.Last()
+		i.data.Next()
+	}
+}
+
 // Next implements InternalIterator.Next, as documented in the pebble/db
 // package.
 func (i *Iter) Next() bool {
@@ -216,7 +346,15 @@ func (i *Iter) Next() bool {
 			i.err = i.data.err
 			break
 		}
+		if !i.index.Valid() {
+			// The index is already past its last entry (see SeekPrefixGE).
+			break
+		}
 		if !i.index.Next() {
+			// Leave the index positioned at the last block so that a subsequent
+			// Prev steps into the block before it rather than reloading the
+			// current block.
+			i.index.Prev()
 			break
 		}
 		if i.loadBlock() {
@@ -230,7 +368,25 @@ func (i *Iter) Next() bool {
 // NextUserKey implements InternalIterator.NextUserKey, as documented in the
 // pebble/db package.
 func (i *Iter) NextUserKey() bool {
-	return i.Next()
+	if i.err != nil {
+		return false
+	}
+	if !i.data.Valid() {
+		return i.Next()
+	}
+	if i.data.NextUserKey() {
+		return true
+	}
+	// The block was exhausted, and the versions of the user key may continue
+	// into the next block. The exhausted block iterator still holds the user
+	// key.
+	i.userKey = append(i.userKey[:0], i.data.Key().UserKey...)
+	for i.Next() {
+		if !bytes.Equal(i.userKey, i.Key().UserKey) {
+			return true
+		}
+	}
+	return false
 }
 
 // Prev implements InternalIterator.Prev, as documented in the pebble/db
@@ -248,6 +404,10 @@ func (i *Iter) Prev() bool {
 			break
 		}
 		if !i.index.Prev() {
+			// Leave the index positioned at the first block so that a subsequent
+			// Next steps into the block after it rather than reloading the
+			// current block.
+			i.index.Next()
 			break
 		}
 		if i.loadBlock() {
@@ -278,7 +438,9 @@ func (i *Iter) Value() []byte {
 // Valid implements InternalIterator.Valid, as documented in the pebble/db
 // package.
 func (i *Iter) Valid() bool {
-	return i.data.Valid()
+	// A failure to load a block leaves i.data positioned in the previous block,
+	// which is not the iterator's position.
+	return i.err == nil && i.data.Valid()
 }
 
 // Error implements InternalIterator.Error, as documented in the pebble/db
@@ -291,12 +453,20 @@ func (i *Iter) Error() error {
 }
 
 // Close implements InternalIterator.Close, as documented in the pebble/db
-// package.
+// package. The Iter is returned to a pool for reuse, and must not be used once
+// it is closed.
 func (i *Iter) Close() error {
-	if err := i.data.Close(); err != nil {
-		return err
+	err := i.data.Close()
+	if err == nil {
+		err = i.err
 	}
-	return i.err
+	*i = Iter{
+		index:   i.index.resetForReuse(),
+		data:    i.data.resetForReuse(),
+		userKey: i.userKey[:0],
+	}
+	iterPool.Put(i)
+	return err
 }
 
 // Reader is a table reader. It implements the DB interface, as documented
@@ -311,11 +481,36 @@ type Reader struct {
 	compare     db.Compare
 	blockFilter *blockFilterReader
 	tableFilter *tableFilterReader
-	Properties  Properties
+	// indexFilter is the index filter, or nil if the table does not have one.
+	// It is only present in tables with a block-level filter.
+	indexFilter *tableFilterReader
+	// blockEntries is the cumulative number of entries in the data blocks:
+	// blockEntries[i] is the number of entries in blocks [0,i]. It is nil if the
+	// table does not record the number of entries in each block.
+	blockEntries []uint64
+	// rangeKey is the range-key block, or nil if the table has no range keys.
+	rangeKey   block
+	Properties Properties
+	// TableFormat is the format in which the table was written.
+	TableFormat db.TableFormat
+	// mmap holds the contents of the file if it is memory-mapped, in which
+	// case uncompressed blocks point directly into the mapped region.
+	mmap []byte
+	// zstd holds the decoder for zstd compressed blocks. It is created on the
+	// first zstd block read, as tables which don't use zstd don't need it.
+	zstd struct {
+		once    sync.Once
+		decoder *zstd.Decoder
+		err     error
+	}
 }
 
 // Close implements DB.Close, as documented in the pebble/db package.
 func (r *Reader) Close() error {
+	if r.zstd.decoder != nil {
+		r.zstd.decoder.Close()
+		r.zstd.decoder = nil
+	}
 	if r.err != nil {
 		if r.file != nil {
 			r.file.Close()
@@ -323,6 +518,7 @@ func (r *Reader) Close() error {
 		}
 		return r.err
 	}
+	r.mmap = nil
 	if r.file != nil {
 		r.err = r.file.Close()
 		r.file = nil
@@ -345,8 +541,13 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 			return nil, db.ErrNotFound
 		}
 	}
+	// The index filter allows the index search and the block filter to be
+	// skipped for keys which are not in the table.
+	if r.indexFilter != nil && !r.indexFilter.mayContain(key) {
+		return nil, db.ErrNotFound
+	}
 
-	i := &Iter{}
+	i := iterPool.Get().(*Iter)
 	if err := i.init(r); err == nil {
 		i.index.SeekGE(key)
 		i.seekBlock(key, r.blockFilter)
@@ -370,20 +571,98 @@ func (r *Reader) NewIter(o *db.IterOptions) db.InternalIterator {
 	if r.err != nil {
 		return &Iter{err: r.err}
 	}
-	i := &Iter{}
+	i := iterPool.Get().(*Iter)
 	_ = i.init(r)
+	if o != nil {
+		i.trySeekUsingNext = o.AscendingSeeks
+		i.fillCache = !o.DontFillCache
+	}
+	return i
+}
+
+// NewRangeKeyIter returns an iterator over the range keys in the table, or nil
+// if the table has no range keys. The range keys are not returned by the
+// iterators created by NewIter.
+func (r *Reader) NewRangeKeyIter() db.InternalIterator {
+	if r.err != nil {
+		return &Iter{err: r.err}
+	}
+	if r.rangeKey == nil {
+		return nil
+	}
+	i := &blockIter{}
+	if err := i.init(r.compare, r.rangeKey, r.Properties.GlobalSeqNum); err != nil {
+		return &Iter{err: err}
+	}
 	return i
 }
 
-// readBlock reads and decompresses a block from disk into memory.
-func (r *Reader) readBlock(bh blockHandle) (block, error) {
+// DataBlockInfo describes a data block of a table, as recorded by the block's
+// entry in the index block.
+type DataBlockInfo struct {
+	// Separator is >= every key in the block and < every key in the following
+	// block. It is not necessarily a key in the table.
+	Separator db.InternalKey
+	// Size is the size of the block in the table, including the block
+	// trailer.
+	Size uint64
+}
+
+// DataBlocks returns a description of each data block of the table, in key
+// order. The descriptions are read from the index block, without reading the
+// data blocks themselves, so they are a cheap sample of the distribution of
+// the keys in the table. The separator keys are copies which the caller may
+// retain.
+func (r *Reader) DataBlocks() ([]DataBlockInfo, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var i blockIter
+	if err := i.init(r.compare, r.index, r.Properties.GlobalSeqNum); err != nil {
+		return nil, err
+	}
+	var blocks []DataBlockInfo
+	for i.First(); i.Valid(); i.Next() {
+		v := i.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			return nil, errors.New("pebble/table: corrupt index entry")
+		}
+		sep := i.Key()
+		sep.UserKey = append([]byte(nil), sep.UserKey...)
+		blocks = append(blocks, DataBlockInfo{
+			Separator: sep,
+			Size:      h.length + blockTrailerLen,
+		})
+	}
+	if err := i.Close(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// readBlock reads and decompresses a block from disk into memory, and adds it
+// to the cache if fillCache is true. If the file is memory-mapped, an
+// uncompressed block is returned without copying and is not added to the
+// cache, as it is only valid until the file is unmapped.
+func (r *Reader) readBlock(bh blockHandle, fillCache bool) (block, error) {
 	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
 		return b, nil
 	}
 
-	b := make([]byte, bh.length+blockTrailerLen)
-	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
-		return nil, err
+	var b []byte
+	if r.mmap != nil {
+		if bh.offset > uint64(len(r.mmap)) ||
+			bh.length+blockTrailerLen > uint64(len(r.mmap))-bh.offset {
+			return nil, errors.New("pebble/table: invalid table (block extends past end of file)")
+		}
+		end := bh.offset + bh.length + blockTrailerLen
+		b = r.mmap[bh.offset:end:end]
+	} else {
+		b = make([]byte, bh.length+blockTrailerLen)
+		if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+			return nil, err
+		}
 	}
 	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
 	checksum1 := crc.New(b[:bh.length+1]).Value()
@@ -392,22 +671,59 @@ func (r *Reader) readBlock(bh blockHandle) (block, error) {
 	}
 	switch b[bh.length] {
 	case noCompressionBlockType:
-		b = b[:bh.length]
-		r.cache.Set(r.fileNum, bh.offset, b)
+		b = b[:bh.length:bh.length]
+		if fillCache && r.mmap == nil {
+			r.cache.Set(r.fileNum, bh.offset, b)
+		}
 		return b, nil
 	case snappyCompressionBlockType:
 		b, err := snappy.Decode(nil, b[:bh.length])
 		if err != nil {
 			return nil, err
 		}
-		r.cache.Set(r.fileNum, bh.offset, b)
+		if fillCache {
+			r.cache.Set(r.fileNum, bh.offset, b)
+		}
+		return b, nil
+	case zstdCompressionBlockType:
+		decoder, err := r.zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		b, err := decoder.DecodeAll(b[:bh.length], nil)
+		if err != nil {
+			return nil, err
+		}
+		if fillCache {
+			r.cache.Set(r.fileNum, bh.offset, b)
+		}
 		return b, nil
 	}
 	return nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
 }
 
+// zstdDecoder returns the decoder for zstd compressed blocks, creating it if
+// necessary. The decoder is configured with the zstd dictionaries of every
+// level as the reader does not know which level the table was written for.
+func (r *Reader) zstdDecoder() (*zstd.Decoder, error) {
+	r.zstd.once.Do(func() {
+		var dicts [][]byte
+		for i := range r.opts.Levels {
+			if d := r.opts.Levels[i].ZstdDictionary; d != nil {
+				dicts = append(dicts, d)
+			}
+		}
+		r.zstd.decoder, r.zstd.err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0), zstd.WithDecoderDicts(dicts...))
+		if r.zstd.err != nil {
+			r.zstd.err = fmt.Errorf("pebble/table: invalid zstd dictionary: %v", r.zstd.err)
+		}
+	})
+	return r.zstd.decoder, r.zstd.err
+}
+
 func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
-	b, err := r.readBlock(metaindexBH)
+	b, err := r.readBlock(metaindexBH, true)
 	if err != nil {
 		return err
 	}
@@ -429,7 +745,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	}
 
 	if bh, ok := meta["rocksdb.properties"]; ok {
-		b, err = r.readBlock(bh)
+		b, err = r.readBlock(bh, true)
 		if err != nil {
 			return err
 		}
@@ -438,6 +754,30 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		}
 	}
 
+	if bh, ok := meta[blockEntriesBlockName]; ok {
+		b, err = r.readBlock(bh, true)
+		if err != nil {
+			return err
+		}
+		var total uint64
+		for len(b) > 0 {
+			n, m := binary.Uvarint(b)
+			if m <= 0 {
+				return errors.New("pebble/table: invalid table (bad block entries block)")
+			}
+			total += n
+			r.blockEntries = append(r.blockEntries, total)
+			b = b[m:]
+		}
+	}
+
+	if bh, ok := meta[rangeKeyBlockName]; ok {
+		r.rangeKey, err = r.readBlock(bh, true)
+		if err != nil {
+			return err
+		}
+	}
+
 	for level := range r.opts.Levels {
 		fp := r.opts.Levels[level].FilterPolicy
 		if fp == nil {
@@ -453,7 +793,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 		var done bool
 		for _, t := range types {
 			if bh, ok := meta[t.prefix+fp.Name()]; ok {
-				b, err = r.readBlock(bh)
+				b, err = r.readBlock(bh, true)
 				if err != nil {
 					return err
 				}
@@ -464,6 +804,13 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 					if r.blockFilter == nil {
 						return errors.New("pebble/table: invalid table (bad filter block)")
 					}
+					if bh, ok := meta[indexFilterPrefix+fp.Name()]; ok {
+						b, err = r.readBlock(bh, true)
+						if err != nil {
+							return err
+						}
+						r.indexFilter = newTableFilterReader(b, fp)
+					}
 				case db.TableFilter:
 					r.tableFilter = newTableFilterReader(b, fp)
 					if r.tableFilter == nil {
@@ -499,6 +846,9 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 		r.err = errors.New("pebble/table: nil file")
 		return r
 	}
+	if mf, ok := f.(storage.MmapFile); ok {
+		r.mmap = mf.Bytes()
+	}
 	stat, err := f.Stat()
 	if err != nil {
 		r.err = fmt.Errorf("pebble/table: invalid table (could not stat file): %v", err)
@@ -527,14 +877,9 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 		r.err = fmt.Errorf("pebble/table: invalid table (could not read footer): %v", err)
 		return r
 	}
-	if string(footer[magicOffset:footerLen]) != magic {
-		r.err = errors.New("pebble/table: invalid table (bad magic number)")
-		return r
-	}
-
 	version := binary.LittleEndian.Uint32(footer[versionOffset:magicOffset])
-	if version != formatVersion {
-		r.err = fmt.Errorf("pebble/table: unsupported format version %d", version)
+	r.TableFormat, r.err = parseTableFormat(footer[magicOffset:footerLen], version)
+	if r.err != nil {
 		return r
 	}
 
@@ -566,7 +911,7 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 	}
 
 	footer = footer[n:]
-	r.index, r.err = r.readBlock(indexBH)
+	r.index, r.err = r.readBlock(indexBH, true)
 
 	// iter, _ := newBlockIter(r.compare, r.index)
 	// for iter.First(); iter.Valid(); iter.Next() {
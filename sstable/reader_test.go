@@ -7,13 +7,18 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/datadriven"
 	"github.com/petermattis/pebble/db"
@@ -123,7 +128,89 @@ func TestReader(t *testing.T) {
 	})
 }
 
-func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader, [][]byte) {
+func TestReaderRangeKeys(t *testing.T) {
+	mem := storage.NewMem()
+	f, err := mem.Create("test.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{})
+	add := func(key string, seqNum uint64, kind db.InternalKeyKind, value string) error {
+		return w.Add(db.MakeInternalKey([]byte(key), seqNum, kind), []byte(value))
+	}
+	// The range keys are ordered independently of the point keys.
+	for _, e := range []struct {
+		key    string
+		seqNum uint64
+		kind   db.InternalKeyKind
+	}{
+		{"a", 1, db.InternalKeyKindSet},
+		{"b", 5, db.InternalKeyKindRangeKeySet},
+		{"c", 2, db.InternalKeyKindSet},
+		{"b", 4, db.InternalKeyKindRangeKeyUnset},
+		{"d", 3, db.InternalKeyKindSet},
+		{"e", 6, db.InternalKeyKindRangeKeySet},
+	} {
+		if err := add(e.key, e.seqNum, e.kind, e.key+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("test.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	if r.Properties.NumEntries != 3 || r.Properties.NumRangeKeys != 3 {
+		t.Fatalf("expected 3 entries and 3 range keys, but found %d and %d",
+			r.Properties.NumEntries, r.Properties.NumRangeKeys)
+	}
+
+	scan := func(iter db.InternalIterator) string {
+		var buf bytes.Buffer
+		for iter.First(); iter.Valid(); iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	expected := "a#1,1:a-value c#2,1:c-value d#3,1:d-value"
+	if s := scan(r.NewIter(nil)); s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+	expected = "b#5,21:b-value b#4,20:b-value e#6,21:e-value"
+	if s := scan(r.NewRangeKeyIter()); s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+
+	// A range key which is not after the previous range key is rejected, even
+	// though it is after the previous point key.
+	f, err = mem.Create("test2.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f, nil, db.LevelOptions{})
+	if err := add("b", 1, db.InternalKeyKindRangeKeySet, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("c", 2, db.InternalKeyKindSet, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("a", 3, db.InternalKeyKindRangeKeySet, "a"); err == nil {
+		t.Fatalf("expected an error adding an out of order range key")
+	}
+	w.Close()
+}
+
+func buildBenchmarkTable(
+	b *testing.B, blockSize, restartInterval int, plain bool,
+) (*Reader, [][]byte) {
 	mem := storage.NewMem()
 	f0, err := mem.Create("bench")
 	if err != nil {
@@ -132,6 +219,7 @@ func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader,
 	defer f0.Close()
 
 	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockPlainEncoding:   plain,
 		BlockRestartInterval: restartInterval,
 		BlockSize:            blockSize,
 		FilterPolicy:         nil,
@@ -164,10 +252,17 @@ func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader,
 func BenchmarkTableIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
-	for _, restartInterval := range []int{16} {
-		b.Run(fmt.Sprintf("restart=%d", restartInterval),
+	for _, c := range []struct {
+		name            string
+		restartInterval int
+		plain           bool
+	}{
+		{"restart=16", 16, false},
+		{"plain", 16, true},
+	} {
+		b.Run(c.name,
 			func(b *testing.B) {
-				r, keys := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, keys := buildBenchmarkTable(b, blockSize, c.restartInterval, c.plain)
 				it := r.NewIter(nil)
 				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -185,7 +280,7 @@ func BenchmarkTableIterSeekLT(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, keys := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, keys := buildBenchmarkTable(b, blockSize, restartInterval, false)
 				it := r.NewIter(nil)
 				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -203,7 +298,7 @@ func BenchmarkTableIterNext(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, _ := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, _ := buildBenchmarkTable(b, blockSize, restartInterval, false)
 				it := r.NewIter(nil)
 
 				b.ResetTimer()
@@ -228,7 +323,7 @@ func BenchmarkTableIterPrev(b *testing.B) {
 	for _, restartInterval := range []int{16} {
 		b.Run(fmt.Sprintf("restart=%d", restartInterval),
 			func(b *testing.B) {
-				r, _ := buildBenchmarkTable(b, blockSize, restartInterval)
+				r, _ := buildBenchmarkTable(b, blockSize, restartInterval, false)
 				it := r.NewIter(nil)
 
 				b.ResetTimer()
@@ -246,3 +341,616 @@ func BenchmarkTableIterPrev(b *testing.B) {
 			})
 	}
 }
+
+func BenchmarkTableGet(b *testing.B) {
+	dir, err := ioutil.TempDir("", "pebble-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const numKeys = 1e5
+	name := filepath.Join(dir, "bench")
+	f0, err := storage.Default.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{
+		BlockSize:   4 << 10,
+		Compression: db.NoCompression,
+	})
+	var keys [][]byte
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := uint64(0); i < numKeys; i++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, i)
+		keys = append(keys, key)
+		w.Add(db.InternalKey{UserKey: key}, value)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%t", mmap), func(b *testing.B) {
+			f, err := storage.Default.Open(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if mmap {
+				if f, err = storage.Mmap(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// The block cache is disabled so that every Get reads the table.
+			r := NewReader(f, 0, nil)
+			defer r.Close()
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.get(keys[rng.Intn(len(keys))], nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderTableFormat(t *testing.T) {
+	mem := storage.NewMem()
+	write := func(name string, format db.TableFormat) []byte {
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, &db.Options{TableFormat: format}, db.LevelOptions{})
+		if err := w.Add(db.MakeInternalKey([]byte("a"), 1, db.InternalKeyKindSet), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, stat.Size())
+		if _, err := f.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	read := func(data []byte) (*Reader, error) {
+		f, err := mem.Create("read.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open("read.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil)
+		return r, r.err
+	}
+
+	for _, format := range []db.TableFormat{0, db.TableFormatRocksDBv2, db.TableFormatPebblev1} {
+		t.Run(format.String(), func(t *testing.T) {
+			data := write("test.sst", format)
+			r, err := read(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := format
+			if expected == 0 {
+				expected = db.TableFormatLatest
+			}
+			if r.TableFormat != expected {
+				t.Fatalf("expected %s, but found %s", expected, r.TableFormat)
+			}
+			iter := r.NewIter(nil)
+			if iter.First(); !iter.Valid() || string(iter.Key().UserKey) != "a" {
+				t.Fatalf("expected to find a")
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A table stamped with the next format version, which this reader
+			// does not know, is refused.
+			footer := data[len(data)-footerLen:]
+			version := binary.LittleEndian.Uint32(footer[versionOffset:])
+			binary.LittleEndian.PutUint32(footer[versionOffset:], version+1)
+			r, err = read(data)
+			if err == nil || !strings.Contains(err.Error(), "unsupported") {
+				t.Fatalf("expected unsupported format version error, but found %v", err)
+			}
+			r.Close()
+		})
+	}
+
+	// An unknown magic string is refused.
+	data := write("test.sst", db.TableFormatLatest)
+	copy(data[len(data)-8:], "notmagic")
+	if r, err := read(data); err == nil || !strings.Contains(err.Error(), "bad magic number") {
+		t.Fatalf("expected bad magic number error, but found %v", err)
+	} else {
+		r.Close()
+	}
+}
+
+func TestIterSeekOrdinal(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	const numKeys = 5000
+	keys := make([][]byte, numKeys)
+	values := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%06d", i))
+		values[i] = make([]byte, rng.Intn(100))
+	}
+
+	// The same keys and values are written in both formats, so the tables have
+	// the same data blocks, but only the Pebble table records the number of
+	// entries in each block.
+	mem := storage.NewMem()
+	open := func(format db.TableFormat) *Reader {
+		name := format.String()
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, &db.Options{TableFormat: format}, db.LevelOptions{BlockSize: 1024})
+		for i := range keys {
+			if err := w.Add(db.MakeInternalKey(keys[i], 0, db.InternalKeyKindSet), values[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, nil)
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	}
+	exact := open(db.TableFormatPebblev1)
+	defer exact.Close()
+	approx := open(db.TableFormatRocksDBv2)
+	defer approx.Close()
+	if exact.blockEntries == nil || approx.blockEntries != nil {
+		t.Fatalf("expected only the %s table to record block entries", db.TableFormatPebblev1)
+	}
+
+	// ordinal returns the ordinal of the entry SeekOrdinal(n) lands on, checking
+	// that stepping from there visits the following keys in order.
+	ordinal := func(r *Reader, n uint64) int {
+		iter := r.NewIter(nil).(*Iter)
+		defer iter.Close()
+		iter.SeekOrdinal(n)
+		if !iter.Valid() {
+			t.Fatalf("SeekOrdinal(%d): expected a valid iterator", n)
+		}
+		j, err := strconv.Atoi(string(iter.Key().UserKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := j + 1; k < j+10 && k < numKeys; k++ {
+			if !iter.Next() || !bytes.Equal(iter.Key().UserKey, keys[k]) {
+				t.Fatalf("SeekOrdinal(%d): expected %s after %s", n, keys[k], keys[k-1])
+			}
+		}
+		return j
+	}
+
+	numBlocks := approx.Properties.NumDataBlocks
+	perBlock := (uint64(numKeys) + numBlocks - 1) / numBlocks
+	for _, n := range append([]uint64{0, numKeys - 1}, uint64(rng.Intn(numKeys)), uint64(rng.Intn(numKeys))) {
+		if j := ordinal(exact, n); j != int(n) {
+			t.Fatalf("SeekOrdinal(%d): expected %s, but found %s", n, keys[n], keys[j])
+		}
+
+		// The approximate position is off by the documented error: the
+		// difference between the actual and estimated number of entries
+		// preceding the estimated block.
+		block := n / perBlock
+		expected := n
+		if block > 0 && block < numBlocks {
+			expected = exact.blockEntries[block-1] + n - block*perBlock
+		}
+		if expected < numKeys {
+			if j := ordinal(approx, n); j != int(expected) {
+				t.Fatalf("SeekOrdinal(%d): expected %s, but found %s", n, keys[expected], keys[j])
+			}
+		}
+	}
+
+	// Seeking past the last entry exhausts the iterator, and Prev steps back to
+	// the last entry.
+	for _, r := range []*Reader{exact, approx} {
+		iter := r.NewIter(nil).(*Iter)
+		iter.SeekOrdinal(numKeys)
+		if iter.Valid() {
+			t.Fatalf("SeekOrdinal(%d): expected an exhausted iterator, but found %s", numKeys, iter.Key())
+		}
+		if !iter.Prev() || !bytes.Equal(iter.Key().UserKey, keys[numKeys-1]) {
+			t.Fatalf("expected Prev to find %s", keys[numKeys-1])
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReaderIterAllKeys(t *testing.T) {
+	// A small block size spreads the keys across many data blocks, so the
+	// iterator must step through the index to read them all.
+	const numKeys = 1000
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{BlockSize: 256})
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%06d", i))
+		if err := w.Add(db.MakeInternalKey(key, uint64(i), db.InternalKeyKindSet), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+	if r.Properties.NumDataBlocks < 10 {
+		t.Fatalf("expected many data blocks, but found %d", r.Properties.NumDataBlocks)
+	}
+
+	iter := r.NewIter(nil)
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		expected := fmt.Sprintf("%06d", n)
+		if key := iter.Key(); string(key.UserKey) != expected || key.SeqNum() != uint64(n) {
+			t.Fatalf("%d: expected key %s#%d, but found %s", n, expected, n, key)
+		}
+		if v := string(iter.Value()); v != expected {
+			t.Fatalf("%d: expected value %s, but found %s", n, expected, v)
+		}
+		n++
+	}
+	if n != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, n)
+	}
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		n--
+		if expected := fmt.Sprintf("%06d", n); string(iter.Key().UserKey) != expected {
+			t.Fatalf("%d: expected key %s, but found %s", n, expected, iter.Key())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected %d keys in reverse, but found %d", numKeys, numKeys-n)
+	}
+}
+
+func TestReaderIterNextUserKey(t *testing.T) {
+	// A small block size spreads the versions of a user key across data
+	// blocks. Key i has i%7*20+1 versions, written from the newest to the
+	// oldest.
+	const numKeys = 50
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{BlockSize: 256})
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("%06d", i))
+		for j := i % 7 * 20; j >= 0; j-- {
+			if err := w.Add(db.MakeInternalKey(key, uint64(j), db.InternalKeyKindSet), key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	iter := r.NewIter(nil)
+	n := 0
+	for iter.First(); iter.Valid(); iter.NextUserKey() {
+		expected := fmt.Sprintf("%06d", n)
+		if key := iter.Key(); string(key.UserKey) != expected || key.SeqNum() != uint64(n%7*20) {
+			t.Fatalf("%d: expected key %s#%d, but found %s", n, expected, n%7*20, key)
+		}
+		n++
+	}
+	if n != numKeys {
+		t.Fatalf("expected %d user keys, but found %d", numKeys, n)
+	}
+
+	// Starting from a version in the middle of a user key.
+	for i := 0; i < numKeys-1; i++ {
+		iter.SeekGE([]byte(fmt.Sprintf("%06d", i)))
+		for j := 0; j < i%7*10; j++ {
+			iter.Next()
+		}
+		if !iter.NextUserKey() {
+			t.Fatalf("%d: expected a next user key", i)
+		}
+		if expected := fmt.Sprintf("%06d", i+1); string(iter.Key().UserKey) != expected {
+			t.Fatalf("%d: expected key %s, but found %s", i, expected, iter.Key())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterDebugCheck(t *testing.T) {
+	// With DebugCheck set, the keys of each data and index block are checked
+	// as they are added, including the separators of data blocks which split
+	// the versions of a user key.
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, &db.Options{DebugCheck: true}, db.LevelOptions{BlockSize: 64})
+	if w.block.compare == nil || w.indexBlock.compare == nil {
+		t.Fatalf("expected the block keys to be checked")
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		for j := i % 10; j >= 0; j-- {
+			if err := w.Add(db.MakeInternalKey(key, uint64(j), db.InternalKeyKindSet), key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order keys are rejected by Add before they reach the block.
+	f, err = mem.Create("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f, &db.Options{DebugCheck: true}, db.LevelOptions{})
+	if err := w.Add(db.MakeInternalKey([]byte("b"), 0, db.InternalKeyKindSet), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet), nil); err == nil {
+		t.Fatalf("expected an error for an out of order key")
+	}
+	// A key added to the block directly, bypassing the check performed by
+	// Add, panics.
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected the block writer to panic")
+			}
+		}()
+		w.block.add(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet), nil)
+	}()
+}
+
+func TestWriterBlockAlignment(t *testing.T) {
+	const align = 512
+	opts := &db.Options{BlockAlignment: align}
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, opts, db.LevelOptions{
+		BlockSize:    128,
+		FilterPolicy: bloom.FilterPolicy(10),
+	})
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		keys = append(keys, key)
+		if err := w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindSet), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, opts)
+	defer r.Close()
+	if r.Properties.BlockAlignment != align {
+		t.Fatalf("expected block alignment %d, but found %d", align, r.Properties.BlockAlignment)
+	}
+
+	// Every block named by the footer, the metaindex and the index is aligned,
+	// as is the size of the table.
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := stat.Size(); size%align != 0 {
+		t.Fatalf("expected a table size which is a multiple of %d, but found %d", align, size)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := f.ReadAt(footer, stat.Size()-footerLen); err != nil {
+		t.Fatal(err)
+	}
+	metaindexBH, n := decodeBlockHandle(footer[1:])
+	indexBH, _ := decodeBlockHandle(footer[1+n:])
+	top := map[string]blockHandle{"metaindex": metaindexBH, "index": indexBH}
+	handles := map[string]blockHandle{}
+	for name, bh := range top {
+		handles[name] = bh
+		b, err := r.readBlock(bh, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, err := newRawBlockIter(bytes.Compare, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i.First(); i.Valid(); i.Next() {
+			h, n := decodeBlockHandle(i.Value())
+			if n == 0 {
+				t.Fatalf("%s: bad block handle", name)
+			}
+			handles[fmt.Sprintf("%s %s", name, i.Key().UserKey)] = h
+		}
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handles) < 10 {
+		t.Fatalf("expected at least 10 blocks, but found %d", len(handles))
+	}
+	for name, bh := range handles {
+		if bh.offset%align != 0 {
+			t.Fatalf("%s: expected an offset which is a multiple of %d, but found %d",
+				name, align, bh.offset)
+		}
+	}
+
+	// The padding is skipped when reading the table.
+	iter := r.NewIter(nil)
+	var i int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if i >= len(keys) || !bytes.Equal(iter.Key().UserKey, keys[i]) {
+			t.Fatalf("%d: unexpected key %s", i, iter.Key())
+		}
+		i++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(keys) {
+		t.Fatalf("expected %d keys, but found %d", len(keys), i)
+	}
+	for _, key := range keys {
+		if v, err := r.get(key, nil); err != nil || !bytes.Equal(v, key) {
+			t.Fatalf("%s: expected %s, but found %s (%v)", key, key, v, err)
+		}
+	}
+	if _, err := Verify(f, opts); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+}
+
+// readErrorFile is a File whose reads fail once fail is set.
+type readErrorFile struct {
+	storage.File
+	fail bool
+}
+
+func (f *readErrorFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fail {
+		return 0, errors.New("injected error")
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestReaderIterReadError(t *testing.T) {
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{BlockSize: 256})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%06d", i))
+		if err := w.Add(db.MakeInternalKey(key, uint64(i), db.InternalKeyKindSet), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"next", "prev", "seek-ge", "seek-lt"} {
+		t.Run(op, func(t *testing.T) {
+			f, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ef := &readErrorFile{File: f}
+			r := NewReader(ef, 0, nil)
+			iter := r.NewIter(nil)
+
+			// Position the iterator at the boundary of a data block, and fail the
+			// read of the next block.
+			if op == "prev" {
+				iter.Last()
+			} else {
+				iter.First()
+			}
+			n := 0
+			for ; iter.Valid() && n < 1000; n++ {
+				ef.fail = true
+				switch op {
+				case "next":
+					iter.Next()
+				case "prev":
+					iter.Prev()
+				case "seek-ge":
+					iter.SeekGE([]byte("000500"))
+				case "seek-lt":
+					iter.SeekLT([]byte("000500"))
+				}
+				if iter.Valid() {
+					// The entry was in the loaded block.
+					ef.fail = false
+				}
+			}
+			if n >= 1000 {
+				t.Fatalf("expected the iterator to stop at the error")
+			}
+			if err := iter.Error(); err == nil {
+				t.Fatalf("expected an error")
+			}
+			if err := iter.Close(); err == nil {
+				t.Fatalf("expected an error from Close")
+			}
+			r.Close()
+		})
+	}
+}
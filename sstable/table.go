@@ -62,6 +62,13 @@ To write a table with three entries:
 */
 package sstable // import "github.com/petermattis/pebble/sstable"
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+)
+
 /*
 The table file format looks like:
 
@@ -110,12 +117,30 @@ is a key that is >= every key in block i and is < every key i block i+1. The
 successor for the final block is a key that is >= every key in block N-1. The
 index block restart interval is 1: every entry is a restart point.
 
-The table footer is exactly 48 bytes long:
+The range-key block is an optional meta block holding the table's range keys,
+which are kept out of the data blocks so that they are not seen by point
+iteration. Its keys are internal keys of kind RangeKeySet or RangeKeyUnset
+whose user key is the start of the range, and its values hold the end of the
+range followed by the range key's value. The block is never compressed, has a
+restart interval of 1 and is found in the metaindex block under the name
+"pebble.range_key".
+
+The table footer is exactly 53 bytes long:
+  - a 1-byte checksum type,
   - the block handle for the metaindex block,
   - the block handle for the index block,
-  - padding to take the two items above up to 40 bytes,
+  - padding to take the three items above up to 41 bytes,
+  - a 4-byte little-endian format version,
   - an 8-byte magic string.
 
+The magic string and format version identify the table format (see
+db.TableFormat). Tables in the RocksDB format use the RocksDB magic string and
+format version 2. Tables in a Pebble format use the Pebble magic string and a
+format version which is incremented whenever the format changes in a way that
+older readers would misinterpret. Readers refuse tables with a Pebble format
+version newer than they support. Additions which older readers safely ignore,
+such as a new meta block, do not require a new version.
+
 A block handle is an offset and a length; the length does not include the 5
 byte trailer. Both numbers are varint-encoded, with no padding between the two
 values. The maximum size of an encoded block handle is therefore 20 bytes.
@@ -125,16 +150,23 @@ const (
 	blockTrailerLen   = 5
 	blockHandleMaxLen = 10 + 10
 	footerLen         = 1 + 2*blockHandleMaxLen + 4 + 8
-	magicOffset       = footerLen - len(magic)
+	magicOffset       = footerLen - len(rocksDBMagic)
 	versionOffset     = magicOffset - 4
 
-	magic = "\xf7\xcf\xf4\x85\xb7\x41\xe2\x88"
+	rocksDBMagic = "\xf7\xcf\xf4\x85\xb7\x41\xe2\x88"
+	pebbleMagic  = "\xf0\x9f\xaa\xb3\xf0\x9f\xaa\xb3"
 
 	noChecksum     = 0
 	checksumCRC32c = 1
 	checksumXXHash = 2
 
-	formatVersion = 2
+	rocksDBFormatVersion2 = 2
+
+	rangeKeyBlockName = "pebble.range_key"
+	// blockEntriesBlockName is the metaindex name of the block containing the
+	// number of entries in each data block, which Iter.SeekOrdinal uses. The
+	// block contains one uvarint per data block.
+	blockEntriesBlockName = "pebble.block_entries"
 
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
@@ -143,4 +175,37 @@ const (
 	// use the default compression (which is snappy).
 	noCompressionBlockType     = 0
 	snappyCompressionBlockType = 1
+	zstdCompressionBlockType   = 7
 )
+
+// footerMagicAndVersion returns the magic string and format version stamped in
+// the footer of a table in the specified format.
+func footerMagicAndVersion(f db.TableFormat) (string, uint32) {
+	switch f {
+	case db.TableFormatRocksDBv2:
+		return rocksDBMagic, rocksDBFormatVersion2
+	case db.TableFormatPebblev1:
+		return pebbleMagic, 1
+	}
+	panic(fmt.Sprintf("pebble/table: unknown table format: %d", f))
+}
+
+// parseTableFormat returns the table format described by the magic string and
+// format version of a table footer.
+func parseTableFormat(magic []byte, version uint32) (db.TableFormat, error) {
+	switch string(magic) {
+	case rocksDBMagic:
+		if version != rocksDBFormatVersion2 {
+			return 0, fmt.Errorf("pebble/table: unsupported format version %d", version)
+		}
+		return db.TableFormatRocksDBv2, nil
+	case pebbleMagic:
+		latest := uint32(db.TableFormatLatest - db.TableFormatPebblev1 + 1)
+		if version == 0 || version > latest {
+			return 0, fmt.Errorf("pebble/table: unsupported pebble format version %d "+
+				"(the newest supported version is %d)", version, latest)
+		}
+		return db.TableFormatPebblev1 + db.TableFormat(version-1), nil
+	}
+	return 0, errors.New("pebble/table: invalid table (bad magic number)")
+}
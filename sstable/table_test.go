@@ -13,10 +13,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
@@ -254,10 +256,12 @@ func build(
 	}
 	defer f0.Close()
 	tmpFileCount++
+	// The pre-made tables were written by RocksDB.
 	w := NewWriter(f0, &db.Options{
 		Merger: &db.Merger{
 			Name: "nullptr",
 		},
+		TableFormat: db.TableFormatRocksDBv2,
 	}, db.LevelOptions{
 		Compression:  compression,
 		FilterPolicy: fp,
@@ -434,6 +438,291 @@ func (c *countingFilterPolicy) MayContain(ftype db.FilterType, filter, key []byt
 	return got
 }
 
+type readCountingFile struct {
+	storage.File
+	reads int
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+	return f.File.ReadAt(p, off)
+}
+
+// filterTypeCountingPolicy counts the filter probes of each filter type.
+type filterTypeCountingPolicy struct {
+	db.FilterPolicy
+	probes [db.TableFilter + 1]int
+}
+
+func (c *filterTypeCountingPolicy) MayContain(ftype db.FilterType, filter, key []byte) bool {
+	c.probes[ftype]++
+	return c.FilterPolicy.MayContain(ftype, filter, key)
+}
+
+func TestIndexFilter(t *testing.T) {
+	// searches returns the number of lookups of keys which searched the index
+	// of a table written with block-level filters. Every index search which
+	// locates a block is followed by a probe of the block's filter.
+	searches := func(indexFilter bool, keys []string, present bool) int {
+		fp := &filterTypeCountingPolicy{FilterPolicy: bloom.FilterPolicy(10)}
+		lo := db.LevelOptions{
+			FilterPolicy: fp,
+			FilterType:   db.BlockFilter,
+			IndexFilter:  indexFilter,
+		}
+		f, err := buildWithOptions(&db.Options{}, lo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{lo}})
+		defer r.Close()
+		if (r.indexFilter != nil) != indexFilter {
+			t.Fatalf("expected index filter=%t, but found %t", indexFilter, r.indexFilter != nil)
+		}
+
+		fp.probes = [len(fp.probes)]int{}
+		for _, k := range keys {
+			v, err := r.get([]byte(k), nil)
+			if present {
+				if err != nil || string(v) != wordCount[k] {
+					t.Fatalf("%s: expected %s, but found %s (%v)", k, wordCount[k], v, err)
+				}
+			} else if err != db.ErrNotFound {
+				t.Fatalf("%s: expected not found, but found %s (%v)", k, v, err)
+			}
+		}
+		if indexFilter && fp.probes[db.TableFilter] != len(keys) {
+			t.Fatalf("expected %d index filter probes, but found %d", len(keys), fp.probes[db.TableFilter])
+		}
+		return fp.probes[db.BlockFilter]
+	}
+
+	var present []string
+	for k := range wordCount {
+		present = append(present, k)
+	}
+	sort.Strings(present)
+	var absent []string
+	for _, k := range nonsenseWords {
+		if minWord < k && k < maxWord {
+			absent = append(absent, k)
+		}
+	}
+	for _, k := range present {
+		if _, ok := wordCount[k+"#"]; !ok && k+"#" < maxWord {
+			absent = append(absent, k+"#")
+		}
+	}
+	sort.Strings(absent)
+
+	// Present keys are never skipped by the index filter.
+	if n, m := searches(false, present, true), searches(true, present, true); n != m {
+		t.Fatalf("expected %d index searches for present keys, but found %d", n, m)
+	}
+
+	// Nearly all of the index searches for absent keys are avoided. The false
+	// positive rate of bloom.FilterPolicy(10) is approximately 1%.
+	without, with := searches(false, absent, false), searches(true, absent, false)
+	if without != len(absent) {
+		t.Fatalf("expected %d index searches without an index filter, but found %d", len(absent), without)
+	}
+	if with > len(absent)/10 {
+		t.Fatalf("expected at most %d index searches with an index filter, but found %d", len(absent)/10, with)
+	}
+	t.Logf("index filter avoided %d of %d index searches for absent keys", without-with, without)
+}
+
+func TestMetaindexOrder(t *testing.T) {
+	// A table with block-level filters, an index filter and block entries has
+	// a metaindex entry for each of them, in sorted order, and each of the
+	// meta blocks is read back.
+	fp := bloom.FilterPolicy(10)
+	lo := db.LevelOptions{
+		FilterPolicy: fp,
+		FilterType:   db.BlockFilter,
+		IndexFilter:  true,
+	}
+	f, err := buildWithOptions(&db.Options{TableFormat: db.TableFormatPebblev1}, lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{Levels: []db.LevelOptions{lo}})
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.indexFilter == nil {
+		t.Fatalf("expected an index filter")
+	}
+	if len(r.blockEntries) != int(r.Properties.NumDataBlocks) {
+		t.Fatalf("expected %d block entries, but found %d", r.Properties.NumDataBlocks, len(r.blockEntries))
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := f.ReadAt(footer, stat.Size()-footerLen); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	bh, n := decodeBlockHandle(footer[1:])
+	if n == 0 {
+		t.Fatalf("bad metaindex block handle")
+	}
+	b, err := r.readBlock(bh, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := newRawBlockIter(bytes.Compare, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i.First(); i.Valid(); i.Next() {
+		names = append(names, string(i.Key().UserKey))
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"filter." + fp.Name(),
+		blockEntriesBlockName,
+		indexFilterPrefix + fp.Name(),
+		"rocksdb.properties",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected metaindex %q, but found %q", expected, names)
+	}
+}
+
+func TestPrefixBloom(t *testing.T) {
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		if i := bytes.IndexByte(a, '@'); i >= 0 {
+			return i
+		}
+		return len(a)
+	}
+	opts := &db.Options{
+		Comparer: &comparer,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+			FilterType:   db.TableFilter,
+		}},
+	}
+
+	const (
+		numTables   = 10
+		numPrefixes = 100
+	)
+	mem := storage.NewMem()
+	var readers []*Reader
+	var files []*readCountingFile
+	for i := 0; i < numTables; i++ {
+		name := fmt.Sprintf("%d.sst", i)
+		f, err := mem.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each table contains the even prefixes in its range, with several
+		// versions of each key.
+		w := NewWriter(f, opts, opts.Levels[0])
+		for j := 0; j < numPrefixes; j += 2 {
+			for v := 1; v <= 3; v++ {
+				key := fmt.Sprintf("p%05d@%d", i*numPrefixes+j, v)
+				if err := w.Add(db.MakeInternalKey([]byte(key), 0, db.InternalKeyKindSet), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err = mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf := &readCountingFile{File: f}
+		r := NewReader(cf, uint64(i), opts)
+		if !r.Properties.PrefixFiltering {
+			t.Fatalf("expected prefix filtering to be enabled")
+		}
+		defer r.Close()
+		readers = append(readers, r)
+		files = append(files, cf)
+	}
+
+	// opened counts the seeks which read a data block.
+	opened := func(seek func(i *Iter, prefix, key []byte)) int {
+		var count int
+		for i, r := range readers {
+			for j := 1; j < numPrefixes; j += 2 {
+				prefix := []byte(fmt.Sprintf("p%05d", i*numPrefixes+j))
+				key := append(append([]byte(nil), prefix...), '@')
+
+				reads := files[i].reads
+				iter := r.NewIter(nil).(*Iter)
+				seek(iter, prefix, key)
+				if iter.Valid() && bytes.HasPrefix(iter.Key().UserKey, prefix) {
+					t.Fatalf("unexpected key %s", iter.Key())
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if files[i].reads > reads {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	seekGE := opened(func(i *Iter, prefix, key []byte) { i.SeekGE(key) })
+	seekPrefixGE := opened(func(i *Iter, prefix, key []byte) { i.SeekPrefixGE(prefix, key) })
+	if seekGE != numTables*numPrefixes/2 {
+		t.Fatalf("expected SeekGE to read %d data blocks, but found %d", numTables*numPrefixes/2, seekGE)
+	}
+	if seekPrefixGE > seekGE/10 {
+		t.Fatalf("expected SeekPrefixGE to read far fewer data blocks than %d, but found %d",
+			seekGE, seekPrefixGE)
+	}
+
+	// An iterator exhausted by the filter stays exhausted on Next, and Prev
+	// steps back onto the last key in the table.
+	for i, r := range readers {
+		prefix := []byte(fmt.Sprintf("p%05d", i*numPrefixes+1))
+		key := append(append([]byte(nil), prefix...), '@')
+		iter := r.NewIter(nil)
+		iter.SeekPrefixGE(prefix, key)
+		if iter.Next() {
+			t.Fatalf("%d: unexpected key %s", i, iter.Key())
+		}
+		last := fmt.Sprintf("p%05d@3", i*numPrefixes+numPrefixes-2)
+		if !iter.Prev() || string(iter.Key().UserKey) != last {
+			t.Fatalf("%d: expected %s, but found %s", i, last, iter.Key())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Prefixes which are present are found.
+	for i, r := range readers {
+		prefix := []byte(fmt.Sprintf("p%05d", i*numPrefixes+2))
+		key := append(append([]byte(nil), prefix...), '@')
+		iter := r.NewIter(nil)
+		iter.SeekPrefixGE(prefix, key)
+		if !iter.Valid() || !bytes.HasPrefix(iter.Key().UserKey, prefix) {
+			t.Fatalf("%d: expected to find prefix %s", i, prefix)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestWriter(t *testing.T) {
 	// Check that we can read a freshly made table.
 	f, err := build(db.DefaultCompression, nil, 0)
@@ -498,6 +787,140 @@ func TestTableBloomNoCompressionOutput(t *testing.T) {
 	testNoCompressionOutput(t, bloom.FilterPolicy(10), db.TableFilter)
 }
 
+func TestLargeValueBlocks(t *testing.T) {
+	const blockSize = 4096
+	mem := storage.NewMem()
+	f, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, nil, db.LevelOptions{
+		BlockSize:   blockSize,
+		Compression: db.NoCompression,
+	})
+	// Every 100th value is multiple megabytes, and the rest are tiny.
+	large := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%06d", i)
+		value := []byte(key)
+		if i%100 == 50 {
+			value = bytes.Repeat([]byte("x"), (2+i%3)<<20)
+			large[key] = true
+		}
+		if err := w.Add(db.MakeInternalKey([]byte(key), 0, db.InternalKeyKindSet), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	// Group the keys by the data block containing them.
+	type blockInfo struct {
+		offset, length uint64
+		keys           []string
+	}
+	var blocks []blockInfo
+	iter := r.NewIter(nil).(*Iter)
+	for iter.First(); iter.Valid(); iter.Next() {
+		bh, _ := decodeBlockHandle(iter.index.Value())
+		if len(blocks) == 0 || blocks[len(blocks)-1].offset != bh.offset {
+			blocks = append(blocks, blockInfo{offset: bh.offset, length: bh.length})
+		}
+		b := &blocks[len(blocks)-1]
+		b.keys = append(b.keys, string(iter.Key().UserKey))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A large value is written to its own block, and the blocks of the tiny
+	// values stay close to the target block size.
+	for _, b := range blocks {
+		var numLarge int
+		for _, key := range b.keys {
+			if large[key] {
+				numLarge++
+			}
+		}
+		switch {
+		case numLarge > 0 && len(b.keys) != 1:
+			t.Fatalf("expected large value to be in its own block, but found block with %d keys: %s",
+				len(b.keys), strings.Join(b.keys, " "))
+		case numLarge == 0 && b.length > blockSize+100:
+			t.Fatalf("expected block of tiny values to be at most %d bytes, but found %d",
+				blockSize+100, b.length)
+		}
+	}
+}
+
+func TestWriterPlainBlocks(t *testing.T) {
+	for _, format := range []db.TableFormat{db.TableFormatRocksDBv2, db.TableFormatPebblev1} {
+		t.Run(format.String(), func(t *testing.T) {
+			mem := storage.NewMem()
+			f, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, &db.Options{TableFormat: format}, db.LevelOptions{
+				BlockPlainEncoding: true,
+				BlockSize:          512,
+			})
+			const numKeys = 1000
+			for i := 0; i < numKeys; i++ {
+				key := []byte(fmt.Sprintf("%06d", i))
+				if err := w.Add(db.MakeInternalKey(key, 0, db.InternalKeyKindSet), key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, &db.Options{TableFormat: format})
+			defer r.Close()
+
+			// Plain blocks are only written in the Pebble table formats.
+			expected := format >= db.TableFormatPebblev1
+			iter := r.NewIter(nil).(*Iter)
+			var n int
+			for iter.First(); iter.Valid(); iter.Next() {
+				if key := fmt.Sprintf("%06d", n); string(iter.Key().UserKey) != key {
+					t.Fatalf("expected %s, but found %s", key, iter.Key().UserKey)
+				}
+				if plain := iter.data.plainStride != 0; plain != expected {
+					t.Fatalf("%s: expected plain=%t, but found %t", iter.Key().UserKey, expected, plain)
+				}
+				n++
+			}
+			if n != numKeys {
+				t.Fatalf("expected %d keys, but found %d", numKeys, n)
+			}
+			for i := 0; i < numKeys; i += 37 {
+				key := []byte(fmt.Sprintf("%06d", i))
+				iter.SeekGE(key)
+				if !iter.Valid() || !bytes.Equal(iter.Key().UserKey, key) {
+					t.Fatalf("SeekGE(%s): expected %s", key, key)
+				}
+			}
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestFinalBlockIsWritten(t *testing.T) {
 	const blockSize = 100
 	keys := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}
@@ -555,6 +978,80 @@ func TestFinalBlockIsWritten(t *testing.T) {
 	}
 }
 
+func TestWriterShortSeparators(t *testing.T) {
+	// Long keys sharing a prefix, which differ in the middle and have a long
+	// tail, so that the index separators can be much shorter than the keys.
+	const n = 1000
+	tail := strings.Repeat("x", 200)
+	key := func(i int) string {
+		return fmt.Sprintf("a/long/shared/prefix/%06d/%s", i, tail)
+	}
+
+	// fullKeys is a comparer which does not shorten the index separators.
+	fullKeys := *db.DefaultComparer
+	fullKeys.Separator = func(dst, a, b []byte) []byte { return append(dst, a...) }
+	fullKeys.Successor = func(dst, a []byte) []byte { return append(dst, a...) }
+
+	build := func(c *db.Comparer) *Reader {
+		mem := storage.NewMem()
+		f, err := mem.Create("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(f, &db.Options{Comparer: c}, db.LevelOptions{BlockSize: 1024})
+		for i := 0; i < n; i += 2 {
+			ikey := db.MakeInternalKey([]byte(key(i)), 0, db.InternalKeyKindSet)
+			if err := w.Add(ikey, []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewReader(f, 0, &db.Options{Comparer: c})
+	}
+
+	r := build(db.DefaultComparer)
+	defer r.Close()
+	full := build(&fullKeys)
+	defer full.Close()
+	if len(r.index)*4 > len(full.index) {
+		t.Fatalf("expected the index to shrink to less than a quarter of %d bytes, but found %d",
+			len(full.index), len(r.index))
+	}
+
+	// Seeks to the present keys, and to the absent keys between them, find the
+	// right keys in both directions.
+	iter := r.NewIter(nil)
+	defer iter.Close()
+	for i := 0; i < n; i++ {
+		k := []byte(key(i))
+		next := i + i%2
+		iter.SeekGE(k)
+		if next >= n {
+			if iter.Valid() {
+				t.Fatalf("SeekGE(%d): expected exhausted iterator, but found %q", i, iter.Key().UserKey)
+			}
+		} else if !iter.Valid() || string(iter.Key().UserKey) != key(next) {
+			t.Fatalf("SeekGE(%d): expected %d, but found valid=%t", i, next, iter.Valid())
+		}
+
+		prev := i - 2 + i%2
+		iter.SeekLT(k)
+		if prev < 0 {
+			if iter.Valid() {
+				t.Fatalf("SeekLT(%d): expected exhausted iterator, but found %q", i, iter.Key().UserKey)
+			}
+		} else if !iter.Valid() || string(iter.Key().UserKey) != key(prev) {
+			t.Fatalf("SeekLT(%d): expected %d, but found valid=%t", i, prev, iter.Valid())
+		}
+	}
+}
+
 func TestReaderGlobalSeqNum(t *testing.T) {
 	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
 	if err != nil {
@@ -573,3 +1070,236 @@ func TestReaderGlobalSeqNum(t *testing.T) {
 		}
 	}
 }
+
+func TestIterDirections(t *testing.T) {
+	for _, c := range []*db.Comparer{db.DefaultComparer, db.ReverseComparer} {
+		var keys []string
+		for i := 0; i < 500; i++ {
+			keys = append(keys, fmt.Sprintf("%05d", i*3))
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return c.Compare([]byte(keys[i]), []byte(keys[j])) < 0
+		})
+		opts := &db.Options{Comparer: c}
+
+		for _, blockSize := range []int{1, 64, 512} {
+			t.Run(fmt.Sprintf("%s/block=%d", c.Name, blockSize), func(t *testing.T) {
+				mem := storage.NewMem()
+				f, err := mem.Create("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := NewWriter(f, opts, db.LevelOptions{
+					BlockRestartInterval: 4,
+					BlockSize:            blockSize,
+				})
+				for _, k := range keys {
+					if err := w.Add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte(k)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				f, err = mem.Open("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := NewReader(f, 0, opts)
+				defer r.Close()
+				for _, o := range []*db.IterOptions{nil, {AscendingSeeks: true}} {
+					iter := r.NewIter(o)
+					checkIterDirections(t, c.Compare, iter, keys)
+
+					// Seek to every key, along with the keys between them, in ascending
+					// order.
+					var seeks []string
+					for i := 0; i <= 1500; i++ {
+						seeks = append(seeks, fmt.Sprintf("%05d", i))
+					}
+					sort.Slice(seeks, func(i, j int) bool {
+						return c.Compare([]byte(seeks[i]), []byte(seeks[j])) < 0
+					})
+					for _, seek := range seeks {
+						iter.SeekGE([]byte(seek))
+						expected := "."
+						if j := sort.Search(len(keys), func(i int) bool {
+							return c.Compare([]byte(keys[i]), []byte(seek)) >= 0
+						}); j < len(keys) {
+							expected = keys[j]
+						}
+						found := "."
+						if iter.Valid() {
+							found = string(iter.Key().UserKey)
+						}
+						if expected != found {
+							t.Fatalf("SeekGE(%s): expected %s, but found %s", seek, expected, found)
+						}
+					}
+					if err := iter.Close(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func buildWithOptions(o *db.Options, lo db.LevelOptions) (storage.File, error) {
+	keys := make([]string, 0, len(wordCount))
+	for k := range wordCount {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	filename := fmt.Sprintf("/tmp%d", tmpFileCount)
+	f0, err := memFileSystem.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f0.Close()
+	tmpFileCount++
+	w := NewWriter(f0, o, lo)
+	for _, k := range keys {
+		ikey := db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet)
+		if err := w.Add(ikey, []byte(wordCount[k])); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return memFileSystem.Open(filename)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	// Build a zstd dictionary from the text the table keys are taken from.
+	text, err := ioutil.ReadFile(filepath.FromSlash("testdata/h.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples [][]byte
+	for i := 4096; i < len(text); i += 4096 {
+		samples = append(samples, text[i-4096:i])
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  text[:4096],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name      string
+		lo        db.LevelOptions
+		blockType byte
+	}{
+		{"none", db.LevelOptions{Compression: db.NoCompression}, noCompressionBlockType},
+		{"snappy", db.LevelOptions{Compression: db.SnappyCompression}, snappyCompressionBlockType},
+		{"zstd", db.LevelOptions{Compression: db.ZstdCompression}, zstdCompressionBlockType},
+		{"zstd-level", db.LevelOptions{
+			Compression: db.ZstdCompression,
+			ZstdLevel:   19,
+		}, zstdCompressionBlockType},
+		{"zstd-dict", db.LevelOptions{
+			Compression:    db.ZstdCompression,
+			ZstdDictionary: dict,
+		}, zstdCompressionBlockType},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			// The table is written with the options of a bottom level, while the
+			// reader sees the options of all of the levels, as a DB does.
+			opts := &db.Options{
+				Levels: []db.LevelOptions{{Compression: db.SnappyCompression}, c.lo},
+			}
+			f, err := buildWithOptions(opts, c.lo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, opts)
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if expected := c.lo.EnsureDefaults().Compression.String(); r.Properties.CompressionName != expected {
+				t.Fatalf("expected compression %s, but found %s", expected, r.Properties.CompressionName)
+			}
+
+			// Check the block type of the first data block.
+			iter, err := newBlockIter(r.compare, r.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			iter.First()
+			bh, _ := decodeBlockHandle(iter.Value())
+			var trailer [blockTrailerLen]byte
+			if _, err := f.ReadAt(trailer[:], int64(bh.offset+bh.length)); err != nil {
+				t.Fatal(err)
+			}
+			if trailer[0] != c.blockType {
+				t.Fatalf("expected block type %d, but found %d", c.blockType, trailer[0])
+			}
+
+			// Check that every key/value pair is read back.
+			n := 0
+			i := r.NewIter(nil)
+			for i.First(); i.Valid(); i.Next() {
+				k := string(i.Key().UserKey)
+				if v := string(i.Value()); v != wordCount[k] {
+					t.Fatalf("%q: expected %q, but found %q", k, wordCount[k], v)
+				}
+				n++
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n != len(wordCount) {
+				t.Fatalf("expected %d keys, but found %d", len(wordCount), n)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// A table compressed with a dictionary cannot be read without it.
+	lo := db.LevelOptions{Compression: db.ZstdCompression, ZstdDictionary: dict}
+	f, err := buildWithOptions(&db.Options{}, lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, &db.Options{})
+	if r.err == nil {
+		i := r.NewIter(nil)
+		i.First()
+		r.err = i.Close()
+	}
+	if r.err == nil {
+		t.Fatalf("expected error reading a table without its zstd dictionary")
+	}
+	r.Close()
+}
+
+func BenchmarkCompression(b *testing.B) {
+	for _, c := range []db.Compression{db.NoCompression, db.SnappyCompression, db.ZstdCompression} {
+		b.Run(c.String(), func(b *testing.B) {
+			var size int64
+			for i := 0; i < b.N; i++ {
+				f, err := build(c, nil, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				stat, err := f.Stat()
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = stat.Size()
+				f.Close()
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+	}
+}
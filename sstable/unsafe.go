@@ -31,3 +31,23 @@ func decodeVarint(ptr unsafe.Pointer) (uint32, unsafe.Pointer) {
 	dst |= (uint32((*src)[4]&0x7f) << 28)
 	return dst, unsafe.Pointer(uintptr(ptr) + 5)
 }
+
+// decodeShortVarint decodes a varint of 1 or 2 bytes, which encodes the length
+// of a key or value smaller than 16KB, returning false if the varint is longer.
+// It is small enough to be inlined into the callers, which decode longer
+// varints using decodeVarint:
+//
+//   v, ptr, ok := decodeShortVarint(ptr)
+//   if !ok {
+//     v, ptr = decodeVarint(ptr)
+//   }
+func decodeShortVarint(ptr unsafe.Pointer) (uint32, unsafe.Pointer, bool) {
+	src := (*[2]uint8)(ptr)
+	if (*src)[0] < 128 {
+		return uint32((*src)[0]), unsafe.Pointer(uintptr(ptr) + 1), true
+	}
+	if (*src)[1] < 128 {
+		return uint32((*src)[0]&0x7f) | uint32((*src)[1])<<7, unsafe.Pointer(uintptr(ptr) + 2), true
+	}
+	return 0, ptr, false
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestDecodeVarint(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// check decodes buf using decodeShortVarint, falling back to decodeVarint
+	// as blockIter does, and compares the result to binary.Uvarint.
+	check := func(buf []byte) {
+		expected, n := binary.Uvarint(buf)
+		if n <= 0 || n > 5 || expected > math.MaxUint32 {
+			// Not a valid encoding of a uint32.
+			return
+		}
+		ptr := unsafe.Pointer(&buf[0])
+		v, end, ok := decodeShortVarint(ptr)
+		if ok != (n <= 2) {
+			t.Fatalf("%x: expected ok=%t, but found %t", buf[:n], n <= 2, ok)
+		}
+		if !ok {
+			v, end = decodeVarint(ptr)
+		}
+		if uint64(v) != expected {
+			t.Fatalf("%x: expected %d, but found %d", buf[:n], expected, v)
+		}
+		if m := int(uintptr(end) - uintptr(ptr)); m != n {
+			t.Fatalf("%x: expected %d bytes, but decoded %d", buf[:n], n, m)
+		}
+		if v2, _ := decodeVarint(ptr); v2 != v {
+			t.Fatalf("%x: expected decodeVarint %d, but found %d", buf[:n], v, v2)
+		}
+	}
+
+	// The encodings of values of every length, followed by random bytes which
+	// must not be decoded.
+	buf := make([]byte, 16)
+	for _, v := range []uint64{0, 1, 127, 128, 255, 16383, 16384, 1<<21 - 1, 1 << 21, 1<<28 - 1, 1 << 28, math.MaxUint32} {
+		rng.Read(buf)
+		binary.PutUvarint(buf, v)
+		check(buf)
+	}
+	for i := 0; i < 100000; i++ {
+		rng.Read(buf)
+		bits := uint(rng.Intn(33))
+		binary.PutUvarint(buf, uint64(rng.Uint32())&(1<<bits-1))
+		check(buf)
+	}
+
+	// Random bytes, of which those decoding to a uint32 are checked.
+	for i := 0; i < 100000; i++ {
+		rng.Read(buf)
+		check(buf)
+	}
+}
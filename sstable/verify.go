@@ -0,0 +1,225 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// VerifyReport describes the contents of a table examined by Verify.
+type VerifyReport struct {
+	// The number of key/value entries in the data blocks.
+	NumEntries int
+	// The number of data blocks.
+	NumBlocks int
+	// The smallest and largest keys in the table. Both are the zero key if the
+	// table contains no entries.
+	Smallest, Largest db.InternalKey
+}
+
+// Verify reads every block of the table in f and checks its consistency: the
+// block checksums, the restart points of each block, the ordering of the
+// internal keys across the whole table, and that the index block separates
+// the data blocks. Unlike an iterator, Verify bounds checks every offset so
+// that a corrupt block results in an error rather than a panic.
+//
+// Verify returns the first inconsistency found. The report describes the
+// portion of the table which was read before the inconsistency. The block
+// cache is bypassed so that the data on disk is verified. Verify does not
+// close f.
+func Verify(f storage.File, o *db.Options) (*VerifyReport, error) {
+	opts := *o.EnsureDefaults()
+	opts.Cache = nil
+	r := NewReader(f, 0, &opts)
+	if r.err != nil {
+		return &VerifyReport{}, r.err
+	}
+	cmp := opts.Comparer.Compare
+
+	report := &VerifyReport{}
+	index, err := decodeBlock(r.index)
+	if err != nil {
+		return report, fmt.Errorf("pebble/table: invalid index block: %v", err)
+	}
+
+	var prevKey, prevSep db.InternalKey
+	for i, e := range index {
+		sep := db.DecodeInternalKey(e.key)
+		if !sep.Valid() {
+			return report, fmt.Errorf("pebble/table: invalid index key %d: %s", i, sep)
+		}
+		if i > 0 && db.InternalCompare(cmp, prevSep, sep) >= 0 {
+			return report, fmt.Errorf("pebble/table: index keys out of order: %s >= %s",
+				prevSep, sep)
+		}
+		bh, n := decodeBlockHandle(e.val)
+		if n == 0 || n != len(e.val) {
+			return report, fmt.Errorf("pebble/table: invalid block handle for index key %s", sep)
+		}
+
+		b, err := r.readBlock(bh, true)
+		if err != nil {
+			return report, fmt.Errorf("pebble/table: data block %d at offset %d: %v",
+				i, bh.offset, err)
+		}
+		entries, err := decodeBlock(b)
+		if err != nil {
+			return report, fmt.Errorf("pebble/table: data block %d at offset %d: %v",
+				i, bh.offset, err)
+		}
+		report.NumBlocks++
+
+		for j, d := range entries {
+			key := db.DecodeInternalKey(d.key)
+			if !key.Valid() {
+				return report, fmt.Errorf("pebble/table: data block %d: invalid key: %s", i, key)
+			}
+			if report.NumEntries > 0 && db.InternalCompare(cmp, prevKey, key) > 0 {
+				return report, fmt.Errorf("pebble/table: data block %d: keys out of order: %s > %s",
+					i, prevKey, key)
+			}
+			if j == 0 && i > 0 && db.InternalCompare(cmp, prevSep, key) >= 0 {
+				return report, fmt.Errorf(
+					"pebble/table: data block %d: first key %s is not after index key %s",
+					i, key, prevSep)
+			}
+			if report.NumEntries == 0 {
+				report.Smallest = key.Clone()
+			}
+			prevKey = key
+			report.NumEntries++
+		}
+		if len(entries) > 0 {
+			report.Largest = prevKey.Clone()
+			if db.InternalCompare(cmp, prevKey, sep) > 0 {
+				return report, fmt.Errorf(
+					"pebble/table: data block %d: last key %s is after index key %s",
+					i, prevKey, sep)
+			}
+		}
+		prevSep = sep
+	}
+	return report, nil
+}
+
+// decodeBlock decodes every entry in a block, returning the entries with their
+// full keys and checking that the restart points are consistent with the
+// entries.
+func decodeBlock(b block) ([]blockEntry, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("block is too small: %d bytes", len(b))
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	if numRestarts == 0 {
+		return nil, fmt.Errorf("block has no restart points")
+	}
+	if numRestarts&plainBlockFlag != 0 {
+		return decodePlainBlock(b)
+	}
+	restarts := len(b) - 4*(1+numRestarts)
+	if numRestarts > len(b)/4 || restarts < 0 {
+		return nil, fmt.Errorf("block has too many restart points: %d", numRestarts)
+	}
+
+	var entries []blockEntry
+	var key []byte
+	offsets := make(map[int]bool)
+	for offset := 0; offset < restarts; {
+		offsets[offset] = true
+		p := b[offset:restarts]
+		shared, n0 := binary.Uvarint(p)
+		if n0 <= 0 {
+			return nil, fmt.Errorf("entry at offset %d: invalid shared length", offset)
+		}
+		unshared, n1 := binary.Uvarint(p[n0:])
+		if n1 <= 0 {
+			return nil, fmt.Errorf("entry at offset %d: invalid unshared length", offset)
+		}
+		valueLen, n2 := binary.Uvarint(p[n0+n1:])
+		if n2 <= 0 {
+			return nil, fmt.Errorf("entry at offset %d: invalid value length", offset)
+		}
+		p = p[n0+n1+n2:]
+		if shared > uint64(len(key)) {
+			return nil, fmt.Errorf("entry at offset %d: shared length %d exceeds previous key length %d",
+				offset, shared, len(key))
+		}
+		if unshared > uint64(len(p)) || valueLen > uint64(len(p))-unshared {
+			return nil, fmt.Errorf("entry at offset %d: entry extends past the restart points", offset)
+		}
+		key = append(key[:shared:shared], p[:unshared]...)
+		entries = append(entries, blockEntry{
+			offset: offset,
+			key:    key,
+			val:    p[unshared : unshared+valueLen],
+		})
+		offset = restarts - len(p) + int(unshared+valueLen)
+	}
+
+	prev := -1
+	for i := 0; i < numRestarts; i++ {
+		restart := int(binary.LittleEndian.Uint32(b[restarts+4*i:]))
+		if len(entries) == 0 && restart == 0 {
+			continue
+		}
+		if restart <= prev {
+			return nil, fmt.Errorf("restart point %d at offset %d is out of order", i, restart)
+		}
+		if !offsets[restart] {
+			return nil, fmt.Errorf("restart point %d at offset %d is not at an entry", i, restart)
+		}
+		if shared, _ := binary.Uvarint(b[restart:]); shared != 0 {
+			return nil, fmt.Errorf("restart point %d at offset %d has a shared key prefix", i, restart)
+		}
+		prev = restart
+	}
+	if len(entries) > 0 {
+		if restart := int(binary.LittleEndian.Uint32(b[restarts:])); restart != 0 {
+			return nil, fmt.Errorf("first restart point is at offset %d, not 0", restart)
+		}
+	}
+	return entries, nil
+}
+
+// decodePlainBlock decodes every entry in a plain block (see plainBlockFlag),
+// checking that the entries have the fixed layout given by the trailer.
+func decodePlainBlock(b block) ([]blockEntry, error) {
+	if len(b) < plainBlockTrailerLen {
+		return nil, fmt.Errorf("plain block is too small: %d bytes", len(b))
+	}
+	trailer := b[len(b)-plainBlockTrailerLen:]
+	keyLen := int(binary.LittleEndian.Uint32(trailer[0:]))
+	valLen := int(binary.LittleEndian.Uint32(trailer[4:]))
+	numEntries := int(binary.LittleEndian.Uint32(trailer[8:]) &^ plainBlockFlag)
+	hdrLen := plainEntryHeaderLen(keyLen, valLen)
+	stride := hdrLen + keyLen + valLen
+	if numEntries == 0 || numEntries > len(b)/stride ||
+		numEntries*stride != len(b)-plainBlockTrailerLen {
+		return nil, fmt.Errorf("plain block has %d entries of %d bytes, but %d bytes of entries",
+			numEntries, stride, len(b)-plainBlockTrailerLen)
+	}
+
+	entries := make([]blockEntry, numEntries)
+	for j := range entries {
+		offset := j * stride
+		p := b[offset : offset+stride]
+		shared, n0 := binary.Uvarint(p)
+		unshared, n1 := binary.Uvarint(p[n0:])
+		value, n2 := binary.Uvarint(p[n0+n1:])
+		if shared != 0 || unshared != uint64(keyLen) || value != uint64(valLen) || n0+n1+n2 != hdrLen {
+			return nil, fmt.Errorf("plain block entry at offset %d does not match the block layout", offset)
+		}
+		entries[j] = blockEntry{
+			offset: offset,
+			key:    p[hdrLen : hdrLen+keyLen],
+			val:    p[hdrLen+keyLen:],
+		}
+	}
+	return entries, nil
+}
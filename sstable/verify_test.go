@@ -0,0 +1,190 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/crc"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestVerify(t *testing.T) {
+	opts := &db.Options{
+		Levels: []db.LevelOptions{{
+			BlockRestartInterval: 4,
+			BlockSize:            256,
+			Compression:          db.NoCompression,
+		}},
+	}
+
+	const numKeys = 200
+	mem := storage.NewMem()
+	f, err := mem.Create("test.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, opts, opts.Levels[0])
+	for i := 0; i < numKeys; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("key%05d", i)), uint64(i), db.InternalKeyKindSet)
+		if err := w.Add(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readFile := func() []byte {
+		f, err := mem.Open("test.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, stat.Size())
+		if _, err := f.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	verify := func(data []byte) (*VerifyReport, error) {
+		f, err := mem.Create("verify.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f, err = mem.Open("verify.sst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return Verify(f, opts)
+	}
+
+	good := readFile()
+	report, err := verify(good)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if report.NumEntries != numKeys {
+		t.Fatalf("expected %d entries, but found %d", numKeys, report.NumEntries)
+	}
+	if report.NumBlocks <= 1 {
+		t.Fatalf("expected multiple blocks, but found %d", report.NumBlocks)
+	}
+	if s := report.Smallest.String(); s != "key00000#0,1" {
+		t.Fatalf("expected smallest key00000#0,1, but found %s", s)
+	}
+	if s := report.Largest.String(); s != "key00199#199,1" {
+		t.Fatalf("expected largest key00199#199,1, but found %s", s)
+	}
+
+	// The first data block starts at offset 0. Find its length from the index
+	// block.
+	f, err = mem.Open("test.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, opts)
+	index, err := decodeBlock(r.index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh, _ := decodeBlockHandle(index[0].val)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bh.offset != 0 {
+		t.Fatalf("expected the first data block at offset 0, but found %d", bh.offset)
+	}
+
+	// corrupt modifies the restart array of the first data block, fixing up
+	// the block checksum so that the corruption is not caught by it.
+	corrupt := func(modify func(restarts []byte)) []byte {
+		data := append([]byte(nil), good...)
+		b := data[:bh.length]
+		numRestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+		modify(b[len(b)-4*(1+numRestarts):])
+		checksum := crc.New(data[:bh.length+1]).Value()
+		binary.LittleEndian.PutUint32(data[bh.length+1:], checksum)
+		return data
+	}
+
+	testCases := []struct {
+		modify   func(restarts []byte)
+		expected string
+	}{
+		{
+			func(restarts []byte) {
+				// Point the second restart into the middle of the first entry.
+				binary.LittleEndian.PutUint32(restarts[4:], 1)
+			},
+			"is not at an entry",
+		},
+		{
+			func(restarts []byte) {
+				// Swap the first two restart points.
+				r0 := binary.LittleEndian.Uint32(restarts[0:])
+				r1 := binary.LittleEndian.Uint32(restarts[4:])
+				binary.LittleEndian.PutUint32(restarts[0:], r1)
+				binary.LittleEndian.PutUint32(restarts[4:], r0)
+			},
+			"out of order",
+		},
+		{
+			func(restarts []byte) {
+				// Inflate the number of restart points past the size of the block.
+				binary.LittleEndian.PutUint32(restarts[len(restarts)-4:], 1<<20)
+			},
+			"too many restart points",
+		},
+		{
+			func(restarts []byte) {
+				// Claim that there are no restart points.
+				binary.LittleEndian.PutUint32(restarts[len(restarts)-4:], 0)
+			},
+			"no restart points",
+		},
+		{
+			func(restarts []byte) {
+				// Grow the restart array, so that it overlaps the last entries.
+				n := binary.LittleEndian.Uint32(restarts[len(restarts)-4:])
+				binary.LittleEndian.PutUint32(restarts[len(restarts)-4:], n+2)
+			},
+			"data block 0",
+		},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			_, err := verify(corrupt(c.modify))
+			if err == nil {
+				t.Fatalf("expected error containing %q, but found none", c.expected)
+			}
+			if !strings.Contains(err.Error(), c.expected) {
+				t.Fatalf("expected error containing %q, but found %v", c.expected, err)
+			}
+		})
+	}
+
+	// A flipped byte without a checksum fix up is caught by the checksum.
+	data := append([]byte(nil), good...)
+	data[10] ^= 0xff
+	if _, err := verify(data); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected checksum mismatch, but found %v", err)
+	}
+}
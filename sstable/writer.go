@@ -6,6 +6,7 @@ package sstable
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"os"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/petermattis/pebble/crc"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
@@ -38,6 +40,7 @@ type Writer struct {
 	stat      os.FileInfo
 	err       error
 	// The next give fields are copied from a db.Options.
+	blockAlignment     int
 	blockSize          int
 	blockSizeThreshold int
 	bytesPerSync       int
@@ -45,6 +48,8 @@ type Writer struct {
 	compression        db.Compression
 	separator          db.Separator
 	successor          db.Successor
+	split              db.Split
+	tableFormat        db.TableFormat
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
@@ -58,24 +63,46 @@ type Writer struct {
 	syncOffset uint64
 	block      blockWriter
 	indexBlock blockWriter
-	props      Properties
-	// compressedBuf is the destination buffer for snappy compression. It is
+	// rangeKeyBlock accumulates the range keys, which are stored in their own
+	// block rather than in the data blocks.
+	rangeKeyBlock blockWriter
+	props         Properties
+	// compressedBuf is the destination buffer for block compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
 	compressedBuf []byte
+	// zstdEncoder compresses blocks when the compression is ZstdCompression.
+	zstdEncoder *zstd.Encoder
+	// blockEntries is the number of entries in each of the data blocks written
+	// so far.
+	blockEntries []uint64
 	// filter accumulates the filter block.
 	filter filterWriter
+	// indexFilter accumulates the index filter, if enabled. See
+	// db.LevelOptions.IndexFilter.
+	indexFilter *tableFilterWriter
+	// lastPrefix is the prefix of the most recent key added to the filter
+	// when prefix filtering is enabled. Used to avoid adding the same prefix
+	// to the filter repeatedly.
+	lastPrefix []byte
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [footerLen]byte
 }
 
 // Add adds a key/value pair to the table being written. For a given Writer,
-// the keys passed to Add must be in increasing order.
+// the keys passed to Add must be in increasing order. Range keys (of kind
+// InternalKeyKindRangeKeySet or InternalKeyKindRangeKeyUnset) are written to a
+// separate range-key block, and must be in increasing order with respect to
+// the other range keys.
 func (w *Writer) Add(key db.InternalKey, value []byte) error {
 	if w.err != nil {
 		return w.err
 	}
+	switch key.Kind() {
+	case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+		return w.addRangeKey(key, value)
+	}
 	prevKey := db.DecodeInternalKey(w.block.curKey)
 	if db.InternalCompare(w.compare, prevKey, key) >= 0 {
 		w.err = fmt.Errorf("pebble/table: Add called in non-increasing key order: %q, %q", prevKey, key)
@@ -87,8 +114,18 @@ func (w *Writer) Add(key db.InternalKey, value []byte) error {
 	}
 
 	if w.filter != nil {
+		if w.props.PrefixFiltering {
+			prefix := key.UserKey[:w.split(key.UserKey)]
+			if w.lastPrefix == nil || !bytes.Equal(w.lastPrefix, prefix) {
+				w.filter.addKey(prefix)
+				w.lastPrefix = append(w.lastPrefix[:0], prefix...)
+			}
+		}
 		w.filter.addKey(key.UserKey)
 	}
+	if w.indexFilter != nil {
+		w.indexFilter.addKey(key.UserKey)
+	}
 	w.props.NumEntries++
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
@@ -96,14 +133,23 @@ func (w *Writer) Add(key db.InternalKey, value []byte) error {
 	return nil
 }
 
+func (w *Writer) addRangeKey(key db.InternalKey, value []byte) error {
+	if w.rangeKeyBlock.nEntries > 0 {
+		prevKey := db.DecodeInternalKey(w.rangeKeyBlock.curKey)
+		if db.InternalCompare(w.compare, prevKey, key) >= 0 {
+			w.err = fmt.Errorf("pebble/table: Add called in non-increasing range key order: %q, %q",
+				prevKey, key)
+			return w.err
+		}
+	}
+	w.props.NumRangeKeys++
+	w.rangeKeyBlock.add(key, value)
+	return nil
+}
+
 func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 	if size := w.block.estimatedSize(); size < w.blockSize {
 		// The block is currently smaller than the target size.
-		if size <= w.blockSizeThreshold {
-			// The block is smaller than the threshold size at which we'll consider
-			// flushing it.
-			return nil
-		}
 		newSize := size + key.Size() + len(value)
 		if w.block.nEntries&w.block.restartInterval == 0 {
 			newSize += 4
@@ -111,12 +157,21 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 		// TODO(peter): newSize += 4                              // varint for shared key bytes
 		newSize += uvarintLen(uint32(key.Size())) // varint for unshared key bytes
 		newSize += uvarintLen(uint32(len(value))) // varint for value size
-		if newSize <= w.blockSize {
+		if size <= w.blockSizeThreshold {
+			// The block is smaller than the threshold size at which we'll consider
+			// flushing it. It is flushed anyway if the new entry would make it more
+			// than twice the target size, so that a large value is written to its
+			// own block rather than enlarging the block of its smaller neighbors.
+			if w.block.nEntries == 0 || newSize <= 2*w.blockSize {
+				return nil
+			}
+		} else if newSize <= w.blockSize {
 			// The block plus the new entry is smaller than the target size.
 			return nil
 		}
 	}
 
+	w.blockEntries = append(w.blockEntries, uint64(w.block.nEntries))
 	bh, err := w.finishBlock(&w.block)
 	if err != nil {
 		w.err = err
@@ -153,12 +208,21 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	// isn't at least 12.5%.
 	b := block.finish()
 	blockType := byte(noCompressionBlockType)
-	if w.compression == db.SnappyCompression {
-		compressed := snappy.Encode(w.compressedBuf, b)
+	var compressed []byte
+	switch w.compression {
+	case db.SnappyCompression:
+		compressed = snappy.Encode(w.compressedBuf, b)
+		blockType = snappyCompressionBlockType
+	case db.ZstdCompression:
+		compressed = w.zstdEncoder.EncodeAll(b, w.compressedBuf[:0])
+		blockType = zstdCompressionBlockType
+	}
+	if compressed != nil {
 		w.compressedBuf = compressed[:cap(compressed)]
 		if len(compressed) < len(b)-len(b)/8 {
-			blockType = snappyCompressionBlockType
 			b = compressed
+		} else {
+			blockType = noCompressionBlockType
 		}
 	}
 	bh, err := w.writeRawBlock(b, blockType)
@@ -173,7 +237,35 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	return bh, err
 }
 
+// pad writes zero padding so that w.offset+reserve is a multiple of the block
+// alignment: with a reserve of zero, the next block is aligned.
+func (w *Writer) pad(reserve uint64) error {
+	if w.blockAlignment <= 0 {
+		return nil
+	}
+	align := uint64(w.blockAlignment)
+	n := (align - (w.offset+reserve)%align) % align
+	for n > 0 {
+		k := n
+		if k > uint64(len(zeroPadding)) {
+			k = uint64(len(zeroPadding))
+		}
+		if _, err := w.writer.Write(zeroPadding[:k]); err != nil {
+			return err
+		}
+		w.offset += k
+		n -= k
+	}
+	return nil
+}
+
+// zeroPadding is the source of the padding written to align blocks.
+var zeroPadding [4096]byte
+
 func (w *Writer) writeRawBlock(b []byte, blockType byte) (blockHandle, error) {
+	if err := w.pad(0); err != nil {
+		return blockHandle{}, err
+	}
 	w.tmp[0] = blockType
 
 	// Calculate the checksum.
@@ -209,6 +301,10 @@ func (w *Writer) writeRawBlock(b []byte, blockType byte) (blockHandle, error) {
 // table was written to.
 func (w *Writer) Close() (err error) {
 	defer func() {
+		if w.zstdEncoder != nil {
+			w.zstdEncoder.Close()
+			w.zstdEncoder = nil
+		}
 		if w.file == nil {
 			return
 		}
@@ -226,6 +322,7 @@ func (w *Writer) Close() (err error) {
 	// aren't any data blocks at all.
 	w.flushPendingBH(db.InternalKey{})
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
+		w.blockEntries = append(w.blockEntries, uint64(w.block.nEntries))
 		bh, err := w.finishBlock(&w.block)
 		if err != nil {
 			w.err = err
@@ -237,7 +334,9 @@ func (w *Writer) Close() (err error) {
 	w.props.DataSize = w.offset
 	w.props.NumDataBlocks = uint64(w.indexBlock.nEntries)
 
-	// Write the filter block.
+	// Write the meta blocks. The metaindex entries must be added in sorted
+	// order of their names: the filter, the block entries, the index filter,
+	// the range keys and the properties.
 	var metaindex rawBlockWriter
 	metaindex.restartInterval = 1
 	if w.filter != nil {
@@ -256,9 +355,52 @@ func (w *Writer) Close() (err error) {
 		w.props.FilterPolicyName = w.filter.policyName()
 		w.props.FilterSize = bh.length
 	}
+	if w.tableFormat >= db.TableFormatPebblev1 {
+		// Write the block entries block. RocksDB does not write this block, so it
+		// is omitted from tables written in a RocksDB format.
+		var b []byte
+		for _, n := range w.blockEntries {
+			k := binary.PutUvarint(w.tmp[:], n)
+			b = append(b, w.tmp[:k]...)
+		}
+		bh, err := w.writeRawBlock(b, noCompressionBlockType)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(blockEntriesBlockName)}, w.tmp[:n])
+	}
+
+	if w.indexFilter != nil {
+		b, err := w.indexFilter.finish()
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		bh, err := w.writeRawBlock(b, noCompressionBlockType)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(indexFilterPrefix + w.indexFilter.policyName())}, w.tmp[:n])
+	}
 
 	// TODO(peter): write the range-del block.
 
+	if w.rangeKeyBlock.nEntries > 0 {
+		// Write the range-key block. Like the filter block, it is not
+		// compressed, and it is read in its entirety when the table is opened.
+		bh, err := w.writeRawBlock(w.rangeKeyBlock.finish(), noCompressionBlockType)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(rangeKeyBlockName)}, w.tmp[:n])
+	}
+
 	{
 		// Write the properties block.
 		var raw rawBlockWriter
@@ -292,7 +434,12 @@ func (w *Writer) Close() (err error) {
 		return w.err
 	}
 
-	// Write the table footer.
+	// Write the table footer, padded so that the table ends at a multiple of
+	// the block alignment.
+	if err := w.pad(footerLen); err != nil {
+		w.err = err
+		return w.err
+	}
 	footer := w.tmp[:footerLen]
 	for i := range footer {
 		footer[i] = 0
@@ -301,7 +448,8 @@ func (w *Writer) Close() (err error) {
 	n := 1
 	n += encodeBlockHandle(footer[n:], metaindexBH)
 	n += encodeBlockHandle(footer[n:], indexBH)
-	binary.LittleEndian.PutUint32(footer[versionOffset:], formatVersion)
+	magic, version := footerMagicAndVersion(w.tableFormat)
+	binary.LittleEndian.PutUint32(footer[versionOffset:], version)
 	copy(footer[magicOffset:], magic)
 	if _, err := w.writer.Write(footer); err != nil {
 		w.err = err
@@ -354,6 +502,7 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 	lo = *lo.EnsureDefaults()
 	w := &Writer{
 		file:               f,
+		blockAlignment:     o.BlockAlignment,
 		blockSize:          lo.BlockSize,
 		blockSizeThreshold: (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
 		bytesPerSync:       o.BytesPerSync,
@@ -361,22 +510,53 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		compression:        lo.Compression,
 		separator:          o.Comparer.Separator,
 		successor:          o.Comparer.Successor,
+		split:              o.Comparer.Split,
+		tableFormat:        o.TableFormat,
 		block: blockWriter{
 			restartInterval: lo.BlockRestartInterval,
+			minUnsharedLen:  lo.BlockMinUnsharedKeyLen,
+			plain:           lo.BlockPlainEncoding && o.TableFormat >= db.TableFormatPebblev1,
 		},
 		indexBlock: blockWriter{
 			restartInterval: 1,
 		},
+		rangeKeyBlock: blockWriter{
+			restartInterval: 1,
+		},
+	}
+	if o.DebugCheck {
+		w.block.compare = w.compare
+		w.indexBlock.compare = w.compare
+		w.rangeKeyBlock.compare = w.compare
 	}
 	if f == nil {
 		w.err = errors.New("pebble/table: nil file")
 		return w
 	}
 
+	if lo.Compression == db.ZstdCompression {
+		opts := []zstd.EOption{
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(lo.ZstdLevel)),
+			zstd.WithEncoderConcurrency(1),
+		}
+		if lo.ZstdDictionary != nil {
+			opts = append(opts, zstd.WithEncoderDict(lo.ZstdDictionary))
+		}
+		var err error
+		w.zstdEncoder, err = zstd.NewWriter(nil, opts...)
+		if err != nil {
+			w.err = fmt.Errorf("pebble/table: invalid zstd options: %v", err)
+			return w
+		}
+	}
+
 	if lo.FilterPolicy != nil {
 		switch lo.FilterType {
 		case db.BlockFilter:
 			w.filter = newBlockFilterWriter(lo.FilterPolicy)
+			if lo.IndexFilter {
+				w.indexFilter = newTableFilterWriter(lo.FilterPolicy)
+			}
 		case db.TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
 		default:
@@ -384,11 +564,19 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		}
 	}
 
+	w.props.BlockAlignment = uint64(o.BlockAlignment)
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
 	w.props.CompressionName = lo.Compression.String()
 	w.props.MergeOperatorName = o.Merger.Name
 	w.props.PrefixExtractorName = "nullptr"
+	if w.split != nil && lo.FilterPolicy != nil && lo.FilterType == db.TableFilter {
+		// Prefix filtering requires a table-level filter. A block-level filter
+		// cannot determine whether a prefix is present in the table without
+		// consulting every block.
+		w.props.PrefixExtractorName = o.Comparer.Name
+		w.props.PrefixFiltering = true
+	}
 	w.props.PropertyCollectorNames = "[]"
 	w.props.WholeKeyFiltering = true
 	w.props.Version = 2 // TODO(peter): what is this?
@@ -0,0 +1,111 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// SSTableInfo describes a live sstable.
+type SSTableInfo struct {
+	// FileNum is the file number of the sstable.
+	FileNum uint64
+	// Size is the size of the sstable in bytes.
+	Size uint64
+	// Smallest and Largest are the inclusive bounds of the internal keys in
+	// the sstable.
+	Smallest db.InternalKey
+	Largest  db.InternalKey
+}
+
+// SSTables is a snapshot of the live sstables of a DB, as returned by
+// DB.SSTables. The sstables in the snapshot are not deleted, even if they are
+// compacted, until the snapshot is closed.
+type SSTables struct {
+	// Levels holds the sstables in each level. Level 0 is ordered by
+	// increasing sequence number, and the other levels by increasing key.
+	Levels [][]SSTableInfo
+
+	d *DB
+	v *version
+}
+
+// SSTables returns a snapshot of the sstables of the current version, which
+// exposes the physical layout of the DB for analysis. The snapshot must be
+// closed when it is no longer needed.
+func (d *DB) SSTables() *SSTables {
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	v.ref()
+	d.mu.Unlock()
+
+	s := &SSTables{
+		Levels: make([][]SSTableInfo, numLevels),
+		d:      d,
+		v:      v,
+	}
+	for level := range v.files {
+		files := v.files[level]
+		if len(files) == 0 {
+			continue
+		}
+		s.Levels[level] = make([]SSTableInfo, len(files))
+		for i := range files {
+			f := &files[i]
+			s.Levels[level][i] = SSTableInfo{
+				FileNum:  f.fileNum,
+				Size:     f.size,
+				Smallest: f.smallest,
+				Largest:  f.largest,
+			}
+		}
+	}
+	return s
+}
+
+// Open opens the sstable with the specified file number, which must be in the
+// snapshot, as a read-only sstable.Reader. The reader is independent of the
+// DB's table cache, and must be closed by the caller before the snapshot is
+// closed.
+func (s *SSTables) Open(fileNum uint64) (*sstable.Reader, error) {
+	if s.v == nil {
+		return nil, fmt.Errorf("pebble: sstables snapshot is closed")
+	}
+	var meta *fileMetadata
+	for level := range s.v.files {
+		for i := range s.v.files[level] {
+			if f := &s.v.files[level][i]; f.fileNum == fileNum {
+				meta = f
+			}
+		}
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("pebble: sstable %d is not in the snapshot", fileNum)
+	}
+	d := s.d
+	f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	r := sstable.NewReader(f, fileNum, d.opts)
+	if meta.smallestSeqNum == meta.largestSeqNum {
+		r.Properties.GlobalSeqNum = meta.largestSeqNum
+	}
+	return r, nil
+}
+
+// Close releases the snapshot, allowing its sstables to be deleted once they
+// are no longer live.
+func (s *SSTables) Close() error {
+	if s.v == nil {
+		return fmt.Errorf("pebble: sstables snapshot is already closed")
+	}
+	s.v.unref()
+	s.v = nil
+	return nil
+}
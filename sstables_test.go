@@ -0,0 +1,125 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSSTables(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Each flush creates an L0 table holding the keys written since the
+	// previous flush.
+	for i, keys := range []string{"a b c", "b d", "e"} {
+		for _, k := range strings.Fields(keys) {
+			if err := d.Set([]byte(k), []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	s := d.SSTables()
+	if n := len(s.Levels); n != numLevels {
+		t.Fatalf("expected %d levels, but found %d", numLevels, n)
+	}
+	var tables []string
+	for level, files := range s.Levels {
+		for _, f := range files {
+			tables = append(tables, fmt.Sprintf("%d:%s-%s", level, f.Smallest.UserKey, f.Largest.UserKey))
+
+			stat, err := fs.Stat(dbFilename("", fileTypeTable, f.FileNum))
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if f.Size != uint64(stat.Size()) {
+				t.Fatalf("%d: expected size %d, but found %d", f.FileNum, stat.Size(), f.Size)
+			}
+		}
+	}
+	if s := strings.Join(tables, " "); s != "0:a-c 0:b-d 0:e-e" {
+		t.Fatalf("unexpected tables: %s", s)
+	}
+
+	// scan returns the contents of the specified table, read using the
+	// snapshot.
+	scan := func(fileNum uint64) string {
+		r, err := s.Open(fileNum)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		var keys []string
+		iter := r.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			keys = append(keys, fmt.Sprintf("%s:%s", iter.Key().UserKey, iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	l0 := s.Levels[0]
+	for i, expected := range []string{"a:0 b:0 c:0", "b:1 d:1", "e:2"} {
+		if keys := scan(l0[i].FileNum); keys != expected {
+			t.Fatalf("%d: expected %s, but found %s", l0[i].FileNum, expected, keys)
+		}
+	}
+	if _, err := s.Open(12345); err == nil {
+		t.Fatalf("expected an error opening a table which is not in the snapshot")
+	}
+
+	// The tables in the snapshot are not deleted by a compaction while the
+	// snapshot is open.
+	fileNums := []uint64{l0[0].FileNum, l0[1].FileNum, l0[2].FileNum}
+	if err := d.CompactFiles(fileNums); err != nil {
+		t.Fatalf("CompactFiles: %v", err)
+	}
+	if b := d.SSTables(); len(b.Levels[0]) != 0 || len(b.Levels[1]) != 1 {
+		t.Fatalf("expected a single L1 table, but found %d L0 and %d L1 tables",
+			len(b.Levels[0]), len(b.Levels[1]))
+	} else if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := scan(l0[1].FileNum); keys != "b:1 d:1" {
+		t.Fatalf("%d: expected b:1 d:1, but found %s", l0[1].FileNum, keys)
+	}
+
+	// Closing the snapshot allows the tables to be deleted.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err == nil {
+		t.Fatalf("expected an error closing the snapshot twice")
+	}
+	d.mu.Lock()
+	d.deleteObsoleteFiles()
+	d.mu.Unlock()
+	for _, fileNum := range fileNums {
+		if _, err := fs.Stat(dbFilename("", fileTypeTable, fileNum)); err == nil {
+			t.Fatalf("%d: expected table to be deleted", fileNum)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !windows
+
+package storage
+
+import "os"
+
+func openDir(name string) (File, error) {
+	return os.Open(name)
+}
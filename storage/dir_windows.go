@@ -0,0 +1,25 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import "os"
+
+// windowsDir is a directory opened for syncing. Windows does not support
+// syncing directories, so Sync does nothing.
+type windowsDir struct {
+	*os.File
+}
+
+func (windowsDir) Sync() error {
+	return nil
+}
+
+func openDir(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return windowsDir{f}, nil
+}
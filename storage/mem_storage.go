@@ -72,7 +72,11 @@ func (y *memStorage) String() string {
 func (y *memStorage) walk(fullname string, f func(dir *node, frag string, final bool) error) error {
 	y.mu.Lock()
 	defer y.mu.Unlock()
+	return y.walkLocked(fullname, f)
+}
 
+// walkLocked is walk, but with y's mutex already held.
+func (y *memStorage) walkLocked(fullname string, f func(dir *node, frag string, final bool) error) error {
 	// For memfs, the current working directory is the same as the root directory,
 	// so we strip off any leading "/"s to make fullname a relative path, and
 	// the walk starts at y.root.
@@ -188,6 +192,33 @@ func (y *memStorage) Open(fullname string) (File, error) {
 	return ret, nil
 }
 
+func (y *memStorage) OpenDir(fullname string) (File, error) {
+	var ret *file
+	err := y.walk(fullname, func(dir *node, frag string, final bool) error {
+		if final {
+			if frag == "" {
+				ret = &file{n: dir}
+				return nil
+			}
+			if n := dir.children[frag]; n != nil && n.isDir {
+				ret = &file{n: n}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, &os.PathError{
+			Op:   "open",
+			Path: fullname,
+			Err:  os.ErrNotExist,
+		}
+	}
+	return ret, nil
+}
+
 func (y *memStorage) Remove(fullname string) error {
 	return y.walk(fullname, func(dir *node, frag string, final bool) error {
 		if final {
@@ -205,14 +236,23 @@ func (y *memStorage) Remove(fullname string) error {
 }
 
 func (y *memStorage) Rename(oldname, newname string) error {
-	var n *node
-	err := y.walk(oldname, func(dir *node, frag string, final bool) error {
+	// The mutex is held across both walks, and the file is only removed from
+	// oldname once newname's directory has been found, so that the rename is
+	// atomic and a failed rename leaves the file in place.
+	y.mu.Lock()
+	defer y.mu.Unlock()
+
+	var (
+		n       *node
+		oldDir  *node
+		oldFrag string
+	)
+	err := y.walkLocked(oldname, func(dir *node, frag string, final bool) error {
 		if final {
 			if frag == "" {
 				return errors.New("pebble/storage: empty file name")
 			}
-			n = dir.children[frag]
-			delete(dir.children, frag)
+			n, oldDir, oldFrag = dir.children[frag], dir, frag
 		}
 		return nil
 	})
@@ -222,11 +262,12 @@ func (y *memStorage) Rename(oldname, newname string) error {
 	if n == nil {
 		return errors.New("pebble/storage: no such file or directory")
 	}
-	return y.walk(newname, func(dir *node, frag string, final bool) error {
+	return y.walkLocked(newname, func(dir *node, frag string, final bool) error {
 		if final {
 			if frag == "" {
 				return errors.New("pebble/storage: empty file name")
 			}
+			delete(oldDir.children, oldFrag)
 			dir.children[frag] = n
 		}
 		return nil
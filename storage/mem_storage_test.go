@@ -6,6 +6,7 @@ package storage
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
@@ -238,3 +239,42 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceFile(t *testing.T) {
+	fs := NewMem()
+	if err := fs.MkdirAll(normalize("/foo"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	read := func(name string) string {
+		f, err := fs.Open(normalize(name))
+		if err != nil {
+			t.Fatalf("Open %q: %v", name, err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll %q: %v", name, err)
+		}
+		return string(data)
+	}
+
+	for _, data := range []string{"a", "bcd", ""} {
+		if err := ReplaceFile(fs, normalize("/foo/x"), normalize("/foo/x.tmp"), []byte(data)); err != nil {
+			t.Fatalf("ReplaceFile: %v", err)
+		}
+		if got := read("/foo/x"); got != data {
+			t.Fatalf("expected %q, but found %q", data, got)
+		}
+		if _, err := fs.Stat(normalize("/foo/x.tmp")); !os.IsNotExist(err) {
+			t.Fatalf("expected the temporary file to be renamed, but found %v", err)
+		}
+	}
+
+	// A rename into a missing directory fails, leaving the file in place.
+	if err := fs.Rename(normalize("/foo/x"), normalize("/bar/x")); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if _, err := fs.Stat(normalize("/foo/x")); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+}
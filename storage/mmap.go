@@ -0,0 +1,13 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+// MmapFile is a read-only File whose contents are memory-mapped. Bytes
+// returns the mapped region, which remains valid until the file is closed.
+// The contents must not be modified.
+type MmapFile interface {
+	File
+	Bytes() []byte
+}
@@ -0,0 +1,13 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package storage
+
+// Mmap returns f unchanged, as memory-mapping files is not implemented on
+// this operating system.
+func Mmap(f File) (File, error) {
+	return f, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	f, err := ioutil.TempFile("", "pebble-mmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := Default.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Mmap(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf, ok := m.(MmapFile)
+	if !ok {
+		m.Close()
+		t.Skip("mmap is not supported")
+	}
+
+	// The mapping remains valid after the file is removed.
+	if err := os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, mf.Bytes()) {
+		t.Fatalf("mapped contents do not match the file")
+	}
+	buf := make([]byte, 10)
+	if _, err := mf.ReadAt(buf, 10); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "0123456789" {
+		t.Fatalf("expected 0123456789, but found %q", buf)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mf.Bytes() != nil {
+		t.Fatalf("expected the mapping to be released on close")
+	}
+}
+
+func TestMmapMem(t *testing.T) {
+	fs := NewMem()
+	f, err := fs.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Mmap(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != f {
+		t.Fatalf("expected a memory-backed file to be returned unchanged")
+	}
+	if _, ok := m.(MmapFile); ok {
+		t.Fatalf("expected a memory-backed file to not be mapped")
+	}
+}
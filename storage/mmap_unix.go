@@ -0,0 +1,61 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile is an *os.File whose contents have been mapped into memory.
+type mmapFile struct {
+	*os.File
+	data []byte
+}
+
+// Mmap memory-maps the contents of f, which must have been opened for
+// reading. Closing the returned file unmaps the contents and closes f. The
+// mapping remains valid if the file is removed while mapped.
+//
+// Files which are not backed by the operating system, such as those created
+// by NewMem, and empty files, cannot be mapped and are returned unchanged.
+func Mmap(f File) (File, error) {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return f, nil
+	}
+	stat, err := osFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size == 0 {
+		return f, nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("pebble/storage: %s is too large to mmap", osFile.Name())
+	}
+	data, err := syscall.Mmap(int(osFile.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("pebble/storage: mmap %s: %v", osFile.Name(), err)
+	}
+	return &mmapFile{File: osFile, data: data}, nil
+}
+
+func (f *mmapFile) Bytes() []byte {
+	return f.data
+}
+
+func (f *mmapFile) Close() error {
+	err := syscall.Munmap(f.data)
+	f.data = nil
+	if err1 := f.File.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -7,6 +7,7 @@ package storage
 import (
 	"io"
 	"os"
+	"path/filepath"
 )
 
 // File is a readable, writable sequence of bytes.
@@ -37,11 +38,25 @@ type Storage interface {
 	// Open opens the named file for reading.
 	Open(name string) (File, error)
 
+	// OpenDir opens the named directory for syncing. Syncing the returned File
+	// makes the creation, removal and renaming of files in the directory
+	// durable, even if the contents of the files have already been synced.
+	OpenDir(name string) (File, error)
+
 	// Remove removes the named file or directory.
 	Remove(name string) error
 
 	// Rename renames a file. It overwrites the file at newname if one exists,
 	// the same as os.Rename.
+	//
+	// Rename must be atomic: newname refers to either the file it replaces or
+	// the renamed file, and never to a partially written or missing file, even
+	// if the process crashes during the rename. The rename is durable once the
+	// directory is synced. The DB relies on this to update files such as
+	// CURRENT, using ReplaceFile, and a corrupt DB may result from a crash in a
+	// Storage which cannot guarantee it. A Storage for a store without an
+	// atomic rename, such as a naive object store adapter, must provide one by
+	// other means.
 	Rename(oldname, newname string) error
 
 	// MkdirAll creates a directory and all necessary parents. The permission
@@ -77,6 +92,41 @@ type Storage interface {
 	Stat(name string) (os.FileInfo, error)
 }
 
+// ReplaceFile atomically replaces the contents of filename with data. The data
+// is written to tmpname and synced, and tmpname is then renamed to filename and
+// the directory synced, so that a crash leaves filename with either its old
+// contents or data, and never partially written. Any existing file at tmpname
+// is overwritten, and tmpname is left behind if ReplaceFile fails.
+func ReplaceFile(fs Storage, filename, tmpname string, data []byte) error {
+	f, err := fs.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpname, filename); err != nil {
+		return err
+	}
+	dir, err := fs.OpenDir(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
 // Default is a Storage implementation backed by the underlying operating
 // system's file system.
 var Default Storage = defaultFS{}
@@ -95,6 +145,10 @@ func (defaultFS) Open(name string) (File, error) {
 	return os.Open(name)
 }
 
+func (defaultFS) OpenDir(name string) (File, error) {
+	return openDir(name)
+}
+
 func (defaultFS) Remove(name string) error {
 	return os.Remove(name)
 }
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/sstable"
@@ -16,9 +17,12 @@ type tableCache struct {
 	dirname string
 	fs      storage.Storage
 	opts    *db.Options
-	size    int
+	// The number of sstable readers currently open. Updated atomically.
+	openFiles int64
 
-	mu    sync.Mutex
+	mu sync.Mutex
+	// The maximum number of nodes in the cache. Protected by mu.
+	size  int
 	nodes map[uint64]*tableCacheNode
 	dummy tableCacheNode
 }
@@ -33,33 +37,112 @@ func (c *tableCache) init(dirname string, fs storage.Storage, opts *db.Options,
 	c.dummy.prev = &c.dummy
 }
 
-func (c *tableCache) newIter(meta *fileMetadata) (db.InternalIterator, error) {
+func (c *tableCache) newIter(
+	meta *fileMetadata, opts *db.IterOptions,
+) (db.InternalIterator, error) {
 	// Calling findNode gives us the responsibility of decrementing n's
 	// refCount. If opening the underlying table resulted in error, then we
 	// decrement this straight away. Otherwise, we pass that responsibility
 	// to the tableCacheIter, which decrements when it is closed.
 	n := c.findNode(meta)
+	if n == nil {
+		return nil, ErrClosed
+	}
 	x := <-n.result
 	if x.err != nil {
-		c.mu.Lock()
-		n.refCount--
-		if n.refCount == 0 {
-			go n.release()
-		}
-		c.mu.Unlock()
+		c.unrefNode(n)
+
+		// Try loading the table again; the error may be transient.
+		go n.load(c)
+		return nil, x.err
+	}
+	n.result <- x
+	return &tableCacheIter{
+		InternalIterator: x.reader.NewIter(opts),
+		cache:            c,
+		node:             n,
+	}, nil
+}
+
+// newRangeKeyIter returns an iterator over the range keys in the table, or
+// nil if the table has no range keys. Like newIter, the returned iterator holds
+// a reference to the table's node until it is closed.
+func (c *tableCache) newRangeKeyIter(meta *fileMetadata) (db.InternalIterator, error) {
+	n := c.findNode(meta)
+	if n == nil {
+		return nil, ErrClosed
+	}
+	x := <-n.result
+	if x.err != nil {
+		c.unrefNode(n)
 
 		// Try loading the table again; the error may be transient.
 		go n.load(c)
 		return nil, x.err
 	}
 	n.result <- x
+	iter := x.reader.NewRangeKeyIter()
+	if iter == nil {
+		c.unrefNode(n)
+		return nil, nil
+	}
 	return &tableCacheIter{
-		InternalIterator: x.reader.NewIter(nil),
+		InternalIterator: iter,
 		cache:            c,
 		node:             n,
 	}, nil
 }
 
+// withReader invokes fn with the reader of the table, which remains open, and
+// referenced by the cache, until fn returns.
+func (c *tableCache) withReader(meta *fileMetadata, fn func(r *sstable.Reader) error) error {
+	n := c.findNode(meta)
+	if n == nil {
+		return ErrClosed
+	}
+	x := <-n.result
+	if x.err != nil {
+		c.unrefNode(n)
+
+		// Try loading the table again; the error may be transient.
+		go n.load(c)
+		return x.err
+	}
+	n.result <- x
+	err := fn(x.reader)
+	c.unrefNode(n)
+	return err
+}
+
+// unrefNode decrements n's refCount, releasing n if it is no longer
+// referenced.
+func (c *tableCache) unrefNode(n *tableCacheNode) {
+	c.mu.Lock()
+	n.refCount--
+	if n.refCount == 0 {
+		go n.release(c)
+	}
+	c.mu.Unlock()
+}
+
+// newSkipCorruptIter is like newIter, but treats a table which cannot be read
+// as empty, reporting it to the EventListener instead of returning an error.
+// See Options.SkipCorruptTables.
+func (c *tableCache) newSkipCorruptIter(
+	meta *fileMetadata, opts *db.IterOptions,
+) (db.InternalIterator, error) {
+	iter, err := c.newIter(meta, opts)
+	if err != nil {
+		c.opts.EventListener.TableSkipped(meta.fileNum, err)
+		return newErrorIter(nil), nil
+	}
+	return &skipCorruptIter{
+		InternalIterator: iter,
+		fileNum:          meta.fileNum,
+		listener:         &c.opts.EventListener,
+	}, nil
+}
+
 // releaseNode releases a node from the tableCache.
 //
 // c.mu must be held when calling this.
@@ -69,16 +152,21 @@ func (c *tableCache) releaseNode(n *tableCacheNode) {
 	n.prev.next = n.next
 	n.refCount--
 	if n.refCount == 0 {
-		go n.release()
+		go n.release(c)
 	}
 }
 
 // findNode returns the node for the table with the given file number, creating
 // that node if it didn't already exist. The caller is responsible for
-// decrementing the returned node's refCount.
+// decrementing the returned node's refCount. It returns nil if the cache has
+// been closed, which a flush or compaction canceled by DB.CloseWithTimeout may
+// find.
 func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.nodes == nil {
+		return nil
+	}
 
 	n := c.nodes[meta.fileNum]
 	if n == nil {
@@ -108,6 +196,33 @@ func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
 	return n
 }
 
+// setSize changes the maximum number of nodes in the cache, releasing the least
+// recently used nodes if the cache is currently larger than size. A released
+// node which is still referenced by an iterator is not closed until that
+// iterator is closed.
+func (c *tableCache) setSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	for len(c.nodes) > c.size {
+		c.releaseNode(c.dummy.prev)
+	}
+}
+
+// metrics returns the maximum size of the cache and the number of sstable
+// readers currently open.
+func (c *tableCache) metrics() (size int, openFiles int64) {
+	c.mu.Lock()
+	size = c.size
+	c.mu.Unlock()
+	return size, atomic.LoadInt64(&c.openFiles)
+}
+
 func (c *tableCache) evict(fileNum uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -124,7 +239,7 @@ func (c *tableCache) Close() error {
 	for n := c.dummy.next; n != &c.dummy; n = n.next {
 		n.refCount--
 		if n.refCount == 0 {
-			go n.release()
+			go n.release(c)
 		}
 	}
 	c.nodes = nil
@@ -155,19 +270,30 @@ func (n *tableCacheNode) load(c *tableCache) {
 		n.result <- tableReaderOrError{err: err}
 		return
 	}
+	if c.opts != nil && c.opts.MmapTables {
+		mf, err := storage.Mmap(f)
+		if err != nil {
+			f.Close()
+			n.result <- tableReaderOrError{err: err}
+			return
+		}
+		f = mf
+	}
 	r := sstable.NewReader(f, n.meta.fileNum, c.opts)
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
+	atomic.AddInt64(&c.openFiles, 1)
 	n.result <- tableReaderOrError{reader: r}
 }
 
-func (n *tableCacheNode) release() {
+func (n *tableCacheNode) release(c *tableCache) {
 	x := <-n.result
 	if x.err != nil {
 		return
 	}
 	x.reader.Close()
+	atomic.AddInt64(&c.openFiles, -1)
 }
 
 type tableCacheIter struct {
@@ -183,14 +309,35 @@ func (i *tableCacheIter) Close() error {
 		return i.closeErr
 	}
 	i.closed = true
-
-	i.cache.mu.Lock()
-	i.node.refCount--
-	if i.node.refCount == 0 {
-		go i.node.release()
-	}
-	i.cache.mu.Unlock()
+	i.cache.unrefNode(i.node)
 
 	i.closeErr = i.InternalIterator.Close()
 	return i.closeErr
 }
+
+// skipCorruptIter wraps the iterator for a table, hiding any error encountered
+// while reading the table. An sstable iterator which encounters an error is
+// no longer valid, so the remainder of the table appears to be empty.
+type skipCorruptIter struct {
+	db.InternalIterator
+	fileNum  uint64
+	listener *db.EventListener
+	reported bool
+}
+
+func (i *skipCorruptIter) skip(err error) {
+	if err != nil && !i.reported {
+		i.reported = true
+		i.listener.TableSkipped(i.fileNum, err)
+	}
+}
+
+func (i *skipCorruptIter) Error() error {
+	i.skip(i.InternalIterator.Error())
+	return nil
+}
+
+func (i *skipCorruptIter) Close() error {
+	i.skip(i.InternalIterator.Close())
+	return nil
+}
@@ -7,7 +7,9 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -166,7 +168,7 @@ func testTableCacheRandomAccess(t *testing.T, concurrent bool) {
 			rngMu.Lock()
 			fileNum, sleepTime := rng.Intn(tableCacheTestNumTables), rng.Intn(1000)
 			rngMu.Unlock()
-			iter, err := c.newIter(&fileMetadata{fileNum: uint64(fileNum)})
+			iter, err := c.newIter(&fileMetadata{fileNum: uint64(fileNum)}, nil)
 			if err != nil {
 				errc <- fmt.Errorf("i=%d, fileNum=%d: find: %v", i, fileNum, err)
 				return
@@ -225,7 +227,7 @@ func TestTableCacheFrequentlyUsed(t *testing.T) {
 
 	for i := 0; i < N; i++ {
 		for _, j := range [...]int{pinned0, i % tableCacheTestNumTables, pinned1} {
-			iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)})
+			iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)}, nil)
 			if err != nil {
 				t.Fatalf("i=%d, j=%d: find: %v", i, j, err)
 			}
@@ -260,7 +262,7 @@ func TestTableCacheEvictions(t *testing.T) {
 	rng := rand.New(rand.NewSource(2))
 	for i := 0; i < N; i++ {
 		j := rng.Intn(tableCacheTestNumTables)
-		iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)})
+		iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)}, nil)
 		if err != nil {
 			t.Fatalf("i=%d, j=%d: find: %v", i, j, err)
 		}
@@ -294,3 +296,143 @@ func TestTableCacheEvictions(t *testing.T) {
 			fEvicted, fSafe, ratio)
 	}
 }
+
+func TestTableCacheSetSize(t *testing.T) {
+	const (
+		pinned0 = 0
+		pinned1 = 1
+		newSize = 10
+	)
+	c, fs, err := newTableCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pin two tables with open iterators. These are the least recently used
+	// nodes once the remaining tables have been accessed.
+	var pinned []db.InternalIterator
+	for _, j := range [...]int{pinned0, pinned1} {
+		iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)}, nil)
+		if err != nil {
+			t.Fatalf("j=%d: find: %v", j, err)
+		}
+		pinned = append(pinned, iter)
+	}
+	for j := 2; j < tableCacheTestCacheSize; j++ {
+		iter, err := c.newIter(&fileMetadata{fileNum: uint64(j)}, nil)
+		if err != nil {
+			t.Fatalf("j=%d: find: %v", j, err)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatalf("j=%d: close: %v", j, err)
+		}
+	}
+
+	checkOpen := func(expected int64) {
+		err := try(100*time.Microsecond, 20*time.Second, func() error {
+			if _, n := c.metrics(); n != expected {
+				return fmt.Errorf("expected %d open files, but found %d", expected, n)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOpen(tableCacheTestCacheSize)
+
+	// Shrinking the cache closes the idle readers, but not those in use.
+	c.setSize(newSize)
+	if size, _ := c.metrics(); size != newSize {
+		t.Fatalf("expected size %d, but found %d", newSize, size)
+	}
+	checkOpen(newSize + 2)
+
+	for _, iter := range pinned {
+		if err := iter.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	checkOpen(newSize)
+
+	// The most recently used tables remain open.
+	fs.validate(t, c, func(i, gotO, gotC int) error {
+		open := gotO > gotC
+		expected := i >= tableCacheTestCacheSize-newSize && i < tableCacheTestCacheSize
+		if open != expected {
+			return fmt.Errorf("i=%d: expected open=%t, but found open=%t", i, expected, open)
+		}
+		return nil
+	})
+}
+
+func TestTableCacheMmapEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-mmap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &db.Options{
+		Levels: []db.LevelOptions{{
+			Compression: db.NoCompression,
+		}},
+		MmapTables: true,
+	}
+	const numKeys = 100
+	name := dbFilename(dir, fileTypeTable, 1)
+	f, err := storage.Default.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, opts, opts.Levels[0])
+	for i := 0; i < numKeys; i++ {
+		key := db.MakeInternalKey([]byte(fmt.Sprintf("key%03d", i)), 0, db.InternalKeyKindSet)
+		if err := w.Add(key, []byte(fmt.Sprintf("val%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &tableCache{}
+	c.init(dir, storage.Default, opts, tableCacheTestCacheSize)
+	iter, err := c.newIter(&fileMetadata{fileNum: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter.First()
+
+	// Evicting and deleting the table while an iterator is open leaves the
+	// mapping in place until the iterator is closed.
+	c.evict(1)
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for ; iter.Valid(); iter.Next() {
+		if expected := fmt.Sprintf("val%03d", n); string(iter.Value()) != expected {
+			t.Fatalf("expected %s, but found %s", expected, iter.Value())
+		}
+		n++
+	}
+	if n != numKeys {
+		t.Fatalf("expected %d keys, but found %d", numKeys, n)
+	}
+	if _, n := c.metrics(); n != 1 {
+		t.Fatalf("expected 1 open file, but found %d", n)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = try(100*time.Microsecond, 20*time.Second, func() error {
+		if _, n := c.metrics(); n != 0 {
+			return fmt.Errorf("expected 0 open files, but found %d", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
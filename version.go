@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
@@ -29,6 +30,54 @@ type fileMetadata struct {
 	largestSeqNum  uint64
 	// true if client asked us nicely to compact this file.
 	markedForCompaction bool
+	// Counts of the entries in the table, accumulated as the table is written.
+	// The counts are zero for tables which were not written by the DB, such as
+	// ingested tables.
+	numEntries        uint64
+	numDeletions      uint64
+	numRangeDeletions uint64
+	rawKeySize        uint64
+	rawValueSize      uint64
+	numRangeKeys      uint64
+}
+
+// updateSeqNum widens the sequence number bounds of m to include seqNum.
+func (m *fileMetadata) updateSeqNum(seqNum uint64) {
+	if m.smallestSeqNum > seqNum {
+		m.smallestSeqNum = seqNum
+	}
+	if m.largestSeqNum < seqNum {
+		m.largestSeqNum = seqNum
+	}
+}
+
+// updateStats adds the entry with the given key and value to the entry counts
+// of m.
+func (m *fileMetadata) updateStats(key db.InternalKey, value []byte) {
+	m.numEntries++
+	switch key.Kind() {
+	case db.InternalKeyKindDelete:
+		m.numDeletions++
+	case db.InternalKeyKindRangeDelete:
+		m.numRangeDeletions++
+	case db.InternalKeyKindRangeKeySet, db.InternalKeyKindRangeKeyUnset:
+		m.numRangeKeys++
+	}
+	m.rawKeySize += uint64(key.Size())
+	m.rawValueSize += uint64(len(value))
+}
+
+// mayContainRangeKeys returns whether the table may contain range keys. Tables
+// without entry counts, such as ingested tables, may contain range keys.
+func (m *fileMetadata) mayContainRangeKeys() bool {
+	return m.numRangeKeys > 0 || m.numEntries == 0
+}
+
+// mayContainRangeDeletions returns whether the table may contain range
+// tombstones. Tables without entry counts, such as ingested tables, may
+// contain range tombstones.
+func (m *fileMetadata) mayContainRangeDeletions() bool {
+	return m.numRangeDeletions > 0 || m.numEntries == 0
 }
 
 // totalSize returns the total size of all the files in f.
@@ -140,9 +189,11 @@ func (v *version) ref() {
 
 func (v *version) unref() {
 	if atomic.AddInt32(&v.refs, -1) == 0 {
-		v.list.mu.Lock()
-		v.list.remove(v)
-		v.list.mu.Unlock()
+		// NB: remove clears v.list.
+		l := v.list
+		l.mu.Lock()
+		l.remove(v)
+		l.mu.Unlock()
 	}
 }
 
@@ -164,18 +215,31 @@ func (v *version) updateCompactionScore(opts *db.Options) {
 	// wish to avoid too many files when the individual file size is small
 	// (perhaps because of a small write-buffer setting, or very high
 	// compression ratios, or lots of overwrites/deletions).
-	v.compactionScore = float64(len(v.files[0])) / float64(opts.L0CompactionThreshold)
+	scores := v.compactionScores(opts)
+	v.compactionScore = scores[0]
 	v.compactionLevel = 0
 
 	for level := 1; level < numLevels-1; level++ {
-		score := float64(totalSize(v.files[level])) / float64(opts.Level(level).MaxBytes)
-		if score > v.compactionScore {
-			v.compactionScore = score
+		if scores[level] > v.compactionScore {
+			v.compactionScore = scores[level]
 			v.compactionLevel = level
 		}
 	}
 }
 
+// compactionScores returns the compaction score of each level of v. The
+// score of level-0 is its number of files relative to
+// opts.L0CompactionThreshold, and the score of the other levels is their size
+// relative to their MaxBytes. The last level is never compacted and has a
+// score of 0. A level needs compacting if its score is at least 1.
+func (v *version) compactionScores(opts *db.Options) (scores [numLevels]float64) {
+	scores[0] = float64(len(v.files[0])) / float64(opts.L0CompactionThreshold)
+	for level := 1; level < numLevels-1; level++ {
+		scores[level] = float64(totalSize(v.files[level])) / float64(opts.Level(level).MaxBytes)
+	}
+	return scores
+}
+
 // overlaps returns all elements of v.files[level] whose user key range
 // intersects the inclusive range [ukey0, ukey1]. If level is non-zero then the
 // user key ranges of v.files[level] are assumed to not overlap (although they
@@ -229,9 +293,19 @@ loop:
 
 // checkOrdering checks that the files are consistent with respect to
 // increasing file numbers (for level 0 files) and increasing and non-
-// overlapping internal key ranges (for level non-0 files).
+// overlapping internal key ranges (for level non-0 files). When invariants are
+// enabled, it also checks that the sequence number bounds of every file are
+// consistent.
 func (v *version) checkOrdering(cmp db.Compare) error {
 	for level, ff := range v.files {
+		if invariantsEnabled {
+			for i := range ff {
+				if f := &ff[i]; f.smallestSeqNum > f.largestSeqNum {
+					return fmt.Errorf("level %d file %06d has inconsistent seqnum bounds: %d, %d",
+						level, f.fileNum, f.smallestSeqNum, f.largestSeqNum)
+				}
+			}
+		}
 		if level == 0 {
 			prevFileNum := uint64(0)
 			for i, f := range ff {
@@ -256,8 +330,13 @@ func (v *version) checkOrdering(cmp db.Compare) error {
 	return nil
 }
 
-// tableNewIter creates a new iterator for the given file number.
-type tableNewIter func(meta *fileMetadata) (db.InternalIterator, error)
+// tableNewIter creates a new iterator for the given file number. The options,
+// which may be nil, are passed through to the sstable iterator.
+type tableNewIter func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error)
+
+// tableNewRangeKeyIter creates a new iterator over the range keys of the given
+// file number, or returns a nil iterator if the file has no range keys.
+type tableNewRangeKeyIter func(meta *fileMetadata) (db.InternalIterator, error)
 
 // get looks up the internal key ikey0 in v's tables such that ikey and ikey0
 // have the same user key, and ikey0's sequence number is the highest such
@@ -265,10 +344,21 @@ type tableNewIter func(meta *fileMetadata) (db.InternalIterator, error)
 //
 // If ikey0's kind is set, the value for that previous set action is returned.
 // If ikey0's kind is delete, the db.ErrNotFound error is returned.
+// If ikey0's kind is merge, the errMergeOperand error is returned.
 // If there is no such ikey0, the db.ErrNotFound error is returned.
+//
+// The returned internal key is that of the entry which determined the result,
+// with the user key of ikey. The number of tables searched is added to
+// *probed. If copyValue is true, the returned value is copied before the table
+// iterator is closed, and does not alias the table's memory.
 func (v *version) get(
-	ikey db.InternalKey, newIter tableNewIter, cmp db.Compare, ro *db.IterOptions,
-) ([]byte, error) {
+	ikey db.InternalKey,
+	newIter tableNewIter,
+	cmp db.Compare,
+	ro *db.IterOptions,
+	copyValue bool,
+	probed *int,
+) ([]byte, db.InternalKey, error) {
 	ukey := ikey.UserKey
 	// Iterate through v's tables, calling internalGet if the table's bounds
 	// might contain ikey. Due to the order in which we search the tables, and
@@ -291,13 +381,14 @@ func (v *version) get(
 		if db.InternalCompare(cmp, ikey, f.largest) > 0 {
 			continue
 		}
-		iter, err := newIter(f)
+		*probed++
+		iter, err := newIter(f, ro)
 		if err != nil {
-			return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
+			return nil, db.InternalKey{}, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 		}
-		value, conclusive, err := internalGet(iter, cmp, ikey)
+		value, key, conclusive, err := internalGet(iter, cmp, ikey, copyValue)
 		if conclusive {
-			return value, err
+			return value, key, err
 		}
 	}
 
@@ -318,18 +409,24 @@ func (v *version) get(
 		if cmp(ukey, f.smallest.UserKey) < 0 {
 			continue
 		}
-		iter, err := newIter(f)
+		*probed++
+		iter, err := newIter(f, ro)
 		if err != nil {
-			return nil, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
+			return nil, db.InternalKey{}, fmt.Errorf("pebble: could not open table %d: %v", f.fileNum, err)
 		}
-		value, conclusive, err := internalGet(iter, cmp, ikey)
+		value, key, conclusive, err := internalGet(iter, cmp, ikey, copyValue)
 		if conclusive {
-			return value, err
+			return value, key, err
 		}
 	}
-	return nil, db.ErrNotFound
+	return nil, db.InternalKey{}, db.ErrNotFound
 }
 
+// errMergeOperand is returned by internalGet when the most recent entry for a
+// key is a merge operand. Resolving the value requires merging the operand
+// with older entries for the key, which may live in other memtables or levels.
+var errMergeOperand = errors.New("pebble: merge operand")
+
 // internalGet looks up the first key/value pair whose (internal) key is >=
 // ikey, according to the internal key ordering, and also returns whether or
 // not that search was conclusive.
@@ -338,16 +435,20 @@ func (v *version) get(
 // user key (according to ucmp), then conclusive will be false. Otherwise,
 // conclusive will be true and:
 //	* if that pair's key's kind is set, that pair's value will be returned,
-//	* if that pair's key's kind is delete, db.ErrNotFound will be returned.
-// If the returned error is non-nil then conclusive will be true.
+//	* if that pair's key's kind is delete, db.ErrNotFound will be returned,
+//	* if that pair's key's kind is merge, errMergeOperand will be returned.
+// If the returned error is non-nil then conclusive will be true. If the search
+// was conclusive, found is the internal key of that pair, with the user key of
+// key (which does not alias the iterator's memory). If copyValue is true, the
+// returned value is copied before t is closed, and does not alias t's memory.
 func internalGet(
-	t db.InternalIterator, cmp db.Compare, key db.InternalKey,
-) (value []byte, conclusive bool, err error) {
+	t db.InternalIterator, cmp db.Compare, key db.InternalKey, copyValue bool,
+) (value []byte, found db.InternalKey, conclusive bool, err error) {
 	for t.SeekGE(key.UserKey); t.Valid(); t.Next() {
 		ikey0 := t.Key()
 		if !ikey0.Valid() {
 			t.Close()
-			return nil, true, fmt.Errorf("pebble: corrupt table: invalid internal key")
+			return nil, found, true, fmt.Errorf("pebble: corrupt table: invalid internal key")
 		}
 		if cmp(ikey0.UserKey, key.UserKey) != 0 {
 			break
@@ -355,14 +456,23 @@ func internalGet(
 		if ikey0.SeqNum() > key.SeqNum() {
 			continue
 		}
-		if ikey0.Kind() == db.InternalKeyKindDelete {
+		found = db.InternalKey{UserKey: key.UserKey, Trailer: ikey0.Trailer}
+		switch ikey0.Kind() {
+		case db.InternalKeyKindDelete:
+			t.Close()
+			return nil, found, true, db.ErrNotFound
+		case db.InternalKeyKindMerge:
 			t.Close()
-			return nil, true, db.ErrNotFound
+			return nil, found, true, errMergeOperand
+		}
+		value = t.Value()
+		if copyValue {
+			value = append([]byte(nil), value...)
 		}
-		return t.Value(), true, t.Close()
+		return value, found, true, t.Close()
 	}
 	err = t.Close()
-	return nil, err != nil, err
+	return nil, found, err != nil, err
 }
 
 type versionList struct {
@@ -8,7 +8,6 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"sort"
@@ -19,8 +18,6 @@ import (
 // TODO(peter): describe the MANIFEST file format, independently of the C++
 // project.
 
-var errCorruptManifest = errors.New("pebble: corrupt manifest")
-
 type byteReader interface {
 	io.ByteReader
 	io.Reader
@@ -53,6 +50,10 @@ const (
 	customTagNeedsCompaction   = 2
 	customTagPathID            = 65
 	customTagNonSafeIgnoreMask = 1 << 6
+
+	// Pebble custom tags. These are below customTagNonSafeIgnoreMask, and so
+	// are ignored by RocksDB.
+	customTagStats = 60
 )
 
 type deletedFileEntry struct {
@@ -182,6 +183,7 @@ func (v *versionEdit) decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var stats fileMetadata
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -205,6 +207,11 @@ func (v *versionEdit) decode(r io.Reader) error {
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
+					case customTagStats:
+						if err := decodeFileStats(field, &stats); err != nil {
+							return err
+						}
+
 					default:
 						if (customTag & customTagNonSafeIgnoreMask) != 0 {
 							return fmt.Errorf("new-file4: custom field not supported: %d", customTag)
@@ -222,6 +229,12 @@ func (v *versionEdit) decode(r io.Reader) error {
 					smallestSeqNum:      smallestSeqNum,
 					largestSeqNum:       largestSeqNum,
 					markedForCompaction: markedForCompaction,
+					numEntries:          stats.numEntries,
+					numDeletions:        stats.numDeletions,
+					numRangeDeletions:   stats.numRangeDeletions,
+					rawKeySize:          stats.rawKeySize,
+					rawValueSize:        stats.rawValueSize,
+					numRangeKeys:        stats.numRangeKeys,
 				},
 			})
 
@@ -236,7 +249,7 @@ func (v *versionEdit) decode(r io.Reader) error {
 			return fmt.Errorf("column families are not supported")
 
 		default:
-			return errCorruptManifest
+			return ErrCorruptManifest
 		}
 	}
 	return nil
@@ -271,7 +284,7 @@ func (v *versionEdit) encode(w io.Writer) error {
 	}
 	for _, x := range v.newFiles {
 		var customFields bool
-		if x.meta.markedForCompaction {
+		if x.meta.markedForCompaction || x.meta.numEntries != 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -289,6 +302,10 @@ func (v *versionEdit) encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.meta.numEntries != 0 {
+				e.writeUvarint(customTagStats)
+				e.writeBytes(encodeFileStats(&x.meta))
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
@@ -296,6 +313,44 @@ func (v *versionEdit) encode(w io.Writer) error {
 	return err
 }
 
+// encodeFileStats encodes the entry counts of m as a sequence of uvarints.
+// New counts are only ever appended to the sequence.
+func encodeFileStats(m *fileMetadata) []byte {
+	var buf [6 * binary.MaxVarintLen64]byte
+	n := 0
+	for _, v := range [...]uint64{
+		m.numEntries, m.numDeletions, m.numRangeDeletions, m.rawKeySize, m.rawValueSize,
+		m.numRangeKeys,
+	} {
+		n += binary.PutUvarint(buf[n:], v)
+	}
+	return buf[:n:n]
+}
+
+// decodeFileStats decodes the entry counts encoded by encodeFileStats into m.
+// Counts missing from the end of field, which was written before those counts
+// were added, are left as zero.
+func decodeFileStats(field []byte, m *fileMetadata) error {
+	for i, v := range [...]*uint64{
+		&m.numEntries, &m.numDeletions, &m.numRangeDeletions, &m.rawKeySize, &m.rawValueSize,
+		&m.numRangeKeys,
+	} {
+		if i >= 5 && len(field) == 0 {
+			break
+		}
+		u, n := binary.Uvarint(field)
+		if n <= 0 {
+			return fmt.Errorf("new-file4: stats field corrupt")
+		}
+		*v = u
+		field = field[n:]
+	}
+	if len(field) != 0 {
+		return fmt.Errorf("new-file4: stats field wrong size")
+	}
+	return nil
+}
+
 type versionEditDecoder struct {
 	byteReader
 }
@@ -309,7 +364,7 @@ func (d versionEditDecoder) readBytes() ([]byte, error) {
 	_, err = io.ReadFull(d, s)
 	if err != nil {
 		if err == io.ErrUnexpectedEOF {
-			return nil, errCorruptManifest
+			return nil, ErrCorruptManifest
 		}
 		return nil, err
 	}
@@ -322,7 +377,7 @@ func (d versionEditDecoder) readLevel() (int, error) {
 		return 0, err
 	}
 	if u >= numLevels {
-		return 0, errCorruptManifest
+		return 0, ErrCorruptManifest
 	}
 	return int(u), nil
 }
@@ -331,7 +386,7 @@ func (d versionEditDecoder) readUvarint() (uint64, error) {
 	u, err := binary.ReadUvarint(d)
 	if err != nil {
 		if err == io.EOF {
-			return 0, errCorruptManifest
+			return 0, ErrCorruptManifest
 		}
 		return 0, err
 	}
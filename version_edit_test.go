@@ -77,6 +77,23 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						markedForCompaction: true,
 					},
 				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:           807,
+						size:              8070,
+						smallest:          db.DecodeInternalKey([]byte("A\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:           db.DecodeInternalKey([]byte("Z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum:    6,
+						largestSeqNum:     9,
+						numEntries:        10,
+						numDeletions:      3,
+						numRangeDeletions: 1,
+						rawKeySize:        123,
+						rawValueSize:      4567,
+						numRangeKeys:      2,
+					},
+				},
 			},
 		},
 	}
@@ -150,7 +167,7 @@ func TestVersionEditDecode(t *testing.T) {
 				t.Fatalf("filename=%q: open error: %v", tc.filename, err)
 			}
 			defer f.Close()
-			i, r := 0, record.NewReader(f)
+			i, r := 0, record.NewReader(f, record.StrictMode)
 			for {
 				rr, err := r.Next()
 				if err == io.EOF {
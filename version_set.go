@@ -52,6 +52,10 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 	// Read the CURRENT file to find the current manifest file.
 	current, err := vs.fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return newError(ErrMissingCurrent, err,
+				"pebble: could not open CURRENT file for DB %q: %v", dirname, err)
+		}
 		return fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
 	}
 	defer current.Close()
@@ -61,10 +65,10 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 	}
 	n := stat.Size()
 	if n == 0 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
+		return newError(ErrCorruptManifest, nil, "pebble: CURRENT file for DB %q is empty", dirname)
 	}
 	if n > 4096 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
+		return newError(ErrCorruptManifest, nil, "pebble: CURRENT file for DB %q is too large", dirname)
 	}
 	b := make([]byte, n)
 	_, err = current.ReadAt(b, 0)
@@ -72,7 +76,7 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 		return err
 	}
 	if b[n-1] != '\n' {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
+		return newError(ErrCorruptManifest, nil, "pebble: CURRENT file for DB %q is malformed", dirname)
 	}
 	b = b[:n-1]
 
@@ -80,26 +84,32 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 	var bve bulkVersionEdit
 	manifest, err := vs.fs.Open(dirname + string(os.PathSeparator) + string(b))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return newError(ErrCorruptManifest, err,
+				"pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
+		}
 		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
 	}
 	defer manifest.Close()
-	rr := record.NewReader(manifest)
+	rr := record.NewReader(manifest, record.StrictMode)
 	for {
 		r, err := rr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return newError(ErrCorruptManifest, err,
+				"pebble: manifest file %q for DB %q: %v", b, dirname, err)
 		}
 		var ve versionEdit
 		err = ve.decode(r)
 		if err != nil {
-			return err
+			return newError(ErrCorruptManifest, err,
+				"pebble: manifest file %q for DB %q: %v", b, dirname, err)
 		}
 		if ve.comparatorName != "" {
 			if ve.comparatorName != vs.cmpName {
-				return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+				return newError(ErrComparerMismatch, nil, "pebble: manifest file %q for DB %q: "+
 					"comparer name from file %q != comparer name from db.Options %q",
 					b, dirname, ve.comparatorName, vs.cmpName)
 			}
@@ -122,9 +132,13 @@ func (vs *versionSet) load(dirname string, opts *db.Options) error {
 		if vs.nextFileNumber == 2 {
 			// We have a freshly created DB.
 		} else {
-			return fmt.Errorf("pebble: incomplete manifest file %q for DB %q", b, dirname)
+			return newError(ErrCorruptManifest, nil,
+				"pebble: incomplete manifest file %q for DB %q", b, dirname)
 		}
 	}
+	if opts.MinFileNumber > 0 {
+		vs.markFileNumUsed(opts.MinFileNumber - 1)
+	}
 	vs.markFileNumUsed(vs.logNumber)
 	vs.markFileNumUsed(vs.prevLogNumber)
 	vs.manifestFileNumber = vs.nextFileNum()
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -493,7 +494,7 @@ func TestVersion(t *testing.T) {
 
 		// m is a map from file numbers to DBs.
 		m := map[uint64]*memTable{}
-		newIter := func(meta *fileMetadata) (db.InternalIterator, error) {
+		newIter := func(meta *fileMetadata, opts *db.IterOptions) (db.InternalIterator, error) {
 			d, ok := m[meta.fileNum]
 			if !ok {
 				return nil, errors.New("no such file")
@@ -548,7 +549,8 @@ func TestVersion(t *testing.T) {
 		for _, query := range tc.queries {
 			s := strings.Split(query, " ")
 			ikey := db.ParseInternalKey(s[0])
-			value, err := v.get(ikey, newIter, cmp, nil)
+			var probed int
+			value, _, err := v.get(ikey, newIter, cmp, nil, false, &probed)
 			got, want := "", s[1]
 			if err != nil {
 				if err != db.ErrNotFound {
@@ -738,3 +740,88 @@ func TestOverlaps(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckOrderingSeqNums(t *testing.T) {
+	// Inconsistent sequence number bounds are only detected when invariants
+	// are enabled.
+	for level := 0; level < 2; level++ {
+		var v version
+		v.files[level] = []fileMetadata{{
+			fileNum:        1,
+			smallest:       db.ParseInternalKey("a.SET.5"),
+			largest:        db.ParseInternalKey("b.SET.3"),
+			smallestSeqNum: 5,
+			largestSeqNum:  3,
+		}}
+		err := v.checkOrdering(db.DefaultComparer.Compare)
+		if !invariantsEnabled {
+			if err != nil {
+				t.Fatalf("L%d: unexpected error: %v", level, err)
+			}
+			continue
+		}
+		expected := fmt.Sprintf("level %d file 000001 has inconsistent seqnum bounds", level)
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("L%d: expected %q, but found %v", level, expected, err)
+		}
+	}
+}
+
+func TestVersionUnref(t *testing.T) {
+	var mu sync.Mutex
+	vs := &versionSet{cmp: db.DefaultComparer.Compare}
+	vs.versions.mu = &mu
+	vs.versions.init()
+
+	// A reader references the current version, which is then replaced. The
+	// reader's unref drops the last reference to the old version, removing it
+	// from the list.
+	v1 := &version{}
+	vs.append(v1)
+	v1.ref()
+	mu.Lock()
+	vs.append(&version{})
+	mu.Unlock()
+	v1.unref()
+	if v1.list != nil {
+		t.Fatalf("expected the old version to be removed from the list")
+	}
+	if vs.versions.root.next != vs.currentVersion() || vs.currentVersion() == v1 {
+		t.Fatalf("expected only the current version in the list")
+	}
+}
+
+// clobberOnCloseIter is a fakeIter which overwrites its values when closed,
+// in the way that closing a table iterator can unmap a memory-mapped table.
+type clobberOnCloseIter struct {
+	fakeIter
+}
+
+func (c *clobberOnCloseIter) Close() error {
+	for _, v := range c.vals {
+		for i := range v {
+			v[i] = 'x'
+		}
+	}
+	return c.fakeIter.Close()
+}
+
+func TestInternalGetCopyValue(t *testing.T) {
+	for _, copyValue := range []bool{false, true} {
+		iter := &clobberOnCloseIter{fakeIter{
+			keys: []db.InternalKey{fakeIkey("a:1")},
+			vals: [][]byte{[]byte("value")},
+		}}
+		value, _, conclusive, err := internalGet(iter, db.DefaultComparer.Compare, fakeIkey("a:2"), copyValue)
+		if !conclusive || err != nil {
+			t.Fatalf("copyValue=%t: expected conclusive result, but found %t (%v)", copyValue, conclusive, err)
+		}
+		expected := "xxxxx"
+		if copyValue {
+			expected = "value"
+		}
+		if string(value) != expected {
+			t.Fatalf("copyValue=%t: expected %s, but found %s", copyValue, expected, value)
+		}
+	}
+}